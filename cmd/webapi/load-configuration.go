@@ -17,6 +17,8 @@ type WebAPIConfiguration struct {
 	Config struct {
 		Path string `conf:"default:/conf/config.yml"`
 	}
+	// Web configures the listeners. DebugHost serves the metrics, without authentication: it listens on every interface
+	// so that Prometheus can scrape the container, and its port must not be published outside the internal network.
 	Web struct {
 		APIHost         string        `conf:"default:0.0.0.0:3000"`
 		DebugHost       string        `conf:"default:0.0.0.0:4000"`
@@ -25,9 +27,24 @@ type WebAPIConfiguration struct {
 		ShutdownTimeout time.Duration `conf:"default:5s"`
 	}
 	Debug bool
-	DB    struct {
+	// ResetPassword is the username of an account to issue a password reset token for. The token is printed, and the
+	// server is not started.
+	ResetPassword string
+	DB            struct {
 		Filename string `conf:"default:/tmp/decaf.db"`
 	}
+	Messages struct {
+		DeleteForEveryoneWindow time.Duration `conf:"default:48h"`
+	}
+	// OIDC configures the login with an OpenID Connect provider. It is disabled while the issuer is empty.
+	OIDC struct {
+		Issuer       string
+		ClientID     string
+		ClientSecret string `conf:"noprint"`
+		RedirectURL  string
+		Scopes       []string `conf:"default:profile;email"`
+		PostLoginURL string   `conf:"default:/"`
+	}
 }
 
 // loadConfiguration creates a WebAPIConfiguration starting from flags, environment variables and configuration file.
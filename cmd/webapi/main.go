@@ -2,7 +2,7 @@
 Webapi is the executable for the main web server.
 It builds a web server around APIs from `service/api`.
 Webapi connects to external resources needed (database) and starts two web servers: the API web server, and the debug.
-Everything is served via the API web server, except debug variables (/debug/vars) and profiler infos (pprof).
+Everything is served via the API web server, except the metrics (/metrics), served by the debug web server.
 
 Usage:
 
@@ -38,6 +38,7 @@ import (
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/oidc"
 	"github.com/ardanlabs/conf"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/sirupsen/logrus"
@@ -106,6 +107,16 @@ func run() error {
 		return fmt.Errorf("creating AppDatabase: %w", err)
 	}
 
+	// Give a way in to an account that cannot log in, like the ones created before passwords existed
+	if cfg.ResetPassword != "" {
+		token, err := api.IssuePasswordReset(db, cfg.ResetPassword)
+		if err != nil {
+			return fmt.Errorf("issuing a password reset token: %w", err)
+		}
+		fmt.Println(token) //nolint:forbidigo
+		return nil
+	}
+
 	// Start (main) API server
 	logger.Info("initializing API server")
 
@@ -115,13 +126,34 @@ func run() error {
 	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
 
 	// Make a channel to listen for errors coming from the listener. Use a
-	// buffered channel so the goroutine can exit if we don't collect this error.
-	serverErrors := make(chan error, 1)
+	// buffered channel so the goroutines can exit if we don't collect their errors.
+	serverErrors := make(chan error, 2)
+
+	// Connect the OpenID Connect provider, if any
+	var provider *oidc.Provider
+	if cfg.OIDC.Issuer != "" {
+		provider, err = oidc.NewProvider(oidc.Config{
+			Issuer:       cfg.OIDC.Issuer,
+			ClientID:     cfg.OIDC.ClientID,
+			ClientSecret: cfg.OIDC.ClientSecret,
+			RedirectURL:  cfg.OIDC.RedirectURL,
+			Scopes:       cfg.OIDC.Scopes,
+		})
+		if err != nil {
+			logger.WithError(err).Error("error configuring the OpenID Connect provider")
+			return fmt.Errorf("configuring the OpenID Connect provider: %w", err)
+		}
+	}
 
 	// Create the API router
 	apirouter, err := api.New(api.Config{
 		Logger:   logger,
 		Database: db,
+
+		DeleteForEveryoneWindow: cfg.Messages.DeleteForEveryoneWindow,
+
+		OIDC:             provider,
+		OIDCPostLoginURL: cfg.OIDC.PostLoginURL,
 	})
 	if err != nil {
 		logger.WithError(err).Error("error creating the API server instance")
@@ -147,12 +179,28 @@ func run() error {
 		WriteTimeout:      cfg.Web.WriteTimeout,
 	}
 
+	// Create the debug server, which serves the metrics on their own port, away from the public API
+	debugMux := http.NewServeMux()
+	debugMux.Handle("/metrics", apirouter.MetricsHandler())
+	debugserver := http.Server{
+		Addr:              cfg.Web.DebugHost,
+		Handler:           debugMux,
+		ReadTimeout:       cfg.Web.ReadTimeout,
+		ReadHeaderTimeout: cfg.Web.ReadTimeout,
+		WriteTimeout:      cfg.Web.WriteTimeout,
+	}
+
 	// Start the service listening for requests in a separate goroutine
 	go func() {
 		logger.Infof("API listening on %s", apiserver.Addr)
 		serverErrors <- apiserver.ListenAndServe()
 		logger.Infof("stopping API server")
 	}()
+	go func() {
+		logger.Infof("debug listening on %s", debugserver.Addr)
+		serverErrors <- debugserver.ListenAndServe()
+		logger.Infof("stopping debug server")
+	}()
 
 	// Waiting for shutdown signal or POSIX signals
 	select {
@@ -163,22 +211,25 @@ func run() error {
 	case sig := <-shutdown:
 		logger.Infof("signal %v received, start shutdown", sig)
 
-		// Asking API server to shut down and load shed.
-		err := apirouter.Close()
-		if err != nil {
-			logger.WithError(err).Warning("graceful shutdown of apirouter error")
-		}
-
 		// Give outstanding requests a deadline for completion.
 		ctx, cancel := context.WithTimeout(context.Background(), cfg.Web.ShutdownTimeout)
 		defer cancel()
 
-		// Asking listener to shut down and load shed.
-		err = apiserver.Shutdown(ctx)
+		// Asking listener to shut down and load shed. The WebSocket and event stream connections are hijacked, so
+		// they are not waited for: closing the API router below tells them the server is going away.
+		err := apiserver.Shutdown(ctx)
 		if err != nil {
 			logger.WithError(err).Warning("error during graceful shutdown of HTTP server")
 			err = apiserver.Close()
 		}
+		if derr := debugserver.Shutdown(ctx); derr != nil {
+			logger.WithError(derr).Warning("error during graceful shutdown of debug server")
+		}
+
+		// Asking API server to shut down, once no request can use its background jobs anymore.
+		if rerr := apirouter.Close(); rerr != nil {
+			logger.WithError(rerr).Warning("graceful shutdown of apirouter error")
+		}
 
 		// Log the status of this shutdown.
 		switch {
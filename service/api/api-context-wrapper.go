@@ -3,11 +3,12 @@ package api
 import (
 	"context"
 	"encoding/json"
-	"strings"
+	"errors"
 
 	"net/http"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
 	"github.com/gofrs/uuid"
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
@@ -41,8 +42,15 @@ func (rt *_router) wrap(fn httpRouterHandler) func(http.ResponseWriter, *http.Re
 	}
 }
 
-// wrapAuth combines authentication middleware with request context wrapping
+// wrapAuth combines authentication middleware with request context wrapping. Only sessions are accepted, not API
+// tokens.
 func (rt *_router) wrapAuth(fn httpRouterHandler) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return rt.wrapScoped("", fn)
+}
+
+// wrapScoped is wrapAuth for the routes that API tokens with `scope` can use too. Tokens restricted to some
+// conversations can only use the routes of those conversations.
+func (rt *_router) wrapScoped(scope string, fn httpRouterHandler) func(http.ResponseWriter, *http.Request, httprouter.Params) {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		// Extract Authorization header and validate
 		authHeader := r.Header.Get("Authorization")
@@ -52,26 +60,56 @@ func (rt *_router) wrapAuth(fn httpRouterHandler) func(http.ResponseWriter, *htt
 		}
 
 		// Check Bearer format
-		if !strings.HasPrefix(authHeader, "Bearer ") {
+		token, ok := bearerToken(r)
+		if !ok {
 			rt.sendError(w, http.StatusUnauthorized, "Invalid authorization format. Use 'Bearer <token>'")
 			return
 		}
 
-		// Extract token (user ID)
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-		token = strings.TrimSpace(token)
-
-		// Validate UUID format
-		userID, err := uuid.FromString(token)
-		if err != nil {
-			rt.sendError(w, http.StatusUnauthorized, "Invalid token format")
-			return
+		var user database.User
+		authCtx := r.Context()
+		if isAPIToken(token) {
+			// Verify the API token exists and allows the route
+			var apiToken database.APIToken
+			var err error
+			user, apiToken, err = rt.authenticateAPIToken(token)
+			if errors.Is(err, errInvalidSession) {
+				rt.sendError(w, http.StatusUnauthorized, "Invalid or revoked token")
+				return
+			} else if err != nil {
+				rt.baseLogger.WithError(err).Error("can't check the API token")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if scope == "" || !tokenHasScope(apiToken, scope) {
+				rt.sendError(w, http.StatusForbidden, "The token does not allow this operation")
+				return
+			}
+			if !tokenAllowsConversation(apiToken, ps.ByName("conversationId")) {
+				rt.sendError(w, http.StatusForbidden, "The token does not allow this conversation")
+				return
+			}
+			authCtx = context.WithValue(authCtx, AuthTokenKey, apiToken)
+		} else {
+			// Verify the session is still active
+			var session database.Session
+			var err error
+			user, session, err = rt.authenticate(r, token)
+			if errors.Is(err, errInvalidSession) {
+				rt.sendError(w, http.StatusUnauthorized, "Invalid or revoked session")
+				return
+			} else if err != nil {
+				rt.baseLogger.WithError(err).Error("can't check the session")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			authCtx = context.WithValue(authCtx, AuthSessionKey, session)
 		}
 
-		// Verify user exists in database
-		user, err := rt.db.GetUserByID(userID.String())
-		if err != nil {
-			rt.sendError(w, http.StatusUnauthorized, "Invalid token - user not found")
+		// The routes under /users/:id are the resources of the user :id, which only they can use, whether with a
+		// session or with a token
+		if id := ps.ByName("id"); id != "" && id != user.UId {
+			rt.sendError(w, http.StatusForbidden, "Access denied - can only access your own resources")
 			return
 		}
 
@@ -93,8 +131,8 @@ func (rt *_router) wrapAuth(fn httpRouterHandler) func(http.ResponseWriter, *htt
 			"user-id":   user.UId,
 		})
 
-		// Add user to request context
-		r = r.WithContext(context.WithValue(r.Context(), AuthUserKey, user))
+		// Add user, and session or token, to request context
+		r = r.WithContext(context.WithValue(authCtx, AuthUserKey, user))
 
 		// Call the actual handler
 		fn(w, r, ps, ctx)
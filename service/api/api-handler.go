@@ -10,36 +10,89 @@ func (rt *_router) Handler() http.Handler {
 	// Public routes (no authentication required)
 	r.GET("/", rt.wrap(rt.getApiRoot))
 	r.POST("/session", rt.wrap(rt.doLogin))
+	r.DELETE("/session", rt.wrapAuth(rt.doLogout))
+	r.POST("/users", rt.wrap(rt.register))
+	r.POST("/password-reset", rt.wrap(rt.resetPassword))
 	r.GET("/liveness", rt.wrap(rt.liveness))
 	r.GET("/users", rt.wrap(rt.listUsers))
+	if rt.oidc != nil {
+		r.POST("/oidc/authorize", rt.wrap(rt.startOIDCLogin))
+		r.GET("/oidc/callback", rt.wrap(rt.oidcCallback))
+		r.POST("/oidc/session", rt.wrap(rt.finishOIDCLogin))
+	}
 
 	// Authenticated routes
 	// User specific routes
 	r.PUT("/users/:id", rt.wrapAuth(rt.setMyUserName))
 	r.PUT("/users/:id/photo", rt.wrapAuth(rt.setMyPhoto))
+	r.PUT("/users/:id/password", rt.wrapAuth(rt.setMyPassword))
+	r.GET("/users/:id/sessions", rt.wrapAuth(rt.listSessions))
+	r.DELETE("/users/:id/sessions", rt.wrapAuth(rt.revokeAllSessions))
+	r.DELETE("/users/:id/sessions/:sessionId", rt.wrapAuth(rt.revokeSession))
 	r.GET("/users/:id/context", rt.wrapAuth(rt.getContextReply))
+	r.GET("/users/:id/mentions", rt.wrapAuth(rt.getMentions))
+
+	// Bots and API tokens
+	r.POST("/users/:id/bots", rt.wrapAuth(rt.createBot))
+	r.GET("/users/:id/bots", rt.wrapAuth(rt.listBots))
+	r.POST("/users/:id/tokens", rt.wrapAuth(rt.createAPIToken))
+	r.GET("/users/:id/tokens", rt.wrapAuth(rt.listAPITokens))
+	r.DELETE("/users/:id/tokens/:tokenId", rt.wrapAuth(rt.deleteAPIToken))
 
 	// Conversations
 	r.POST("/users/:id/conversations", rt.wrapAuth(rt.createConversation))
-	r.GET("/users/:id/conversations", rt.wrapAuth(rt.getMyConversations))
-	r.GET("/users/:id/conversations/:conversationId", rt.wrapAuth(rt.getConversation))
+	r.GET("/users/:id/conversations", rt.wrapScoped(scopeConversationsRead, rt.getMyConversations))
+	r.GET("/users/:id/conversations/:conversationId", rt.wrapScoped(scopeConversationsRead, rt.getConversation))
+	r.DELETE("/users/:id/conversations/:conversationId", rt.wrapAuth(rt.deleteConversation))
 	r.POST("/users/:id/conversations/:conversationId/members", rt.wrapAuth(rt.addtoGroup))
 	r.DELETE("/users/:id/conversations/:conversationId/members", rt.wrapAuth(rt.leaveGroup))
 	r.PUT("/users/:id/conversations/:conversationId/name", rt.wrapAuth(rt.setGroupName))
 	r.PUT("/users/:id/conversations/:conversationId/photo", rt.wrapAuth(rt.setGroupPhoto))
+	r.PUT("/users/:id/conversations/:conversationId/ttl", rt.wrapAuth(rt.setMessageTTL))
+	r.PUT("/users/:id/conversations/:conversationId/draft", rt.wrapAuth(rt.saveDraft))
+
+	// Webhooks
+	r.POST("/users/:id/conversations/:conversationId/webhooks", rt.wrapAuth(rt.createWebhook))
+	r.GET("/users/:id/conversations/:conversationId/webhooks", rt.wrapAuth(rt.listWebhooks))
+	r.PUT("/users/:id/conversations/:conversationId/webhooks/:webhookId/enabled", rt.wrapAuth(rt.setWebhookEnabled))
+	r.DELETE("/users/:id/conversations/:conversationId/webhooks/:webhookId", rt.wrapAuth(rt.deleteWebhook))
+	r.GET("/users/:id/conversations/:conversationId/webhooks/:webhookId/deliveries", rt.wrapAuth(rt.listWebhookDeliveries))
 
 	// Messages
-	r.GET("/users/:id/conversations/:conversationId/messages", rt.wrapAuth(rt.getMessages))
-	r.POST("/users/:id/conversations/:conversationId/messages", rt.wrapAuth(rt.sendMessage))
-	r.DELETE("/users/:id/conversations/:conversationId/messages/:messageId", rt.wrapAuth(rt.deleteMessage))
+	r.GET("/users/:id/conversations/:conversationId/messages", rt.wrapScoped(scopeMessagesRead, rt.getMessages))
+	r.DELETE("/users/:id/conversations/:conversationId/messages", rt.wrapAuth(rt.clearConversationHistory))
+	r.POST("/users/:id/conversations/:conversationId/messages", rt.wrapScoped(scopeMessagesWrite, rt.sendMessage))
+	r.DELETE("/users/:id/conversations/:conversationId/messages/:messageId", rt.wrapScoped(scopeMessagesWrite, rt.deleteMessage))
 	r.POST("/users/:id/conversations/:conversationId/messages/:messageId/forward", rt.wrapAuth(rt.forwardMessage))
 
-	// Comments (emoji toggle)
-	r.POST("/users/:id/conversations/:conversationId/messages/:messageId/comments", rt.wrapAuth(rt.reactToMessage))
-	r.DELETE("/users/:id/conversations/:conversationId/messages/:messageId/comments/:emoji", rt.wrapAuth(rt.removeReaction))
+	// Scheduled messages
+	r.GET("/users/:id/scheduled-messages", rt.wrapAuth(rt.listScheduledMessages))
+	r.PUT("/users/:id/scheduled-messages/:scheduledId", rt.wrapAuth(rt.updateScheduledMessage))
+	r.DELETE("/users/:id/scheduled-messages/:scheduledId", rt.wrapAuth(rt.cancelScheduledMessage))
+
+	// Reactions (emoji)
+	r.POST("/users/:id/conversations/:conversationId/messages/:messageId/reactions", rt.wrapScoped(scopeReactionsWrite, rt.reactToMessage))
+	r.DELETE("/users/:id/conversations/:conversationId/messages/:messageId/reactions/:emoji", rt.wrapScoped(scopeReactionsWrite, rt.removeReaction))
+
+	// Comments (threaded replies)
+	r.GET("/users/:id/conversations/:conversationId/messages/:messageId/comments", rt.wrapScoped(scopeMessagesRead, rt.listComments))
+	r.POST("/users/:id/conversations/:conversationId/messages/:messageId/comments", rt.wrapScoped(scopeMessagesWrite, rt.commentMessage))
+	r.DELETE("/users/:id/conversations/:conversationId/messages/:messageId/comments/:commentId", rt.wrapAuth(rt.uncommentMessage))
+
+	// Pins
+	r.GET("/users/:id/conversations/:conversationId/pins", rt.wrapScoped(scopeMessagesRead, rt.listPins))
+	r.PUT("/users/:id/conversations/:conversationId/pins/:messageId", rt.wrapAuth(rt.pinMessage))
+	r.DELETE("/users/:id/conversations/:conversationId/pins/:messageId", rt.wrapAuth(rt.unpinMessage))
+
+	// Starred messages
+	r.GET("/users/:id/starred", rt.wrapAuth(rt.getStarred))
+	r.PUT("/users/:id/conversations/:conversationId/messages/:messageId/star", rt.wrapAuth(rt.starMessage))
+	r.DELETE("/users/:id/conversations/:conversationId/messages/:messageId/star", rt.wrapAuth(rt.unstarMessage))
 
-	// Comments
-	// Comments feature removed (emoji reactions only)
+	// Polls
+	r.PUT("/users/:id/conversations/:conversationId/messages/:messageId/votes", rt.wrapAuth(rt.votePoll))
+	r.DELETE("/users/:id/conversations/:conversationId/messages/:messageId/votes", rt.wrapAuth(rt.retractVote))
+	r.POST("/users/:id/conversations/:conversationId/messages/:messageId/poll/close", rt.wrapAuth(rt.closePoll))
 
 	// Contacts
 	r.POST("/users/:id/contacts", rt.wrapAuth(rt.addContact))
@@ -48,6 +101,7 @@ func (rt *_router) Handler() http.Handler {
 
 	// WebSocket (should this be authenticated?)
 	r.GET("/ws", rt.wrap(rt.serveWs))
+	r.GET("/users/:id/events", rt.wrap(rt.streamEvents))
 
 	// Admin endpoints removed
 
@@ -15,7 +15,7 @@ func (rt *_router) getApiRoot(w http.ResponseWriter, r *http.Request, ps httprou
 		"name":      "WASAText API",
 		"version":   "1.2.0",
 		"status":    "running",
-		"endpoints": 27, // Total number of endpoints including this one
+		"endpoints": 68, // Total number of endpoints including this one
 	}
 
 	// Set content type header
@@ -39,8 +39,12 @@ package api
 import (
 	"errors"
 	"net/http"
+	"time"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/linkpreview"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/oidc"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/webhook"
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
 )
@@ -52,13 +56,38 @@ type Config struct {
 
 	// Database is the instance of database.AppDatabase where data are saved
 	Database database.AppDatabase
+
+	// LinkPreviews fetches the previews of the links in messages (optional). By default, only public addresses are
+	// reached and the previews are cached by URL.
+	LinkPreviews linkpreview.Fetcher
+
+	// Webhooks posts the events of conversations to their webhooks (optional). By default, only public addresses are
+	// reached.
+	Webhooks webhook.Sender
+
+	// DeleteForEveryoneWindow is how long after sending a message its sender can delete it for everyone. Zero means
+	// defaultDeleteForEveryoneWindow.
+	DeleteForEveryoneWindow time.Duration
+
+	// OIDC signs users in with an OpenID Connect provider (optional). The /oidc routes are only served when it is set.
+	OIDC *oidc.Provider
+
+	// OIDCPostLoginURL is the page of the web UI where the browser is sent back after signing in with the provider.
+	// Default: "/".
+	OIDCPostLoginURL string
 }
 
+// defaultDeleteForEveryoneWindow is the default of Config.DeleteForEveryoneWindow
+const defaultDeleteForEveryoneWindow = 48 * time.Hour
+
 // Router is the package API interface representing an API handler builder
 type Router interface {
 	// Handler returns an HTTP handler for APIs provided in this package
 	Handler() http.Handler
 
+	// MetricsHandler returns an HTTP handler for the metrics of the server, to be served on an internal listener
+	MetricsHandler() http.Handler
+
 	// Close terminates any resource used in the package
 	Close() error
 }
@@ -72,6 +101,12 @@ func New(cfg Config) (Router, error) {
 	if cfg.Database == nil {
 		return nil, errors.New("database is required")
 	}
+	if cfg.DeleteForEveryoneWindow < 0 {
+		return nil, errors.New("the delete for everyone window cannot be negative")
+	}
+	if cfg.DeleteForEveryoneWindow == 0 {
+		cfg.DeleteForEveryoneWindow = defaultDeleteForEveryoneWindow
+	}
 
 	// Create a new router where we will register HTTP endpoints. The server will pass requests to this router to be
 	// handled.
@@ -83,13 +118,54 @@ func New(cfg Config) (Router, error) {
 		router:     router,
 		baseLogger: cfg.Logger,
 		db:         cfg.Database,
+
+		deleteWindow: cfg.DeleteForEveryoneWindow,
+	}
+
+	if cfg.OIDC != nil {
+		if cfg.OIDCPostLoginURL == "" {
+			cfg.OIDCPostLoginURL = "/"
+		}
+		rt.oidc = newOIDCLogins(cfg.OIDC, cfg.OIDCPostLoginURL)
 	}
 
 	// Initialize system logger
 	rt.sysLogger = NewSystemLogger(rt)
 
-	// Initialize WebSocket hub
-	InitializeHub(rt)
+	// Send the changes made by handlers to the WebSocket clients, the webhooks, the audit log and the metrics
+	if cfg.Webhooks == nil {
+		cfg.Webhooks = webhook.NewHTTPSender(webhook.Config{})
+	}
+	rt.hub = newHub(rt)
+	rt.webhooks = newWebhookDeliverer(rt, cfg.Webhooks)
+	rt.metrics = newEventMetrics()
+	rt.events = newEventBus(rt)
+	rt.events.subscribe("websocket", rt.hub.handleEvent)
+	rt.events.subscribe("webhooks", rt.webhooks.handleEvent)
+	rt.events.subscribe("audit", rt.auditEvent)
+	rt.events.subscribe("metrics", rt.metrics.count)
+
+	// Start delivering scheduled messages, including the ones queued before a restart
+	rt.dispatcher = newMessageDispatcher(rt)
+	rt.dispatcher.run()
+
+	// Start deleting disappearing messages when they expire
+	rt.reaper = newMessageReaper(rt)
+	rt.reaper.run()
+
+	// Start removing the content of the messages deleted for everyone, including the ones left over before a restart
+	rt.purger = newMessagePurger(rt)
+	rt.purger.run()
+
+	// Start fetching the previews of the links in new messages
+	if cfg.LinkPreviews == nil {
+		cfg.LinkPreviews = newDefaultLinkPreviewFetcher()
+	}
+	rt.previews = newLinkPreviewer(rt, cfg.LinkPreviews)
+	rt.previews.run()
+
+	// Start delivering the events of conversations to their webhooks, including the ones pending before a restart
+	rt.webhooks.run()
 
 	// Log system startup
 	rt.sysLogger.LogInfo("API server initialized successfully")
@@ -107,4 +183,34 @@ type _router struct {
 
 	db        database.AppDatabase
 	sysLogger *SystemLogger
+
+	// events carries the changes made by handlers to the subscribers: hub, webhooks, audit log and metrics
+	events *eventBus
+
+	// hub holds the connected WebSocket clients
+	hub *Hub
+
+	// metrics counts the events published on the bus
+	metrics *eventMetrics
+
+	// dispatcher sends scheduled messages when they are due
+	dispatcher *messageDispatcher
+
+	// reaper deletes disappearing messages when they expire
+	reaper *messageReaper
+
+	// purger removes the content of messages deleted for everyone
+	purger *messagePurger
+
+	// deleteWindow is how long after sending a message its sender can delete it for everyone
+	deleteWindow time.Duration
+
+	// previews fetches the previews of links in new messages
+	previews *linkPreviewer
+
+	// webhooks posts the events of conversations to their webhooks
+	webhooks *webhookDeliverer
+
+	// oidc tracks the logins with the OpenID Connect provider, nil if there is none
+	oidc *oidcLogins
 }
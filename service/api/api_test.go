@@ -0,0 +1,115 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/sirupsen/logrus"
+)
+
+// testRouters holds the routers of the running tests, closed once by stopHub or at the end of the test
+var testRouters sync.Map
+
+// newTestRouter returns a router on a new database, closed at the end of the test
+func newTestRouter(t *testing.T) *_router {
+	t.Helper()
+	return newTestRouterWithConfig(t, Config{})
+}
+
+// newTestRouterWithConfig is newTestRouter with the optional parts of `cfg`; the logger and database are set here
+func newTestRouterWithConfig(t *testing.T, cfg Config) *_router {
+	t.Helper()
+	conn, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db")+"?_foreign_keys=on&_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	db, err := database.New(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	cfg.Logger = logger
+	cfg.Database = db
+	router, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := router.(*_router)
+	testRouters.Store(rt, new(sync.Once))
+	t.Cleanup(func() {
+		stopHub(t, rt)
+		testRouters.Delete(rt)
+	})
+	return rt
+}
+
+// stopHub closes the router, if it is still open; the hub goroutine is then done, and its maps can be read by the
+// test
+func stopHub(t *testing.T, rt *_router) {
+	t.Helper()
+	once, ok := testRouters.Load(rt)
+	if !ok {
+		return
+	}
+	once.(*sync.Once).Do(func() {
+		if err := rt.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// registerTestUser creates an account through the API, and returns its ID and session token
+func registerTestUser(t *testing.T, server *httptest.Server, name string) (string, string) {
+	t.Helper()
+	resp, err := http.Post(server.URL+"/users", "application/json",
+		strings.NewReader(`{"name":"`+name+`","password":"password123"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("can't register %s: %s", name, resp.Status)
+	}
+	var login struct {
+		Identifier string `json:"identifier"`
+		Token      string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&login); err != nil {
+		t.Fatal(err)
+	}
+	return login.Identifier, login.Token
+}
+
+// createTestConversation creates a conversation of the user with the participants, and returns its ID
+func createTestConversation(t *testing.T, server *httptest.Server, uid string, token string, participants ...string) string {
+	t.Helper()
+	body, _ := json.Marshal(map[string]interface{}{"participants": participants, "name": "test"})
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/users/"+uid+"/conversations", strings.NewReader(string(body)))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("can't create a conversation: %s", resp.Status)
+	}
+	var conversation database.Conversation
+	if err := json.NewDecoder(resp.Body).Decode(&conversation); err != nil {
+		t.Fatal(err)
+	}
+	return conversation.CId
+}
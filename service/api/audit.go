@@ -0,0 +1,27 @@
+package api
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// auditEvent writes an event of the bus to the log, as the audit trail of the changes made through the API. Drafts are
+// saved while the user types, so they are only logged at debug level.
+func (rt *_router) auditEvent(e busEvent) {
+	logger := rt.baseLogger.WithFields(logrus.Fields{
+		"event":   e.Event.Type(),
+		"version": e.Event.Version(),
+		"actor":   e.ActorId,
+		"at":      e.At.Format(time.RFC3339Nano),
+	})
+	if e.Conversation != "" {
+		logger = logger.WithField("conversation", e.Conversation)
+	}
+
+	if _, ok := e.Event.(DraftUpdatedEvent); ok {
+		logger.Debug("audit")
+		return
+	}
+	logger.Info("audit")
+}
@@ -3,10 +3,8 @@ package api
 import (
 	"context"
 	"net/http"
-	"strings"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
-	"github.com/gofrs/uuid"
 )
 
 // Context key for authenticated user
@@ -14,42 +12,30 @@ type contextKey string
 
 const AuthUserKey contextKey = "auth_user"
 
-// AuthMiddleware validates Bearer token and adds user to context
+// AuthSessionKey is the context key of the session of the authenticated user
+const AuthSessionKey contextKey = "auth_session"
+
+// AuthTokenKey is the context key of the API token of the authenticated user, for the requests made with one
+const AuthTokenKey contextKey = "auth_token"
+
+// AuthMiddleware validates the Bearer session token and adds user and session to context
 func (rt *_router) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Extract Authorization header
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
+		token, ok := bearerToken(r)
+		if !ok {
 			rt.sendError(w, http.StatusUnauthorized, "Authorization header required")
 			return
 		}
 
-		// Check Bearer format
-		if !strings.HasPrefix(authHeader, "Bearer ") {
-			rt.sendError(w, http.StatusUnauthorized, "Invalid authorization format. Use 'Bearer <token>'")
-			return
-		}
-
-		// Extract token (user ID)
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-		token = strings.TrimSpace(token)
-
-		// Validate UUID format
-		userID, err := uuid.FromString(token)
-		if err != nil {
-			rt.sendError(w, http.StatusUnauthorized, "Invalid token format")
-			return
-		}
-
-		// Verify user exists in database
-		user, err := rt.db.GetUserByID(userID.String())
+		user, session, err := rt.authenticate(r, token)
 		if err != nil {
-			rt.sendError(w, http.StatusUnauthorized, "Invalid token - user not found")
+			rt.sendError(w, http.StatusUnauthorized, "Invalid or revoked session")
 			return
 		}
 
-		// Add user to request context
+		// Add user and session to request context
 		ctx := context.WithValue(r.Context(), AuthUserKey, user)
+		ctx = context.WithValue(ctx, AuthSessionKey, session)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	}
 }
@@ -60,6 +46,12 @@ func GetAuthenticatedUser(r *http.Request) (database.User, bool) {
 	return user, ok
 }
 
+// GetAuthenticatedSession extracts the session of the authenticated user from request context
+func GetAuthenticatedSession(r *http.Request) (database.Session, bool) {
+	session, ok := r.Context().Value(AuthSessionKey).(database.Session)
+	return session, ok
+}
+
 // RequireAuth is a helper to check if user is authenticated and matches path parameter
 func (rt *_router) RequireAuth(w http.ResponseWriter, r *http.Request, pathUserID string) (database.User, bool) {
 	user, ok := GetAuthenticatedUser(r)
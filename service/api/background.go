@@ -0,0 +1,88 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// backgroundMaxSleep bounds how long a background loop waits between two runs, so that it recovers from clock changes
+// and from work added without a notification
+const backgroundMaxSleep = time.Minute
+
+// backgroundRetryDelay is how long a background loop waits before retrying work that failed
+const backgroundRetryDelay = 5 * time.Second
+
+// backgroundLoop runs a task of the router in its own goroutine, again and again, until the loop is closed
+type backgroundLoop struct {
+	// wake cuts the current wait short, e.g. after new work was queued
+	wake chan struct{}
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func newBackgroundLoop() *backgroundLoop {
+	return &backgroundLoop{
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// start runs `step` in a new goroutine. `step` returns how long to wait before running it again.
+func (l *backgroundLoop) start(step func() time.Duration) {
+	go func() {
+		defer close(l.done)
+
+		for {
+			timer := time.NewTimer(step())
+			select {
+			case <-l.stop:
+				timer.Stop()
+				return
+			case <-l.wake:
+				timer.Stop()
+			case <-timer.C:
+			}
+		}
+	}()
+}
+
+// notify asks the loop to run again without waiting. It never blocks.
+func (l *backgroundLoop) notify() {
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// stopping reports whether the loop was closed. Long steps should check it to return early.
+func (l *backgroundLoop) stopping() bool {
+	select {
+	case <-l.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops the loop and waits for the current step to finish
+func (l *backgroundLoop) close() {
+	l.stopOnce.Do(func() {
+		close(l.stop)
+	})
+	<-l.done
+}
+
+// waitUntil returns how long a loop should sleep to run again at `next`, capped to backgroundMaxSleep
+func waitUntil(next time.Time) time.Duration {
+	wait := time.Until(next)
+	if wait < 0 {
+		return 0
+	}
+	if wait > backgroundMaxSleep {
+		return backgroundMaxSleep
+	}
+	return wait
+}
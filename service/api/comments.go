@@ -0,0 +1,158 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxCommentLength is the maximum length of a comment, in characters
+const maxCommentLength = 2000
+
+// commentPage is a page of comments. NextCursor is the value to pass as `after` to get the next page; it is empty
+// when there are no more comments.
+type commentPage struct {
+	Comments   []database.Comment `json:"comments"`
+	NextCursor string             `json:"nextCursor,omitempty"`
+}
+
+// listComments returns the threaded replies to a message, oldest first
+func (rt *_router) listComments(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	userId := ps.ByName("id")
+	conversationId := ps.ByName("conversationId")
+	messageId := ps.ByName("messageId")
+
+	user, ok := rt.RequireAuth(w, r, userId)
+	if !ok {
+		return
+	}
+
+	limit, ok := parseLimit(r)
+	if !ok {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	comments, err := rt.db.ListComments(conversationId, user, messageId, r.URL.Query().Get("after"), limit)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "conversation, message or cursor not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, database.ErrNotParticipant) {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("failed to list comments")
+		http.Error(w, "failed to list comments", http.StatusInternalServerError)
+		return
+	}
+
+	page := commentPage{Comments: comments}
+	if len(comments) == limit {
+		page.NextCursor = comments[len(comments)-1].Id
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		ctx.Logger.WithError(err).Error("failed to encode comments response")
+	}
+}
+
+// commentMessage adds a threaded reply to a message
+func (rt *_router) commentMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	userId := ps.ByName("id")
+	conversationId := ps.ByName("conversationId")
+	messageId := ps.ByName("messageId")
+
+	user, ok := rt.RequireAuth(w, r, userId)
+	if !ok {
+		return
+	}
+
+	var requestBody struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	text := strings.TrimSpace(requestBody.Text)
+	if text == "" {
+		http.Error(w, "Comment cannot be empty", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(text) > maxCommentLength {
+		http.Error(w, "Comment is too long", http.StatusBadRequest)
+		return
+	}
+
+	comment, err := rt.db.CommentMessage(conversationId, user, messageId, text)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "conversation or message not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, database.ErrNotParticipant) {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("failed to add comment")
+		http.Error(w, "Failed to add comment", http.StatusInternalServerError)
+		return
+	}
+
+	rt.publishConversationEvent(conversationId, user.UId, CommentAddedEvent{
+		ConversationId: conversationId,
+		MessageId:      messageId,
+		Comment:        comment,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(comment); err != nil {
+		ctx.Logger.WithError(err).Error("failed to encode comment response")
+	}
+}
+
+// uncommentMessage removes a threaded reply. Only its author can remove it.
+func (rt *_router) uncommentMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	userId := ps.ByName("id")
+	conversationId := ps.ByName("conversationId")
+	messageId := ps.ByName("messageId")
+	commentId := ps.ByName("commentId")
+
+	user, ok := rt.RequireAuth(w, r, userId)
+	if !ok {
+		return
+	}
+
+	err := rt.db.UncommentMessage(conversationId, user, messageId, commentId)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "comment not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, database.ErrNotParticipant) {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return
+	} else if errors.Is(err, database.ErrForbidden) {
+		http.Error(w, "only the author can remove a comment", http.StatusForbidden)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("failed to remove comment")
+		http.Error(w, "Failed to remove comment", http.StatusInternalServerError)
+		return
+	}
+
+	rt.publishConversationEvent(conversationId, user.UId, CommentRemovedEvent{
+		ConversationId: conversationId,
+		MessageId:      messageId,
+		CommentId:      commentId,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
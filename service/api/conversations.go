@@ -1,7 +1,9 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
@@ -51,8 +53,9 @@ func (rt *_router) createConversation(w http.ResponseWriter, r *http.Request, ps
 	for _, pid := range request.Participants {
 		// Check if user exists in database
 		var username, picture string
-		err := rt.db.GetRawDB().QueryRow("SELECT username, COALESCE(picture, '') FROM users WHERE id = ?", pid).
-			Scan(&username, &picture)
+		var isBot bool
+		err := rt.db.GetRawDB().QueryRow("SELECT username, COALESCE(picture, ''), is_bot FROM users WHERE id = ?", pid).
+			Scan(&username, &picture, &isBot)
 		if err != nil {
 			http.Error(w, "participant not found: "+pid, http.StatusBadRequest)
 			return
@@ -61,11 +64,12 @@ func (rt *_router) createConversation(w http.ResponseWriter, r *http.Request, ps
 			UId:      pid,
 			Username: username,
 			Picture:  picture,
+			IsBot:    isBot,
 		})
 	}
 
 	// Create conversation
-	conversation, err := rt.db.CreateConversation(participants, request.Name)
+	conversation, err := rt.db.CreateConversation(database.User{UId: userId}, participants, request.Name)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -79,16 +83,11 @@ func (rt *_router) createConversation(w http.ResponseWriter, r *http.Request, ps
 }
 
 func (rt *_router) getMyConversations(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	// Get user ID from URL
-	userId := ps.ByName("id")
-	if userId == "" {
-		http.Error(w, "missing user id", http.StatusBadRequest)
+	user, ok := rt.RequireAuth(w, r, ps.ByName("id"))
+	if !ok {
 		return
 	}
 
-	// Build a User struct (other fields can be empty)
-	user := database.User{UId: userId}
-
 	// Fetch conversations from DB
 	conversations, err := rt.db.GetMyConversations(user)
 	if err != nil {
@@ -104,14 +103,12 @@ func (rt *_router) getMyConversations(w http.ResponseWriter, r *http.Request, ps
 }
 
 func (rt *_router) getConversation(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	// Get user ID and conversation ID from URL
-	userId := ps.ByName("id")
-	conversationId := ps.ByName("conversationId")
-
-	if userId == "" || conversationId == "" {
-		http.Error(w, "missing user id or conversation id", http.StatusBadRequest)
+	user, ok := rt.RequireAuth(w, r, ps.ByName("id"))
+	if !ok {
 		return
 	}
+	userId := user.UId
+	conversationId := ps.ByName("conversationId")
 
 	// Get conversation details
 	conversation, err := rt.db.GetConversation(conversationId)
@@ -141,13 +138,32 @@ func (rt *_router) getConversation(w http.ResponseWriter, r *http.Request, ps ht
 	}
 }
 
+// requireParticipant checks that the user `uid` takes part in the conversation `cid`. If not, it sends an error and
+// returns false.
+func (rt *_router) requireParticipant(w http.ResponseWriter, ctx reqcontext.RequestContext, cid string, uid string) bool {
+	isParticipant, err := rt.db.IsParticipant(cid, uid)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "conversation not found", http.StatusNotFound)
+		return false
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("failed to check conversation membership")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return false
+	} else if !isParticipant {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
 func (rt *_router) addtoGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	// Get user ID and conversation ID from URL
-	userId := ps.ByName("id")
+	user, ok := rt.RequireAuth(w, r, ps.ByName("id"))
+	if !ok {
+		return
+	}
+	userId := user.UId
 	conversationId := ps.ByName("conversationId")
-
-	if userId == "" || conversationId == "" {
-		http.Error(w, "missing user id or conversation id", http.StatusBadRequest)
+	if !rt.requireParticipant(w, ctx, conversationId, userId) {
 		return
 	}
 
@@ -166,14 +182,17 @@ func (rt *_router) addtoGroup(w http.ResponseWriter, r *http.Request, ps httprou
 		return
 	}
 
-	// Find user by username
-	var memberUserId, memberUsername string
-	err := rt.db.GetRawDB().QueryRow("SELECT id, username FROM users WHERE username = ?", request.Name).
-		Scan(&memberUserId, &memberUsername)
-	if err != nil {
+	// Find user by username, whatever the case, as at login
+	found, err := rt.db.GetUserByName(request.Name)
+	if errors.Is(err, sql.ErrNoRows) {
 		http.Error(w, "user not found", http.StatusNotFound)
 		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("failed to find user")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
+	memberUserId, memberUsername := found.UId, found.Username
 
 	// Add user to group
 	memberUser := database.User{UId: memberUserId, Username: memberUsername}
@@ -182,6 +201,12 @@ func (rt *_router) addtoGroup(w http.ResponseWriter, r *http.Request, ps httprou
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	rt.publishConversationEvent(conversationId, userId, MemberJoinedEvent{
+		ConversationId: conversationId,
+		UserId:         memberUserId,
+		Username:       memberUsername,
+		AddedBy:        userId,
+	})
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -191,41 +216,45 @@ func (rt *_router) addtoGroup(w http.ResponseWriter, r *http.Request, ps httprou
 }
 
 func (rt *_router) leaveGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	// Get user ID and conversation ID from URL
-	userId := ps.ByName("id")
-	conversationId := ps.ByName("conversationId")
-
-	if userId == "" || conversationId == "" {
-		http.Error(w, "missing user id or conversation id", http.StatusBadRequest)
+	user, ok := rt.RequireAuth(w, r, ps.ByName("id"))
+	if !ok {
 		return
 	}
-
-	// Get user details
-	var username string
-	err := rt.db.GetRawDB().QueryRow("SELECT username FROM users WHERE id = ?", userId).Scan(&username)
-	if err != nil {
-		http.Error(w, "user not found", http.StatusNotFound)
+	userId := user.UId
+	conversationId := ps.ByName("conversationId")
+	if !rt.requireParticipant(w, ctx, conversationId, userId) {
 		return
 	}
 
 	// Remove user from group
-	user := database.User{UId: userId, Username: username}
-	_, err = rt.db.LeaveGroup(conversationId, user)
+	conversation, err := rt.db.LeaveGroup(conversationId, user)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	// The user is no longer a participant, but their other sessions must learn they left
+	rt.events.publish(busEvent{
+		Event: MemberLeftEvent{
+			ConversationId: conversationId,
+			UserId:         userId,
+			Username:       user.Username,
+		},
+		Conversation: conversationId,
+		Recipients:   append(participantIDs(conversation), userId),
+		ActorId:      userId,
+	})
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func (rt *_router) setGroupName(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	// Get user ID and conversation ID from URL
-	userId := ps.ByName("id")
+	user, ok := rt.RequireAuth(w, r, ps.ByName("id"))
+	if !ok {
+		return
+	}
+	userId := user.UId
 	conversationId := ps.ByName("conversationId")
-
-	if userId == "" || conversationId == "" {
-		http.Error(w, "missing user id or conversation id", http.StatusBadRequest)
+	if !rt.requireParticipant(w, ctx, conversationId, userId) {
 		return
 	}
 
@@ -247,17 +276,19 @@ func (rt *_router) setGroupName(w http.ResponseWriter, r *http.Request, ps httpr
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	rt.publishConversationEvent(conversationId, userId, ConversationUpdatedEvent{Id: conversationId, Name: &newName})
 
 	w.WriteHeader(http.StatusOK)
 }
 
 func (rt *_router) setGroupPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	// Get user ID and conversation ID from URL
-	userId := ps.ByName("id")
+	user, ok := rt.RequireAuth(w, r, ps.ByName("id"))
+	if !ok {
+		return
+	}
+	userId := user.UId
 	conversationId := ps.ByName("conversationId")
-
-	if userId == "" || conversationId == "" {
-		http.Error(w, "missing user id or conversation id", http.StatusBadRequest)
+	if !rt.requireParticipant(w, ctx, conversationId, userId) {
 		return
 	}
 
@@ -279,6 +310,129 @@ func (rt *_router) setGroupPhoto(w http.ResponseWriter, r *http.Request, ps http
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	rt.publishConversationEvent(conversationId, userId, ConversationUpdatedEvent{Id: conversationId, Picture: &newPicture})
 
 	w.WriteHeader(http.StatusOK)
 }
+
+// clearConversationHistory hides all the current messages of the conversation for the calling user only
+func (rt *_router) clearConversationHistory(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	userId := ps.ByName("id")
+	conversationId := ps.ByName("conversationId")
+
+	user, ok := rt.RequireAuth(w, r, userId)
+	if !ok {
+		return
+	}
+
+	err := rt.db.ClearConversationHistory(conversationId, user)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "conversation not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, database.ErrNotParticipant) {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("failed to clear conversation history")
+		http.Error(w, "failed to clear conversation history", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteConversation deletes the conversation and all its content for every participant. Only the owner (creator) of
+// the conversation can do this.
+func (rt *_router) deleteConversation(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	userId := ps.ByName("id")
+	conversationId := ps.ByName("conversationId")
+
+	user, ok := rt.RequireAuth(w, r, userId)
+	if !ok {
+		return
+	}
+
+	// Load the participants first, to notify them once the conversation is gone
+	conversation, err := rt.db.GetConversation(conversationId)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "conversation not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("failed to get conversation")
+		http.Error(w, "failed to delete conversation", http.StatusInternalServerError)
+		return
+	}
+
+	err = rt.db.DeleteConversation(conversationId, user)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "conversation not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, database.ErrForbidden) {
+		http.Error(w, "only the conversation owner can delete it", http.StatusForbidden)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("failed to delete conversation")
+		http.Error(w, "failed to delete conversation", http.StatusInternalServerError)
+		return
+	}
+
+	rt.events.publish(busEvent{
+		Event:        ConversationDeletedEvent{ConversationId: conversationId},
+		Conversation: conversationId,
+		Recipients:   participantIDs(conversation),
+		ActorId:      user.UId,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// maxMessageTTL is the longest time disappearing messages can be kept, in seconds
+const maxMessageTTL = 365 * 24 * 60 * 60
+
+// minMessageTTL is the shortest time disappearing messages can be kept, in seconds
+const minMessageTTL = 5
+
+// setMessageTTL sets how long the new messages of the conversation are kept before they disappear
+func (rt *_router) setMessageTTL(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	userId := ps.ByName("id")
+	conversationId := ps.ByName("conversationId")
+
+	user, ok := rt.RequireAuth(w, r, userId)
+	if !ok {
+		return
+	}
+
+	var requestBody struct {
+		TTL *int `json:"ttl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil || requestBody.TTL == nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	ttl := *requestBody.TTL
+	if ttl != 0 && (ttl < minMessageTTL || ttl > maxMessageTTL) {
+		http.Error(w, "ttl must be 0 (off) or between 5 seconds and one year", http.StatusBadRequest)
+		return
+	}
+
+	err := rt.db.SetMessageTTL(conversationId, user, ttl)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "conversation not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, database.ErrNotParticipant) {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("failed to set message TTL")
+		http.Error(w, "Failed to set message TTL", http.StatusInternalServerError)
+		return
+	}
+
+	rt.publishConversationEvent(conversationId, user.UId, MessageTTLUpdatedEvent{
+		ConversationId: conversationId,
+		UserId:         user.UId,
+		TTL:            ttl,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAddToGroupIgnoresCase(t *testing.T) {
+	rt := newTestRouter(t)
+	server := httptest.NewServer(rt.Handler())
+	defer server.Close()
+
+	alice, token := registerTestUser(t, server, "groupalice")
+	bob, _ := registerTestUser(t, server, "groupbob")
+	carol, _ := registerTestUser(t, server, "GroupCarol")
+	cid := createTestConversation(t, server, alice, token, bob)
+
+	resp := postTestJSON(t, server, token, "/users/"+alice+"/conversations/"+cid+"/members", `{"name":"groupCAROL"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("added with %s, want %d", resp.Status, http.StatusCreated)
+	}
+	var added string
+	if err := json.NewDecoder(resp.Body).Decode(&added); err != nil {
+		t.Fatal(err)
+	}
+	if added != carol {
+		t.Errorf("added %s, want %s", added, carol)
+	}
+}
+
+func TestLeaveGroupTellsTheLeaver(t *testing.T) {
+	rt := newTestRouter(t)
+	server := httptest.NewServer(rt.Handler())
+	defer server.Close()
+
+	alice, aliceToken := registerTestUser(t, server, "leavealice")
+	bob, bobToken := registerTestUser(t, server, "leavebob")
+	cid := createTestConversation(t, server, alice, aliceToken, bob)
+	conn := dialTestWs(t, server, bobToken)
+
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+"/users/"+bob+"/conversations/"+cid+"/members", nil)
+	req.Header.Set("Authorization", "Bearer "+bobToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("left with %s, want %d", resp.Status, http.StatusNoContent)
+	}
+	if m := readTestWs(t, conn); m.Type != "member_left" {
+		t.Errorf("the user who left got %s %s, want member_left", m.Type, m.Payload)
+	}
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+)
+
+// dispatchBatchSize is the maximum number of due messages loaded from the database at once
+const dispatchBatchSize = 100
+
+// messageDispatcher delivers scheduled messages when they are due. The queue lives in the database, so messages
+// scheduled before a restart are delivered once the dispatcher runs again; the ones that became due while the server
+// was down are sent right away.
+type messageDispatcher struct {
+	*backgroundLoop
+	rt *_router
+}
+
+func newMessageDispatcher(rt *_router) *messageDispatcher {
+	return &messageDispatcher{
+		backgroundLoop: newBackgroundLoop(),
+		rt:             rt,
+	}
+}
+
+func (d *messageDispatcher) run() {
+	d.start(func() time.Duration {
+		ok := d.dispatchDue()
+		wait := d.nextWait()
+		if !ok && wait < backgroundRetryDelay {
+			wait = backgroundRetryDelay
+		}
+		return wait
+	})
+}
+
+// nextWait returns how long to sleep before the next scheduled message is due
+func (d *messageDispatcher) nextWait() time.Duration {
+	next, ok, err := d.rt.db.NextScheduledMessageTime()
+	if err != nil {
+		d.rt.baseLogger.WithError(err).Error("failed to read the scheduled messages queue")
+		return backgroundMaxSleep
+	}
+	if !ok {
+		return backgroundMaxSleep
+	}
+	return waitUntil(next)
+}
+
+// dispatchDue delivers every message that is due, stopping early if the dispatcher is closed. It returns false if
+// some message could not be delivered and is still in the queue.
+func (d *messageDispatcher) dispatchDue() bool {
+	ok := true
+	for {
+		now := time.Now()
+		due, err := d.rt.db.GetDueScheduledMessages(now, dispatchBatchSize)
+		if err != nil {
+			d.rt.baseLogger.WithError(err).Error("failed to load due scheduled messages")
+			return false
+		}
+
+		delivered := 0
+		for _, scheduled := range due {
+			if d.stopping() {
+				return ok
+			}
+			if d.deliver(scheduled, now) {
+				delivered++
+			} else {
+				ok = false
+			}
+		}
+
+		// Stop on a short batch, or when nothing moved to avoid reloading the same failing messages
+		if len(due) < dispatchBatchSize || delivered == 0 {
+			return ok
+		}
+	}
+}
+
+// deliver sends a due scheduled message. It returns false if the message is still in the queue.
+func (d *messageDispatcher) deliver(scheduled database.ScheduledMessage, now time.Time) bool {
+	logger := d.rt.baseLogger.WithField("scheduledMessageId", scheduled.Id)
+
+	message, err := d.rt.db.DeliverScheduledMessage(scheduled.Id, now)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Cancelled or postponed after it was loaded, or its conversation was deleted
+		return true
+	} else if errors.Is(err, database.ErrNotParticipant) {
+		logger.Warn("scheduled message discarded: the sender left the conversation")
+		return true
+	} else if err != nil {
+		logger.WithError(err).Error("failed to deliver scheduled message")
+		return false
+	}
+
+	conversation, err := d.rt.db.GetConversation(scheduled.ConversationId)
+	if err != nil {
+		// The message is saved, clients will see it when they reload the conversation
+		logger.WithError(err).Error("failed to load conversation of scheduled message")
+		return true
+	}
+
+	d.rt.sysLogger.LogInfo("Scheduled message sent in conversation " + conversation.CId + " by user " + message.SenderId)
+	d.rt.publishMessage(conversation, message, "")
+	return true
+}
@@ -1,60 +1,256 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/password"
 	"github.com/julienschmidt/httprouter"
 )
 
+// loginFailureWindow is how far back failed logins are counted for rate limiting
+const loginFailureWindow = 15 * time.Minute
+
+// maxLoginFailuresPerName and maxLoginFailuresPerAddress are how many failed logins are allowed in loginFailureWindow
+// for a single username, and from a single address, before further attempts are refused. A successful login resets
+// the count of the username.
+const (
+	maxLoginFailuresPerName    = 5
+	maxLoginFailuresPerAddress = 20
+)
+
+// minPasswordLength is the minimum length of a new password, in bytes
+const minPasswordLength = 8
+
+// credentials is the body of the login and register requests
+type credentials struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// validate returns an error message if the credentials are malformed, or the empty string
+func (c credentials) validate() string {
+	if len(c.Name) < 3 || len(c.Name) > 16 {
+		return "username must be 3-16 characters"
+	}
+	if c.Password == "" {
+		return "password is required"
+	}
+	if len(c.Password) > password.MaxLength {
+		return "password is too long"
+	}
+	return ""
+}
+
+// unknownUserHash is verified against when the username does not exist, so that the response takes as long as for
+// a wrong password and doesn't tell which usernames exist
+var unknownUserHash struct {
+	once sync.Once
+	hash string
+}
+
+// verifyUnknownUser verifies a password against unknownUserHash, taking as long as a real check
+func verifyUnknownUser(plain string) {
+	unknownUserHash.once.Do(func() {
+		unknownUserHash.hash, _ = password.Hash("")
+	})
+	_, _ = password.Verify(unknownUserHash.hash, plain)
+}
+
 // doLogin handles user login
 func (rt *_router) doLogin(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	type loginRequest struct {
-		Name string `json:"name"`
-	}
-	var req loginRequest
+	var req credentials
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&req); err != nil {
 		http.Error(w, "invalid input", http.StatusBadRequest)
 		return
 	}
-	if len(req.Name) < 3 || len(req.Name) > 16 {
+	if msg := req.validate(); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	event := database.LoginEvent{
+		Username:   req.Name,
+		RemoteAddr: remoteAddress(r),
+		UserAgent:  r.UserAgent(),
+	}
+
+	byName, byAddr, err := rt.db.CountLoginFailures(req.Name, event.RemoteAddr, time.Now().Add(-loginFailureWindow))
+	if err != nil {
+		ctx.Logger.WithError(err).Error("failed to count login failures")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if byName >= maxLoginFailuresPerName || byAddr >= maxLoginFailuresPerAddress {
+		w.Header().Set("Retry-After", strconv.Itoa(int(loginFailureWindow.Seconds())))
+		http.Error(w, "Too many failed logins, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	user, ok, err := rt.checkCredentials(req)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("failed to check credentials")
+		rt.sysLogger.LogError("Database error during login: " + err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	event.UserId = user.UId
+	event.Success = ok
+	if err := rt.db.DoLogin(event); err != nil {
+		ctx.Logger.WithError(err).Error("failed to record login")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		rt.sysLogger.LogWarn("Failed login for user " + req.Name)
+		http.Error(w, "invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	token, err := rt.newSession(r, user)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("failed to start session")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	rt.sysLogger.LogInfo("User " + user.Username + " logged in successfully")
+
+	writeLoginResponse(w, ctx, map[string]string{"identifier": user.UId, "token": token})
+}
+
+// checkCredentials returns the user with the given username and whether the password is theirs. The user is empty
+// if the username does not exist.
+//
+// Accounts created before passwords were introduced have none, and neither do the accounts provisioned by the OpenID
+// Connect provider: they cannot log in with a password until they set one, with a reset token or once logged in
+// otherwise. Bots cannot log in.
+func (rt *_router) checkCredentials(req credentials) (database.User, bool, error) {
+	user, err := rt.db.GetUserByName(req.Name)
+	if errors.Is(err, sql.ErrNoRows) {
+		verifyUnknownUser(req.Password)
+		return database.User{}, false, nil
+	} else if err != nil {
+		return database.User{}, false, err
+	}
+	if user.IsBot {
+		// Bots have no password and act only through API tokens
+		return user, false, nil
+	}
+
+	hash, err := rt.db.GetPasswordHash(user.UId)
+	if errors.Is(err, sql.ErrNoRows) {
+		verifyUnknownUser(req.Password)
+		return user, false, nil
+	} else if err != nil {
+		return database.User{}, false, err
+	}
+
+	ok, err := password.Verify(hash, req.Password)
+	if err != nil {
+		return database.User{}, false, err
+	}
+	if ok && password.NeedsRehash(hash) {
+		return user, true, rt.setPassword(user.UId, req.Password)
+	}
+	return user, ok, nil
+}
+
+// setPassword hashes and saves the password of the user `uid`
+func (rt *_router) setPassword(uid string, plain string) error {
+	hash, err := password.Hash(plain)
+	if err != nil {
+		return err
+	}
+	return rt.db.SetPasswordHash(uid, hash)
+}
+
+// register creates a new account with a password, and starts a session of it
+func (rt *_router) register(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	var req credentials
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&req); err != nil {
 		http.Error(w, "invalid input", http.StatusBadRequest)
 		return
 	}
-	// Try to find user by name
-	users, err := rt.db.ListUsers(req.Name)
-	var user database.User
+	if msg := req.validate(); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	if !isValidUsername(req.Name) {
+		http.Error(w, "username can only contain letters, numbers and underscores", http.StatusBadRequest)
+		return
+	}
+	if len(req.Password) < minPasswordLength {
+		http.Error(w, "password must be at least 8 characters", http.StatusBadRequest)
+		return
+	}
+
+	hash, err := password.Hash(req.Password)
 	if err != nil {
-		rt.sysLogger.LogError("Database error during user lookup: " + err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	if len(users) > 0 {
-		user = users[0]
-		rt.sysLogger.LogInfo("User " + req.Name + " logged in successfully")
-	} else {
-		// Auto-create user on login
-		newUser, err := rt.db.SetMyUserName(req.Name)
-		if err != nil {
-			rt.sysLogger.LogError("Failed to create user: " + err.Error())
-			http.Error(w, "failed to create user", http.StatusInternalServerError)
-			return
-		}
-		user = newUser
-		rt.sysLogger.LogInfo("Auto-created and logged in user: " + req.Name)
+		ctx.Logger.WithError(err).Error("failed to hash password")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	user, err := rt.db.CreateUser(req.Name, hash)
+	if errors.Is(err, database.ErrUsernameTaken) {
+		http.Error(w, "username already taken", http.StatusConflict)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("failed to create user")
+		rt.sysLogger.LogError("Failed to create user: " + err.Error())
+		http.Error(w, "failed to create user", http.StatusInternalServerError)
+		return
+	}
+	rt.sysLogger.LogInfo("Registered user: " + user.Username)
+
+	err = rt.db.DoLogin(database.LoginEvent{
+		UserId:     user.UId,
+		Username:   user.Username,
+		Success:    true,
+		RemoteAddr: remoteAddress(r),
+		UserAgent:  r.UserAgent(),
+	})
+	if err != nil {
+		ctx.Logger.WithError(err).Error("failed to record login")
 	}
 
-	resp := map[string]string{"identifier": user.UId}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		ctx.Logger.WithError(err).Error("failed to encode login response")
+	token, err := rt.newSession(r, user)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("failed to start session")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+
+	writeLoginResponse(w, ctx, map[string]string{"identifier": user.UId, "token": token})
+}
+
+// isValidUsername reports whether name only has ASCII letters, digits and underscores, so that comparing usernames
+// regardless of case is unambiguous. Older accounts may have other characters.
+func isValidUsername(name string) bool {
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// remoteAddress returns the IP address of the client, without the port
+func remoteAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
 
 // User represents a user in the system
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/richtext"
+	"github.com/julienschmidt/httprouter"
+)
+
+// saveDraft stores the text the caller is writing in a conversation, and sends it to the caller's other sessions with
+// a `draft_updated` event. Edits are ordered by `updatedAt`, the time of the edit on the client: the latest edit wins,
+// and an older one is refused with 409 and the stored draft.
+func (rt *_router) saveDraft(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conversationId := ps.ByName("conversationId")
+
+	user, ok := rt.RequireAuth(w, r, ps.ByName("id"))
+	if !ok {
+		return
+	}
+
+	var requestBody struct {
+		Text             string     `json:"text"`
+		ReplyToMessageId string     `json:"replyToMessageId,omitempty"`
+		UpdatedAt        *time.Time `json:"updatedAt,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(requestBody.Text) > richtext.MaxLength {
+		http.Error(w, "Draft is too long", http.StatusBadRequest)
+		return
+	}
+
+	// A clock ahead of the server would make the draft win over every later edit
+	updatedAt := time.Now()
+	if requestBody.UpdatedAt != nil && requestBody.UpdatedAt.Before(updatedAt) {
+		updatedAt = *requestBody.UpdatedAt
+	}
+
+	draft, saved, err := rt.db.SaveDraft(conversationId, user, requestBody.Text, requestBody.ReplyToMessageId, updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "conversation not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, database.ErrNotParticipant) {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return
+	} else if errors.Is(err, database.ErrInvalidReplyTarget) {
+		http.Error(w, "reply target not found", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("failed to save draft")
+		http.Error(w, "Failed to save draft", http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusConflict
+	if saved {
+		status = http.StatusOK
+		rt.publishUserEvent([]string{user.UId}, user.UId, DraftUpdatedEvent{
+			ConversationId: conversationId,
+			Draft:          draft,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(draft); err != nil {
+		ctx.Logger.WithError(err).Error("failed to encode draft")
+	}
+}
+
+// clearDraft empties the draft of the sender of a message, unless it was edited in the meantime, and tells the
+// sender's sessions
+func (rt *_router) clearDraft(conversationId string, userId string) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	cleared, err := rt.db.ClearDraft(conversationId, userId, now)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("failed to clear draft")
+		return
+	}
+	if cleared {
+		rt.publishUserEvent([]string{userId}, userId, DraftUpdatedEvent{
+			ConversationId: conversationId,
+			Draft: database.Draft{
+				UpdatedAt: now.Format("2006-01-02T15:04:05.000Z07:00"),
+			},
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxEmojiBytes caps the size of a reaction. The longest emoji ZWJ sequences in use today are around 35 bytes.
+const maxEmojiBytes = 64
+
+const (
+	zeroWidthJoiner   = '\u200D'
+	variationSelector = '\uFE0F'
+	combiningKeycap   = '\u20E3'
+	blackFlag         = '\U0001F3F4'
+	cancelTag         = '\U000E007F'
+)
+
+// emojiCharacters approximates the Unicode Extended_Pictographic property, which is not available in the standard
+// library. Regional indicators and skin tone modifiers are handled separately by isEmoji.
+var emojiCharacters = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x00A9, Hi: 0x00AE, Stride: 5},
+		{Lo: 0x203C, Hi: 0x203C, Stride: 1},
+		{Lo: 0x2049, Hi: 0x2049, Stride: 1},
+		{Lo: 0x2122, Hi: 0x2122, Stride: 1},
+		{Lo: 0x2139, Hi: 0x2139, Stride: 1},
+		{Lo: 0x2194, Hi: 0x2199, Stride: 1},
+		{Lo: 0x21A9, Hi: 0x21AA, Stride: 1},
+		{Lo: 0x231A, Hi: 0x231B, Stride: 1},
+		{Lo: 0x2328, Hi: 0x2328, Stride: 1},
+		{Lo: 0x23CF, Hi: 0x23CF, Stride: 1},
+		{Lo: 0x23E9, Hi: 0x23F3, Stride: 1},
+		{Lo: 0x23F8, Hi: 0x23FA, Stride: 1},
+		{Lo: 0x24C2, Hi: 0x24C2, Stride: 1},
+		{Lo: 0x25AA, Hi: 0x25AB, Stride: 1},
+		{Lo: 0x25B6, Hi: 0x25B6, Stride: 1},
+		{Lo: 0x25C0, Hi: 0x25C0, Stride: 1},
+		{Lo: 0x25FB, Hi: 0x25FE, Stride: 1},
+		{Lo: 0x2600, Hi: 0x27BF, Stride: 1},
+		{Lo: 0x2934, Hi: 0x2935, Stride: 1},
+		{Lo: 0x2B05, Hi: 0x2B07, Stride: 1},
+		{Lo: 0x2B1B, Hi: 0x2B1C, Stride: 1},
+		{Lo: 0x2B50, Hi: 0x2B50, Stride: 1},
+		{Lo: 0x2B55, Hi: 0x2B55, Stride: 1},
+		{Lo: 0x3030, Hi: 0x3030, Stride: 1},
+		{Lo: 0x303D, Hi: 0x303D, Stride: 1},
+		{Lo: 0x3297, Hi: 0x3299, Stride: 2},
+	},
+	R32: []unicode.Range32{
+		{Lo: 0x1F000, Hi: 0x1F1E5, Stride: 1},
+		{Lo: 0x1F200, Hi: 0x1F3FA, Stride: 1},
+		{Lo: 0x1F400, Hi: 0x1FAFF, Stride: 1},
+	},
+	LatinOffset: 1,
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+func isSkinToneModifier(r rune) bool {
+	return r >= 0x1F3FB && r <= 0x1F3FF
+}
+
+func isTag(r rune) bool {
+	return r >= 0xE0020 && r <= 0xE007E
+}
+
+func isKeycapBase(r rune) bool {
+	return (r >= '0' && r <= '9') || r == '#' || r == '*'
+}
+
+// isEmoji reports whether s is exactly one emoji, following the shapes of the Unicode emoji sequences (UTS #51):
+// a single pictograph with optional variation selector and skin tone, a keycap, a flag (two regional indicators or a
+// tag sequence), or several of those joined by ZWJ.
+func isEmoji(s string) bool {
+	if s == "" || len(s) > maxEmojiBytes || !utf8.ValidString(s) {
+		return false
+	}
+	runes := []rune(s)
+
+	// Keycap: [0-9#*] FE0F? 20E3
+	if isKeycapBase(runes[0]) {
+		switch {
+		case len(runes) == 2 && runes[1] == combiningKeycap:
+			return true
+		case len(runes) == 3 && runes[1] == variationSelector && runes[2] == combiningKeycap:
+			return true
+		}
+		return false
+	}
+
+	// Flag: two regional indicators
+	if isRegionalIndicator(runes[0]) {
+		return len(runes) == 2 && isRegionalIndicator(runes[1])
+	}
+
+	// Subdivision flag: black flag, tags, cancel tag
+	if runes[0] == blackFlag && len(runes) > 2 && isTag(runes[1]) {
+		for _, r := range runes[1 : len(runes)-1] {
+			if !isTag(r) {
+				return false
+			}
+		}
+		return runes[len(runes)-1] == cancelTag
+	}
+
+	// ZWJ sequence of one or more elements: pictograph FE0F? modifier?
+	i := 0
+	for {
+		if i >= len(runes) || !unicode.Is(emojiCharacters, runes[i]) {
+			return false
+		}
+		i++
+		if i < len(runes) && runes[i] == variationSelector {
+			i++
+		}
+		if i < len(runes) && isSkinToneModifier(runes[i]) {
+			i++
+		}
+		if i == len(runes) {
+			return true
+		}
+		if runes[i] != zeroWidthJoiner {
+			return false
+		}
+		i++
+	}
+}
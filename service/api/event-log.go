@@ -0,0 +1,82 @@
+package api
+
+import (
+	"encoding/json"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+)
+
+// eventLogSize is how many events are kept for each user, to replay them to the clients that reconnect. A client that
+// missed more has to resync.
+const eventLogSize = 1000
+
+// eventLogReady is the payload of the `ready` message, sent once a client is up to date: Seq is the last event of the
+// user, and Replayed how many events were sent again
+type eventLogReady struct {
+	Seq      int64 `json:"seq"`
+	Replayed int   `json:"replayed"`
+}
+
+// eventLogResync is the payload of the `resync_required` message, sent to a client whose last event is no longer in the
+// log. It must reload its state and continue from Seq.
+type eventLogResync struct {
+	Seq int64 `json:"seq"`
+}
+
+// logEvent adds an event of the bus to the event log of its recipients, and returns the sequence number it got for
+// each of them. The event is still sent live if it cannot be logged.
+func (rt *_router) logEvent(e busEvent) map[string]int64 {
+	payload, err := json.Marshal(e.Event)
+	if err != nil {
+		rt.baseLogger.WithError(err).WithField("event", e.Event.Type()).Error("failed to encode event")
+		return nil
+	}
+	seqs, err := rt.db.AppendUserEvents(e.Recipients, database.UserEvent{
+		Type:    e.Event.Type(),
+		Version: e.Event.Version(),
+		Payload: string(payload),
+	}, eventLogSize)
+	if err != nil {
+		rt.baseLogger.WithError(err).WithField("event", e.Event.Type()).Error("failed to log event")
+		return nil
+	}
+	return seqs
+}
+
+// resume brings a client that just registered up to date, sending the messages with `write`: a reconnecting client
+// gets the events it missed from the event log, or is told to resync if some of them were dropped. It returns the
+// sequence number of the last event the client got.
+func (c *Client) resume(write func(WSMessage) error) (int64, error) {
+	rt := c.Hub.router
+	oldest, last, err := rt.db.GetUserEventRange(c.UserID)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("can't read the event log")
+		return 0, err
+	}
+
+	if c.resumeAfter < 0 {
+		return last, write(WSMessage{Type: "ready", Payload: eventLogReady{Seq: last}})
+	}
+	// The events after resumeAfter were dropped, or the client saw events that do not exist
+	if c.resumeAfter < oldest-1 || c.resumeAfter > last {
+		return last, write(WSMessage{Type: "resync_required", Payload: eventLogResync{Seq: last}})
+	}
+
+	events, err := rt.db.ListUserEvents(c.UserID, c.resumeAfter, last)
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("can't read the event log")
+		return 0, err
+	}
+	for _, e := range events {
+		err = write(WSMessage{
+			Type:    e.Type,
+			Version: e.Version,
+			Seq:     e.Seq,
+			Payload: json.RawMessage(e.Payload),
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return last, write(WSMessage{Type: "ready", Payload: eventLogReady{Seq: last, Replayed: len(events)}})
+}
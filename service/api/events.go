@@ -0,0 +1,370 @@
+package api
+
+import (
+	"sync"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+)
+
+// eventQueueSize is how many events a subscriber can lag behind before publishers wait for it
+const eventQueueSize = 1024
+
+// Event is a change saved by the application. Handlers publish events on the event bus of the router, and the
+// WebSocket hub, the webhooks, the audit log and the metrics subscribe to it.
+//
+// The fields of an event are its payload on the WebSocket and in webhooks. Version grows when a field is removed or
+// changes meaning; adding a field keeps the version.
+type Event interface {
+	// Type is the name of the event, e.g. "message"
+	Type() string
+	Version() int
+}
+
+// busEvent is an event with the users it concerns
+type busEvent struct {
+	Event Event
+
+	// Conversation is the conversation whose participants are told about the event. It is empty for the events that
+	// only concern some users, like a message hidden for its sender: those never reach webhooks.
+	Conversation string
+
+	// Recipients are the users told about the event; each of them gets it in their event log, with the next sequence
+	// number of the user. If nil, the event goes to every connected client and is not logged.
+	Recipients []string
+
+	// ActorId is the user who made the change, empty when the server did
+	ActorId string
+
+	At time.Time
+}
+
+// eventSubscriber receives the events of the bus in its own goroutine, in the order they were published
+type eventSubscriber struct {
+	name   string
+	queue  chan busEvent
+	handle func(busEvent)
+}
+
+// eventBus delivers the events published by handlers to the subscribers. Each subscriber has its own queue, so a slow
+// one does not delay the others until its queue is full.
+type eventBus struct {
+	rt *_router
+
+	mutex       sync.RWMutex
+	closed      bool
+	subscribers []*eventSubscriber
+	done        sync.WaitGroup
+}
+
+func newEventBus(rt *_router) *eventBus {
+	return &eventBus{rt: rt}
+}
+
+// subscribe calls `handle` with every event published from now on. Subscribers are added while the router is created,
+// before any event is published.
+func (b *eventBus) subscribe(name string, handle func(busEvent)) {
+	s := &eventSubscriber{
+		name:   name,
+		queue:  make(chan busEvent, eventQueueSize),
+		handle: handle,
+	}
+
+	b.mutex.Lock()
+	b.subscribers = append(b.subscribers, s)
+	b.mutex.Unlock()
+
+	b.done.Add(1)
+	go func() {
+		defer b.done.Done()
+		for e := range s.queue {
+			b.deliver(s, e)
+		}
+	}()
+}
+
+// deliver passes an event to a subscriber; a subscriber that panics loses the event, not the server
+func (b *eventBus) deliver(s *eventSubscriber, e busEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			b.rt.baseLogger.WithField("subscriber", s.name).WithField("event", e.Event.Type()).
+				Errorf("event subscriber panicked: %v", r)
+		}
+	}()
+	s.handle(e)
+}
+
+// publish queues an event for every subscriber. It waits when the queue of a subscriber is full. Events published
+// after the bus was closed are dropped.
+func (b *eventBus) publish(e busEvent) {
+	if e.At.IsZero() {
+		e.At = time.Now().UTC()
+	}
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if b.closed {
+		b.rt.baseLogger.WithField("event", e.Event.Type()).Warn("event published after shutdown")
+		return
+	}
+	for _, s := range b.subscribers {
+		s.queue <- e
+	}
+}
+
+// close stops accepting events and waits for the subscribers to handle the queued ones
+func (b *eventBus) close() {
+	b.mutex.Lock()
+	if !b.closed {
+		b.closed = true
+		for _, s := range b.subscribers {
+			close(s.queue)
+		}
+	}
+	b.mutex.Unlock()
+	b.done.Wait()
+}
+
+// publishConversationEvent publishes an event to the participants of the conversation `cid`
+func (rt *_router) publishConversationEvent(cid string, actorId string, event Event) {
+	conversation, err := rt.db.GetConversation(cid)
+	if err != nil {
+		rt.baseLogger.WithError(err).WithField("event", event.Type()).Warn("can't load conversation participants for event")
+		return
+	}
+	rt.events.publish(busEvent{
+		Event:        event,
+		Conversation: cid,
+		Recipients:   participantIDs(conversation),
+		ActorId:      actorId,
+	})
+}
+
+// publishUserEvent publishes an event that only concerns `userIds`, like the private changes of a user that their
+// other sessions must follow
+func (rt *_router) publishUserEvent(userIds []string, actorId string, event Event) {
+	rt.events.publish(busEvent{
+		Event:      event,
+		Recipients: userIds,
+		ActorId:    actorId,
+	})
+}
+
+// participantIDs returns the user IDs of the participants of a conversation
+func participantIDs(conversation database.Conversation) []string {
+	ids := make([]string, 0, len(conversation.Participants))
+	for _, participant := range conversation.Participants {
+		ids = append(ids, participant.UId)
+	}
+	return ids
+}
+
+// MessageCreatedEvent is a new message, sent or forwarded. Version 1 had snake_case keys and only some fields.
+type MessageCreatedEvent struct {
+	ConversationId string `json:"conversationId"`
+	database.Message
+	// ClientMessageId is the idempotency key of the sender, so that their clients can match the message they display
+	// while waiting for the server
+	ClientMessageId string `json:"clientMessageId,omitempty"`
+}
+
+func (MessageCreatedEvent) Type() string { return "message" }
+func (MessageCreatedEvent) Version() int { return 2 }
+
+// MentionEvent tells a user that a message mentions them
+type MentionEvent struct {
+	ConversationId string `json:"conversationId"`
+	MessageId      string `json:"messageId"`
+	SenderId       string `json:"senderId"`
+	Text           string `json:"text"`
+}
+
+func (MentionEvent) Type() string { return "mention" }
+func (MentionEvent) Version() int { return 1 }
+
+// MessageUpdatedEvent is the link preview of a message, fetched after it was sent
+type MessageUpdatedEvent struct {
+	ConversationId string                `json:"conversationId"`
+	MessageId      string                `json:"messageId"`
+	LinkPreview    *database.LinkPreview `json:"linkPreview"`
+}
+
+func (MessageUpdatedEvent) Type() string { return "message_updated" }
+func (MessageUpdatedEvent) Version() int { return 1 }
+
+// PollUpdatedEvent is a vote, or the closing of a poll. The poll never carries the votes of the voter.
+type PollUpdatedEvent struct {
+	ConversationId string        `json:"conversationId"`
+	MessageId      string        `json:"messageId"`
+	Poll           database.Poll `json:"poll"`
+}
+
+func (PollUpdatedEvent) Type() string { return "poll_updated" }
+func (PollUpdatedEvent) Version() int { return 1 }
+
+// MessageDeletedEvent is a message deleted for everyone, or hidden for the user who deleted it
+type MessageDeletedEvent struct {
+	ConversationId string `json:"conversationId"`
+	MessageId      string `json:"messageId"`
+	ForEveryone    bool   `json:"forEveryone"`
+	DeletedAt      string `json:"deletedAt,omitempty"`
+}
+
+func (MessageDeletedEvent) Type() string { return "message_deleted" }
+func (MessageDeletedEvent) Version() int { return 1 }
+
+// MessagesExpiredEvent is the disappearing messages of a conversation that were deleted when they expired
+type MessagesExpiredEvent struct {
+	ConversationId string   `json:"conversationId"`
+	MessageIds     []string `json:"messageIds"`
+}
+
+func (MessagesExpiredEvent) Type() string { return "messages_expired" }
+func (MessagesExpiredEvent) Version() int { return 1 }
+
+// ReactionEvent is a reaction added to a message or removed from it
+type ReactionEvent struct {
+	ConversationId string `json:"conversationId"`
+	MessageId      string `json:"messageId"`
+	UserId         string `json:"userId"`
+	Emoji          string `json:"emoji"`
+	Added          bool   `json:"-"`
+}
+
+func (e ReactionEvent) Type() string {
+	if e.Added {
+		return "reaction_added"
+	}
+	return "reaction_removed"
+}
+func (ReactionEvent) Version() int { return 1 }
+
+// CommentAddedEvent is a threaded reply to a message
+type CommentAddedEvent struct {
+	ConversationId string           `json:"conversationId"`
+	MessageId      string           `json:"messageId"`
+	Comment        database.Comment `json:"comment"`
+}
+
+func (CommentAddedEvent) Type() string { return "comment_added" }
+func (CommentAddedEvent) Version() int { return 1 }
+
+// CommentRemovedEvent is a threaded reply removed by its author
+type CommentRemovedEvent struct {
+	ConversationId string `json:"conversationId"`
+	MessageId      string `json:"messageId"`
+	CommentId      string `json:"commentId"`
+}
+
+func (CommentRemovedEvent) Type() string { return "comment_removed" }
+func (CommentRemovedEvent) Version() int { return 1 }
+
+// PinEvent is a message pinned to a conversation or unpinned
+type PinEvent struct {
+	ConversationId string `json:"conversationId"`
+	MessageId      string `json:"messageId"`
+	UserId         string `json:"userId"`
+	Pinned         bool   `json:"-"`
+}
+
+func (e PinEvent) Type() string {
+	if e.Pinned {
+		return "pinned"
+	}
+	return "unpinned"
+}
+func (PinEvent) Version() int { return 1 }
+
+// StarEvent is a message starred or unstarred by a user. Stars are private to the user.
+type StarEvent struct {
+	ConversationId string `json:"conversationId"`
+	MessageId      string `json:"messageId"`
+	Starred        bool   `json:"-"`
+}
+
+func (e StarEvent) Type() string {
+	if e.Starred {
+		return "starred"
+	}
+	return "unstarred"
+}
+func (StarEvent) Version() int { return 1 }
+
+// DraftUpdatedEvent is the draft of a user in a conversation, edited or cleared
+type DraftUpdatedEvent struct {
+	ConversationId string         `json:"conversationId"`
+	Draft          database.Draft `json:"draft"`
+}
+
+func (DraftUpdatedEvent) Type() string { return "draft_updated" }
+func (DraftUpdatedEvent) Version() int { return 1 }
+
+// MemberJoinedEvent is a user added to a group
+type MemberJoinedEvent struct {
+	ConversationId string `json:"conversationId"`
+	UserId         string `json:"userId"`
+	Username       string `json:"username"`
+	AddedBy        string `json:"addedBy"`
+}
+
+func (MemberJoinedEvent) Type() string { return "member_joined" }
+func (MemberJoinedEvent) Version() int { return 1 }
+
+// MemberLeftEvent is a user who left a group
+type MemberLeftEvent struct {
+	ConversationId string `json:"conversationId"`
+	UserId         string `json:"userId"`
+	Username       string `json:"username"`
+}
+
+func (MemberLeftEvent) Type() string { return "member_left" }
+func (MemberLeftEvent) Version() int { return 1 }
+
+// ConversationUpdatedEvent is a change of the name or of the picture of a group. Only the changed fields are set; the
+// keys are the ones of the Conversation model.
+type ConversationUpdatedEvent struct {
+	Id      string  `json:"id"`
+	Name    *string `json:"name,omitempty"`
+	Picture *string `json:"picture,omitempty"`
+}
+
+func (ConversationUpdatedEvent) Type() string { return "conversation_updated" }
+func (ConversationUpdatedEvent) Version() int { return 1 }
+
+// ConversationDeletedEvent is a conversation deleted by its owner
+type ConversationDeletedEvent struct {
+	ConversationId string `json:"conversationId"`
+}
+
+func (ConversationDeletedEvent) Type() string { return "conversation_deleted" }
+func (ConversationDeletedEvent) Version() int { return 1 }
+
+// MessageTTLUpdatedEvent is a change of how long the new messages of a conversation are kept
+type MessageTTLUpdatedEvent struct {
+	ConversationId string `json:"conversationId"`
+	UserId         string `json:"userId"`
+	TTL            int    `json:"ttl"`
+}
+
+func (MessageTTLUpdatedEvent) Type() string { return "message_ttl_updated" }
+func (MessageTTLUpdatedEvent) Version() int { return 1 }
+
+// UserUpdatedEvent is a change of the profile of a user; the keys are the ones of the User model
+type UserUpdatedEvent struct {
+	Id       string `json:"id"`
+	Username string `json:"username"`
+	Picture  string `json:"picture"`
+}
+
+func (UserUpdatedEvent) Type() string { return "user_updated" }
+func (UserUpdatedEvent) Version() int { return 1 }
+
+// SessionRevokedEvent is a session of a user that ended, or all of them if SessionId is empty. Their WebSocket
+// connections are closed.
+type SessionRevokedEvent struct {
+	UserId    string `json:"userId"`
+	SessionId string `json:"sessionId,omitempty"`
+}
+
+func (SessionRevokedEvent) Type() string { return "session_revoked" }
+func (SessionRevokedEvent) Version() int { return 1 }
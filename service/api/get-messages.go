@@ -1,107 +1,87 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/richtext"
 	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
 )
 
 func (rt *_router) getMessages(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	convId := ps.ByName("conversationId")
-	userId := ps.ByName("id")
+	user, ok := rt.RequireAuth(w, r, ps.ByName("id"))
+	if !ok {
+		return
+	}
+	userId := user.UId
 	db := rt.db
-	sqldb := db.GetRawDB()
+
+	// Only participants can read the conversation
+	if !rt.requireParticipant(w, ctx, convId, userId) {
+		return
+	}
 
 	// Get messages using database interface
-	dbMessages, err := db.GetConversationMessages(convId)
+	dbMessages, err := db.GetConversationMessages(convId, user)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("failed to get the messages of the conversation")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
+	// The reactions and read state are loaded with the messages. A message of the user is read once another
+	// participant read it; the messages they received are shown as delivered.
 	var messages []map[string]interface{}
-	var messageIds []string
 	for _, msg := range dbMessages {
-		// Collect message IDs for marking as read
-		if msg.SenderId != userId {
-			messageIds = append(messageIds, msg.Id)
-		}
-
-		// Get reactions for this message
-		reactionRows, err := sqldb.Query(`
-	       	SELECT emoji, COUNT(*) as count, GROUP_CONCAT(u.username, ',') as usernames
-	       	FROM reactions r
-	       	JOIN users u ON r.sender_id = u.id
-	       	WHERE r.message_id = ?
-	       	GROUP BY emoji`, msg.Id)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		reactions := make(map[string]interface{})
-		for reactionRows.Next() {
-			var emoji string
-			var count int
-			var usernames string
-			if scanErr := reactionRows.Scan(&emoji, &count, &usernames); scanErr != nil {
-				reactionRows.Close()
-				http.Error(w, scanErr.Error(), http.StatusInternalServerError)
-				return
-			}
-			reactions[emoji] = map[string]interface{}{
-				"count": count,
-				"users": usernames,
-			}
-		}
-		if err = reactionRows.Err(); err != nil {
-			reactionRows.Close()
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		reactionRows.Close()
-
-		// Check read status for this message
-		var isMessageRead bool
-
-		if msg.SenderId == userId {
-			// For messages sent by current user: check if any other participant has read it
-			var readCount int
-			err = sqldb.QueryRow(`
-	       		SELECT COUNT(*) 
-	       		FROM read_status 
-	       		WHERE message_id = ? AND user_id != ?`,
-				msg.Id, userId).Scan(&readCount)
-			if err != nil {
-				readCount = 0
-			}
-			isMessageRead = readCount > 0
-		} else {
-			// For messages received by current user: always show as "delivered"
-			// (we could check if current user has read it, but for sender's view we care about recipients)
-			isMessageRead = false
-		}
-
-		messages = append(messages, map[string]interface{}{
+		message := map[string]interface{}{
 			"id":             msg.Id,
 			"senderId":       msg.SenderId,
 			"text":           msg.Text,
 			"imageUrl":       msg.ImageUrl,
 			"senderUsername": msg.SenderUsername,
 			"time":           msg.Time,
-			"comments":       reactions,
-			"isRead":         isMessageRead,
-		})
+			"reactions":      msg.Reactions,
+			"commentCount":   msg.CommentCount,
+			"isRead":         msg.IsRead,
+		}
+		if msg.ForwardedFrom != nil {
+			message["forwardedFrom"] = msg.ForwardedFrom
+		}
+		if len(msg.Mentions) > 0 {
+			message["mentions"] = msg.Mentions
+		}
+		if msg.Poll != nil {
+			message["poll"] = msg.Poll
+		}
+		if msg.DeletedAt != "" {
+			// Tombstone of a message deleted for everyone
+			message["deletedAt"] = msg.DeletedAt
+			delete(message, "reactions")
+		}
+		if msg.Starred {
+			message["starred"] = true
+		}
+		if msg.LinkPreview != nil {
+			message["linkPreview"] = msg.LinkPreview
+		}
+		if msg.Text != "" {
+			// Formatting parsed once here, so that every client shows the same
+			richText := richtext.Parse(msg.Text)
+			message["richText"] = richText
+			message["html"] = richtext.HTML(richText)
+		}
+		messages = append(messages, message)
 	}
 
 	// Mark all unread messages as read
-	for _, msgId := range messageIds {
-		err := db.MarkMessageAsRead(msgId, userId)
-		if err != nil {
-			ctx.Logger.WithError(err).Error("failed to mark message as read")
-		}
+	if _, err := db.MarkConversationRead(convId, user); err != nil {
+		ctx.Logger.WithError(err).Error("failed to mark messages as read")
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -111,3 +91,24 @@ func (rt *_router) getMessages(w http.ResponseWriter, r *http.Request, ps httpro
 		return
 	}
 }
+
+// markConversationRead marks the messages of a conversation as read by `user`, as getMessages does when the
+// conversation is opened. It is the mark_read command of the WebSocket.
+func (rt *_router) markConversationRead(logger logrus.FieldLogger, user database.User, conversationId string) (int, *commandError) {
+	isParticipant, err := rt.db.IsParticipant(conversationId, user.UId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, &commandError{Status: http.StatusNotFound, Message: "conversation not found"}
+	} else if err != nil {
+		logger.WithError(err).Error("failed to check conversation membership")
+		return 0, internalError("Internal server error")
+	} else if !isParticipant {
+		return 0, &commandError{Status: http.StatusForbidden, Message: "unauthorized"}
+	}
+
+	marked, err := rt.db.MarkConversationRead(conversationId, user)
+	if err != nil {
+		logger.WithError(err).Error("failed to mark messages as read")
+		return 0, internalError("Internal server error")
+	}
+	return marked, nil
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// mentionPattern matches "@username" when the @ is at the start of the text or after a character that can't be part
+// of a username (so e-mail addresses are not mentions)
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@(\w{3,16})\b`)
+
+// parseMentions returns the IDs of the participants mentioned in text. Usernames are matched case-insensitively; the
+// sender and names that are not participants of the conversation are ignored.
+func parseMentions(text string, participants []database.User, senderId string) []string {
+	byName := make(map[string]string, len(participants))
+	for _, participant := range participants {
+		byName[strings.ToLower(participant.Username)] = participant.UId
+	}
+
+	var mentioned []string
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		uid, ok := byName[strings.ToLower(match[1])]
+		if !ok || uid == senderId || seen[uid] {
+			continue
+		}
+		seen[uid] = true
+		mentioned = append(mentioned, uid)
+	}
+	return mentioned
+}
+
+// mentionPage is a page of mentions. NextCursor is the value to pass as `before` to get the next page; it is empty
+// when there are no more mentions.
+type mentionPage struct {
+	Mentions   []database.Mention `json:"mentions"`
+	NextCursor string             `json:"nextCursor,omitempty"`
+}
+
+// getMentions returns the recent messages mentioning the caller, most recent first
+func (rt *_router) getMentions(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	user, ok := rt.RequireAuth(w, r, ps.ByName("id"))
+	if !ok {
+		return
+	}
+
+	limit, ok := parseLimit(r)
+	if !ok {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	mentions, err := rt.db.GetMentions(user, r.URL.Query().Get("before"), limit)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "cursor not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("failed to list mentions")
+		http.Error(w, "failed to list mentions", http.StatusInternalServerError)
+		return
+	}
+
+	page := mentionPage{Mentions: mentions}
+	if len(mentions) == limit {
+		page.NextCursor = mentions[len(mentions)-1].Message.Id
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		ctx.Logger.WithError(err).Error("failed to encode mentions response")
+	}
+}
@@ -1,101 +1,229 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"time"
+	"unicode/utf8"
 
-	"github.com/gofrs/uuid"
 	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/richtext"
 )
 
+// messageInput is a message to send, from the body of a request or from a WebSocket command
+type messageInput struct {
+	Content         string     `json:"content"`
+	ImageUrl        string     `json:"imageUrl,omitempty"`
+	SendAt          *time.Time `json:"sendAt,omitempty"`
+	ClientMessageId string     `json:"clientMessageId,omitempty"`
+	Poll            *pollInput `json:"poll,omitempty"`
+}
+
+// postedMessage is the outcome of postMessage: the message sent, or the scheduled message if it has a send time.
+// Duplicate is set when the idempotency key was already used, and Message is the original message.
+type postedMessage struct {
+	Message   database.Message
+	Scheduled *database.ScheduledMessage
+	Duplicate bool
+}
+
 func (rt *_router) sendMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	// Get parameters from URL
 	userId := ps.ByName("id")
 	conversationId := ps.ByName("conversationId")
 
-	// Parse request body
-	var requestBody struct {
-		Content  string `json:"content"`
-		ImageUrl string `json:"imageUrl,omitempty"`
+	user, ok := rt.RequireAuth(w, r, userId)
+	if !ok {
+		return
 	}
 
+	// Parse request body
+	var requestBody messageInput
 	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
 		ctx.Logger.WithError(err).Error("failed to decode request body")
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	// Validate that at least content or imageUrl is provided
-	if requestBody.Content == "" && requestBody.ImageUrl == "" {
-		http.Error(w, "Message must have content or image", http.StatusBadRequest)
-		return
+	// The idempotency key can be sent in the body or as a header, but both must agree
+	if clientKey := r.Header.Get("Idempotency-Key"); clientKey != "" {
+		if requestBody.ClientMessageId != "" && clientKey != requestBody.ClientMessageId {
+			http.Error(w, "clientMessageId and Idempotency-Key differ", http.StatusBadRequest)
+			return
+		}
+		requestBody.ClientMessageId = clientKey
 	}
 
-	// Get database connection
-	db := rt.db.GetRawDB()
-
-	// Check if conversation exists and user is a participant
-	var participants string
-	err := db.QueryRow("SELECT participants FROM conversations WHERE id = ?", conversationId).Scan(&participants)
-	if err != nil {
-		ctx.Logger.WithError(err).Error("conversation not found")
-		http.Error(w, "Conversation not found", http.StatusNotFound)
+	posted, cerr := rt.postMessage(ctx.Logger, user, conversationId, requestBody)
+	if cerr != nil {
+		http.Error(w, cerr.Message, cerr.Status)
 		return
 	}
 
-	// Check if user is a participant (participants is stored as JSON array)
-	// For simplicity, we'll check if the user ID is in the participants string
-	// In a production system, you'd want to properly parse the JSON
-	if participants == "" {
-		http.Error(w, "Invalid conversation", http.StatusBadRequest)
+	// Messages with a send time are delivered later by the dispatcher
+	if posted.Scheduled != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		if err := json.NewEncoder(w).Encode(posted.Scheduled); err != nil {
+			ctx.Logger.WithError(err).Error("failed to encode scheduled message")
+		}
 		return
 	}
 
-	// Generate message ID
-	messageId, err := uuid.NewV4()
-	if err != nil {
-		ctx.Logger.WithError(err).Error("failed to generate message ID")
+	// A retry of a message that was already sent gets the original ID
+	status := http.StatusCreated
+	if posted.Duplicate {
+		status = http.StatusOK
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+
+	// Return success response with message ID
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(posted.Message.Id); err != nil {
+		ctx.Logger.WithError(err).Error("failed to encode message response")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+}
+
+// postMessage validates a message of `user` to the conversation `conversationId` and saves it, or schedules it if it
+// has a send time. The sendMessage handler and the send_message command of the WebSocket both go through it.
+func (rt *_router) postMessage(logger logrus.FieldLogger, user database.User, conversationId string, input messageInput) (postedMessage, *commandError) {
+	// Validate that at least content or imageUrl is provided; the question is the content of a poll
+	if input.Poll != nil {
+		if input.Content != "" || input.ImageUrl != "" {
+			return postedMessage{}, badRequest("A poll cannot have content or image")
+		}
+		if input.SendAt != nil {
+			return postedMessage{}, badRequest("Polls cannot be scheduled")
+		}
+		if msg := input.Poll.validate(); msg != "" {
+			return postedMessage{}, badRequest(msg)
+		}
+	} else if input.Content == "" && input.ImageUrl == "" {
+		return postedMessage{}, badRequest("Message must have content or image")
+	}
+	if utf8.RuneCountInString(input.Content) > richtext.MaxLength {
+		return postedMessage{}, badRequest("Message is too long")
+	}
+
+	clientKey := input.ClientMessageId
+	if clientKey != "" && !isValidClientKey(clientKey) {
+		return postedMessage{}, badRequest("Invalid idempotency key")
+	}
+	if clientKey != "" && input.SendAt != nil {
+		return postedMessage{}, badRequest("Idempotency keys are not supported for scheduled messages")
+	}
+
+	// Check if conversation exists and user is a participant
+	conversation, err := rt.db.GetConversation(conversationId)
+	if err != nil {
+		logger.WithError(err).Error("conversation not found")
+		return postedMessage{}, &commandError{Status: http.StatusNotFound, Message: "Conversation not found"}
+	}
+	isParticipant := false
+	for _, pid := range participantIDs(conversation) {
+		if pid == user.UId {
+			isParticipant = true
+			break
+		}
+	}
+	if !isParticipant {
+		return postedMessage{}, &commandError{Status: http.StatusForbidden, Message: "unauthorized"}
+	}
+
+	// Messages with a send time are queued and delivered later by the dispatcher
+	if input.SendAt != nil {
+		if msg := validateSendAt(*input.SendAt); msg != "" {
+			return postedMessage{}, badRequest(msg)
+		}
+		scheduled, err := rt.db.ScheduleMessage(conversationId, user, input.Content, input.ImageUrl, *input.SendAt)
+		if err != nil {
+			logger.WithError(err).Error("failed to schedule message")
+			return postedMessage{}, internalError("Failed to schedule message")
+		}
+		rt.dispatcher.notify()
+		rt.clearDraft(conversationId, user.UId)
+		return postedMessage{Scheduled: &scheduled}, nil
+	}
 
 	// Save message to database
-	_, err = db.Exec("INSERT INTO messages (id, conversation_id, sender_id, message, image_url) VALUES (?, ?, ?, ?, ?)",
-		messageId.String(), conversationId, userId, requestBody.Content, requestBody.ImageUrl)
+	var message database.Message
+	var duplicate bool
+	if input.Poll != nil {
+		message, duplicate, err = rt.db.CreatePollMessage(conversationId, user, input.Poll.poll(),
+			input.Poll.ClosesAt, clientKey, idempotencyWindow)
+	} else {
+		message, duplicate, err = rt.db.CreateMessage(conversationId, user, input.Content, input.ImageUrl,
+			clientKey, idempotencyWindow)
+	}
 	if err != nil {
-		ctx.Logger.WithError(err).Error("failed to save message to database")
+		logger.WithError(err).Error("failed to save message to database")
 		rt.sysLogger.LogError("Failed to save message to database: " + err.Error())
-		http.Error(w, "Failed to save message", http.StatusInternalServerError)
-		return
+		return postedMessage{}, internalError("Failed to save message")
 	}
 
-	// Log successful message send
-	rt.sysLogger.LogInfo("Message sent in conversation " + conversationId + " by user " + userId)
+	// A retry of a message that was already sent gets the original message, and nobody is notified again
+	if !duplicate {
+		rt.publishMessage(conversation, message, clientKey)
+		rt.clearDraft(conversationId, user.UId)
+	}
+	return postedMessage{Message: message, Duplicate: duplicate}, nil
+}
 
-	// Broadcast message to WebSocket clients
-	messageData := map[string]interface{}{
-		"id":              messageId.String(),
-		"conversation_id": conversationId,
-		"sender_id":       userId,
-		"content":         requestBody.Content,
-		"image_url":       requestBody.ImageUrl,
+// publishMessage records the mentions of a message that was just saved and publishes it on the event bus.
+// `clientMessageId` is the idempotency key the sender chose, if any; it lets the sender match the event with the
+// message it is displaying while waiting for the server.
+func (rt *_router) publishMessage(conversation database.Conversation, message database.Message, clientMessageId string) {
+	// Resolve @mentions against the participants
+	mentions := parseMentions(message.Text, conversation.Participants, message.SenderId)
+	if len(mentions) > 0 {
+		if err := rt.db.SetMessageMentions(message.Id, mentions); err != nil {
+			rt.baseLogger.WithError(err).Error("failed to save message mentions")
+			mentions = nil
+		}
 	}
-	BroadcastMessage("message", messageData)
-	rt.sysLogger.LogDebug("Message broadcasted to WebSocket clients")
 
-	// Return success response with message ID
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	if err := json.NewEncoder(w).Encode(messageId.String()); err != nil {
-		ctx.Logger.WithError(err).Error("failed to encode message response")
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+	message.Mentions = mentions
+	rt.events.publish(busEvent{
+		Event: MessageCreatedEvent{
+			ConversationId:  conversation.CId,
+			Message:         message,
+			ClientMessageId: clientMessageId,
+		},
+		Conversation: conversation.CId,
+		Recipients:   participantIDs(conversation),
+		ActorId:      message.SenderId,
+	})
+
+	// The reaper may be sleeping past the expiry time of this message
+	if conversation.MessageTTL > 0 {
+		rt.reaper.notify()
+	}
+
+	rt.previews.enqueue(conversation.CId, message)
+
+	// Mentioned users get a dedicated event, independent of how they follow the conversation
+	if len(mentions) > 0 {
+		rt.publishUserEvent(mentions, message.SenderId, MentionEvent{
+			ConversationId: conversation.CId,
+			MessageId:      message.Id,
+			SenderId:       message.SenderId,
+			Text:           message.Text,
+		})
 	}
 }
 
+// deleteMessage deletes a message for the caller only (`scope=me`, the default), or replaces it with a tombstone for
+// every participant (`scope=everyone`). Only the sender can delete a message for everyone, within rt.deleteWindow
+// from sending it.
 func (rt *_router) deleteMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	// Get parameters from URL
 	userId := ps.ByName("id")
@@ -107,33 +235,107 @@ func (rt *_router) deleteMessage(w http.ResponseWriter, r *http.Request, ps http
 		return
 	}
 
-	// Check if message exists and belongs to the user
-	var senderId string
-	err := rt.db.GetRawDB().QueryRow(
-		"SELECT sender_id FROM messages WHERE id = ? AND conversation_id = ?",
-		messageId, conversationId).Scan(&senderId)
-	if err != nil {
-		http.Error(w, "message not found", http.StatusNotFound)
+	user, ok := rt.RequireAuth(w, r, userId)
+	if !ok {
 		return
 	}
 
-	// Check if user is the sender of the message
-	if senderId != userId {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	scope := r.URL.Query().Get("scope")
+	if scope == "" {
+		scope = "me"
+	}
+	if scope != "me" && scope != "everyone" {
+		http.Error(w, "scope must be me or everyone", http.StatusBadRequest)
 		return
 	}
 
-	// Delete the message (reactions and comments will cascade delete due to foreign keys)
-	_, err = rt.db.GetRawDB().Exec("DELETE FROM messages WHERE id = ?", messageId)
-	if err != nil {
+	if scope == "me" {
+		hidden, err := rt.db.HideMessage(conversationId, user, messageId)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "message not found", http.StatusNotFound)
+			return
+		} else if errors.Is(err, database.ErrNotParticipant) {
+			http.Error(w, "unauthorized", http.StatusForbidden)
+			return
+		} else if err != nil {
+			ctx.Logger.WithError(err).Error("failed to hide message")
+			http.Error(w, "failed to delete message", http.StatusInternalServerError)
+			return
+		}
+
+		// The other sessions of the caller drop the message too
+		if hidden {
+			rt.publishUserEvent([]string{user.UId}, user.UId, MessageDeletedEvent{
+				ConversationId: conversationId,
+				MessageId:      messageId,
+			})
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	message, deleted, err := rt.db.DeleteMessageForEveryone(conversationId, user, messageId, rt.deleteWindow)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "message not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, database.ErrNotParticipant) {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return
+	} else if errors.Is(err, database.ErrForbidden) {
+		http.Error(w, "Only the sender can delete a message for everyone", http.StatusForbidden)
+		return
+	} else if errors.Is(err, database.ErrDeleteWindowExpired) {
+		http.Error(w, "The message is too old to be deleted for everyone", http.StatusConflict)
+		return
+	} else if err != nil {
 		ctx.Logger.WithError(err).Error("failed to delete message")
 		http.Error(w, "failed to delete message", http.StatusInternalServerError)
 		return
 	}
 
+	if deleted {
+		rt.publishConversationEvent(conversationId, user.UId, MessageDeletedEvent{
+			ConversationId: conversationId,
+			MessageId:      messageId,
+			ForEveryone:    true,
+			DeletedAt:      message.DeletedAt,
+		})
+		rt.purger.notify()
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// idempotencyWindow is how long a client idempotency key is remembered after the message was sent
+const idempotencyWindow = 24 * time.Hour
+
+// maxClientKeyLength is the maximum length of a client idempotency key
+const maxClientKeyLength = 128
+
+// isValidClientKey reports whether key can be used as an idempotency key: printable ASCII, up to maxClientKeyLength
+// characters. UUIDs are a good choice.
+func isValidClientKey(key string) bool {
+	if len(key) > maxClientKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x21 || key[i] > 0x7E {
+			return false
+		}
+	}
+	return true
+}
+
+// maxForwardTargets is the maximum number of conversations a message can be forwarded to in a single request
+const maxForwardTargets = 20
+
+// forwardResult is the outcome of forwarding a message to a single target conversation
+type forwardResult struct {
+	ConversationId string            `json:"conversationId"`
+	Message        *database.Message `json:"message,omitempty"`
+	Error          string            `json:"error,omitempty"`
+}
+
 func (rt *_router) forwardMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	// Get parameters from URL
 	userId := ps.ByName("id")
@@ -145,9 +347,14 @@ func (rt *_router) forwardMessage(w http.ResponseWriter, r *http.Request, ps htt
 		return
 	}
 
-	// Parse request body for target conversation
+	user, ok := rt.RequireAuth(w, r, userId)
+	if !ok {
+		return
+	}
+
+	// Parse request body for target conversations
 	var requestBody struct {
-		Content string `json:"content"` // This should be the target conversation ID
+		Targets []string `json:"targets"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
@@ -156,42 +363,92 @@ func (rt *_router) forwardMessage(w http.ResponseWriter, r *http.Request, ps htt
 		return
 	}
 
-	if requestBody.Content == "" {
-		http.Error(w, "target conversation ID is required", http.StatusBadRequest)
+	if len(requestBody.Targets) == 0 {
+		http.Error(w, "at least one target conversation is required", http.StatusBadRequest)
 		return
 	}
-
-	targetConversationId := requestBody.Content
-
-	// Create user object
-	user := database.User{
-		UId: userId,
+	if len(requestBody.Targets) > maxForwardTargets {
+		http.Error(w, "too many target conversations", http.StatusBadRequest)
+		return
 	}
 
-	// Use the database ForwardMessage function which handles both text and images
-	conversation, err := rt.db.ForwardMessage(targetConversationId, user, messageId)
-	if err != nil {
-		ctx.Logger.WithError(err).Error("failed to forward message")
-		http.Error(w, "Failed to forward message", http.StatusInternalServerError)
+	// Check that the caller can read the source message
+	isParticipant, err := rt.db.IsParticipant(conversationId, user.UId)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "conversation not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("failed to check conversation membership")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	} else if !isParticipant {
+		http.Error(w, "unauthorized", http.StatusForbidden)
 		return
 	}
+	if message, err := rt.db.GetVisibleMessage(conversationId, user, messageId); errors.Is(err, sql.ErrNoRows) || message.DeletedAt != "" {
+		http.Error(w, "message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("failed to get message")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	} else if message.Poll != nil {
+		// A forwarded message is a copy of the text, which would not be the poll
+		http.Error(w, "polls cannot be forwarded", http.StatusBadRequest)
+		return
+	}
+
+	// Forward to each target, collecting a result for each of them
+	results := make([]forwardResult, 0, len(requestBody.Targets))
+	for _, targetId := range requestBody.Targets {
+		result := forwardResult{ConversationId: targetId}
+
+		message, err := rt.db.ForwardMessage(conversationId, messageId, user, targetId)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			result.Error = "conversation not found"
+		case errors.Is(err, database.ErrNotParticipant):
+			result.Error = "not a participant of the conversation"
+		case err != nil:
+			ctx.Logger.WithError(err).Error("failed to forward message")
+			result.Error = "failed to forward message"
+		default:
+			result.Message = &message
+			rt.publishConversationEvent(targetId, user.UId, MessageCreatedEvent{
+				ConversationId: targetId,
+				Message:        message,
+			})
+			rt.previews.enqueue(targetId, message)
+		}
+		results = append(results, result)
+	}
+
+	// Some targets may have disappearing messages
+	rt.reaper.notify()
 
-	// Return the updated conversation
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(conversation); err != nil {
-		ctx.Logger.WithError(err).Error("failed to encode conversation response")
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		ctx.Logger.WithError(err).Error("failed to encode forward response")
 		return
 	}
 }
 
+// maxDistinctReactions is the maximum number of different emojis a single message can be reacted with
+const maxDistinctReactions = 20
+
+// reactToMessage toggles the caller's reaction with the given emoji: it is added if missing, and removed otherwise
 func (rt *_router) reactToMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	// Get parameters from URL
 	userId := ps.ByName("id")
 	conversationId := ps.ByName("conversationId")
 	messageId := ps.ByName("messageId")
 
+	user, ok := rt.RequireAuth(w, r, userId)
+	if !ok {
+		return
+	}
+
 	// Parse request body
 	var requestBody struct {
 		Emoji string `json:"emoji"`
@@ -203,29 +460,58 @@ func (rt *_router) reactToMessage(w http.ResponseWriter, r *http.Request, ps htt
 		return
 	}
 
-	// Validate emoji
-	if requestBody.Emoji == "" {
-		http.Error(w, "Emoji cannot be empty", http.StatusBadRequest)
+	reacted, cerr := rt.toggleReaction(ctx.Logger, user, conversationId, messageId, requestBody.Emoji)
+	if cerr != nil {
+		http.Error(w, cerr.Message, cerr.Status)
 		return
 	}
 
-	// Create user object
-	user := database.User{
-		UId: userId,
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(reactionResult{Emoji: requestBody.Emoji, Reacted: reacted}); err != nil {
+		ctx.Logger.WithError(err).Error("failed to encode reaction response")
 	}
+}
 
-	// Add reaction to database
-	_, err := rt.db.ReactToMessage(conversationId, user, messageId, requestBody.Emoji)
-	if err != nil {
-		ctx.Logger.WithError(err).Error("failed to add reaction")
-		http.Error(w, "Failed to add reaction", http.StatusInternalServerError)
-		return
+// reactionResult is the state of the reaction of the caller after toggling it
+type reactionResult struct {
+	Emoji   string `json:"emoji"`
+	Reacted bool   `json:"reacted"`
+}
+
+// toggleReaction adds the reaction of `user` with `emoji` to a message if missing, and removes it otherwise. It
+// reports whether the reaction is now present. The reactToMessage handler and the react command of the WebSocket both
+// go through it.
+func (rt *_router) toggleReaction(logger logrus.FieldLogger, user database.User, conversationId string, messageId string, emoji string) (bool, *commandError) {
+	// Validate emoji
+	if !isEmoji(emoji) {
+		return false, badRequest("Reaction must be a single emoji")
 	}
 
-	// Return success response (no content)
-	w.WriteHeader(http.StatusNoContent)
+	// Toggle the reaction
+	reacted, err := rt.db.ToggleReaction(conversationId, user, messageId, emoji, maxDistinctReactions)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, &commandError{Status: http.StatusNotFound, Message: "conversation or message not found"}
+	} else if errors.Is(err, database.ErrNotParticipant) {
+		return false, &commandError{Status: http.StatusForbidden, Message: "unauthorized"}
+	} else if errors.Is(err, database.ErrReactionLimit) {
+		return false, &commandError{Status: http.StatusConflict, Message: "Too many different reactions on this message"}
+	} else if err != nil {
+		logger.WithError(err).Error("failed to toggle reaction")
+		return false, internalError("Failed to toggle reaction")
+	}
+
+	rt.publishConversationEvent(conversationId, user.UId, ReactionEvent{
+		ConversationId: conversationId,
+		MessageId:      messageId,
+		UserId:         user.UId,
+		Emoji:          emoji,
+		Added:          reacted,
+	})
+	return reacted, nil
 }
 
+// removeReaction removes the caller's reaction with the given emoji. Removing a missing reaction succeeds.
 func (rt *_router) removeReaction(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	// Get parameters from URL
 	userId := ps.ByName("id")
@@ -233,27 +519,40 @@ func (rt *_router) removeReaction(w http.ResponseWriter, r *http.Request, ps htt
 	messageId := ps.ByName("messageId")
 	emoji := ps.ByName("emoji")
 
-	// Validate emoji
-	if emoji == "" {
-		http.Error(w, "Emoji cannot be empty", http.StatusBadRequest)
+	user, ok := rt.RequireAuth(w, r, userId)
+	if !ok {
 		return
 	}
 
-	// Create user object
-	user := database.User{
-		UId: userId,
+	// Validate emoji
+	if !isEmoji(emoji) {
+		http.Error(w, "Reaction must be a single emoji", http.StatusBadRequest)
+		return
 	}
 
 	// Remove reaction from database
-	_, err := rt.db.RemoveReaction(conversationId, user, messageId, emoji)
-	if err != nil {
+	removed, err := rt.db.RemoveReaction(conversationId, user, messageId, emoji)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "conversation or message not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, database.ErrNotParticipant) {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return
+	} else if err != nil {
 		ctx.Logger.WithError(err).Error("failed to remove reaction")
 		http.Error(w, "Failed to remove reaction", http.StatusInternalServerError)
 		return
 	}
 
+	if removed {
+		rt.publishConversationEvent(conversationId, user.UId, ReactionEvent{
+			ConversationId: conversationId,
+			MessageId:      messageId,
+			UserId:         user.UId,
+			Emoji:          emoji,
+		})
+	}
+
 	// Return success response
 	w.WriteHeader(http.StatusNoContent)
 }
-
-// Comments feature removed (emoji reactions only)
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// postTestJSON sends a JSON body with the session token of a user
+func postTestJSON(t *testing.T, server *httptest.Server, token string, path string, body string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, server.URL+path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	return resp
+}
+
+func TestForwardPoll(t *testing.T) {
+	rt := newTestRouter(t)
+	server := httptest.NewServer(rt.Handler())
+	defer server.Close()
+
+	alice, token := registerTestUser(t, server, "fwdalice")
+	bob, _ := registerTestUser(t, server, "fwdbob")
+	source := createTestConversation(t, server, alice, token, bob)
+	target := createTestConversation(t, server, alice, token, bob)
+	messages := "/users/" + alice + "/conversations/" + source + "/messages"
+
+	for _, tt := range []struct {
+		name    string
+		message string
+		status  int
+	}{
+		{"text", `{"content":"hello"}`, http.StatusOK},
+		{"poll", `{"poll":{"question":"lunch?","options":["yes","no"]}}`, http.StatusBadRequest},
+	} {
+		resp := postTestJSON(t, server, token, messages, tt.message)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("%s: can't send the message: %s", tt.name, resp.Status)
+		}
+		var mid string
+		if err := json.NewDecoder(resp.Body).Decode(&mid); err != nil {
+			t.Fatal(err)
+		}
+
+		resp = postTestJSON(t, server, token, messages+"/"+mid+"/forward", `{"targets":["`+target+`"]}`)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: forwarded with %s, want %d", tt.name, resp.Status, tt.status)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// eventMetrics counts the events published on the bus, by type and version
+type eventMetrics struct {
+	mutex  sync.Mutex
+	counts map[eventKind]uint64
+}
+
+type eventKind struct {
+	eventType string
+	version   int
+}
+
+func newEventMetrics() *eventMetrics {
+	return &eventMetrics{counts: make(map[eventKind]uint64)}
+}
+
+// count is the subscriber of the event bus
+func (m *eventMetrics) count(e busEvent) {
+	m.mutex.Lock()
+	m.counts[eventKind{e.Event.Type(), e.Event.Version()}]++
+	m.mutex.Unlock()
+}
+
+// MetricsHandler returns the metrics of the server in the Prometheus text format. It is not part of the API: it is
+// meant for an internal listener, as the counters reveal the activity on the server.
+func (rt *_router) MetricsHandler() http.Handler {
+	return http.HandlerFunc(rt.getMetrics)
+}
+
+func (rt *_router) getMetrics(w http.ResponseWriter, r *http.Request) {
+	rt.metrics.mutex.Lock()
+	counts := make(map[eventKind]uint64, len(rt.metrics.counts))
+	kinds := make([]eventKind, 0, len(rt.metrics.counts))
+	for kind, n := range rt.metrics.counts {
+		counts[kind] = n
+		kinds = append(kinds, kind)
+	}
+	rt.metrics.mutex.Unlock()
+
+	sort.Slice(kinds, func(i, j int) bool {
+		if kinds[i].eventType != kinds[j].eventType {
+			return kinds[i].eventType < kinds[j].eventType
+		}
+		return kinds[i].version < kinds[j].version
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = fmt.Fprintln(w, "# HELP wasatext_events_total Events published since the server started.")
+	_, _ = fmt.Fprintln(w, "# TYPE wasatext_events_total counter")
+	for _, kind := range kinds {
+		_, _ = fmt.Fprintf(w, "wasatext_events_total{type=%q,version=\"%d\"} %d\n", kind.eventType, kind.version, counts[kind])
+	}
+}
@@ -0,0 +1,354 @@
+package api
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/oidc"
+	"github.com/julienschmidt/httprouter"
+)
+
+// oidcFlowTTL is how long a user has to sign in at the provider after starting a login
+const oidcFlowTTL = 10 * time.Minute
+
+// oidcTicketTTL is how long the web UI has to redeem the ticket of a login, once back from the provider
+const oidcTicketTTL = 2 * time.Minute
+
+// maxPendingOIDCFlows bounds the logins waiting for the provider, since anyone can start one
+const maxPendingOIDCFlows = 10000
+
+// maxUsernameAttempts is how many usernames are tried when provisioning a user whose preferred one is taken
+const maxUsernameAttempts = 20
+
+// oidcLogins tracks the logins with the OpenID Connect provider.
+//
+// A login goes through three requests. POST /oidc/authorize starts it, and returns the URL of the provider and the
+// state of the login. The provider sends the browser to GET /oidc/callback, which verifies the user and redirects to
+// the web UI with a one-time ticket in the fragment. POST /oidc/session redeems the ticket, along with the state that
+// the web UI kept, for the identifier of the user. Asking for the state again binds the login to the browser that
+// started it, so that nobody can log a victim into their own account by sending them a callback link.
+type oidcLogins struct {
+	provider     *oidc.Provider
+	postLoginURL string
+
+	mu      sync.Mutex
+	flows   map[string]oidcFlow
+	tickets map[string]oidcTicket
+}
+
+// oidcFlow is a login waiting for the provider, by state
+type oidcFlow struct {
+	verifier string
+	nonce    string
+	// linkUser is the user that links the identity to their account, empty when logging in
+	linkUser string
+	expires  time.Time
+}
+
+// oidcTicket is a login verified by the provider, waiting for the web UI to redeem it
+type oidcTicket struct {
+	identity oidc.Identity
+	state    string
+	linkUser string
+	expires  time.Time
+}
+
+func newOIDCLogins(provider *oidc.Provider, postLoginURL string) *oidcLogins {
+	return &oidcLogins{
+		provider:     provider,
+		postLoginURL: postLoginURL,
+		flows:        make(map[string]oidcFlow),
+		tickets:      make(map[string]oidcTicket),
+	}
+}
+
+// errTooManyFlows is returned when too many logins are waiting for the provider
+var errTooManyFlows = errors.New("too many pending logins")
+
+// start records a new login and returns its state
+func (ol *oidcLogins) start(flow oidcFlow) (string, error) {
+	ol.mu.Lock()
+	defer ol.mu.Unlock()
+
+	now := time.Now()
+	for state, f := range ol.flows {
+		if now.After(f.expires) {
+			delete(ol.flows, state)
+		}
+	}
+	if len(ol.flows) >= maxPendingOIDCFlows {
+		return "", errTooManyFlows
+	}
+
+	state := oidc.RandomString()
+	flow.expires = now.Add(oidcFlowTTL)
+	ol.flows[state] = flow
+	return state, nil
+}
+
+// finish removes the login with the given state and returns it, if it has not expired
+func (ol *oidcLogins) finish(state string) (oidcFlow, bool) {
+	ol.mu.Lock()
+	defer ol.mu.Unlock()
+
+	flow, ok := ol.flows[state]
+	delete(ol.flows, state)
+	return flow, ok && time.Now().Before(flow.expires)
+}
+
+// issue returns a new ticket for a verified login
+func (ol *oidcLogins) issue(ticket oidcTicket) string {
+	ol.mu.Lock()
+	defer ol.mu.Unlock()
+
+	now := time.Now()
+	for id, t := range ol.tickets {
+		if now.After(t.expires) {
+			delete(ol.tickets, id)
+		}
+	}
+
+	id := oidc.RandomString()
+	ticket.expires = now.Add(oidcTicketTTL)
+	ol.tickets[id] = ticket
+	return id
+}
+
+// redeem removes the ticket and returns it, if it has not expired and belongs to the login with the given state.
+// A ticket can only be tried once.
+func (ol *oidcLogins) redeem(id string, state string) (oidcTicket, bool) {
+	ol.mu.Lock()
+	defer ol.mu.Unlock()
+
+	ticket, ok := ol.tickets[id]
+	delete(ol.tickets, id)
+	if !ok || time.Now().After(ticket.expires) {
+		return oidcTicket{}, false
+	}
+	return ticket, subtle.ConstantTimeCompare([]byte(ticket.state), []byte(state)) == 1
+}
+
+// startOIDCLogin starts a login with the OpenID Connect provider. With a bearer token, the identity is linked to the
+// account of the token instead.
+func (rt *_router) startOIDCLogin(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	var flow oidcFlow
+	if r.Header.Get("Authorization") != "" {
+		user, ok := rt.bearerUser(r)
+		if !ok {
+			rt.sendError(w, http.StatusUnauthorized, "Invalid token")
+			return
+		}
+		flow.linkUser = user.UId
+	}
+	flow.verifier = oidc.RandomString()
+	flow.nonce = oidc.RandomString()
+
+	state, err := rt.oidc.start(flow)
+	if errors.Is(err, errTooManyFlows) {
+		http.Error(w, "Too many pending logins, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	authURL, err := rt.oidc.provider.AuthCodeURL(r.Context(), state, flow.nonce, oidc.Challenge(flow.verifier))
+	if err != nil {
+		ctx.Logger.WithError(err).Error("failed to reach the identity provider")
+		http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]string{"authorizationUrl": authURL, "state": state}); err != nil {
+		ctx.Logger.WithError(err).Error("failed to encode authorize response")
+	}
+}
+
+// oidcCallback is where the provider sends the browser back. It verifies the user with the provider, and redirects
+// to the web UI with a ticket, or with the reason of the failure.
+func (rt *_router) oidcCallback(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	q := r.URL.Query()
+	state := q.Get("state")
+	flow, ok := rt.oidc.finish(state)
+	if !ok {
+		rt.redirectAfterOIDC(w, r, "oidc_error", "invalid_state")
+		return
+	}
+	if providerErr := q.Get("error"); providerErr != "" {
+		rt.redirectAfterOIDC(w, r, "oidc_error", providerErr)
+		return
+	}
+
+	identity, err := rt.oidc.provider.Exchange(r.Context(), q.Get("code"), flow.verifier, flow.nonce)
+	if err != nil {
+		ctx.Logger.WithError(err).Warn("OpenID Connect login failed")
+		rt.sysLogger.LogWarn("Failed login with the identity provider: " + err.Error())
+		rt.redirectAfterOIDC(w, r, "oidc_error", "login_failed")
+		return
+	}
+
+	ticket := rt.oidc.issue(oidcTicket{identity: identity, state: state, linkUser: flow.linkUser})
+	rt.redirectAfterOIDC(w, r, "oidc", ticket)
+}
+
+// redirectAfterOIDC sends the browser to the web UI, with `key=value` in the fragment so that it never reaches a
+// server or the Referer header
+func (rt *_router) redirectAfterOIDC(w http.ResponseWriter, r *http.Request, key string, value string) {
+	target := rt.oidc.postLoginURL
+	if i := strings.IndexByte(target, '#'); i >= 0 {
+		target = target[:i]
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, target+"#"+key+"="+url.QueryEscape(value), http.StatusFound)
+}
+
+// finishOIDCLogin redeems the ticket of a login for the identifier of the user, provisioning a new user for an
+// identity seen for the first time. For a link, the identity is linked to the user of the bearer token, who must
+// be the one that started it.
+func (rt *_router) finishOIDCLogin(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	var req struct {
+		Ticket string `json:"ticket"`
+		State  string `json:"state"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid input", http.StatusBadRequest)
+		return
+	}
+	ticket, ok := rt.oidc.redeem(req.Ticket, req.State)
+	if !ok {
+		http.Error(w, "invalid or expired ticket", http.StatusUnauthorized)
+		return
+	}
+	identity := database.Identity{
+		Issuer:  ticket.identity.Issuer,
+		Subject: ticket.identity.Subject,
+		Email:   ticket.identity.Email,
+	}
+
+	var user database.User
+	var err error
+	if ticket.linkUser != "" {
+		var ok bool
+		user, ok = rt.bearerUser(r)
+		if !ok || user.UId != ticket.linkUser {
+			rt.sendError(w, http.StatusUnauthorized, "Invalid token")
+			return
+		}
+		err = rt.db.LinkIdentity(user.UId, identity)
+		if errors.Is(err, database.ErrIdentityLinked) {
+			http.Error(w, "the identity is linked to another user", http.StatusConflict)
+			return
+		}
+		if err == nil {
+			rt.sysLogger.LogInfo("User " + user.Username + " linked an identity of " + identity.Issuer)
+		}
+	} else {
+		user, err = rt.userForIdentity(identity, ticket.identity)
+	}
+	if err != nil {
+		ctx.Logger.WithError(err).Error("failed to log in with the identity provider")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	err = rt.db.DoLogin(database.LoginEvent{
+		UserId:     user.UId,
+		Username:   user.Username,
+		Success:    true,
+		RemoteAddr: remoteAddress(r),
+		UserAgent:  r.UserAgent(),
+	})
+	if err != nil {
+		ctx.Logger.WithError(err).Error("failed to record login")
+	}
+	rt.sysLogger.LogInfo("User " + user.Username + " logged in with the identity provider")
+
+	token, err := rt.newSession(r, user)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("failed to start session")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Unlike after a password login, the web UI does not know the username yet
+	writeLoginResponse(w, ctx, map[string]string{"identifier": user.UId, "name": user.Username, "token": token})
+}
+
+// userForIdentity returns the user linked to the identity, provisioning one the first time the identity logs in
+func (rt *_router) userForIdentity(identity database.Identity, claims oidc.Identity) (database.User, error) {
+	user, err := rt.db.GetUserByIdentity(identity.Issuer, identity.Subject)
+	if err == nil || !errors.Is(err, sql.ErrNoRows) {
+		return user, err
+	}
+
+	base := usernameFromClaims(claims)
+	for attempt := 0; attempt < maxUsernameAttempts; attempt++ {
+		name := base
+		if attempt > 0 {
+			suffix := strconv.Itoa(attempt + 1)
+			if attempt >= 10 {
+				suffix = strconv.Itoa(1000 + rand.Intn(9000))
+			}
+			if len(name)+len(suffix) > 16 {
+				name = name[:16-len(suffix)]
+			}
+			name += suffix
+		}
+
+		user, err = rt.db.CreateUserWithIdentity(name, identity)
+		switch {
+		case errors.Is(err, database.ErrUsernameTaken):
+			continue
+		case errors.Is(err, database.ErrIdentityLinked):
+			// Another login of the same identity provisioned it first
+			return rt.db.GetUserByIdentity(identity.Issuer, identity.Subject)
+		case err == nil:
+			rt.sysLogger.LogInfo("Provisioned user " + user.Username + " for an identity of " + identity.Issuer)
+		}
+		return user, err
+	}
+	return database.User{}, errors.New("no free username for " + base)
+}
+
+// usernameFromClaims returns a valid username resembling the preferred username, email or name of the user
+func usernameFromClaims(claims oidc.Identity) string {
+	candidates := []string{claims.PreferredUsername, claims.Email, claims.Name}
+	if i := strings.IndexByte(claims.Email, '@'); i >= 0 {
+		candidates[1] = claims.Email[:i]
+	}
+	for _, candidate := range candidates {
+		var b strings.Builder
+		for i := 0; i < len(candidate) && b.Len() < 16; i++ {
+			c := candidate[i]
+			switch {
+			case c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_':
+				b.WriteByte(c)
+			case c == '.' || c == '-' || c == ' ':
+				b.WriteByte('_')
+			}
+		}
+		if name := strings.Trim(b.String(), "_"); len(name) >= 3 {
+			return name
+		}
+	}
+	return "user"
+}
+
+// bearerUser returns the user of the bearer token of the request, if it is the token of an active session
+func (rt *_router) bearerUser(r *http.Request) (database.User, bool) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return database.User{}, false
+	}
+	user, _, err := rt.authenticate(r, token)
+	return user, err == nil
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/oidc"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/oidc/oidctest"
+)
+
+// oidcTestServer serves a router whose identity provider is `issuer`
+func oidcTestServer(t *testing.T, issuer *oidctest.Issuer) *httptest.Server {
+	t.Helper()
+	// The provider needs the URL of the callback, known once the server is started
+	var handler http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	provider, err := oidc.NewProvider(oidc.Config{
+		Issuer:      issuer.URL,
+		ClientID:    "wasatext",
+		RedirectURL: server.URL + "/oidc/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := newTestRouterWithConfig(t, Config{OIDC: provider, OIDCPostLoginURL: "/app"})
+	handler = rt.Handler()
+	return server
+}
+
+// oidcSignIn starts a login, signs in at the issuer as `subject`, and returns the fragment the callback redirected to
+// along with the state of the login
+func oidcSignIn(t *testing.T, server *httptest.Server, issuer *oidctest.Issuer, subject string) (url.Values, string) {
+	t.Helper()
+	resp, err := http.Post(server.URL+"/oidc/authorize", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var started struct {
+		AuthorizationURL string `json:"authorizationUrl"`
+		State            string `json:"state"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&started); err != nil {
+		t.Fatal(err)
+	}
+
+	callback, err := issuer.SignIn(started.AuthorizationURL, subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err = client.Get(callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound || location.Path != "/app" {
+		t.Fatalf("the callback answered %s, redirecting to %q", resp.Status, resp.Header.Get("Location"))
+	}
+	fragment, err := url.ParseQuery(location.Fragment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fragment, started.State
+}
+
+// redeemOIDCTicket posts the ticket of a login to /oidc/session
+func redeemOIDCTicket(t *testing.T, server *httptest.Server, ticket string, state string) *http.Response {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"ticket": ticket, "state": state})
+	resp, err := http.Post(server.URL+"/oidc/session", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestOIDCLoginIssuesSession(t *testing.T) {
+	issuer := oidctest.NewIssuer("wasatext")
+	defer issuer.Close()
+	server := oidcTestServer(t, issuer)
+
+	fragment, state := oidcSignIn(t, server, issuer, "dora")
+	ticket := fragment.Get("oidc")
+	if ticket == "" {
+		t.Fatalf("the login failed: %v", fragment)
+	}
+
+	// The ticket is bound to the state of the browser that started the login, and can only be tried once
+	for _, tryState := range []string{"another state", state} {
+		resp := redeemOIDCTicket(t, server, ticket, tryState)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("a ticket redeemed with state %q got %s", tryState, resp.Status)
+		}
+	}
+
+	fragment, state = oidcSignIn(t, server, issuer, "dora")
+	resp := redeemOIDCTicket(t, server, fragment.Get("oidc"), state)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("redeeming the ticket got %s", resp.Status)
+	}
+	var login struct {
+		Identifier string `json:"identifier"`
+		Name       string `json:"name"`
+		Token      string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&login); err != nil {
+		t.Fatal(err)
+	}
+	if login.Name != "dora" || login.Token == "" {
+		t.Fatalf("got %+v, want a session of dora", login)
+	}
+
+	// The token is a session: it lists itself among the sessions of the user
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/users/"+login.Identifier+"/sessions", nil)
+	req.Header.Set("Authorization", "Bearer "+login.Token)
+	sessions, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions.Body.Close()
+	if sessions.StatusCode != http.StatusOK {
+		t.Errorf("the session of the login got %s", sessions.Status)
+	}
+
+	// The same identity logs in to the same user
+	fragment, state = oidcSignIn(t, server, issuer, "dora")
+	resp2 := redeemOIDCTicket(t, server, fragment.Get("oidc"), state)
+	defer resp2.Body.Close()
+	var again struct {
+		Identifier string `json:"identifier"`
+	}
+	if err := json.NewDecoder(resp2.Body).Decode(&again); err != nil {
+		t.Fatal(err)
+	}
+	if again.Identifier != login.Identifier {
+		t.Errorf("the identity logged in to %s, then to %s", login.Identifier, again.Identifier)
+	}
+}
+
+func TestOIDCLoginRejectsInvalidTokens(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(issuer *oidctest.Issuer)
+	}{
+		{"bad signature", func(issuer *oidctest.Issuer) { issuer.ForgeSignatures() }},
+		{"wrong audience", func(issuer *oidctest.Issuer) { issuer.SetClaim("aud", "another-client") }},
+		{"wrong nonce", func(issuer *oidctest.Issuer) { issuer.SetClaim("nonce", "another nonce") }},
+		{"expired", func(issuer *oidctest.Issuer) { issuer.SetClaim("exp", 1) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer := oidctest.NewIssuer("wasatext")
+			defer issuer.Close()
+			server := oidcTestServer(t, issuer)
+
+			tt.setup(issuer)
+			fragment, _ := oidcSignIn(t, server, issuer, "mallory")
+			if fragment.Get("oidc") != "" || fragment.Get("oidc_error") != "login_failed" {
+				t.Errorf("got %v, want a failed login", fragment)
+			}
+		})
+	}
+}
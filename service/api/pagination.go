@@ -0,0 +1,29 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+)
+
+const (
+	// defaultPageLimit is the page size used when the client does not send a `limit` query parameter
+	defaultPageLimit = 50
+
+	// maxPageLimit is the largest page size a client can ask for
+	maxPageLimit = 100
+)
+
+// parseLimit reads the `limit` query parameter. It returns false if the value is present but not a number between 1
+// and maxPageLimit.
+func parseLimit(r *http.Request) (int, bool) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return defaultPageLimit, true
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > maxPageLimit {
+		return 0, false
+	}
+	return limit, true
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/password"
+	"github.com/julienschmidt/httprouter"
+)
+
+// passwordResetValidity is how long a password reset token can be used after it was issued
+const passwordResetValidity = 24 * time.Hour
+
+// IssuePasswordReset creates a password reset token for the user with the given username, and returns it. Operators
+// give it to the users who cannot log in, like the accounts created before passwords existed.
+func IssuePasswordReset(db database.AppDatabase, username string) (string, error) {
+	user, err := db.GetUserByName(username)
+	if err != nil {
+		return "", err
+	}
+	if user.IsBot {
+		return "", errors.New("bots cannot have a password")
+	}
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	return token, db.CreatePasswordReset(user.UId, hashToken(token), time.Now().Add(passwordResetValidity))
+}
+
+// validateNewPassword returns an error message if `plain` cannot be used as a password, or the empty string
+func validateNewPassword(plain string) string {
+	if len(plain) < minPasswordLength {
+		return "password must be at least 8 characters"
+	}
+	if len(plain) > password.MaxLength {
+		return "password is too long"
+	}
+	return ""
+}
+
+// setMyPassword sets the password of the user. A user who already has one must give it too.
+func (rt *_router) setMyPassword(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	user, ok := rt.RequireAuth(w, r, ps.ByName("id"))
+	if !ok {
+		return
+	}
+
+	var req struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid input", http.StatusBadRequest)
+		return
+	}
+	if msg := validateNewPassword(req.NewPassword); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	hash, err := rt.db.GetPasswordHash(user.UId)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		ctx.Logger.WithError(err).Error("failed to get password hash")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err == nil {
+		ok, err := password.Verify(hash, req.CurrentPassword)
+		if err != nil {
+			ctx.Logger.WithError(err).Error("failed to verify password")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "wrong current password", http.StatusForbidden)
+			return
+		}
+	}
+
+	if err := rt.setPassword(user.UId, req.NewPassword); err != nil {
+		ctx.Logger.WithError(err).Error("failed to set password")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	rt.sysLogger.LogInfo("User " + user.Username + " set their password")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resetPassword sets the password of a user with a reset token issued by the operator. The other sessions of the
+// user are logged out, and a new one is started.
+func (rt *_router) resetPassword(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	var req struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"newPassword"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid input", http.StatusBadRequest)
+		return
+	}
+	if msg := validateNewPassword(req.NewPassword); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	uid, err := rt.db.UsePasswordReset(hashToken(req.Token))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "invalid or expired reset token", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("failed to use password reset")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	user, err := rt.db.GetUserByID(uid)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("failed to get user")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := rt.setPassword(user.UId, req.NewPassword); err != nil {
+		ctx.Logger.WithError(err).Error("failed to set password")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := rt.db.DeleteSessions(user.UId); err != nil {
+		ctx.Logger.WithError(err).Error("failed to revoke sessions")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	rt.publishUserEvent([]string{user.UId}, user.UId, SessionRevokedEvent{UserId: user.UId})
+	rt.sysLogger.LogInfo("User " + user.Username + " reset their password")
+
+	token, err := rt.newSession(r, user)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("failed to start session")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeLoginResponse(w, ctx, map[string]string{"identifier": user.UId, "token": token})
+}
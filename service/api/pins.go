@@ -0,0 +1,96 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// listPins returns the pinned messages of a conversation, most recently pinned first
+func (rt *_router) listPins(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	userId := ps.ByName("id")
+	conversationId := ps.ByName("conversationId")
+
+	user, ok := rt.RequireAuth(w, r, userId)
+	if !ok {
+		return
+	}
+
+	pins, err := rt.db.ListPins(conversationId, user)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "conversation not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, database.ErrNotParticipant) {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("failed to list pins")
+		http.Error(w, "Failed to list pins", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(pins); err != nil {
+		ctx.Logger.WithError(err).Error("failed to encode pins")
+	}
+}
+
+// pinMessage pins a message in its conversation. Pinning an already pinned message succeeds without changes.
+func (rt *_router) pinMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	rt.setPinned(w, r, ps, ctx, true)
+}
+
+// unpinMessage unpins a message. Unpinning a message that is not pinned succeeds without changes.
+func (rt *_router) unpinMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	rt.setPinned(w, r, ps, ctx, false)
+}
+
+func (rt *_router) setPinned(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext, pinned bool) {
+	userId := ps.ByName("id")
+	conversationId := ps.ByName("conversationId")
+	messageId := ps.ByName("messageId")
+
+	user, ok := rt.RequireAuth(w, r, userId)
+	if !ok {
+		return
+	}
+
+	var changed bool
+	var err error
+	if pinned {
+		changed, err = rt.db.PinMessage(conversationId, user, messageId)
+	} else {
+		changed, err = rt.db.UnpinMessage(conversationId, user, messageId)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "conversation or message not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, database.ErrNotParticipant) {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return
+	} else if errors.Is(err, database.ErrForbidden) {
+		http.Error(w, "only the group owner can pin messages", http.StatusForbidden)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("failed to update pin")
+		http.Error(w, "Failed to update pin", http.StatusInternalServerError)
+		return
+	}
+
+	if changed {
+		rt.publishConversationEvent(conversationId, user.UId, PinEvent{
+			ConversationId: conversationId,
+			MessageId:      messageId,
+			UserId:         user.UId,
+			Pinned:         pinned,
+		})
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	maxPollQuestionLength = 300
+	minPollOptions        = 2
+	maxPollOptions        = 12
+	maxPollOptionLength   = 100
+)
+
+// pollInput is the poll in the body of a new message
+type pollInput struct {
+	Question       string     `json:"question"`
+	Options        []string   `json:"options"`
+	MultipleChoice bool       `json:"multipleChoice"`
+	Anonymous      bool       `json:"anonymous"`
+	ClosesAt       *time.Time `json:"closesAt,omitempty"`
+}
+
+// validate checks the poll of a new message. It returns the error message for the client, or an empty string if the
+// poll is valid. Question and options are trimmed in place.
+func (p *pollInput) validate() string {
+	p.Question = strings.TrimSpace(p.Question)
+	if p.Question == "" || utf8.RuneCountInString(p.Question) > maxPollQuestionLength {
+		return "The question must be between 1 and 300 characters"
+	}
+	if len(p.Options) < minPollOptions || len(p.Options) > maxPollOptions {
+		return "A poll must have between 2 and 12 options"
+	}
+	seen := make(map[string]bool)
+	for i, option := range p.Options {
+		option = strings.TrimSpace(option)
+		if option == "" || utf8.RuneCountInString(option) > maxPollOptionLength {
+			return "Options must be between 1 and 100 characters"
+		}
+		if seen[strings.ToLower(option)] {
+			return "Options must be different"
+		}
+		seen[strings.ToLower(option)] = true
+		p.Options[i] = option
+	}
+	if p.ClosesAt != nil {
+		now := time.Now()
+		if !p.ClosesAt.After(now) {
+			return "closesAt must be in the future"
+		}
+		if p.ClosesAt.After(now.Add(maxScheduleAhead)) {
+			return "closesAt must be within one year"
+		}
+	}
+	return ""
+}
+
+func (p *pollInput) poll() database.Poll {
+	poll := database.Poll{
+		Question:       p.Question,
+		MultipleChoice: p.MultipleChoice,
+		Anonymous:      p.Anonymous,
+	}
+	for _, option := range p.Options {
+		poll.Options = append(poll.Options, database.PollOption{Text: option})
+	}
+	return poll
+}
+
+// votePoll replaces the caller's votes on a poll. The body is the list of the chosen option indexes.
+func (rt *_router) votePoll(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	user, ok := rt.RequireAuth(w, r, ps.ByName("id"))
+	if !ok {
+		return
+	}
+
+	var requestBody struct {
+		Options []int `json:"options"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	poll, err := rt.db.VotePoll(ps.ByName("conversationId"), user, ps.ByName("messageId"), requestBody.Options)
+	rt.respondPoll(w, ps, ctx, poll, err)
+}
+
+// retractVote removes the caller's votes on a poll
+func (rt *_router) retractVote(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	user, ok := rt.RequireAuth(w, r, ps.ByName("id"))
+	if !ok {
+		return
+	}
+
+	poll, err := rt.db.RetractVote(ps.ByName("conversationId"), user, ps.ByName("messageId"))
+	rt.respondPoll(w, ps, ctx, poll, err)
+}
+
+// closePoll stops the voting on a poll before its closing time. Only the creator of the poll can close it.
+func (rt *_router) closePoll(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	user, ok := rt.RequireAuth(w, r, ps.ByName("id"))
+	if !ok {
+		return
+	}
+
+	poll, err := rt.db.ClosePoll(ps.ByName("conversationId"), user, ps.ByName("messageId"))
+	rt.respondPoll(w, ps, ctx, poll, err)
+}
+
+// respondPoll writes the result of a change to a poll, and sends the new tallies to the participants
+func (rt *_router) respondPoll(w http.ResponseWriter, ps httprouter.Params, ctx reqcontext.RequestContext, poll *database.Poll, err error) {
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "conversation or poll not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, database.ErrNotParticipant) {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return
+	} else if errors.Is(err, database.ErrForbidden) {
+		http.Error(w, "only the creator can close the poll", http.StatusForbidden)
+		return
+	} else if errors.Is(err, database.ErrPollClosed) {
+		http.Error(w, "the poll is closed", http.StatusConflict)
+		return
+	} else if errors.Is(err, database.ErrInvalidVote) {
+		http.Error(w, "invalid options for the poll", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("failed to update poll")
+		http.Error(w, "Failed to update poll", http.StatusInternalServerError)
+		return
+	}
+
+	// The votes of the caller are not shared with the others
+	shared := *poll
+	shared.MyVotes = nil
+	conversationId := ps.ByName("conversationId")
+	rt.publishConversationEvent(conversationId, ps.ByName("id"), PollUpdatedEvent{
+		ConversationId: conversationId,
+		MessageId:      ps.ByName("messageId"),
+		Poll:           shared,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(poll); err != nil {
+		ctx.Logger.WithError(err).Error("failed to encode poll")
+	}
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/linkpreview"
+)
+
+const (
+	// linkPreviewWorkers is how many previews are fetched at the same time
+	linkPreviewWorkers = 4
+
+	// linkPreviewQueueSize is how many messages can wait for a preview; links in messages sent while the queue is
+	// full get no preview
+	linkPreviewQueueSize = 256
+
+	linkPreviewCacheSize = 1000
+	linkPreviewCacheTTL  = time.Hour
+)
+
+// newDefaultLinkPreviewFetcher returns the fetcher used when the configuration has none: it only reaches public
+// addresses, and remembers the pages it downloaded
+func newDefaultLinkPreviewFetcher() linkpreview.Fetcher {
+	return linkpreview.NewCache(linkpreview.NewHTTPFetcher(linkpreview.Config{}), linkPreviewCacheSize, linkPreviewCacheTTL)
+}
+
+// linkPreviewer fetches the preview of the first link of new messages in the background, saves it with the message and
+// tells the participants with a `message_updated` event
+type linkPreviewer struct {
+	rt      *_router
+	fetcher linkpreview.Fetcher
+
+	jobs chan linkPreviewJob
+
+	// ctx is cancelled on close, to cut the downloads short
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type linkPreviewJob struct {
+	conversationId string
+	messageId      string
+	url            string
+}
+
+func newLinkPreviewer(rt *_router, fetcher linkpreview.Fetcher) *linkPreviewer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &linkPreviewer{
+		rt:      rt,
+		fetcher: fetcher,
+		jobs:    make(chan linkPreviewJob, linkPreviewQueueSize),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+func (lp *linkPreviewer) run() {
+	for i := 0; i < linkPreviewWorkers; i++ {
+		lp.wg.Add(1)
+		go func() {
+			defer lp.wg.Done()
+			for {
+				select {
+				case <-lp.ctx.Done():
+					return
+				case job := <-lp.jobs:
+					lp.preview(job)
+				}
+			}
+		}()
+	}
+}
+
+// enqueue schedules the preview of the first link in `message`, if any. It never blocks.
+func (lp *linkPreviewer) enqueue(conversationId string, message database.Message) {
+	url := linkpreview.FirstURL(message.Text)
+	if url == "" {
+		return
+	}
+
+	select {
+	case lp.jobs <- linkPreviewJob{conversationId: conversationId, messageId: message.Id, url: url}:
+	default:
+		lp.rt.baseLogger.WithField("messageId", message.Id).Warn("link preview queue is full, skipping preview")
+	}
+}
+
+// close stops the workers and waits for them to return. Queued previews are dropped.
+func (lp *linkPreviewer) close() {
+	lp.cancel()
+	lp.wg.Wait()
+}
+
+func (lp *linkPreviewer) preview(job linkPreviewJob) {
+	logger := lp.rt.baseLogger.WithField("messageId", job.messageId)
+
+	preview, err := lp.fetcher.Fetch(lp.ctx, job.url)
+	if errors.Is(err, linkpreview.ErrNoPreview) || errors.Is(err, linkpreview.ErrForbiddenAddress) {
+		return
+	} else if err != nil {
+		if lp.ctx.Err() == nil {
+			logger.WithError(err).Debug("failed to fetch link preview")
+		}
+		return
+	}
+
+	saved := database.LinkPreview{
+		URL:         preview.URL,
+		Title:       preview.Title,
+		Description: preview.Description,
+		ImageURL:    preview.ImageURL,
+		SiteName:    preview.SiteName,
+	}
+	err = lp.rt.db.SetLinkPreview(job.messageId, saved)
+	if errors.Is(err, sql.ErrNoRows) {
+		// The message was deleted while the page was downloading
+		return
+	} else if err != nil {
+		logger.WithError(err).Error("failed to save link preview")
+		return
+	}
+
+	lp.rt.publishConversationEvent(job.conversationId, "", MessageUpdatedEvent{
+		ConversationId: job.conversationId,
+		MessageId:      job.messageId,
+		LinkPreview:    &saved,
+	})
+}
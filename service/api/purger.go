@@ -0,0 +1,38 @@
+package api
+
+import (
+	"time"
+)
+
+// purgeBatchSize is how many deleted messages are purged in a single transaction, so that a burst of deletes doesn't
+// hold the database for long
+const purgeBatchSize = 100
+
+// messagePurger removes the content of the messages deleted for everyone. Their tombstones already hide it, so a late
+// run only delays freeing the space.
+type messagePurger struct {
+	*backgroundLoop
+	rt *_router
+}
+
+func newMessagePurger(rt *_router) *messagePurger {
+	return &messagePurger{
+		backgroundLoop: newBackgroundLoop(),
+		rt:             rt,
+	}
+}
+
+func (mp *messagePurger) run() {
+	mp.start(func() time.Duration {
+		purged, err := mp.rt.db.PurgeDeletedMessages(purgeBatchSize)
+		if err != nil {
+			mp.rt.baseLogger.WithError(err).Error("failed to purge deleted messages")
+			return backgroundRetryDelay
+		}
+		if purged == purgeBatchSize && !mp.stopping() {
+			// There may be more
+			return 0
+		}
+		return backgroundMaxSleep
+	})
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"time"
+)
+
+// messageReaper deletes disappearing messages once they expire, and tells the participants of their conversations
+// with a `messages_expired` event. Expired messages are already hidden by the database queries, so a late run only
+// delays the cleanup.
+type messageReaper struct {
+	*backgroundLoop
+	rt *_router
+}
+
+func newMessageReaper(rt *_router) *messageReaper {
+	return &messageReaper{
+		backgroundLoop: newBackgroundLoop(),
+		rt:             rt,
+	}
+}
+
+func (mr *messageReaper) run() {
+	mr.start(func() time.Duration {
+		if !mr.deleteExpired() {
+			return backgroundRetryDelay
+		}
+		return mr.nextWait()
+	})
+}
+
+// nextWait returns how long to sleep before the next message expires
+func (mr *messageReaper) nextWait() time.Duration {
+	next, ok, err := mr.rt.db.NextMessageExpiry()
+	if err != nil {
+		mr.rt.baseLogger.WithError(err).Error("failed to read the next message expiry")
+		return backgroundMaxSleep
+	}
+	if !ok {
+		return backgroundMaxSleep
+	}
+	return waitUntil(next)
+}
+
+// deleteExpired deletes the messages that expired so far. It returns false if they could not be deleted.
+func (mr *messageReaper) deleteExpired() bool {
+	expired, err := mr.rt.db.DeleteExpiredMessages(time.Now())
+	if err != nil {
+		mr.rt.baseLogger.WithError(err).Error("failed to delete expired messages")
+		return false
+	}
+
+	for conversationId, messageIds := range expired {
+		mr.rt.publishConversationEvent(conversationId, "", MessagesExpiredEvent{
+			ConversationId: conversationId,
+			MessageIds:     messageIds,
+		})
+	}
+	return true
+}
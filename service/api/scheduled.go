@@ -0,0 +1,119 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/richtext"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxScheduleAhead is how far in the future a message can be scheduled
+const maxScheduleAhead = 365 * 24 * time.Hour
+
+// validateSendAt checks the send time of a scheduled message. It returns the error message for the client, or an
+// empty string if the time is valid.
+func validateSendAt(sendAt time.Time) string {
+	now := time.Now()
+	if !sendAt.After(now) {
+		return "sendAt must be in the future"
+	}
+	if sendAt.After(now.Add(maxScheduleAhead)) {
+		return "sendAt must be within one year"
+	}
+	return ""
+}
+
+// listScheduledMessages returns the caller's messages that are waiting to be sent, the next to be sent first
+func (rt *_router) listScheduledMessages(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	user, ok := rt.RequireAuth(w, r, ps.ByName("id"))
+	if !ok {
+		return
+	}
+
+	scheduled, err := rt.db.ListScheduledMessages(user)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("failed to list scheduled messages")
+		http.Error(w, "Failed to list scheduled messages", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(scheduled); err != nil {
+		ctx.Logger.WithError(err).Error("failed to encode scheduled messages")
+	}
+}
+
+// updateScheduledMessage replaces the content and send time of a message that was not sent yet
+func (rt *_router) updateScheduledMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	user, ok := rt.RequireAuth(w, r, ps.ByName("id"))
+	if !ok {
+		return
+	}
+
+	var requestBody struct {
+		Content  string    `json:"content"`
+		ImageUrl string    `json:"imageUrl,omitempty"`
+		SendAt   time.Time `json:"sendAt"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if requestBody.Content == "" && requestBody.ImageUrl == "" {
+		http.Error(w, "Message must have content or image", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(requestBody.Content) > richtext.MaxLength {
+		http.Error(w, "Message is too long", http.StatusBadRequest)
+		return
+	}
+	if msg := validateSendAt(requestBody.SendAt); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	scheduled, err := rt.db.UpdateScheduledMessage(user, ps.ByName("scheduledId"), requestBody.Content,
+		requestBody.ImageUrl, requestBody.SendAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "scheduled message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("failed to update scheduled message")
+		http.Error(w, "Failed to update scheduled message", http.StatusInternalServerError)
+		return
+	}
+	rt.dispatcher.notify()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(scheduled); err != nil {
+		ctx.Logger.WithError(err).Error("failed to encode scheduled message")
+	}
+}
+
+// cancelScheduledMessage removes a message from the queue before it is sent
+func (rt *_router) cancelScheduledMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	user, ok := rt.RequireAuth(w, r, ps.ByName("id"))
+	if !ok {
+		return
+	}
+
+	err := rt.db.CancelScheduledMessage(user, ps.ByName("scheduledId"))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "scheduled message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("failed to cancel scheduled message")
+		http.Error(w, "Failed to cancel scheduled message", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
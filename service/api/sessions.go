@@ -0,0 +1,185 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// sessionActivityInterval is how often the last activity of a session is updated while it is in use
+const sessionActivityInterval = time.Minute
+
+// errInvalidSession is returned when a bearer token is not the token of an active session
+var errInvalidSession = errors.New("invalid or revoked session")
+
+// sessionView is a session as listed to its user
+type sessionView struct {
+	database.Session
+
+	// Current is true for the session of the request
+	Current bool `json:"current"`
+}
+
+// hashToken returns the hash of a session token, as stored in the database. Tokens are random, so a plain hash is
+// enough for a leaked database not to leak working tokens.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomToken returns a new random token, for sessions and password resets
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// newSession starts a session of `user` on the device of the request, and returns its token
+func (rt *_router) newSession(r *http.Request, user database.User) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = rt.db.CreateSession(user.UId, hashToken(token), r.UserAgent(), remoteAddress(r))
+	return token, err
+}
+
+// authenticate returns the user and the session of a session token, and records the activity of the session
+func (rt *_router) authenticate(r *http.Request, token string) (database.User, database.Session, error) {
+	if token == "" {
+		return database.User{}, database.Session{}, errInvalidSession
+	}
+	session, user, err := rt.db.GetSessionByToken(hashToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.User{}, database.Session{}, errInvalidSession
+	} else if err != nil {
+		return database.User{}, database.Session{}, err
+	}
+
+	if err := rt.db.TouchSession(session.Id, remoteAddress(r), time.Now().Add(-sessionActivityInterval)); err != nil {
+		rt.baseLogger.WithError(err).Warn("can't update the activity of a session")
+	}
+	return user, session, nil
+}
+
+// bearerToken returns the token of the Authorization header, and false if the header is not a bearer token
+func bearerToken(r *http.Request) (string, bool) {
+	authHeader := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer ")), true
+}
+
+// writeLoginResponse sends the identifier of the user and the token of their new session
+func writeLoginResponse(w http.ResponseWriter, ctx reqcontext.RequestContext, resp map[string]string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		ctx.Logger.WithError(err).Error("failed to encode login response")
+	}
+}
+
+// listSessions lists the sessions of the user, the most recently used first
+func (rt *_router) listSessions(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	user, ok := rt.RequireAuth(w, r, ps.ByName("id"))
+	if !ok {
+		return
+	}
+	current, _ := GetAuthenticatedSession(r)
+
+	sessions, err := rt.db.ListSessions(user.UId)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("failed to list sessions")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	views := make([]sessionView, 0, len(sessions))
+	for _, s := range sessions {
+		views = append(views, sessionView{Session: s, Current: s.Id == current.Id})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(views); err != nil {
+		ctx.Logger.WithError(err).Error("failed to encode sessions")
+	}
+}
+
+// revokeSession logs out one session of the user, on whatever device it is, and closes its WebSocket connections
+func (rt *_router) revokeSession(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	user, ok := rt.RequireAuth(w, r, ps.ByName("id"))
+	if !ok {
+		return
+	}
+	sid := ps.ByName("sessionId")
+
+	found, err := rt.db.DeleteSession(user.UId, sid)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("failed to revoke session")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	rt.publishUserEvent([]string{user.UId}, user.UId, SessionRevokedEvent{UserId: user.UId, SessionId: sid})
+	rt.sysLogger.LogInfo("User " + user.Username + " revoked a session")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeAllSessions logs out the user everywhere, including the session of the request
+func (rt *_router) revokeAllSessions(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	user, ok := rt.RequireAuth(w, r, ps.ByName("id"))
+	if !ok {
+		return
+	}
+
+	n, err := rt.db.DeleteSessions(user.UId)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("failed to revoke sessions")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	rt.publishUserEvent([]string{user.UId}, user.UId, SessionRevokedEvent{UserId: user.UId})
+	rt.sysLogger.LogInfo("User " + user.Username + " logged out everywhere (" + strconv.Itoa(n) + " sessions)")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// doLogout ends the session of the request
+func (rt *_router) doLogout(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	user, ok := rt.RequireAuth(w, r, "")
+	if !ok {
+		return
+	}
+	session, _ := GetAuthenticatedSession(r)
+
+	if _, err := rt.db.DeleteSession(user.UId, session.Id); err != nil {
+		ctx.Logger.WithError(err).Error("failed to end session")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	rt.publishUserEvent([]string{user.UId}, user.UId, SessionRevokedEvent{UserId: user.UId, SessionId: session.Id})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]string{"message": "Logged out"}); err != nil {
+		ctx.Logger.WithError(err).Error("failed to encode logout response")
+	}
+}
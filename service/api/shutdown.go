@@ -2,5 +2,14 @@ package api
 
 // Close should close everything opened in the lifecycle of the `_router`; for example, background goroutines.
 func (rt *_router) Close() error {
+	rt.dispatcher.close()
+	rt.reaper.close()
+	rt.purger.close()
+	rt.previews.close()
+	// The events published so far are queued as webhook deliveries before the deliverer stops
+	rt.events.close()
+	// The WebSocket and event stream clients are told the server is going away
+	rt.hub.close()
+	rt.webhooks.close()
 	return nil
 }
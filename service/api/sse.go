@@ -0,0 +1,193 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// sseHeartbeatInterval is how often a comment is sent on an idle stream, so that proxies do not close it
+	sseHeartbeatInterval = 25 * time.Second
+
+	// sseWriteTimeout bounds the write of a single message; a client that does not read is disconnected
+	sseWriteTimeout = 10 * time.Second
+
+	// sseRetry is how long browsers wait before reconnecting, in milliseconds
+	sseRetry = 3000
+)
+
+// sseStream writes Server-Sent Events on a hijacked connection. The connection is taken over from the HTTP server so
+// that its WriteTimeout, meant for ordinary requests, does not cut the stream; each write gets its own deadline.
+type sseStream struct {
+	conn net.Conn
+	w    *bufio.Writer
+}
+
+// write sends a frame and flushes it
+func (s *sseStream) write(frame []byte) error {
+	if err := s.conn.SetWriteDeadline(time.Now().Add(sseWriteTimeout)); err != nil {
+		return err
+	}
+	if _, err := s.w.Write(frame); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+// send sends a message of the hub as an event. The data is the same JSON as on the WebSocket; the ID is the sequence
+// number of the user after the message, which browsers send back in Last-Event-ID when they reconnect.
+func (s *sseStream) send(m WSMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	var frame bytes.Buffer
+	id := m.Seq
+	switch payload := m.Payload.(type) {
+	case eventLogReady:
+		id = payload.Seq
+	case eventLogResync:
+		id = payload.Seq
+	}
+	if id != 0 || m.Type == "ready" || m.Type == "resync_required" {
+		frame.WriteString("id: " + strconv.FormatInt(id, 10) + "\n")
+	}
+	frame.WriteString("data: ")
+	frame.Write(data)
+	frame.WriteString("\n\n")
+	return s.write(frame.Bytes())
+}
+
+// streamEvents sends the events of the user as Server-Sent Events, for the clients that cannot use the WebSocket. The
+// stream carries the same messages as the WebSocket, and resumes from the Last-Event-ID header like the WebSocket does
+// from lastSeq.
+func (rt *_router) streamEvents(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	// EventSource cannot set headers either, so the session token may come in the query
+	token, ok := bearerToken(r)
+	if !ok {
+		token = r.URL.Query().Get("token")
+	}
+	user, session, err := rt.authenticate(r, token)
+	if errors.Is(err, errInvalidSession) {
+		http.Error(w, "Invalid or revoked session", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("can't check the session")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if user.UId != ps.ByName("id") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	resumeAfter := int64(-1)
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.URL.Query().Get("lastEventId")
+	}
+	if lastEventId != "" {
+		resumeAfter, err = strconv.ParseInt(lastEventId, 10, 64)
+		if err != nil || resumeAfter < 0 {
+			http.Error(w, "invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The stream counts towards the connection limit of the user like a WebSocket
+	client := &Client{
+		UserID:    user.UId,
+		SessionID: session.Id,
+		Send:      make(chan WSMessage, clientSendBuffer),
+		Hub:       rt.hub,
+
+		resumeAfter: resumeAfter,
+	}
+	if !rt.hub.add(client) {
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return
+	}
+	defer rt.hub.remove(client)
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		ctx.Logger.Error("the response writer cannot be hijacked for an event stream")
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		ctx.Logger.WithError(err).Error("can't hijack the connection for an event stream")
+		return
+	}
+	defer conn.Close()
+	// Drop the deadlines of the HTTP server
+	_ = conn.SetDeadline(time.Time{})
+
+	// The headers already set, like the CORS ones, are kept. The body lasts until the connection is closed.
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "close")
+	w.Header().Set("X-Accel-Buffering", "no")
+	stream := &sseStream{conn: conn, w: rw.Writer}
+	var head bytes.Buffer
+	head.WriteString("HTTP/1.1 200 OK\r\n")
+	if err := w.Header().Write(&head); err != nil {
+		return
+	}
+	head.WriteString("\r\nretry: " + strconv.Itoa(sseRetry) + "\n\n")
+	if err := stream.write(head.Bytes()); err != nil {
+		return
+	}
+
+	// The client only sends a request; reading fails once it goes away
+	gone := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, rw.Reader)
+		close(gone)
+	}()
+
+	// The hub may queue events that were already replayed, or that are older than the stream
+	lastSeq, err := client.resume(stream.send)
+	if err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case message, ok := <-client.Send:
+			if !ok {
+				// Closed by the hub: the session was revoked, the client fell behind, or the server is stopping
+				return
+			}
+			if message.Seq != 0 {
+				if message.Seq <= lastSeq {
+					continue
+				}
+				lastSeq = message.Seq
+			}
+			if err := stream.send(message); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if err := stream.write([]byte(": heartbeat\n\n")); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestEvents opens the event stream of the user, and reads its `ready` message
+func openTestEvents(t *testing.T, server *httptest.Server, uid string, token string) *bufio.Reader {
+	t.Helper()
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(server.URL + "/users/" + uid + "/events?token=" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("can't open the event stream: %s", resp.Status)
+	}
+	events := bufio.NewReader(resp.Body)
+	if m := readTestEvent(t, events); m.Type != "ready" {
+		t.Fatalf("the first event is %q, want ready", m.Type)
+	}
+	return events
+}
+
+// readTestEvent reads the data of the next event of the stream, with the payload left as JSON
+func readTestEvent(t *testing.T, events *bufio.Reader) WSMessage {
+	t.Helper()
+	for {
+		line, err := events.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var m WSMessage
+		var payload json.RawMessage
+		m.Payload = &payload
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &m); err != nil {
+			t.Fatal(err)
+		}
+		m.Payload = payload
+		return m
+	}
+}
+
+func TestEventStreamTypingOfOtherConversations(t *testing.T) {
+	rt := newTestRouter(t)
+	server := httptest.NewServer(rt.Handler())
+	defer server.Close()
+
+	alice, aliceToken := registerTestUser(t, server, "ssealice")
+	bob, bobToken := registerTestUser(t, server, "ssebob")
+	carol, carolToken := registerTestUser(t, server, "ssecarol")
+	cid := createTestConversation(t, server, alice, aliceToken, bob)
+	other := createTestConversation(t, server, alice, aliceToken, carol)
+
+	bobEvents := openTestEvents(t, server, bob, bobToken)
+	carolEvents := openTestEvents(t, server, carol, carolToken)
+	conn := dialTestWs(t, server, aliceToken)
+
+	if err := conn.WriteJSON(wsCommand{Type: "typing_start", Payload: json.RawMessage(`{"conversationId":"` + cid + `"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if m := readTestEvent(t, bobEvents); m.Type != "user_typing" {
+		t.Fatalf("a participant got %s %s, want user_typing", m.Type, m.Payload)
+	}
+
+	// The indicator was sent to all its recipients, so the next event of the user outside the conversation is the
+	// message sent afterwards
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/users/"+alice+"/conversations/"+other+"/messages",
+		strings.NewReader(`{"content":"hello"}`))
+	req.Header.Set("Authorization", "Bearer "+aliceToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("can't send a message: %s", resp.Status)
+	}
+	if m := readTestEvent(t, carolEvents); m.Type != "message" {
+		t.Errorf("a user outside the conversation got %s %s, want the message", m.Type, m.Payload)
+	}
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// starredPage is a page of starred messages. NextCursor is the value to pass as `before` to get the next page; it is
+// empty when there are no more messages.
+type starredPage struct {
+	Starred    []database.StarredMessage `json:"starred"`
+	NextCursor string                    `json:"nextCursor,omitempty"`
+}
+
+// getStarred returns the messages starred by the caller across all conversations, most recently starred first
+func (rt *_router) getStarred(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	user, ok := rt.RequireAuth(w, r, ps.ByName("id"))
+	if !ok {
+		return
+	}
+
+	limit, ok := parseLimit(r)
+	if !ok {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	starred, err := rt.db.GetStarredMessages(user, r.URL.Query().Get("before"), limit)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "cursor not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("failed to list starred messages")
+		http.Error(w, "failed to list starred messages", http.StatusInternalServerError)
+		return
+	}
+
+	page := starredPage{Starred: starred}
+	if len(starred) == limit {
+		page.NextCursor = starred[len(starred)-1].Message.Id
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		ctx.Logger.WithError(err).Error("failed to encode starred messages response")
+	}
+}
+
+// starMessage bookmarks a message for the caller. Starring a starred message succeeds without changes.
+func (rt *_router) starMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	rt.setStarred(w, r, ps, ctx, true)
+}
+
+// unstarMessage removes the caller's bookmark on a message. Unstarring a message that is not starred succeeds without
+// changes.
+func (rt *_router) unstarMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	rt.setStarred(w, r, ps, ctx, false)
+}
+
+func (rt *_router) setStarred(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext, starred bool) {
+	conversationId := ps.ByName("conversationId")
+	messageId := ps.ByName("messageId")
+
+	user, ok := rt.RequireAuth(w, r, ps.ByName("id"))
+	if !ok {
+		return
+	}
+
+	var changed bool
+	var err error
+	if starred {
+		changed, err = rt.db.StarMessage(conversationId, user, messageId)
+	} else {
+		changed, err = rt.db.UnstarMessage(conversationId, user, messageId)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "conversation or message not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, database.ErrNotParticipant) {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("failed to update star")
+		http.Error(w, "Failed to update star", http.StatusInternalServerError)
+		return
+	}
+
+	// Stars are private: only the other sessions of the caller are told
+	if changed {
+		rt.publishUserEvent([]string{user.UId}, user.UId, StarEvent{
+			ConversationId: conversationId,
+			MessageId:      messageId,
+			Starred:        starred,
+		})
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,303 @@
+package api
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// apiTokenPrefix starts every API token, to tell them from session tokens and to make leaked ones easy to find
+const apiTokenPrefix = "wat_"
+
+// Scopes of API tokens. Each allows the routes registered with it in Handler.
+const (
+	scopeConversationsRead = "conversations:read"
+	scopeMessagesRead      = "messages:read"
+	scopeMessagesWrite     = "messages:write"
+	scopeReactionsWrite    = "reactions:write"
+)
+
+var knownScopes = map[string]bool{
+	scopeConversationsRead: true,
+	scopeMessagesRead:      true,
+	scopeMessagesWrite:     true,
+	scopeReactionsWrite:    true,
+}
+
+// maxTokenConversations bounds how many conversations a token can be restricted to
+const maxTokenConversations = 100
+
+// apiTokenRequest is the body of the request creating an API token
+type apiTokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	Conversations []string `json:"conversations"`
+	// BotId is the bot the token acts as; the token acts as its creator when empty
+	BotId string `json:"botId"`
+}
+
+// isAPIToken reports whether a bearer token is an API token rather than a session token
+func isAPIToken(token string) bool {
+	return strings.HasPrefix(token, apiTokenPrefix)
+}
+
+// authenticateAPIToken returns the user that an API token acts as, and the token, and records its use
+func (rt *_router) authenticateAPIToken(token string) (database.User, database.APIToken, error) {
+	apiToken, user, err := rt.db.GetAPITokenByHash(hashToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.User{}, database.APIToken{}, errInvalidSession
+	} else if err != nil {
+		return database.User{}, database.APIToken{}, err
+	}
+
+	if err := rt.db.TouchAPIToken(apiToken.Id, time.Now().Add(-sessionActivityInterval)); err != nil {
+		rt.baseLogger.WithError(err).Warn("can't update the last use of an API token")
+	}
+	return user, apiToken, nil
+}
+
+// tokenHasScope reports whether the API token was granted `scope`
+func tokenHasScope(t database.APIToken, scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenAllowsConversation reports whether the API token can be used on the conversation `cid`. A token restricted to
+// some conversations cannot be used on routes outside of a conversation, where `cid` is empty.
+func tokenAllowsConversation(t database.APIToken, cid string) bool {
+	if len(t.Conversations) == 0 {
+		return true
+	}
+	for _, c := range t.Conversations {
+		if c == cid {
+			return true
+		}
+	}
+	return false
+}
+
+// createBot creates a bot account owned by the user. Bots cannot log in; they act through the API tokens that their
+// owner creates for them.
+func (rt *_router) createBot(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	user, ok := rt.RequireAuth(w, r, ps.ByName("id"))
+	if !ok {
+		return
+	}
+	if user.IsBot {
+		http.Error(w, "bots cannot own bots", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid input", http.StatusBadRequest)
+		return
+	}
+	if len(req.Name) < 3 || len(req.Name) > 16 {
+		http.Error(w, "username must be 3-16 characters", http.StatusBadRequest)
+		return
+	}
+	if !isValidUsername(req.Name) {
+		http.Error(w, "username can only contain letters, numbers and underscores", http.StatusBadRequest)
+		return
+	}
+
+	bot, err := rt.db.CreateBot(user.UId, req.Name)
+	if errors.Is(err, database.ErrUsernameTaken) {
+		http.Error(w, "username already taken", http.StatusConflict)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("failed to create bot")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	rt.sysLogger.LogInfo("User " + user.Username + " created bot " + bot.Username)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(bot); err != nil {
+		ctx.Logger.WithError(err).Error("failed to encode bot")
+	}
+}
+
+// listBots lists the bots owned by the user
+func (rt *_router) listBots(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	user, ok := rt.RequireAuth(w, r, ps.ByName("id"))
+	if !ok {
+		return
+	}
+
+	bots, err := rt.db.ListBots(user.UId)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("failed to list bots")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(bots); err != nil {
+		ctx.Logger.WithError(err).Error("failed to encode bots")
+	}
+}
+
+// createAPIToken creates an API token acting as the user, or as one of their bots. The token itself is only
+// returned here; the server keeps a hash.
+func (rt *_router) createAPIToken(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	user, ok := rt.RequireAuth(w, r, ps.ByName("id"))
+	if !ok {
+		return
+	}
+
+	var req apiTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid input", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 64 {
+		http.Error(w, "name must be 1-64 characters", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, "at least one scope is required", http.StatusBadRequest)
+		return
+	}
+	seen := make(map[string]bool)
+	scopes := make([]string, 0, len(req.Scopes))
+	for _, scope := range req.Scopes {
+		if !knownScopes[scope] {
+			http.Error(w, "unknown scope: "+scope, http.StatusBadRequest)
+			return
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(req.Conversations) > maxTokenConversations {
+		http.Error(w, "too many conversations", http.StatusBadRequest)
+		return
+	}
+	seen = make(map[string]bool)
+	conversations := make([]string, 0, len(req.Conversations))
+	for _, cid := range req.Conversations {
+		if cid == "" {
+			http.Error(w, "invalid conversation", http.StatusBadRequest)
+			return
+		}
+		if !seen[cid] {
+			seen[cid] = true
+			conversations = append(conversations, cid)
+		}
+	}
+
+	actsAs := user.UId
+	if req.BotId != "" {
+		bots, err := rt.db.ListBots(user.UId)
+		if err != nil {
+			ctx.Logger.WithError(err).Error("failed to list bots")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		owned := false
+		for _, bot := range bots {
+			owned = owned || bot.UId == req.BotId
+		}
+		if !owned {
+			http.Error(w, "bot not found", http.StatusNotFound)
+			return
+		}
+		actsAs = req.BotId
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		ctx.Logger.WithError(err).Error("failed to generate API token")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	secret := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	token, err := rt.db.CreateAPIToken(database.APIToken{
+		UserId:        actsAs,
+		CreatedBy:     user.UId,
+		Name:          req.Name,
+		Scopes:        scopes,
+		Conversations: conversations,
+	}, hashToken(secret))
+	if err != nil {
+		ctx.Logger.WithError(err).Error("failed to create API token")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	rt.sysLogger.LogInfo("User " + user.Username + " created API token " + token.Name)
+
+	resp := struct {
+		database.APIToken
+		Token string `json:"token"`
+	}{token, secret}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		ctx.Logger.WithError(err).Error("failed to encode API token")
+	}
+}
+
+// listAPITokens lists the API tokens created by the user, for themselves and for their bots, without the tokens
+// themselves
+func (rt *_router) listAPITokens(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	user, ok := rt.RequireAuth(w, r, ps.ByName("id"))
+	if !ok {
+		return
+	}
+
+	tokens, err := rt.db.ListAPITokens(user.UId)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("failed to list API tokens")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tokens); err != nil {
+		ctx.Logger.WithError(err).Error("failed to encode API tokens")
+	}
+}
+
+// deleteAPIToken revokes an API token created by the user. It stops working immediately.
+func (rt *_router) deleteAPIToken(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	user, ok := rt.RequireAuth(w, r, ps.ByName("id"))
+	if !ok {
+		return
+	}
+
+	found, err := rt.db.DeleteAPIToken(user.UId, ps.ByName("tokenId"))
+	if err != nil {
+		ctx.Logger.WithError(err).Error("failed to delete API token")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "token not found", http.StatusNotFound)
+		return
+	}
+	rt.sysLogger.LogInfo("User " + user.Username + " deleted an API token")
+
+	w.WriteHeader(http.StatusNoContent)
+}
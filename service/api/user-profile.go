@@ -3,6 +3,7 @@ package api
 import (
 	"encoding/json"
 	"net/http"
+	"strings"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
@@ -28,10 +29,14 @@ func (rt *_router) setMyUserName(w http.ResponseWriter, r *http.Request, ps http
 		http.Error(w, "username must be 3-16 characters", http.StatusBadRequest)
 		return
 	}
+	if !isValidUsername(name) {
+		http.Error(w, "username can only contain letters, numbers and underscores", http.StatusBadRequest)
+		return
+	}
 
-	// Check if username already exists (except for current user)
+	// Check if username already exists (except for current user), whatever the case
 	var existingUserId string
-	err := rt.db.GetRawDB().QueryRow("SELECT id FROM users WHERE username = ? AND id != ?", name, userId).Scan(&existingUserId)
+	err := rt.db.GetRawDB().QueryRow("SELECT id FROM users WHERE username = ? COLLATE NOCASE AND id != ?", name, userId).Scan(&existingUserId)
 	if err == nil {
 		http.Error(w, "username already in use", http.StatusBadRequest)
 		return
@@ -39,8 +44,12 @@ func (rt *_router) setMyUserName(w http.ResponseWriter, r *http.Request, ps http
 
 	// Update username
 	_, err = rt.db.GetRawDB().Exec("UPDATE users SET username = ? WHERE id = ?", name, userId)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		http.Error(w, "username already in use", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("failed to update username")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
@@ -48,11 +57,13 @@ func (rt *_router) setMyUserName(w http.ResponseWriter, r *http.Request, ps http
 	var picture string
 	err = rt.db.GetRawDB().QueryRow("SELECT COALESCE(picture, '') FROM users WHERE id = ?", userId).Scan(&picture)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("failed to get user picture")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
 	user := database.User{UId: userId, Username: name, Picture: picture}
+	rt.publishUserEvent(rt.profileAudience(userId), userId, UserUpdatedEvent{Id: userId, Username: name, Picture: picture})
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(user); err != nil {
@@ -93,6 +104,7 @@ func (rt *_router) setMyPhoto(w http.ResponseWriter, r *http.Request, ps httprou
 	}
 
 	user := database.User{UId: userId, Username: username, Picture: photo}
+	rt.publishUserEvent(rt.profileAudience(userId), userId, UserUpdatedEvent{Id: userId, Username: username, Picture: photo})
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(user); err != nil {
@@ -101,3 +113,24 @@ func (rt *_router) setMyPhoto(w http.ResponseWriter, r *http.Request, ps httprou
 		return
 	}
 }
+
+// profileAudience returns the users who see the profile of the user `userId`: the user, and the participants of their
+// conversations
+func (rt *_router) profileAudience(userId string) []string {
+	ids := []string{userId}
+	seen := map[string]bool{userId: true}
+	conversations, err := rt.db.GetMyConversations(database.User{UId: userId})
+	if err != nil {
+		rt.baseLogger.WithError(err).Warn("can't load the conversations of the user for a profile event")
+		return ids
+	}
+	for _, conversation := range conversations {
+		for _, participant := range conversation.Participants {
+			if !seen[participant.UId] {
+				seen[participant.UId] = true
+				ids = append(ids, participant.UId)
+			}
+		}
+	}
+	return ids
+}
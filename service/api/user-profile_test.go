@@ -0,0 +1,36 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSetMyUserNameCharset(t *testing.T) {
+	rt := newTestRouter(t)
+	server := httptest.NewServer(rt.Handler())
+	defer server.Close()
+
+	uid, token := registerTestUser(t, server, "renamed")
+	for _, tt := range []struct {
+		name   string
+		status int
+	}{
+		{"new name", http.StatusBadRequest},
+		{"Renamé", http.StatusBadRequest},
+		{"new_name2", http.StatusOK},
+	} {
+		req, _ := http.NewRequest(http.MethodPut, server.URL+"/users/"+uid, strings.NewReader(`"`+tt.name+`"`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("renamed to %q: got %s, want %d", tt.name, resp.Status, tt.status)
+		}
+	}
+}
@@ -0,0 +1,465 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/webhook"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// webhookWorkers is how many deliveries are posted at the same time
+	webhookWorkers = 4
+
+	// webhookBatchSize is the maximum number of due deliveries loaded from the database at once
+	webhookBatchSize = 100
+
+	// webhookMaxAttempts is how many times a delivery is attempted before giving up on it
+	webhookMaxAttempts = 8
+
+	// webhookRetryBase is the wait before the first retry; it doubles after each failed attempt, up to webhookRetryMax
+	webhookRetryBase = 30 * time.Second
+	webhookRetryMax  = time.Hour
+
+	// webhookDisableAfter is how many failed attempts in a row disable a webhook
+	webhookDisableAfter = 20
+
+	// maxWebhooksPerConversation bounds the webhooks of a conversation
+	maxWebhooksPerConversation = 10
+
+	// webhookLogLimit is how many deliveries are listed in the log of a webhook
+	webhookLogLimit = 50
+)
+
+// webhookEvents maps the types of the events of conversations to the webhook events they are delivered as. The other
+// events are not sent to webhooks.
+var webhookEvents = map[string]string{
+	"message":         "message.created",
+	"message_updated": "message.updated",
+	"poll_updated":    "message.updated",
+	"message_deleted": "message.deleted",
+	"member_joined":   "member.joined",
+	"member_left":     "member.left",
+}
+
+// allWebhookEvents are the events a webhook subscribes to when it names none
+var allWebhookEvents = []string{"message.created", "message.updated", "message.deleted", "member.joined", "member.left"}
+
+// webhookBody is the JSON posted to a webhook
+type webhookBody struct {
+	Id             string          `json:"id"`
+	Event          string          `json:"event"`
+	ConversationId string          `json:"conversationId"`
+	CreatedAt      string          `json:"createdAt"`
+	Data           json.RawMessage `json:"data"`
+}
+
+// webhookDeliverer posts the events of conversations to their webhooks. The queue lives in the database, so the
+// deliveries pending before a restart are sent once the deliverer runs again. Failed deliveries are retried with
+// exponential backoff, and a webhook that keeps failing is disabled.
+type webhookDeliverer struct {
+	*backgroundLoop
+	rt     *_router
+	sender webhook.Sender
+
+	// ctx is cancelled on close, to cut the deliveries in progress short
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newWebhookDeliverer(rt *_router, sender webhook.Sender) *webhookDeliverer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &webhookDeliverer{
+		backgroundLoop: newBackgroundLoop(),
+		rt:             rt,
+		sender:         sender,
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+}
+
+func (d *webhookDeliverer) run() {
+	d.start(func() time.Duration {
+		ok := d.deliverDue()
+		wait := d.nextWait()
+		if !ok && wait < backgroundRetryDelay {
+			wait = backgroundRetryDelay
+		}
+		return wait
+	})
+}
+
+// close stops the deliverer and waits for it. The deliveries in progress are attempted again after a restart.
+func (d *webhookDeliverer) close() {
+	d.cancel()
+	d.backgroundLoop.close()
+}
+
+// handleEvent is the subscriber of the event bus: it queues the delivery of the events of conversations to the
+// webhooks that subscribed to them
+func (d *webhookDeliverer) handleEvent(e busEvent) {
+	event, ok := webhookEvents[e.Event.Type()]
+	if !ok || e.Conversation == "" {
+		return
+	}
+	data, err := json.Marshal(e.Event)
+	if err != nil {
+		d.rt.baseLogger.WithError(err).Error("failed to encode webhook event")
+		return
+	}
+
+	queued, err := d.rt.db.EnqueueWebhookEvent(e.Conversation, event, string(data))
+	if err != nil {
+		d.rt.baseLogger.WithError(err).WithField("conversationId", e.Conversation).Error("failed to queue webhook deliveries")
+	}
+	if queued > 0 {
+		d.notify()
+	}
+}
+
+// nextWait returns how long to sleep before the next delivery is due
+func (d *webhookDeliverer) nextWait() time.Duration {
+	next, ok, err := d.rt.db.NextWebhookDeliveryTime()
+	if err != nil {
+		d.rt.baseLogger.WithError(err).Error("failed to read the webhook deliveries queue")
+		return backgroundMaxSleep
+	}
+	if !ok {
+		return backgroundMaxSleep
+	}
+	return waitUntil(next)
+}
+
+// deliverDue attempts every delivery that is due, stopping early if the deliverer is closed. It returns false if some
+// attempt could not be recorded, and its delivery is still due.
+func (d *webhookDeliverer) deliverDue() bool {
+	for {
+		var recorded, failed int32
+		due, err := d.rt.db.GetDueWebhookDeliveries(time.Now(), webhookBatchSize)
+		if err != nil {
+			d.rt.baseLogger.WithError(err).Error("failed to load due webhook deliveries")
+			return false
+		}
+
+		// A slow receiver only holds up one worker
+		jobs := make(chan database.DueWebhookDelivery)
+		var wg sync.WaitGroup
+		for i := 0; i < webhookWorkers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for job := range jobs {
+					if d.deliver(job) {
+						atomic.AddInt32(&recorded, 1)
+					} else {
+						atomic.AddInt32(&failed, 1)
+					}
+				}
+			}()
+		}
+		for _, job := range due {
+			if d.stopping() {
+				break
+			}
+			jobs <- job
+		}
+		close(jobs)
+		wg.Wait()
+
+		// Stop on a short batch, or when nothing moved to avoid reloading the same deliveries
+		if len(due) < webhookBatchSize || recorded == 0 || d.stopping() {
+			return failed == 0
+		}
+	}
+}
+
+// deliver attempts a delivery and records the outcome. It returns false if the delivery is still due.
+func (d *webhookDeliverer) deliver(due database.DueWebhookDelivery) bool {
+	logger := d.rt.baseLogger.WithField("webhookId", due.Webhook.Id).WithField("deliveryId", due.Delivery.Id)
+
+	body, err := json.Marshal(webhookBody{
+		Id:             due.Delivery.Id,
+		Event:          due.Delivery.Event,
+		ConversationId: due.Webhook.ConversationId,
+		CreatedAt:      due.Delivery.CreatedAt,
+		Data:           json.RawMessage(due.Delivery.Payload),
+	})
+	if err != nil {
+		logger.WithError(err).Error("failed to encode webhook delivery")
+		return false
+	}
+
+	status, err := d.sender.Send(d.ctx, webhook.Delivery{
+		ID:     due.Delivery.Id,
+		Event:  due.Delivery.Event,
+		URL:    due.Webhook.URL,
+		Secret: due.Webhook.Secret,
+		Body:   body,
+	})
+	if d.ctx.Err() != nil {
+		// Closing: the delivery stays pending, and is attempted again after a restart
+		return false
+	}
+
+	attempt := database.WebhookAttempt{
+		DeliveryId:   due.Delivery.Id,
+		WebhookId:    due.Webhook.Id,
+		StatusCode:   status,
+		Succeeded:    err == nil && status >= 200 && status < 300,
+		DisableAfter: webhookDisableAfter,
+	}
+	switch {
+	case err != nil:
+		attempt.Error = err.Error()
+	case !attempt.Succeeded:
+		attempt.Error = "unexpected status " + strconv.Itoa(status)
+	}
+	// An address that is not allowed will not become allowed by waiting
+	attempts := due.Delivery.Attempts + 1
+	if !attempt.Succeeded && attempts < webhookMaxAttempts && !errors.Is(err, webhook.ErrForbiddenAddress) {
+		attempt.RetryAt = time.Now().Add(webhookBackoff(attempts))
+	}
+
+	disabled, err := d.rt.db.RecordWebhookAttempt(attempt)
+	if err != nil {
+		logger.WithError(err).Error("failed to record webhook delivery attempt")
+		return false
+	}
+	if !attempt.Succeeded {
+		logger.WithField("attempt", attempts).Debug("webhook delivery failed: " + attempt.Error)
+	}
+	if disabled {
+		d.rt.sysLogger.LogWarn("Webhook " + due.Webhook.Id + " of conversation " + due.Webhook.ConversationId +
+			" disabled after too many failed deliveries")
+	}
+	return true
+}
+
+// webhookBackoff returns how long to wait before retrying a delivery that failed `attempts` times
+func webhookBackoff(attempts int) time.Duration {
+	wait := webhookRetryBase
+	for i := 1; i < attempts && wait < webhookRetryMax; i++ {
+		wait *= 2
+	}
+	if wait > webhookRetryMax {
+		wait = webhookRetryMax
+	}
+	return wait
+}
+
+// requireWebhookAccess checks that the caller is the user of the path and a participant of the conversation of the
+// path, whose webhooks they can manage
+func (rt *_router) requireWebhookAccess(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) (database.User, string, bool) {
+	user, ok := rt.RequireAuth(w, r, ps.ByName("id"))
+	if !ok {
+		return database.User{}, "", false
+	}
+	cid := ps.ByName("conversationId")
+	participant, err := rt.db.IsParticipant(cid, user.UId)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("failed to check conversation participant")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return database.User{}, "", false
+	}
+	if !participant {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return database.User{}, "", false
+	}
+	return user, cid, true
+}
+
+// createWebhook subscribes a URL to events of the conversation. The secret that signs the deliveries is only
+// returned here.
+func (rt *_router) createWebhook(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	user, cid, ok := rt.requireWebhookAccess(w, r, ps, ctx)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid input", http.StatusBadRequest)
+		return
+	}
+	if len(req.URL) > 2048 || !webhook.ValidURL(req.URL) {
+		http.Error(w, "url must be an absolute http or https URL", http.StatusBadRequest)
+		return
+	}
+	events := allWebhookEvents
+	if len(req.Events) > 0 {
+		requested := make(map[string]bool, len(req.Events))
+		for _, e := range req.Events {
+			requested[e] = true
+		}
+		events = make([]string, 0, len(requested))
+		for _, event := range allWebhookEvents {
+			if requested[event] {
+				events = append(events, event)
+				delete(requested, event)
+			}
+		}
+		for e := range requested {
+			http.Error(w, "unknown event: "+e, http.StatusBadRequest)
+			return
+		}
+	}
+
+	existing, err := rt.db.ListWebhooks(cid)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("failed to list webhooks")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(existing) >= maxWebhooksPerConversation {
+		http.Error(w, "the conversation has too many webhooks", http.StatusConflict)
+		return
+	}
+
+	secret, err := webhook.NewSecret()
+	if err != nil {
+		ctx.Logger.WithError(err).Error("failed to generate webhook secret")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	created, err := rt.db.CreateWebhook(database.Webhook{
+		ConversationId: cid,
+		CreatedBy:      user.UId,
+		URL:            req.URL,
+		Secret:         secret,
+		Events:         events,
+	})
+	if err != nil {
+		ctx.Logger.WithError(err).Error("failed to create webhook")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	rt.sysLogger.LogInfo("User " + user.Username + " added a webhook to conversation " + cid)
+
+	resp := struct {
+		database.Webhook
+		Secret string `json:"secret"`
+	}{created, secret}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		ctx.Logger.WithError(err).Error("failed to encode webhook")
+	}
+}
+
+// listWebhooks lists the webhooks of the conversation, without their secrets
+func (rt *_router) listWebhooks(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	_, cid, ok := rt.requireWebhookAccess(w, r, ps, ctx)
+	if !ok {
+		return
+	}
+
+	webhooks, err := rt.db.ListWebhooks(cid)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("failed to list webhooks")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(webhooks); err != nil {
+		ctx.Logger.WithError(err).Error("failed to encode webhooks")
+	}
+}
+
+// setWebhookEnabled enables or disables a webhook. Enabling a webhook that was disabled after too many failures gives
+// it a fresh start; the events of the time it was disabled are not sent.
+func (rt *_router) setWebhookEnabled(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	_, cid, ok := rt.requireWebhookAccess(w, r, ps, ctx)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+		http.Error(w, "invalid input", http.StatusBadRequest)
+		return
+	}
+
+	updated, err := rt.db.SetWebhookEnabled(cid, ps.ByName("webhookId"), *req.Enabled)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "webhook not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("failed to update webhook")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(updated); err != nil {
+		ctx.Logger.WithError(err).Error("failed to encode webhook")
+	}
+}
+
+// deleteWebhook removes a webhook with its pending deliveries and its log
+func (rt *_router) deleteWebhook(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	user, cid, ok := rt.requireWebhookAccess(w, r, ps, ctx)
+	if !ok {
+		return
+	}
+
+	found, err := rt.db.DeleteWebhook(cid, ps.ByName("webhookId"))
+	if err != nil {
+		ctx.Logger.WithError(err).Error("failed to delete webhook")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "webhook not found", http.StatusNotFound)
+		return
+	}
+	rt.sysLogger.LogInfo("User " + user.Username + " removed a webhook from conversation " + cid)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listWebhookDeliveries returns the latest deliveries of a webhook, pending or not, the most recent first
+func (rt *_router) listWebhookDeliveries(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	_, cid, ok := rt.requireWebhookAccess(w, r, ps, ctx)
+	if !ok {
+		return
+	}
+
+	hook, err := rt.db.GetWebhook(cid, ps.ByName("webhookId"))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "webhook not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("failed to load webhook")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	deliveries, err := rt.db.ListWebhookDeliveries(hook.Id, webhookLogLimit)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("failed to list webhook deliveries")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(deliveries); err != nil {
+		ctx.Logger.WithError(err).Error("failed to encode webhook deliveries")
+	}
+}
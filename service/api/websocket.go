@@ -1,11 +1,13 @@
 package api
 
 import (
-	"log"
+	"errors"
 	"net/http"
-	"sync"
+	"strconv"
+	"time"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
 	"github.com/gorilla/websocket"
 	"github.com/julienschmidt/httprouter"
 )
@@ -21,195 +23,419 @@ var upgrader = websocket.Upgrader{
 
 // WebSocket message types
 type WSMessage struct {
-	Type    string      `json:"type"`
-	Payload interface{} `json:"payload"`
+	Type string `json:"type"`
+	// Version is the version of the event, for the events of the event bus
+	Version int `json:"version,omitempty"`
+	// Seq numbers the events of the user, for the events kept in their event log
+	Seq int64 `json:"seq,omitempty"`
+	// RequestId is the ID of the command of the client that an `ack` or `error` replies to
+	RequestId string      `json:"requestId,omitempty"`
+	Payload   interface{} `json:"payload"`
 }
 
+const (
+	// wsWriteWait bounds the write of a single message; a client that does not read is disconnected
+	wsWriteWait = 10 * time.Second
+
+	// wsPongWait is how long a client may stay silent, pongs included, before it is considered gone
+	wsPongWait = 60 * time.Second
+
+	// wsPingPeriod is how often the server pings a client; it must be shorter than wsPongWait
+	wsPingPeriod = wsPongWait * 9 / 10
+
+	// wsMaxMessageSize is the largest message a client may send, in bytes. A larger one closes the connection.
+	wsMaxMessageSize = 64 * 1024
+
+	// clientSendBuffer is how many messages a client can lag behind before it is evicted as too slow
+	clientSendBuffer = 256
+
+	// maxConnectionsPerUser is how many WebSocket and event stream clients a user may have open at once
+	maxConnectionsPerUser = 10
+)
+
 // Client represents a WebSocket client
 type Client struct {
 	UserID string
-	Conn   *websocket.Conn
-	Send   chan WSMessage
-	Hub    *Hub
+	// SessionID is the session the client authenticated with; revoking it closes the client
+	SessionID string
+	Conn      *websocket.Conn
+	// Send is closed by the hub, and only by the hub, when the client is removed
+	Send chan WSMessage
+	Hub  *Hub
+
+	// user is the account of the client, loaded when it connected; the commands run as this user
+	user database.User
+
+	// resumeAfter is the sequence number of the last event the client saw before reconnecting, or -1 for a new client
+	resumeAfter int64
+
+	// closeCode and closeText are the reason of the close frame, set by the hub before it closes Send
+	closeCode int
+	closeText string
+}
+
+// hubMessage is a message queued for broadcast. If recipients is nil, the message goes to every client; otherwise
+// only to the clients of the users in the set. seqs holds the sequence number of the message for each recipient whose
+// event log has it.
+type hubMessage struct {
+	message    WSMessage
+	recipients map[string]bool
+	seqs       map[string]int64
 }
 
-// Hub maintains the set of active clients and broadcasts messages
+// hubRevocation closes the clients of a revoked session, or of all the sessions of the user if sessionID is empty
+type hubRevocation struct {
+	userID    string
+	sessionID string
+}
+
+// hubReply is a message for a single client, like the reply to one of its commands
+type hubReply struct {
+	client  *Client
+	message WSMessage
+}
+
+// hubRegistration adds a client to the hub; accepted tells whether the user was under the connection limit
+type hubRegistration struct {
+	client   *Client
+	accepted chan bool
+}
+
+// Hub maintains the set of active clients and broadcasts messages. The clients are only touched by the goroutine of
+// the hub, which is the only one that closes their Send channel.
 type Hub struct {
 	clients    map[*Client]bool
-	register   chan *Client
+	perUser    map[string]int
+	register   chan hubRegistration
 	unregister chan *Client
-	broadcast  chan WSMessage
-	mutex      sync.RWMutex
+	broadcast  chan hubMessage
+	replies    chan hubReply
+	revoke     chan hubRevocation
+	stop       chan struct{}
+	stopped    chan struct{}
 	router     *_router
 }
 
-// Global hub instance
-var hub *Hub
-
-// InitializeHub initializes the global hub with a router reference
-func InitializeHub(rt *_router) {
-	hub = &Hub{
+// newHub returns the hub of the router's WebSocket clients, already running
+func newHub(rt *_router) *Hub {
+	h := &Hub{
 		clients:    make(map[*Client]bool),
-		register:   make(chan *Client),
+		perUser:    make(map[string]int),
+		register:   make(chan hubRegistration),
 		unregister: make(chan *Client),
-		broadcast:  make(chan WSMessage),
+		broadcast:  make(chan hubMessage),
+		replies:    make(chan hubReply),
+		revoke:     make(chan hubRevocation),
+		stop:       make(chan struct{}),
+		stopped:    make(chan struct{}),
 		router:     rt,
 	}
-	go hub.run()
+	go h.run()
 	rt.sysLogger.LogInfo("WebSocket hub initialized successfully")
+	return h
+}
+
+// handleEvent is the subscriber of the event bus: it sends the events to the connected clients of their recipients,
+// and closes the clients of revoked sessions
+func (h *Hub) handleEvent(e busEvent) {
+	if revoked, ok := e.Event.(SessionRevokedEvent); ok {
+		select {
+		case h.revoke <- hubRevocation{userID: revoked.UserId, sessionID: revoked.SessionId}:
+		case <-h.stop:
+		}
+		return
+	}
+
+	message := hubMessage{message: WSMessage{
+		Type:    e.Event.Type(),
+		Version: e.Event.Version(),
+		Payload: e.Event,
+	}}
+	if e.Recipients != nil {
+		message.recipients = make(map[string]bool, len(e.Recipients))
+		for _, uid := range e.Recipients {
+			message.recipients[uid] = true
+		}
+		message.seqs = h.router.logEvent(e)
+	}
+	h.send(message)
+}
+
+// add registers a client. It returns false if the user already has too many clients, or if the hub is stopped.
+func (h *Hub) add(client *Client) bool {
+	accepted := make(chan bool, 1)
+	select {
+	case h.register <- hubRegistration{client: client, accepted: accepted}:
+		return <-accepted
+	case <-h.stop:
+		return false
+	}
+}
+
+// remove unregisters a client; its Send channel is closed if it was still registered
+func (h *Hub) remove(client *Client) {
+	select {
+	case h.unregister <- client:
+	case <-h.stop:
+	}
+}
+
+// send queues a message for broadcast
+func (h *Hub) send(message hubMessage) {
+	select {
+	case h.broadcast <- message:
+	case <-h.stop:
+	}
+}
+
+// reply queues a message for a single client
+func (h *Hub) reply(client *Client, message WSMessage) {
+	select {
+	case h.replies <- hubReply{client: client, message: message}:
+	case <-h.stop:
+	}
+}
+
+// close removes every client, telling them the server is going away, and stops the hub
+func (h *Hub) close() {
+	close(h.stop)
+	<-h.stopped
+}
+
+// evict removes a client and closes its Send channel, so that its pump sends a close frame with `code` and `text`.
+// A client that was already removed is left alone.
+func (h *Hub) evict(client *Client, code int, text string) {
+	if !h.clients[client] {
+		return
+	}
+	delete(h.clients, client)
+	h.perUser[client.UserID]--
+	if h.perUser[client.UserID] == 0 {
+		delete(h.perUser, client.UserID)
+	}
+	client.closeCode = code
+	client.closeText = text
+	close(client.Send)
+	h.router.sysLogger.LogInfo("WebSocket client disconnected: " + client.UserID)
 }
 
 // Run the hub
 func (h *Hub) run() {
+	defer close(h.stopped)
 	for {
 		select {
-		case client := <-h.register:
-			h.mutex.Lock()
+		case registration := <-h.register:
+			client := registration.client
+			if h.perUser[client.UserID] >= maxConnectionsPerUser {
+				registration.accepted <- false
+				continue
+			}
 			h.clients[client] = true
-			h.mutex.Unlock()
+			h.perUser[client.UserID]++
+			registration.accepted <- true
 			h.router.sysLogger.LogInfo("WebSocket client connected: " + client.UserID)
-			log.Printf("WebSocket client connected: %s", client.UserID)
 
 		case client := <-h.unregister:
-			h.mutex.Lock()
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.Send)
+			h.evict(client, websocket.CloseNormalClosure, "")
+
+		case revocation := <-h.revoke:
+			for client := range h.clients {
+				if client.UserID != revocation.userID ||
+					revocation.sessionID != "" && client.SessionID != revocation.sessionID {
+					continue
+				}
+				// Tell the client why, if there is room, before the close frame
+				select {
+				case client.Send <- WSMessage{Type: "session_revoked", Payload: map[string]interface{}{}}:
+				default:
+				}
+				h.evict(client, websocket.ClosePolicyViolation, "session revoked")
 			}
-			h.mutex.Unlock()
-			h.router.sysLogger.LogInfo("WebSocket client disconnected: " + client.UserID)
-			log.Printf("WebSocket client disconnected: %s", client.UserID)
 
 		case message := <-h.broadcast:
-			h.mutex.RLock()
 			for client := range h.clients {
+				if message.recipients != nil && !message.recipients[client.UserID] {
+					continue
+				}
+				m := message.message
+				m.Seq = message.seqs[client.UserID]
 				select {
-				case client.Send <- message:
+				case client.Send <- m:
 				default:
-					close(client.Send)
-					delete(h.clients, client)
+					// The client does not keep up: it reconnects and resumes from the event log
+					h.evict(client, websocket.CloseTryAgainLater, "too slow")
 				}
 			}
-			h.mutex.RUnlock()
+
+		case reply := <-h.replies:
+			if !h.clients[reply.client] {
+				continue
+			}
+			select {
+			case reply.client.Send <- reply.message:
+			default:
+				h.evict(reply.client, websocket.CloseTryAgainLater, "too slow")
+			}
+
+		case <-h.stop:
+			for client := range h.clients {
+				h.evict(client, websocket.CloseGoingAway, "server shutting down")
+			}
+			return
 		}
 	}
 }
 
 // serveWs handles WebSocket requests from clients
 func (rt *_router) serveWs(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	// Get user ID from query parameter (try both userId and user_id for compatibility)
-	userID := r.URL.Query().Get("userId")
-	if userID == "" {
-		userID = r.URL.Query().Get("user_id")
+	// Browsers cannot set headers on WebSocket requests, so the session token may come in the query
+	token, ok := bearerToken(r)
+	if !ok {
+		token = r.URL.Query().Get("token")
 	}
-	if userID == "" {
-		http.Error(w, "User ID required", http.StatusBadRequest)
+	user, session, err := rt.authenticate(r, token)
+	if errors.Is(err, errInvalidSession) {
+		http.Error(w, "Invalid or revoked session", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		ctx.Logger.WithError(err).Error("can't check the session")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	userID := user.UId
 
-	// Upgrade connection to WebSocket
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		rt.sysLogger.LogError("WebSocket upgrade failed for user " + userID + ": " + err.Error())
-		log.Printf("WebSocket upgrade error: %v", err)
-		return
+	// A client that reconnects tells the last event it saw, to get the ones it missed
+	resumeAfter := int64(-1)
+	if lastSeq := r.URL.Query().Get("lastSeq"); lastSeq != "" {
+		resumeAfter, err = strconv.ParseInt(lastSeq, 10, 64)
+		if err != nil || resumeAfter < 0 {
+			http.Error(w, "invalid lastSeq", http.StatusBadRequest)
+			return
+		}
 	}
 
-	// Create client
+	// Register client before the upgrade, so that a user over the limit gets an HTTP error. It gets the new events from
+	// now on, so the event log is read after.
 	client := &Client{
-		UserID: userID,
-		Conn:   conn,
-		Send:   make(chan WSMessage, 256),
-		Hub:    hub,
+		UserID:    userID,
+		SessionID: session.Id,
+		Send:      make(chan WSMessage, clientSendBuffer),
+		Hub:       rt.hub,
+
+		user:        user,
+		resumeAfter: resumeAfter,
+	}
+	if !rt.hub.add(client) {
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return
 	}
 
-	// Register client
-	if hub != nil {
-		hub.register <- client
+	// Upgrade connection to WebSocket
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		rt.hub.remove(client)
+		rt.sysLogger.LogError("WebSocket upgrade failed for user " + userID + ": " + err.Error())
+		return
 	}
+	client.Conn = conn
 
 	// Start goroutines for reading and writing
 	go client.writePump()
 	go client.readPump()
 }
 
-// readPump handles messages from the WebSocket connection
+// readPump handles messages from the WebSocket connection: typing indicators, and the commands that get a reply. The
+// connection is dropped when the client sends a message larger than wsMaxMessageSize, or stays silent longer than
+// wsPongWait.
 func (c *Client) readPump() {
 	defer func() {
-		if c.Hub != nil {
-			c.Hub.unregister <- c
-		}
+		c.Hub.remove(c)
 		c.Conn.Close()
 	}()
 
+	c.Conn.SetReadLimit(wsMaxMessageSize)
+	_ = c.Conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.Conn.SetPongHandler(func(string) error {
+		return c.Conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
 	for {
-		var msg WSMessage
+		var msg wsCommand
 		err := c.Conn.ReadJSON(&msg)
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("WebSocket error: %v", err)
+				c.Hub.router.sysLogger.LogError("WebSocket error for user " + c.UserID + ": " + err.Error())
 			}
 			break
 		}
+		_ = c.Conn.SetReadDeadline(time.Now().Add(wsPongWait))
 
 		// Handle different message types
 		switch msg.Type {
 		case "typing_start":
-			// Broadcast typing indicator to other clients
-			if c.Hub != nil {
-				c.Hub.broadcast <- WSMessage{
-					Type: "user_typing",
-					Payload: map[string]interface{}{
-						"userId": c.UserID,
-						"typing": true,
-					},
-				}
-			}
+			c.sendTyping(msg, true)
 		case "typing_stop":
-			// Broadcast stop typing indicator
-			if c.Hub != nil {
-				c.Hub.broadcast <- WSMessage{
-					Type: "user_typing",
-					Payload: map[string]interface{}{
-						"userId": c.UserID,
-						"typing": false,
-					},
-				}
-			}
+			c.sendTyping(msg, false)
+		case "send_message", "mark_read", "react":
+			// The next command is read once this one is done, so replies come in order
+			c.handleCommand(msg)
 		}
 	}
 }
 
-// writePump handles sending messages to the WebSocket connection
+// writePump handles sending messages to the WebSocket connection, and pings the client every wsPingPeriod
 func (c *Client) writePump() {
-	defer c.Conn.Close()
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.Conn.Close()
+	}()
+
+	// The hub may queue events that were already replayed, or that are older than the connection
+	lastSeq, err := c.resume(c.write)
+	if err != nil {
+		return
+	}
 
 	for {
 		select {
 		case message, ok := <-c.Send:
 			if !ok {
-				if err := c.Conn.WriteMessage(websocket.CloseMessage, []byte{}); err != nil {
-					// Log the error but continue with return since connection is closing
-					// We can't use ctx.Logger here as we don't have access to it
+				// Removed by the hub, which set the reason
+				code := c.closeCode
+				if code == 0 {
+					code = websocket.CloseNormalClosure
+				}
+				_ = c.Conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				_ = c.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, c.closeText))
+				return
+			}
+
+			if message.Seq != 0 {
+				if message.Seq <= lastSeq {
+					continue
 				}
+				lastSeq = message.Seq
+			}
+
+			if err := c.write(message); err != nil {
+				// Closing the connection stops readPump, which removes the client from the hub
 				return
 			}
 
-			if err := c.Conn.WriteJSON(message); err != nil {
-				// Log the error and close the connection
-				// Client will be removed from hub by the cleanup routine
+		case <-ticker.C:
+			_ = c.Conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
 		}
 	}
 }
 
-// BroadcastMessage broadcasts a message to all connected clients
-func BroadcastMessage(msgType string, payload interface{}) {
-	if hub != nil {
-		hub.broadcast <- WSMessage{
-			Type:    msgType,
-			Payload: payload,
-		}
+// write sends a message to the WebSocket connection, giving up after wsWriteWait
+func (c *Client) write(m WSMessage) error {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(wsWriteWait)); err != nil {
+		return err
 	}
+	return c.Conn.WriteJSON(m)
 }
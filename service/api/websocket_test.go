@@ -0,0 +1,397 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestClient returns a client of the hub that is not connected to anything; the test reads its Send channel
+func newTestClient(h *Hub, userID string, sessionID string, buffer int) *Client {
+	return &Client{
+		UserID:    userID,
+		SessionID: sessionID,
+		Send:      make(chan WSMessage, buffer),
+		Hub:       h,
+
+		resumeAfter: -1,
+	}
+}
+
+// drain reads the messages of a client until the hub closes its Send channel, and returns them
+func drain(t *testing.T, c *Client) []WSMessage {
+	t.Helper()
+	var messages []WSMessage
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case m, ok := <-c.Send:
+			if !ok {
+				return messages
+			}
+			messages = append(messages, m)
+		case <-timeout:
+			t.Fatalf("the client of %s was not closed", c.UserID)
+			return nil
+		}
+	}
+}
+
+func TestHubConcurrentClients(t *testing.T) {
+	rt := newTestRouter(t)
+	h := rt.hub
+
+	const users = 50
+	const clientsPerUser = 8
+	var clients, registered sync.WaitGroup
+	for u := 0; u < users; u++ {
+		for k := 0; k < clientsPerUser; k++ {
+			clients.Add(1)
+			registered.Add(1)
+			go func(u, k int) {
+				defer clients.Done()
+				c := newTestClient(h, fmt.Sprintf("user%d", u), fmt.Sprintf("session%d", k), clientSendBuffer)
+				accepted := h.add(c)
+				registered.Done()
+				if !accepted {
+					t.Errorf("client %d of user%d was refused", k, u)
+					return
+				}
+				// Half of the clients leave after a few messages, the others stay until the hub stops
+				received := 0
+				for range c.Send {
+					received++
+					if k%2 == 0 && received == 10 {
+						h.remove(c)
+						// Removing twice is harmless
+						h.remove(c)
+					}
+				}
+			}(u, k)
+		}
+	}
+
+	registered.Wait()
+
+	var publishers sync.WaitGroup
+	for p := 0; p < 8; p++ {
+		publishers.Add(1)
+		go func(p int) {
+			defer publishers.Done()
+			for i := 0; i < 100; i++ {
+				h.send(hubMessage{message: WSMessage{Type: "test", Payload: i}})
+			}
+		}(p)
+	}
+	publishers.Wait()
+
+	stopHub(t, rt)
+	clients.Wait()
+	if len(h.clients) != 0 || len(h.perUser) != 0 {
+		t.Errorf("the hub still has %d clients of %d users", len(h.clients), len(h.perUser))
+	}
+}
+
+func TestHubEvictsSlowConsumers(t *testing.T) {
+	rt := newTestRouter(t)
+	h := rt.hub
+
+	slow := newTestClient(h, "slow", "s", 2)
+	fast := newTestClient(h, "fast", "f", clientSendBuffer)
+	if !h.add(slow) || !h.add(fast) {
+		t.Fatal("client refused")
+	}
+
+	var received []WSMessage
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		received = drain(t, fast)
+	}()
+
+	for i := 0; i < 10; i++ {
+		h.send(hubMessage{message: WSMessage{Type: "test", Payload: i}})
+	}
+
+	// The slow client got what fit in its buffer, then was closed as too slow
+	if n := len(drain(t, slow)); n != 2 {
+		t.Errorf("the slow client got %d messages, want 2", n)
+	}
+	if slow.closeCode != websocket.CloseTryAgainLater {
+		t.Errorf("the slow client was closed with %d, want %d", slow.closeCode, websocket.CloseTryAgainLater)
+	}
+	// A client removed by the hub can still unregister, as its pumps do when they stop
+	h.remove(slow)
+
+	stopHub(t, rt)
+	<-done
+	if len(received) != 10 {
+		t.Errorf("the fast client got %d messages, want 10", len(received))
+	}
+	if fast.closeCode != websocket.CloseGoingAway {
+		t.Errorf("the fast client was closed with %d, want %d", fast.closeCode, websocket.CloseGoingAway)
+	}
+}
+
+func TestHubRevokesSessions(t *testing.T) {
+	rt := newTestRouter(t)
+	h := rt.hub
+
+	revoked := newTestClient(h, "user", "revoked", clientSendBuffer)
+	kept := newTestClient(h, "user", "kept", clientSendBuffer)
+	other := newTestClient(h, "other", "revoked", clientSendBuffer)
+	for _, c := range []*Client{revoked, kept, other} {
+		if !h.add(c) {
+			t.Fatal("client refused")
+		}
+	}
+
+	h.handleEvent(busEvent{Event: SessionRevokedEvent{UserId: "user", SessionId: "revoked"}})
+	messages := drain(t, revoked)
+	if len(messages) != 1 || messages[0].Type != "session_revoked" {
+		t.Errorf("the revoked client got %v, want session_revoked", messages)
+	}
+	if revoked.closeCode != websocket.ClosePolicyViolation {
+		t.Errorf("the revoked client was closed with %d, want %d", revoked.closeCode, websocket.ClosePolicyViolation)
+	}
+
+	// The other session of the user, and the same session ID of another user, are still connected
+	h.send(hubMessage{message: WSMessage{Type: "test"}})
+	for _, c := range []*Client{kept, other} {
+		select {
+		case m := <-c.Send:
+			if m.Type != "test" {
+				t.Errorf("got %s, want test", m.Type)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("a client that was not revoked got nothing")
+		}
+	}
+
+	// Revoking every session of the user closes the rest
+	h.handleEvent(busEvent{Event: SessionRevokedEvent{UserId: "user"}})
+	drain(t, kept)
+}
+
+func TestHubRevocationRace(t *testing.T) {
+	rt := newTestRouter(t)
+	h := rt.hub
+
+	var clients, registered sync.WaitGroup
+	for u := 0; u < 20; u++ {
+		for k := 0; k < 5; k++ {
+			clients.Add(1)
+			registered.Add(1)
+			go func(u, k int) {
+				defer clients.Done()
+				// Small buffers, so that some clients are evicted as slow while they are revoked
+				c := newTestClient(h, fmt.Sprintf("user%d", u), fmt.Sprintf("session%d", k%2), 4)
+				accepted := h.add(c)
+				registered.Done()
+				if !accepted {
+					t.Errorf("client %d of user%d was refused", k, u)
+					return
+				}
+				for range c.Send {
+					time.Sleep(time.Millisecond)
+				}
+				h.remove(c)
+			}(u, k)
+		}
+	}
+
+	registered.Wait()
+
+	var publishers sync.WaitGroup
+	for p := 0; p < 4; p++ {
+		publishers.Add(1)
+		go func(p int) {
+			defer publishers.Done()
+			for i := 0; i < 100; i++ {
+				h.send(hubMessage{message: WSMessage{Type: "test"}})
+				if i%10 == 0 {
+					h.handleEvent(busEvent{Event: SessionRevokedEvent{UserId: fmt.Sprintf("user%d", (p+i)%20), SessionId: "session1"}})
+				}
+			}
+		}(p)
+	}
+	publishers.Wait()
+
+	stopHub(t, rt)
+	clients.Wait()
+	if len(h.clients) != 0 || len(h.perUser) != 0 {
+		t.Errorf("the hub still has %d clients of %d users", len(h.clients), len(h.perUser))
+	}
+}
+
+func TestHubConnectionLimit(t *testing.T) {
+	rt := newTestRouter(t)
+	h := rt.hub
+
+	clients := make([]*Client, 0, maxConnectionsPerUser)
+	for i := 0; i < maxConnectionsPerUser; i++ {
+		c := newTestClient(h, "user", "s", 1)
+		if !h.add(c) {
+			t.Fatalf("client %d refused under the limit", i)
+		}
+		clients = append(clients, c)
+	}
+	if h.add(newTestClient(h, "user", "s", 1)) {
+		t.Error("a client over the limit was accepted")
+	}
+	if !h.add(newTestClient(h, "another", "s", 1)) {
+		t.Error("the limit of a user applied to another")
+	}
+
+	// A client that leaves makes room for another
+	h.remove(clients[0])
+	if !h.add(newTestClient(h, "user", "s", 1)) {
+		t.Error("a client was refused after another one left")
+	}
+
+	stopHub(t, rt)
+	if h.add(newTestClient(h, "user", "s", 1)) {
+		t.Error("a client was accepted after the hub stopped")
+	}
+}
+
+func TestServeWsLimitsAndRevocation(t *testing.T) {
+	rt := newTestRouter(t)
+	server := httptest.NewServer(rt.Handler())
+	defer server.Close()
+
+	_, token := registerTestUser(t, server, "wsuser")
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?token=" + token
+
+	conns := make([]*websocket.Conn, 0, maxConnectionsPerUser)
+	for i := 0; i < maxConnectionsPerUser; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatalf("connection %d: %v", i, err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("a connection over the limit got %v, want 429", err)
+	}
+
+	// A message over the size limit closes its connection
+	if err := conns[0].WriteMessage(websocket.TextMessage, make([]byte, wsMaxMessageSize+1)); err != nil {
+		t.Fatal(err)
+	}
+	_ = conns[0].SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := conns[0].ReadMessage(); err != nil {
+			break
+		}
+	}
+
+	// Logging out closes the other connections of the session with a policy violation
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+"/session", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	var wg sync.WaitGroup
+	for _, conn := range conns[1:] {
+		wg.Add(1)
+		go func(conn *websocket.Conn) {
+			defer wg.Done()
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for {
+				_, _, err := conn.ReadMessage()
+				if err == nil {
+					continue
+				}
+				if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+					t.Errorf("the connection was closed with %v, want a policy violation", err)
+				}
+				return
+			}
+		}(conn)
+	}
+	wg.Wait()
+}
+
+// dialTestWs connects to the WebSocket with the token, and reads the `ready` message
+func dialTestWs(t *testing.T, server *httptest.Server, token string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws?token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	if m := readTestWs(t, conn); m.Type != "ready" {
+		t.Fatalf("the first message is %q, want ready", m.Type)
+	}
+	return conn
+}
+
+// readTestWs reads the next message of the connection, with the payload left as JSON
+func readTestWs(t *testing.T, conn *websocket.Conn) WSMessage {
+	t.Helper()
+	var m WSMessage
+	var payload json.RawMessage
+	m.Payload = &payload
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&m); err != nil {
+		t.Fatal(err)
+	}
+	m.Payload = payload
+	return m
+}
+
+func TestTypingGoesToOtherParticipants(t *testing.T) {
+	rt := newTestRouter(t)
+	server := httptest.NewServer(rt.Handler())
+	defer server.Close()
+
+	alice, aliceToken := registerTestUser(t, server, "typingalice")
+	bob, bobToken := registerTestUser(t, server, "typingbob")
+	_, carolToken := registerTestUser(t, server, "typingcarol")
+	cid := createTestConversation(t, server, alice, aliceToken, bob)
+
+	aliceConn := dialTestWs(t, server, aliceToken)
+	bobConn := dialTestWs(t, server, bobToken)
+	carolConn := dialTestWs(t, server, carolToken)
+
+	typing := wsCommand{Type: "typing_start", Payload: json.RawMessage(`{"conversationId":"` + cid + `"}`)}
+	if err := aliceConn.WriteJSON(typing); err != nil {
+		t.Fatal(err)
+	}
+	m := readTestWs(t, bobConn)
+	want := `{"conversationId":"` + cid + `","typing":true,"userId":"` + alice + `"}`
+	if m.Type != "user_typing" || string(m.Payload.(json.RawMessage)) != want {
+		t.Fatalf("the other participant got %s %s, want user_typing %s", m.Type, m.Payload, want)
+	}
+
+	// The hub sent the indicator to everyone it goes to, so the next message of the others is the reply to their own
+	// command
+	typing.RequestId = "carol"
+	if err := carolConn.WriteJSON(typing); err != nil {
+		t.Fatal(err)
+	}
+	if m := readTestWs(t, carolConn); m.Type != "error" || m.RequestId != "carol" ||
+		!strings.Contains(string(m.Payload.(json.RawMessage)), `"status":403`) {
+		t.Errorf("a user outside the conversation got %s %s, want a 403 error", m.Type, m.Payload)
+	}
+	markRead := wsCommand{Type: "mark_read", RequestId: "alice", Payload: json.RawMessage(`{"conversationId":"` + cid + `"}`)}
+	if err := aliceConn.WriteJSON(markRead); err != nil {
+		t.Fatal(err)
+	}
+	if m := readTestWs(t, aliceConn); m.Type != "ack" || m.RequestId != "alice" {
+		t.Errorf("the user typing got %s %s, want the ack of mark_read", m.Type, m.Payload)
+	}
+}
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+)
+
+// commandError is a request refused by the code shared by the REST handlers and the commands of the WebSocket. Status
+// is the HTTP status of the REST response, which the WebSocket sends in its error replies too.
+type commandError struct {
+	Status  int    `json:"status"`
+	Message string `json:"error"`
+}
+
+func (e *commandError) Error() string { return e.Message }
+
+func badRequest(message string) *commandError {
+	return &commandError{Status: http.StatusBadRequest, Message: message}
+}
+
+func internalError(message string) *commandError {
+	return &commandError{Status: http.StatusInternalServerError, Message: message}
+}
+
+// wsCommand is a message sent by a client. Commands that change something carry a RequestId chosen by the client,
+// which the reply (an `ack` or an `error`) repeats.
+type wsCommand struct {
+	Type      string          `json:"type"`
+	RequestId string          `json:"requestId"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// sendMessageCommand is the payload of `send_message`: the body of the sendMessage request, with its conversation
+type sendMessageCommand struct {
+	ConversationId string `json:"conversationId"`
+	messageInput
+}
+
+// sendMessageAck is the payload of the ack of `send_message`: the message sent, or the scheduled message
+type sendMessageAck struct {
+	Message   *database.Message          `json:"message,omitempty"`
+	Scheduled *database.ScheduledMessage `json:"scheduled,omitempty"`
+	// Duplicate is set when the clientMessageId was already used; Message is the original message
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+// markReadCommand is the payload of `mark_read`
+type markReadCommand struct {
+	ConversationId string `json:"conversationId"`
+}
+
+// markReadAck is the payload of the ack of `mark_read`
+type markReadAck struct {
+	ConversationId string `json:"conversationId"`
+	// Marked is how many messages were marked as read
+	Marked int `json:"marked"`
+}
+
+// reactCommand is the payload of `react`, which toggles a reaction like the reactToMessage request
+type reactCommand struct {
+	ConversationId string `json:"conversationId"`
+	MessageId      string `json:"messageId"`
+	Emoji          string `json:"emoji"`
+}
+
+// typingCommand is the payload of `typing_start` and `typing_stop`
+type typingCommand struct {
+	ConversationId string `json:"conversationId"`
+}
+
+// sendTyping tells the other participants of the conversation that the user of the client started or stopped typing.
+// Typing indicators are not logged as events. A client that may not send one gets an error, with the requestId if any.
+func (c *Client) sendTyping(command wsCommand, typing bool) {
+	rt := c.Hub.router
+	var payload typingCommand
+	if err := json.Unmarshal(command.Payload, &payload); err != nil || payload.ConversationId == "" {
+		c.Hub.reply(c, WSMessage{Type: "error", RequestId: command.RequestId, Payload: badRequest("Invalid payload")})
+		return
+	}
+	conversation, err := rt.db.GetConversation(payload.ConversationId)
+	recipients := make(map[string]bool, len(conversation.Participants))
+	isParticipant := false
+	for _, participant := range conversation.Participants {
+		if participant.UId == c.UserID {
+			isParticipant = true
+		} else {
+			recipients[participant.UId] = true
+		}
+	}
+	var cerr *commandError
+	if errors.Is(err, sql.ErrNoRows) {
+		cerr = &commandError{Status: http.StatusNotFound, Message: "conversation not found"}
+	} else if err != nil {
+		rt.baseLogger.WithError(err).WithField("user", c.UserID).Error("failed to get the conversation of a typing indicator")
+		cerr = internalError("Internal server error")
+	} else if !isParticipant {
+		cerr = &commandError{Status: http.StatusForbidden, Message: "unauthorized"}
+	}
+	if cerr != nil {
+		c.Hub.reply(c, WSMessage{Type: "error", RequestId: command.RequestId, Payload: cerr})
+		return
+	}
+
+	c.Hub.send(hubMessage{recipients: recipients, message: WSMessage{
+		Type: "user_typing",
+		Payload: map[string]interface{}{
+			"conversationId": conversation.CId,
+			"userId":         c.UserID,
+			"typing":         typing,
+		},
+	}})
+}
+
+// runCommand runs a command of the client and returns the payload of its ack. The commands go through the same code
+// as their REST requests, as the user of the client.
+func (c *Client) runCommand(command wsCommand) (interface{}, *commandError) {
+	rt := c.Hub.router
+	logger := rt.baseLogger.WithField("user", c.UserID).WithField("command", command.Type)
+
+	switch command.Type {
+	case "send_message":
+		var payload sendMessageCommand
+		if err := json.Unmarshal(command.Payload, &payload); err != nil {
+			return nil, badRequest("Invalid payload")
+		}
+		posted, cerr := rt.postMessage(logger, c.user, payload.ConversationId, payload.messageInput)
+		if cerr != nil {
+			return nil, cerr
+		}
+		if posted.Scheduled != nil {
+			return sendMessageAck{Scheduled: posted.Scheduled}, nil
+		}
+		return sendMessageAck{Message: &posted.Message, Duplicate: posted.Duplicate}, nil
+
+	case "mark_read":
+		var payload markReadCommand
+		if err := json.Unmarshal(command.Payload, &payload); err != nil {
+			return nil, badRequest("Invalid payload")
+		}
+		marked, cerr := rt.markConversationRead(logger, c.user, payload.ConversationId)
+		if cerr != nil {
+			return nil, cerr
+		}
+		return markReadAck{ConversationId: payload.ConversationId, Marked: marked}, nil
+
+	case "react":
+		var payload reactCommand
+		if err := json.Unmarshal(command.Payload, &payload); err != nil {
+			return nil, badRequest("Invalid payload")
+		}
+		reacted, cerr := rt.toggleReaction(logger, c.user, payload.ConversationId, payload.MessageId, payload.Emoji)
+		if cerr != nil {
+			return nil, cerr
+		}
+		return reactionResult{Emoji: payload.Emoji, Reacted: reacted}, nil
+	}
+	return nil, badRequest("unknown command")
+}
+
+// handleCommand runs a command of the client and queues its reply
+func (c *Client) handleCommand(command wsCommand) {
+	var reply WSMessage
+	if command.RequestId == "" || !isValidClientKey(command.RequestId) {
+		// Without a valid ID the client could not match the reply; it gets one with the ID it sent, if any
+		reply = WSMessage{Type: "error", Payload: badRequest("Invalid requestId")}
+	} else if ack, cerr := c.runCommand(command); cerr != nil {
+		reply = WSMessage{Type: "error", Payload: cerr}
+	} else {
+		reply = WSMessage{Type: "ack", Payload: ack}
+	}
+	reply.RequestId = command.RequestId
+	c.Hub.reply(c, reply)
+}
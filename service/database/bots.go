@@ -0,0 +1,182 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// CreateBot creates a bot account owned by the user `owner`. It returns ErrUsernameTaken if another user has the
+// same username, ignoring the case of ASCII letters.
+func (db *appdbimpl) CreateBot(owner string, name string) (User, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return User{}, err
+	}
+
+	tx, err := db.c.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var taken bool
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ? COLLATE NOCASE)", name).Scan(&taken)
+	if err != nil {
+		return User{}, err
+	}
+	if taken {
+		return User{}, ErrUsernameTaken
+	}
+
+	_, err = tx.Exec("INSERT INTO users (id, username, is_bot, bot_owner_id) VALUES (?, ?, 1, ?)", id.String(), name, owner)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return User{}, ErrUsernameTaken
+		}
+		return User{}, err
+	}
+
+	return User{UId: id.String(), Username: name, IsBot: true}, tx.Commit()
+}
+
+// ListBots returns the bots owned by the user `owner`
+func (db *appdbimpl) ListBots(owner string) ([]User, error) {
+	rows, err := db.c.Query("SELECT id, username, picture FROM users WHERE bot_owner_id = ? AND is_bot ORDER BY username",
+		owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bots := make([]User, 0)
+	for rows.Next() {
+		bot := User{IsBot: true}
+		var picture sql.NullString
+		if err := rows.Scan(&bot.UId, &bot.Username, &picture); err != nil {
+			return nil, err
+		}
+		bot.Picture = picture.String
+		bots = append(bots, bot)
+	}
+	return bots, rows.Err()
+}
+
+// CreateAPIToken records a new API token, authenticated by the token with the given hash. The ID and creation time
+// are assigned here.
+func (db *appdbimpl) CreateAPIToken(token APIToken, tokenHash string) (APIToken, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return APIToken{}, err
+	}
+	if token.Conversations == nil {
+		token.Conversations = []string{}
+	}
+	scopes, err := json.Marshal(token.Scopes)
+	if err != nil {
+		return APIToken{}, err
+	}
+	conversations, err := json.Marshal(token.Conversations)
+	if err != nil {
+		return APIToken{}, err
+	}
+
+	now := time.Now().UTC().Format(sqlTimeLayout)
+	_, err = db.c.Exec(`INSERT INTO api_tokens (id, user_id, created_by, name, token_hash, scopes, conversations, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, id.String(), token.UserId, token.CreatedBy, token.Name, tokenHash,
+		string(scopes), string(conversations), now)
+	if err != nil {
+		return APIToken{}, err
+	}
+	token.Id = id.String()
+	token.CreatedAt = formatTimestamp(now)
+	return token, nil
+}
+
+// GetAPITokenByHash returns the API token with the given hash, and the user it acts as. It returns sql.ErrNoRows if
+// there is none, e.g. because the token was deleted.
+func (db *appdbimpl) GetAPITokenByHash(tokenHash string) (APIToken, User, error) {
+	var t APIToken
+	var u User
+	var picture, lastUsedAt sql.NullString
+	var scopes, conversations, createdAt string
+	err := db.c.QueryRow(`SELECT t.id, t.created_by, t.name, t.scopes, t.conversations, CAST(t.created_at AS TEXT),
+			CAST(t.last_used_at AS TEXT), u.id, u.username, u.picture, u.is_bot
+		FROM api_tokens t JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = ?`, tokenHash).Scan(&t.Id, &t.CreatedBy, &t.Name, &scopes, &conversations, &createdAt,
+		&lastUsedAt, &u.UId, &u.Username, &picture, &u.IsBot)
+	if err != nil {
+		return APIToken{}, User{}, err
+	}
+	t.UserId = u.UId
+	if err := scanAPITokenLists(&t, scopes, conversations); err != nil {
+		return APIToken{}, User{}, err
+	}
+	t.CreatedAt = formatTimestamp(createdAt)
+	if lastUsedAt.Valid {
+		t.LastUsedAt = formatTimestamp(lastUsedAt.String)
+	}
+	u.Picture = picture.String
+	return t, u, nil
+}
+
+// TouchAPIToken records that the token `id` was used now. Tokens last used after `before` are left alone, so that a
+// busy script doesn't write to the database on each request.
+func (db *appdbimpl) TouchAPIToken(id string, before time.Time) error {
+	_, err := db.c.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ?)",
+		time.Now().UTC().Format(sqlTimeLayout), id, before.UTC().Format(sqlTimeLayout))
+	return err
+}
+
+// ListAPITokens returns the API tokens created by the user `createdBy`, for themselves and for their bots
+func (db *appdbimpl) ListAPITokens(createdBy string) ([]APIToken, error) {
+	rows, err := db.c.Query(`SELECT id, user_id, name, scopes, conversations, CAST(created_at AS TEXT),
+			CAST(last_used_at AS TEXT)
+		FROM api_tokens WHERE created_by = ? ORDER BY created_at DESC`, createdBy)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := make([]APIToken, 0)
+	for rows.Next() {
+		t := APIToken{CreatedBy: createdBy}
+		var lastUsedAt sql.NullString
+		var scopes, conversations, createdAt string
+		if err := rows.Scan(&t.Id, &t.UserId, &t.Name, &scopes, &conversations, &createdAt, &lastUsedAt); err != nil {
+			return nil, err
+		}
+		if err := scanAPITokenLists(&t, scopes, conversations); err != nil {
+			return nil, err
+		}
+		t.CreatedAt = formatTimestamp(createdAt)
+		if lastUsedAt.Valid {
+			t.LastUsedAt = formatTimestamp(lastUsedAt.String)
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// DeleteAPIToken revokes the API token `id` created by the user `createdBy`. It reports whether there was such a
+// token.
+func (db *appdbimpl) DeleteAPIToken(createdBy string, id string) (bool, error) {
+	res, err := db.c.Exec("DELETE FROM api_tokens WHERE id = ? AND created_by = ?", id, createdBy)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func scanAPITokenLists(t *APIToken, scopes string, conversations string) error {
+	if err := json.Unmarshal([]byte(scopes), &t.Scopes); err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(conversations), &t.Conversations)
+}
@@ -0,0 +1,127 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// CommentMessage adds a threaded reply to the message `mid` of conversation `cid`. The user must be a participant of
+// the conversation.
+func (db *appdbimpl) CommentMessage(cid string, user User, mid string, comment string) (Comment, error) {
+	if err := db.checkMessageAccess(cid, user, mid); err != nil {
+		return Comment{}, err
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return Comment{}, err
+	}
+
+	// Millisecond precision keeps comments posted in the same second in order
+	_, err = db.c.Exec(`INSERT INTO comments (id, message_id, sender_id, comment, timestamp)
+		VALUES (?, ?, ?, ?, strftime('%Y-%m-%d %H:%M:%f', 'now'))`,
+		id.String(), mid, user.UId, comment)
+	if err != nil {
+		return Comment{}, err
+	}
+
+	return db.getComment(mid, id.String())
+}
+
+// UncommentMessage removes the comment `commentId` from the message `mid`. Only the author of the comment can remove
+// it, even once the message was deleted for everyone.
+func (db *appdbimpl) UncommentMessage(cid string, user User, mid string, commentId string) error {
+	if err := db.checkMessageReadAccess(cid, user, mid); err != nil {
+		return err
+	}
+
+	comment, err := db.getComment(mid, commentId)
+	if err != nil {
+		return err
+	}
+	if comment.SenderId != user.UId {
+		return ErrForbidden
+	}
+
+	_, err = db.c.Exec("DELETE FROM comments WHERE id = ?", commentId)
+	return err
+}
+
+// ListComments returns up to `limit` comments of the message `mid`, oldest first. If `after` is the ID of a comment of
+// the same message, only comments that come after it are returned. The comments of a message deleted for everyone are
+// kept with its tombstone.
+func (db *appdbimpl) ListComments(cid string, user User, mid string, after string, limit int) ([]Comment, error) {
+	if err := db.checkMessageReadAccess(cid, user, mid); err != nil {
+		return nil, err
+	}
+
+	// Comments are sorted by (timestamp, id), so the cursor is the position of the `after` comment in that order
+	var afterTimestamp sql.NullString
+	if after != "" {
+		err := db.c.QueryRow("SELECT COALESCE(timestamp, '') FROM comments WHERE id = ? AND message_id = ?", after, mid).
+			Scan(&afterTimestamp)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := db.c.Query(`
+		SELECT c.id, c.message_id, c.sender_id, u.username, COALESCE(u.picture, ''), c.comment, COALESCE(c.timestamp, '')
+		FROM comments c
+		JOIN users u ON c.sender_id = u.id
+		WHERE c.message_id = ?
+		AND (? IS NULL OR COALESCE(c.timestamp, '') > ? OR (COALESCE(c.timestamp, '') = ? AND c.id > ?))
+		ORDER BY COALESCE(c.timestamp, ''), c.id
+		LIMIT ?`, mid, afterTimestamp, afterTimestamp, afterTimestamp, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := make([]Comment, 0)
+	for rows.Next() {
+		var c Comment
+		var timestamp string
+		if scanErr := rows.Scan(&c.Id, &c.MessageId, &c.SenderId, &c.SenderUsername, &c.SenderPicture, &c.Text,
+			&timestamp); scanErr != nil {
+			return nil, scanErr
+		}
+		c.Time = formatTimestamp(timestamp)
+		comments = append(comments, c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return comments, nil
+}
+
+// getComment returns the comment `commentId` of the message `mid`
+func (db *appdbimpl) getComment(mid string, commentId string) (Comment, error) {
+	var c Comment
+	var timestamp string
+	err := db.c.QueryRow(`
+		SELECT c.id, c.message_id, c.sender_id, u.username, COALESCE(u.picture, ''), c.comment, COALESCE(c.timestamp, '')
+		FROM comments c
+		JOIN users u ON c.sender_id = u.id
+		WHERE c.id = ? AND c.message_id = ?`, commentId, mid).Scan(&c.Id, &c.MessageId, &c.SenderId,
+		&c.SenderUsername, &c.SenderPicture, &c.Text, &timestamp)
+	if err != nil {
+		return Comment{}, err
+	}
+	c.Time = formatTimestamp(timestamp)
+	return c, nil
+}
+
+// formatTimestamp converts a SQLite timestamp to RFC 3339. Comments created before the timestamp column existed
+// have no time, so an empty string is returned for them.
+func formatTimestamp(timestamp string) string {
+	t, err := time.Parse("2006-01-02 15:04:05", timestamp)
+	if err != nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
@@ -23,7 +23,7 @@ func (db *appdbimpl) AddContact(user User, contact User) (User, error) {
 
 func (db *appdbimpl) ListContacts(user User) ([]User, error) {
 	rows, err := db.c.Query(`
-		SELECT u.id, u.username, u.picture 
+		SELECT u.id, u.username, u.picture, u.is_bot
 		FROM users u 
 		JOIN contacts c ON u.id = c.contact_id 
 		WHERE c.user_id = ?`, user.UId)
@@ -36,7 +36,7 @@ func (db *appdbimpl) ListContacts(user User) ([]User, error) {
 	for rows.Next() {
 		var contact User
 		var picture sql.NullString
-		if scanErr := rows.Scan(&contact.UId, &contact.Username, &picture); scanErr != nil {
+		if scanErr := rows.Scan(&contact.UId, &contact.Username, &picture, &contact.IsBot); scanErr != nil {
 			return nil, scanErr
 		}
 		// Handle NULL picture values
@@ -19,7 +19,7 @@ var demoAvatars = []string{
 	"https://randomuser.me/api/portraits/men/5.jpg",
 }
 
-func (db *appdbimpl) CreateConversation(participants []User, name string) (Conversation, error) {
+func (db *appdbimpl) CreateConversation(owner User, participants []User, name string) (Conversation, error) {
 	id, err := uuid.NewV4()
 	if err != nil {
 		return Conversation{}, err
@@ -48,13 +48,13 @@ func (db *appdbimpl) CreateConversation(participants []User, name string) (Conve
 		return Conversation{}, err
 	}
 
-	_, err = db.c.Exec("INSERT INTO conversations (id, participants, name, picture) VALUES (?, ?, ?, ?)",
-		id.String(), string(participantsJSON), conversationName, avatar)
+	_, err = db.c.Exec("INSERT INTO conversations (id, participants, name, picture, owner_id) VALUES (?, ?, ?, ?, ?)",
+		id.String(), string(participantsJSON), conversationName, avatar, owner.UId)
 	if err != nil {
 		return Conversation{}, err
 	}
 
-	return Conversation{CId: id.String(), Participants: participants, Name: conversationName, Picture: avatar}, nil
+	return Conversation{CId: id.String(), Participants: participants, Name: conversationName, Picture: avatar, OwnerId: owner.UId}, nil
 }
 
 func (db *appdbimpl) GetMyConversations(user User) ([]Conversation, error) {
@@ -65,21 +65,31 @@ func (db *appdbimpl) GetMyConversations(user User) ([]Conversation, error) {
 			c.participants, 
 			c.name, 
 			c.picture,
+			COALESCE(c.message_ttl, 0),
 			m.id as last_msg_id,
 			m.sender_id as last_msg_sender_id,
-			m.message as last_msg_text,
-			COALESCE(m.image_url, '') as last_msg_image_url,
+			`+messageTextSQL+` as last_msg_text,
+			`+messageImageSQL+` as last_msg_image_url,
+			CAST(m.deleted_at AS TEXT) as last_msg_deleted_at,
 			u.username as last_msg_sender_username,
-			CAST((julianday(m.timestamp) - 2440587.5) * 86400000 AS INTEGER) as last_msg_time
+			CAST((julianday(m.timestamp) - 2440587.5) * 86400000 AS INTEGER) as last_msg_time,
+			COALESCE(m.timestamp <= s.cleared_at, 0) as last_msg_cleared,
+			d.text as draft_text,
+			d.reply_to_message_id as draft_reply_to,
+			CAST(d.updated_at AS TEXT) as draft_updated_at
 		FROM conversations c
 		LEFT JOIN (
-			SELECT conversation_id, MAX(timestamp) as max_timestamp
-			FROM messages 
-			GROUP BY conversation_id
+			SELECT m.conversation_id, MAX(m.timestamp) as max_timestamp
+			FROM messages m
+			WHERE `+unexpiredSQL+` AND `+notHiddenSQL+`
+			GROUP BY m.conversation_id
 		) latest ON c.id = latest.conversation_id
 		LEFT JOIN messages m ON latest.conversation_id = m.conversation_id AND latest.max_timestamp = m.timestamp
+			AND `+unexpiredSQL+` AND `+notHiddenSQL+`
 		LEFT JOIN users u ON m.sender_id = u.id
-		ORDER BY (m.timestamp IS NULL), m.timestamp DESC`)
+		LEFT JOIN conversation_user_state s ON s.conversation_id = c.id AND s.user_id = ?
+		LEFT JOIN conversation_drafts d ON d.conversation_id = c.id AND d.user_id = ?
+		ORDER BY (m.timestamp IS NULL), m.timestamp DESC`, user.UId, user.UId, user.UId, user.UId)
 
 	if err != nil {
 		return nil, err
@@ -96,14 +106,27 @@ func (db *appdbimpl) GetMyConversations(user User) ([]Conversation, error) {
 		var lastMsgSenderId sql.NullString
 		var lastMsgText sql.NullString
 		var lastMsgImageUrl sql.NullString
+		var lastMsgDeletedAt sql.NullString
 		var lastMsgSenderUsername sql.NullString
 		var lastMsgTime sql.NullInt64
+		var lastMsgCleared bool
+		var draftText, draftReplyTo, draftUpdatedAt sql.NullString
 
-		if scanErr := rows.Scan(&conv.CId, &participantsJSON, &name, &picture,
-			&lastMsgId, &lastMsgSenderId, &lastMsgText, &lastMsgImageUrl, &lastMsgSenderUsername, &lastMsgTime); scanErr != nil {
+		if scanErr := rows.Scan(&conv.CId, &participantsJSON, &name, &picture, &conv.MessageTTL,
+			&lastMsgId, &lastMsgSenderId, &lastMsgText, &lastMsgImageUrl, &lastMsgDeletedAt, &lastMsgSenderUsername, &lastMsgTime,
+			&lastMsgCleared, &draftText, &draftReplyTo, &draftUpdatedAt); scanErr != nil {
 			return nil, scanErr
 		}
 
+		// Cleared drafts are kept to order later edits, but there is nothing to show
+		if draftText.String != "" || draftReplyTo.Valid {
+			conv.Draft = &Draft{
+				Text:             draftText.String,
+				ReplyToMessageId: draftReplyTo.String,
+				UpdatedAt:        formatDraftTime(draftUpdatedAt.String),
+			}
+		}
+
 		if name.Valid {
 			conv.Name = name.String
 		} else {
@@ -146,7 +169,7 @@ func (db *appdbimpl) GetMyConversations(user User) ([]Conversation, error) {
 			for _, uid := range participantIDs {
 				var u User
 				var upic sql.NullString
-				if qErr := db.c.QueryRow("SELECT id, username, picture FROM users WHERE id = ?", uid).Scan(&u.UId, &u.Username, &upic); qErr != nil {
+				if qErr := db.c.QueryRow("SELECT id, username, picture, is_bot FROM users WHERE id = ?", uid).Scan(&u.UId, &u.Username, &upic, &u.IsBot); qErr != nil {
 					return nil, qErr
 				}
 				if upic.Valid {
@@ -156,8 +179,8 @@ func (db *appdbimpl) GetMyConversations(user User) ([]Conversation, error) {
 			}
 			conv.Participants = participants
 
-			// Add last message information if available
-			if lastMsgId.Valid {
+			// Add last message information if available and not hidden by a history clear
+			if lastMsgId.Valid && !lastMsgCleared {
 				conv.LastMessage = &Message{
 					Id:             lastMsgId.String,
 					SenderId:       lastMsgSenderId.String,
@@ -165,6 +188,9 @@ func (db *appdbimpl) GetMyConversations(user User) ([]Conversation, error) {
 					ImageUrl:       lastMsgImageUrl.String,
 					SenderUsername: lastMsgSenderUsername.String,
 				}
+				if lastMsgDeletedAt.Valid {
+					conv.LastMessage.DeletedAt = formatTimestamp(lastMsgDeletedAt.String)
+				}
 				if lastMsgTime.Valid {
 					conv.LastMessageTime = fmt.Sprintf("%d", lastMsgTime.Int64)
 				}
@@ -190,11 +216,13 @@ func (db *appdbimpl) GetMyConversations(user User) ([]Conversation, error) {
 func (db *appdbimpl) GetConversation(cid string) (Conversation, error) {
 	var conv Conversation
 	var participantsJSON string
-	err := db.c.QueryRow("SELECT id, participants FROM conversations WHERE id = ?", cid).
-		Scan(&conv.CId, &participantsJSON)
+	var ownerId sql.NullString
+	err := db.c.QueryRow("SELECT id, participants, owner_id, COALESCE(message_ttl, 0) FROM conversations WHERE id = ?", cid).
+		Scan(&conv.CId, &participantsJSON, &ownerId, &conv.MessageTTL)
 	if err != nil {
 		return Conversation{}, err
 	}
+	conv.OwnerId = ownerId.String
 
 	var participantIDs []string
 
@@ -216,7 +244,7 @@ func (db *appdbimpl) GetConversation(cid string) (Conversation, error) {
 	for _, uid := range participantIDs {
 		var user User
 		var picture sql.NullString
-		err := db.c.QueryRow("SELECT id, username, picture FROM users WHERE id = ?", uid).Scan(&user.UId, &user.Username, &picture)
+		err := db.c.QueryRow("SELECT id, username, picture, is_bot FROM users WHERE id = ?", uid).Scan(&user.UId, &user.Username, &picture, &user.IsBot)
 		if err != nil {
 			return Conversation{}, err
 		}
@@ -228,6 +256,23 @@ func (db *appdbimpl) GetConversation(cid string) (Conversation, error) {
 		participants = append(participants, user)
 	}
 	conv.Participants = participants
+
+	err = db.c.QueryRow(`
+		SELECT COUNT(*) FROM pinned_messages p
+		JOIN messages m ON m.id = p.message_id
+		WHERE p.conversation_id = ? AND `+unexpiredSQL, cid).Scan(&conv.PinCount)
+	if err != nil {
+		return Conversation{}, err
+	}
+	if conv.PinCount > 0 {
+		pins, err := db.getPins(cid, 1)
+		if err != nil {
+			return Conversation{}, err
+		}
+		if len(pins) > 0 {
+			conv.LastPin = &pins[0]
+		}
+	}
 	return conv, nil
 }
 
@@ -300,10 +345,30 @@ func (db *appdbimpl) LeaveGroup(cid string, user User) (Conversation, error) {
 		}
 	}
 	newJSON, _ := json.Marshal(newIDs)
-	_, err = db.c.Exec("UPDATE conversations SET participants = ? WHERE id = ?", string(newJSON), cid)
+
+	tx, err := db.c.Begin()
+	if err != nil {
+		return Conversation{}, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	_, err = tx.Exec("UPDATE conversations SET participants = ? WHERE id = ?", string(newJSON), cid)
 	if err != nil {
 		return Conversation{}, err
 	}
+	// Stars and drafts are personal, and about messages the user can no longer see
+	_, err = tx.Exec("DELETE FROM starred_messages WHERE user_id = ? AND conversation_id = ?", user.UId, cid)
+	if err != nil {
+		return Conversation{}, err
+	}
+	_, err = tx.Exec("DELETE FROM conversation_drafts WHERE user_id = ? AND conversation_id = ?", user.UId, cid)
+	if err != nil {
+		return Conversation{}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return Conversation{}, err
+	}
 	return db.GetConversation(cid)
 }
 
@@ -321,17 +386,22 @@ func (db *appdbimpl) SetGroupPhoto(cid string, picture string) (Conversation, er
 }
 
 func (db *appdbimpl) GetUnreadCount(conversationId string, userId string) (int, error) {
+	// A message is unread if the user has no read_status row for it. Messages hidden by a
+	// history clear or deleted are not counted.
 	var count int
 	err := db.c.QueryRow(`
 		SELECT COUNT(*) 
-		FROM messages 
-		WHERE conversation_id = ? 
-		AND sender_id != ? 
-		AND timestamp > COALESCE(
-			(SELECT last_read_timestamp FROM conversation_participants 
-			 WHERE conversation_id = ? AND user_id = ?), 
-			'1970-01-01 00:00:00'
-		)`, conversationId, userId, conversationId, userId).Scan(&count)
+		FROM messages m
+		LEFT JOIN conversation_user_state s ON s.conversation_id = m.conversation_id AND s.user_id = ?
+		WHERE m.conversation_id = ? 
+		AND m.sender_id != ? 
+		AND (s.cleared_at IS NULL OR m.timestamp > s.cleared_at)
+		AND `+unexpiredSQL+`
+		AND m.deleted_at IS NULL
+		AND `+notHiddenSQL+`
+		AND NOT EXISTS (
+			SELECT 1 FROM read_status r WHERE r.message_id = m.id AND r.user_id = ?
+		)`, userId, conversationId, userId, userId, userId).Scan(&count)
 
 	if err != nil {
 		return 0, err
@@ -339,3 +409,123 @@ func (db *appdbimpl) GetUnreadCount(conversationId string, userId string) (int,
 
 	return count, nil
 }
+
+// participantSQL is a SQL condition that is true if the user bound to its parameter is a participant of the
+// conversation aliased as `c`. Like parseParticipantIDs, it understands both formats of the participants column.
+const participantSQL = `EXISTS (
+	SELECT 1 FROM json_each(c.participants) p
+	WHERE (CASE p.type WHEN 'object' THEN json_extract(p.value, '$.id') ELSE p.value END) = ?
+)`
+
+// parseParticipantIDs decodes the participants column, accepting both the current format (array of user IDs) and
+// the old one (array of User objects)
+func parseParticipantIDs(participantsJSON string) ([]string, error) {
+	var participantIDs []string
+	if err := json.Unmarshal([]byte(participantsJSON), &participantIDs); err == nil {
+		return participantIDs, nil
+	}
+
+	var participantObjects []User
+	if err := json.Unmarshal([]byte(participantsJSON), &participantObjects); err != nil {
+		return nil, err
+	}
+	for _, participant := range participantObjects {
+		participantIDs = append(participantIDs, participant.UId)
+	}
+	return participantIDs, nil
+}
+
+// IsParticipant returns true if the user `uid` is a participant of the conversation `cid`. It returns sql.ErrNoRows
+// if the conversation does not exist.
+func (db *appdbimpl) IsParticipant(cid string, uid string) (bool, error) {
+	var participantsJSON string
+	err := db.c.QueryRow("SELECT participants FROM conversations WHERE id = ?", cid).Scan(&participantsJSON)
+	if err != nil {
+		return false, err
+	}
+
+	participantIDs, err := parseParticipantIDs(participantsJSON)
+	if err != nil {
+		return false, err
+	}
+	for _, pid := range participantIDs {
+		if pid == uid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ClearConversationHistory hides every message sent so far in the conversation from the given user only. Other
+// participants are not affected, and new messages are shown as usual.
+func (db *appdbimpl) ClearConversationHistory(cid string, user User) error {
+	ok, err := db.IsParticipant(cid, user.UId)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotParticipant
+	}
+
+	_, err = db.c.Exec(`
+		INSERT INTO conversation_user_state (conversation_id, user_id, cleared_at)
+		VALUES (?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(conversation_id, user_id) DO UPDATE SET cleared_at = excluded.cleared_at`,
+		cid, user.UId)
+	return err
+}
+
+// DeleteConversation deletes the conversation for everyone, together with its messages, reactions, comments and
+// read receipts. Only the owner of the conversation can delete it.
+func (db *appdbimpl) DeleteConversation(cid string, user User) error {
+	var ownerId sql.NullString
+	err := db.c.QueryRow("SELECT owner_id FROM conversations WHERE id = ?", cid).Scan(&ownerId)
+	if err != nil {
+		return err
+	}
+	if !ownerId.Valid || ownerId.String != user.UId {
+		return ErrForbidden
+	}
+
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Foreign keys would cascade these, but we don't rely on them being enabled on every connection. Images are
+	// stored inline in the messages rows, so removing the rows also frees them.
+	cleanup := []string{
+		"DELETE FROM read_status WHERE message_id IN (SELECT id FROM messages WHERE conversation_id = ?)",
+		"DELETE FROM reactions WHERE message_id IN (SELECT id FROM messages WHERE conversation_id = ?)",
+		"DELETE FROM comments WHERE message_id IN (SELECT id FROM messages WHERE conversation_id = ?)",
+		"DELETE FROM message_mentions WHERE message_id IN (SELECT id FROM messages WHERE conversation_id = ?)",
+		"DELETE FROM poll_votes WHERE message_id IN (SELECT id FROM messages WHERE conversation_id = ?)",
+		"DELETE FROM poll_options WHERE message_id IN (SELECT id FROM messages WHERE conversation_id = ?)",
+		"DELETE FROM polls WHERE message_id IN (SELECT id FROM messages WHERE conversation_id = ?)",
+		"DELETE FROM pinned_messages WHERE conversation_id = ?",
+		"DELETE FROM link_previews WHERE message_id IN (SELECT id FROM messages WHERE conversation_id = ?)",
+		"DELETE FROM starred_messages WHERE conversation_id = ?",
+		"DELETE FROM hidden_messages WHERE conversation_id = ?",
+		"DELETE FROM conversation_drafts WHERE conversation_id = ?",
+		"DELETE FROM scheduled_messages WHERE conversation_id = ?",
+		"DELETE FROM message_client_keys WHERE conversation_id = ?",
+		"DELETE FROM webhook_deliveries WHERE webhook_id IN (SELECT id FROM webhooks WHERE conversation_id = ?)",
+		"DELETE FROM webhooks WHERE conversation_id = ?",
+		// The logged events of the conversation would replay its messages to the members that reconnect. The log is
+		// by user, so it is scanned; it holds a bounded number of events per user. conversation_updated has the keys of
+		// the Conversation model, so its conversation is in `id`.
+		`DELETE FROM user_events WHERE json_extract(payload, '$.conversationId') = ?1
+			OR (type = 'conversation_updated' AND json_extract(payload, '$.id') = ?1)`,
+		"DELETE FROM messages WHERE conversation_id = ?",
+		"DELETE FROM conversation_user_state WHERE conversation_id = ?",
+		"DELETE FROM conversations WHERE id = ?",
+	}
+	for _, query := range cleanup {
+		if _, err := tx.Exec(query, cid); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
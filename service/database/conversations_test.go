@@ -0,0 +1,104 @@
+package database_test
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var (
+	alice = database.User{UId: "f2555a8a-2e66-4326-9588-20e7e298d615", Username: "Alice"}
+	bob   = database.User{UId: "7b8f3c2a-4d1e-4c37-9b6a-12a34bcdef01", Username: "Bob"}
+)
+
+// openTestDB opens a new database file, closed at the end of the test
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	conn, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db")+"?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func TestDeleteConversationOwnedBeforeUpgrade(t *testing.T) {
+	conn := openTestDB(t)
+	db, err := database.New(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Conversations created before they had owners, with the participants stored as IDs and as user objects
+	conv, err := db.CreateConversation(alice, []database.User{alice, bob}, "group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Exec("UPDATE conversations SET owner_id = NULL WHERE id = ?", conv.CId); err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Exec(`INSERT INTO conversations (id, participants, name) VALUES ('old-format', ?, 'old group')`,
+		`[{"id":"`+bob.UId+`","username":"Bob"},{"id":"`+alice.UId+`","username":"Alice"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The upgrade gives them their first participant as owner
+	db, err = database.New(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		cid          string
+		owner, other database.User
+	}{
+		{conv.CId, alice, bob},
+		{"old-format", bob, alice},
+	} {
+		if err := db.DeleteConversation(tt.cid, tt.other); !errors.Is(err, database.ErrForbidden) {
+			t.Errorf("%s: deleted by %s: got %v, want %v", tt.cid, tt.other.Username, err, database.ErrForbidden)
+		}
+		if err := db.DeleteConversation(tt.cid, tt.owner); err != nil {
+			t.Errorf("%s: deleted by its first participant %s: %v", tt.cid, tt.owner.Username, err)
+		}
+	}
+}
+
+func TestDeleteConversationEvents(t *testing.T) {
+	db, err := database.New(openTestDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conv, err := db.CreateConversation(alice, []database.User{alice, bob}, "group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := db.CreateConversation(alice, []database.User{alice, bob}, "other group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range []database.UserEvent{
+		{Type: "message", Version: 1, Payload: `{"conversationId":"` + conv.CId + `","id":"m1"}`},
+		{Type: "conversation_updated", Version: 1, Payload: `{"id":"` + conv.CId + `","name":"renamed"}`},
+		{Type: "conversation_updated", Version: 1, Payload: `{"id":"` + other.CId + `","name":"renamed"}`},
+	} {
+		if _, err := db.AppendUserEvents([]string{bob.UId}, event, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.DeleteConversation(conv.CId, alice); err != nil {
+		t.Fatal(err)
+	}
+	events, err := db.ListUserEvents(bob.UId, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Payload != `{"id":"`+other.CId+`","name":"renamed"}` {
+		t.Errorf("the events left are %+v, want only the one of the other conversation", events)
+	}
+}
@@ -36,12 +36,123 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"time"
 )
 
 type User struct {
 	UId      string `json:"id"`
 	Username string `json:"username"`
 	Picture  string `json:"picture,omitempty"`
+	// IsBot is true for the accounts of bots, which act through API tokens and cannot log in
+	IsBot bool `json:"isBot,omitempty"`
+}
+
+// APIToken is a token for scripts and bots. It acts as the user UserId, but only within its scopes and, if any are
+// listed, its conversations.
+type APIToken struct {
+	Id            string   `json:"id"`
+	UserId        string   `json:"userId"`
+	CreatedBy     string   `json:"-"`
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	Conversations []string `json:"conversations"`
+	CreatedAt     string   `json:"createdAt"`
+	LastUsedAt    string   `json:"lastUsedAt,omitempty"`
+}
+
+// Webhook sends the events of a conversation to a URL. Secret signs the deliveries; it is only shown when the webhook
+// is created.
+type Webhook struct {
+	Id                  string   `json:"id"`
+	ConversationId      string   `json:"conversationId"`
+	CreatedBy           string   `json:"createdBy"`
+	URL                 string   `json:"url"`
+	Secret              string   `json:"-"`
+	Events              []string `json:"events"`
+	Enabled             bool     `json:"enabled"`
+	ConsecutiveFailures int      `json:"consecutiveFailures"`
+	DisabledReason      string   `json:"disabledReason,omitempty"`
+	CreatedAt           string   `json:"createdAt"`
+}
+
+// Statuses of a webhook delivery
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliverySucceeded = "succeeded"
+	WebhookDeliveryFailed    = "failed"
+)
+
+// WebhookDelivery is an event sent, or to be sent, to a webhook. Payload is the JSON data of the event.
+type WebhookDelivery struct {
+	Id             string `json:"id"`
+	WebhookId      string `json:"webhookId"`
+	Event          string `json:"event"`
+	Payload        string `json:"-"`
+	Status         string `json:"status"`
+	Attempts       int    `json:"attempts"`
+	NextAttemptAt  string `json:"nextAttemptAt,omitempty"`
+	LastStatusCode int    `json:"lastStatusCode,omitempty"`
+	LastError      string `json:"lastError,omitempty"`
+	CreatedAt      string `json:"createdAt"`
+	DeliveredAt    string `json:"deliveredAt,omitempty"`
+}
+
+// DueWebhookDelivery is a pending delivery with the webhook it goes to
+type DueWebhookDelivery struct {
+	Delivery WebhookDelivery
+	Webhook  Webhook
+}
+
+// UserEvent is an event sent to a user, kept in their event log so that clients that missed it can get it again. Seq
+// grows by one with each event of the user.
+type UserEvent struct {
+	Seq       int64
+	Type      string
+	Version   int
+	Payload   string
+	CreatedAt string
+}
+
+// WebhookAttempt is the outcome of an attempt to deliver an event to a webhook
+type WebhookAttempt struct {
+	DeliveryId string
+	WebhookId  string
+	StatusCode int
+	Error      string
+	Succeeded  bool
+
+	// RetryAt is when to try again after a failure; zero gives up on the delivery
+	RetryAt time.Time
+
+	// DisableAfter is how many failed attempts in a row disable the webhook
+	DisableAfter int
+}
+
+// Session is a login of a user on a device. Its token is only known to the device; the database keeps a hash.
+type Session struct {
+	Id           string `json:"id"`
+	UserId       string `json:"-"`
+	UserAgent    string `json:"userAgent"`
+	RemoteAddr   string `json:"remoteAddr"`
+	CreatedAt    string `json:"createdAt"`
+	LastActiveAt string `json:"lastActiveAt"`
+}
+
+// LoginEvent is an attempt to log in, recorded for auditing and to rate limit failures
+type LoginEvent struct {
+	// UserId is empty when the username does not exist
+	UserId     string
+	Username   string
+	Success    bool
+	RemoteAddr string
+	UserAgent  string
+}
+
+// Identity is an account at an OpenID Connect provider, identified by the provider URL and the subject it assigned
+type Identity struct {
+	Issuer  string
+	Subject string
+	Email   string
 }
 
 type LogEntry struct {
@@ -52,52 +163,258 @@ type LogEntry struct {
 }
 
 type Message struct {
-	Id             string                 `json:"id"`
-	SenderId       string                 `json:"senderId"`
-	Text           string                 `json:"text"`
-	ImageUrl       string                 `json:"imageUrl,omitempty"`
-	SenderUsername string                 `json:"senderUsername"`
-	Time           string                 `json:"time,omitempty"`
-	Comments       map[string]interface{} `json:"comments,omitempty"`
-	IsRead         bool                   `json:"isRead,omitempty"`
-	ReadBy         []string               `json:"readBy,omitempty"`
+	Id             string              `json:"id"`
+	SenderId       string              `json:"senderId"`
+	Text           string              `json:"text"`
+	ImageUrl       string              `json:"imageUrl,omitempty"`
+	SenderUsername string              `json:"senderUsername"`
+	Time           string              `json:"time,omitempty"`
+	Reactions      map[string]Reaction `json:"reactions,omitempty"`
+	CommentCount   int                 `json:"commentCount,omitempty"`
+	IsRead         bool                `json:"isRead,omitempty"`
+	ReadBy         []string            `json:"readBy,omitempty"`
+	ForwardedFrom  *ForwardedFrom      `json:"forwardedFrom,omitempty"`
+	Mentions       []string            `json:"mentions,omitempty"`
+	Poll           *Poll               `json:"poll,omitempty"`
+	LinkPreview    *LinkPreview        `json:"linkPreview,omitempty"`
+	Starred        bool                `json:"starred,omitempty"`
+	DeletedAt      string              `json:"deletedAt,omitempty"`
+}
+
+// LinkPreview is the metadata of the first link in a message, fetched after the message was sent
+type LinkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	ImageURL    string `json:"imageUrl,omitempty"`
+	SiteName    string `json:"siteName,omitempty"`
+}
+
+// Poll is a message asking the participants to vote on a question. Options are identified by their index.
+type Poll struct {
+	Question       string       `json:"question"`
+	Options        []PollOption `json:"options"`
+	MultipleChoice bool         `json:"multipleChoice"`
+	Anonymous      bool         `json:"anonymous"`
+	ClosesAt       string       `json:"closesAt,omitempty"`
+	Closed         bool         `json:"closed"`
+	VoterCount     int          `json:"voterCount"`
+	MyVotes        []int        `json:"myVotes,omitempty"`
+}
+
+// PollOption is an answer of a poll with its tally. VoterIds is empty for anonymous polls.
+type PollOption struct {
+	Text     string   `json:"text"`
+	Votes    int      `json:"votes"`
+	VoterIds []string `json:"voterIds,omitempty"`
+}
+
+// Mention is a message that mentions a user, together with the conversation it was sent in
+type Mention struct {
+	ConversationId   string  `json:"conversationId"`
+	ConversationName string  `json:"conversationName"`
+	Message          Message `json:"message"`
+}
+
+// StarredMessage is a message bookmarked by a user, together with the conversation it was sent in
+type StarredMessage struct {
+	ConversationId   string  `json:"conversationId"`
+	ConversationName string  `json:"conversationName"`
+	StarredAt        string  `json:"starredAt"`
+	Message          Message `json:"message"`
+}
+
+// ForwardedFrom references the original message a forwarded message was copied from
+type ForwardedFrom struct {
+	MessageId      string `json:"messageId"`
+	SenderId       string `json:"senderId"`
+	SenderUsername string `json:"senderUsername,omitempty"`
+}
+
+// Reaction summarizes the reactions to a message with a single emoji
+type Reaction struct {
+	Count   int      `json:"count"`
+	UserIds []string `json:"userIds"`
+}
+
+// Comment is a threaded reply to a message
+type Comment struct {
+	Id             string `json:"id"`
+	MessageId      string `json:"messageId"`
+	SenderId       string `json:"senderId"`
+	SenderUsername string `json:"senderUsername"`
+	SenderPicture  string `json:"senderPicture,omitempty"`
+	Text           string `json:"text"`
+	Time           string `json:"time"`
+}
+
+// ScheduledMessage is a message queued to be sent to a conversation at a later time
+type ScheduledMessage struct {
+	Id             string `json:"id"`
+	ConversationId string `json:"conversationId"`
+	SenderId       string `json:"senderId"`
+	Text           string `json:"text"`
+	ImageUrl       string `json:"imageUrl,omitempty"`
+	SendAt         string `json:"sendAt"`
+}
+
+// Pin is a message pinned in a conversation
+type Pin struct {
+	PinnedBy         string  `json:"pinnedBy"`
+	PinnedByUsername string  `json:"pinnedByUsername,omitempty"`
+	PinnedAt         string  `json:"pinnedAt"`
+	Message          Message `json:"message"`
 }
 
 type Conversation struct {
 	CId             string   `json:"id"`
 	Name            string   `json:"name"`
 	Picture         string   `json:"picture"`
+	OwnerId         string   `json:"ownerId,omitempty"`
 	Participants    []User   `json:"participants"`
 	LastMessage     *Message `json:"lastMessage,omitempty"`
 	LastMessageTime string   `json:"lastMessageTime,omitempty"`
 	UnreadCount     int      `json:"unreadCount,omitempty"`
+	PinCount        int      `json:"pinCount,omitempty"`
+	LastPin         *Pin     `json:"lastPin,omitempty"`
+	MessageTTL      int      `json:"messageTtl,omitempty"`
+	Draft           *Draft   `json:"draft,omitempty"`
+}
+
+// Draft is the text a user is writing in a conversation and has not sent yet. UpdatedAt orders the edits made in
+// different sessions.
+type Draft struct {
+	Text             string `json:"text"`
+	ReplyToMessageId string `json:"replyToMessageId,omitempty"`
+	UpdatedAt        string `json:"updatedAt"`
 }
 
+// ErrNotParticipant is returned when a user acts on a conversation they are not part of
+var ErrNotParticipant = errors.New("user is not a participant of the conversation")
+
+// ErrUsernameTaken is returned when registering a username that another user already has
+var ErrUsernameTaken = errors.New("username already taken")
+
+// ErrIdentityLinked is returned when linking an identity that is already linked to another user
+var ErrIdentityLinked = errors.New("identity already linked to another user")
+
+// ErrForbidden is returned when a user is not allowed to perform the requested operation
+var ErrForbidden = errors.New("operation not allowed")
+
+// ErrReactionLimit is returned when a message already has the maximum number of distinct reactions
+var ErrReactionLimit = errors.New("too many distinct reactions on the message")
+
+// ErrDeleteWindowExpired is returned when a message is too old to be deleted for everyone
+var ErrDeleteWindowExpired = errors.New("the message can no longer be deleted for everyone")
+
+// ErrInvalidReplyTarget is returned when a draft replies to a message that is not in its conversation
+var ErrInvalidReplyTarget = errors.New("the reply target is not a message of the conversation")
+
+// ErrPollClosed is returned when voting on a poll that is closed
+var ErrPollClosed = errors.New("the poll is closed")
+
+// ErrInvalidVote is returned when a vote names options that are not in the poll, or more than one option of a single
+// choice poll
+var ErrInvalidVote = errors.New("invalid options for the poll")
+
 // AppDatabase is the high level interface for the DB
 type AppDatabase interface {
 	Ping() error
-	DoLogin(user User)
+	DoLogin(event LoginEvent) error
+	CountLoginFailures(name string, remoteAddr string, since time.Time) (int, int, error)
 	GetUserByID(userID string) (User, error)
+	GetUserByName(name string) (User, error)
+	CreateUser(name string, passwordHash string) (User, error)
+	GetPasswordHash(uid string) (string, error)
+	SetPasswordHash(uid string, passwordHash string) error
+	CreatePasswordReset(uid string, tokenHash string, expiresAt time.Time) error
+	UsePasswordReset(tokenHash string) (string, error)
+	GetUserByIdentity(issuer string, subject string) (User, error)
+	CreateUserWithIdentity(name string, identity Identity) (User, error)
+	LinkIdentity(uid string, identity Identity) error
+	HasIdentity(uid string) (bool, error)
+	CreateSession(uid string, tokenHash string, userAgent string, remoteAddr string) (Session, error)
+	GetSessionByToken(tokenHash string) (Session, User, error)
+	TouchSession(sid string, remoteAddr string, before time.Time) error
+	ListSessions(uid string) ([]Session, error)
+	DeleteSession(uid string, sid string) (bool, error)
+	DeleteSessions(uid string) (int, error)
+	CreateBot(owner string, name string) (User, error)
+	ListBots(owner string) ([]User, error)
+	CreateAPIToken(token APIToken, tokenHash string) (APIToken, error)
+	GetAPITokenByHash(tokenHash string) (APIToken, User, error)
+	TouchAPIToken(id string, before time.Time) error
+	ListAPITokens(createdBy string) ([]APIToken, error)
+	DeleteAPIToken(createdBy string, id string) (bool, error)
+	CreateWebhook(webhook Webhook) (Webhook, error)
+	GetWebhook(cid string, id string) (Webhook, error)
+	ListWebhooks(cid string) ([]Webhook, error)
+	SetWebhookEnabled(cid string, id string, enabled bool) (Webhook, error)
+	DeleteWebhook(cid string, id string) (bool, error)
+	EnqueueWebhookEvent(cid string, event string, payload string) (int, error)
+	GetDueWebhookDeliveries(now time.Time, limit int) ([]DueWebhookDelivery, error)
+	NextWebhookDeliveryTime() (time.Time, bool, error)
+	RecordWebhookAttempt(attempt WebhookAttempt) (bool, error)
+	ListWebhookDeliveries(webhookId string, limit int) ([]WebhookDelivery, error)
+	AppendUserEvents(uids []string, event UserEvent, keep int) (map[string]int64, error)
+	GetUserEventRange(uid string) (int64, int64, error)
+	ListUserEvents(uid string, after int64, upTo int64) ([]UserEvent, error)
 	ListUsers(username string) ([]User, error)
 	SetMyUserName(username string) (User, error)
 	SetMyPhoto(picture string) (User, error)
-	CreateConversation(participants []User, name string) (Conversation, error)
+	CreateConversation(owner User, participants []User, name string) (Conversation, error)
 	GetMyConversations(user User) ([]Conversation, error)
 	GetConversation(cid string) (Conversation, error)
+	IsParticipant(cid string, uid string) (bool, error)
+	ClearConversationHistory(cid string, user User) error
+	DeleteConversation(cid string, user User) error
 	AddToGroup(cid string, user User) (Conversation, error)
 	LeaveGroup(cid string, user User) (Conversation, error)
 	SetGroupName(cid string, name string) (Conversation, error)
 	SetGroupPhoto(cid string, picture string) (Conversation, error)
 	SendMessage(cid string, user User, message string) (Conversation, error)
 	SendMessageWithImage(cid string, user User, message string, imageUrl string) (Conversation, error)
-	GetConversationMessages(cid string) ([]Message, error)
-	DeleteMessage(cid string, user User, mid string) (Conversation, error)
-	ForwardMessage(cid string, user User, mid string) (Conversation, error)
-	ReactToMessage(cid string, user User, mid string, emoji string) (Conversation, error)
-	RemoveReaction(cid string, user User, mid string, emoji string) (Conversation, error)
-	CommentMessage(cid string, user User, mid string, comment string) (Conversation, error)
-	UncommentMessage(cid string, user User, mid string, commentId string) (Conversation, error)
+	CreateMessage(cid string, user User, text string, imageUrl string, clientKey string, keyWindow time.Duration) (Message, bool, error)
+	CreatePollMessage(cid string, user User, poll Poll, closesAt *time.Time, clientKey string, keyWindow time.Duration) (Message, bool, error)
+	VotePoll(cid string, user User, mid string, options []int) (*Poll, error)
+	RetractVote(cid string, user User, mid string) (*Poll, error)
+	ClosePoll(cid string, user User, mid string) (*Poll, error)
+	SetLinkPreview(mid string, preview LinkPreview) error
+	GetConversationMessages(cid string, user User) ([]Message, error)
+	HideMessage(cid string, user User, mid string) (bool, error)
+	DeleteMessageForEveryone(cid string, user User, mid string, window time.Duration) (Message, bool, error)
+	PurgeDeletedMessages(limit int) (int, error)
+	GetMessage(cid string, mid string) (Message, error)
+	GetVisibleMessage(cid string, user User, mid string) (Message, error)
+	ForwardMessage(sourceCid string, mid string, user User, targetCid string) (Message, error)
+	ToggleReaction(cid string, user User, mid string, emoji string, maxDistinct int) (bool, error)
+	RemoveReaction(cid string, user User, mid string, emoji string) (bool, error)
+	GetMessageReactions(mid string) (map[string]Reaction, error)
+	CommentMessage(cid string, user User, mid string, comment string) (Comment, error)
+	UncommentMessage(cid string, user User, mid string, commentId string) error
+	ListComments(cid string, user User, mid string, after string, limit int) ([]Comment, error)
+	SetMessageMentions(mid string, userIds []string) error
+	GetMentions(user User, before string, limit int) ([]Mention, error)
+	StarMessage(cid string, user User, mid string) (bool, error)
+	UnstarMessage(cid string, user User, mid string) (bool, error)
+	GetStarredMessages(user User, before string, limit int) ([]StarredMessage, error)
+	SaveDraft(cid string, user User, text string, replyTo string, updatedAt time.Time) (Draft, bool, error)
+	ClearDraft(cid string, uid string, at time.Time) (bool, error)
+	PinMessage(cid string, user User, mid string) (bool, error)
+	UnpinMessage(cid string, user User, mid string) (bool, error)
+	ListPins(cid string, user User) ([]Pin, error)
+	ScheduleMessage(cid string, user User, text string, imageUrl string, sendAt time.Time) (ScheduledMessage, error)
+	ListScheduledMessages(user User) ([]ScheduledMessage, error)
+	UpdateScheduledMessage(user User, id string, text string, imageUrl string, sendAt time.Time) (ScheduledMessage, error)
+	CancelScheduledMessage(user User, id string) error
+	GetDueScheduledMessages(now time.Time, limit int) ([]ScheduledMessage, error)
+	NextScheduledMessageTime() (time.Time, bool, error)
+	DeliverScheduledMessage(id string, now time.Time) (Message, error)
+	SetMessageTTL(cid string, user User, ttl int) error
+	NextMessageExpiry() (time.Time, bool, error)
+	DeleteExpiredMessages(now time.Time) (map[string][]string, error)
 	MarkMessageAsRead(messageId string, userId string) error
+	MarkConversationRead(cid string, user User) (int, error)
 	GetUnreadCount(conversationId string, userId string) (int, error)
 	GetContextReply() (string, error)
 	AddContact(user User, contact User) (User, error)
@@ -228,6 +545,262 @@ func New(db *sql.DB) (AppDatabase, error) {
 		return nil, fmt.Errorf("error creating read_status table: %w", err)
 	}
 
+	// Per-user conversation state, e.g. the "clear history" watermark
+	conversationUserStateTable := `CREATE TABLE IF NOT EXISTS conversation_user_state (
+		conversation_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		cleared_at DATETIME,
+		PRIMARY KEY(conversation_id, user_id),
+		FOREIGN KEY(conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	);`
+	_, err = db.Exec(conversationUserStateTable)
+	if err != nil {
+		return nil, fmt.Errorf("error creating conversation_user_state table: %w", err)
+	}
+
+	messageMentionsTable := `CREATE TABLE IF NOT EXISTS message_mentions (
+		message_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		PRIMARY KEY(message_id, user_id),
+		FOREIGN KEY(message_id) REFERENCES messages(id) ON DELETE CASCADE,
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	);`
+	_, err = db.Exec(messageMentionsTable)
+	if err != nil {
+		return nil, fmt.Errorf("error creating message_mentions table: %w", err)
+	}
+
+	pinnedMessagesTable := `CREATE TABLE IF NOT EXISTS pinned_messages (
+		conversation_id TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		pinned_by TEXT NOT NULL,
+		pinned_at DATETIME NOT NULL,
+		PRIMARY KEY(conversation_id, message_id),
+		FOREIGN KEY(conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
+		FOREIGN KEY(message_id) REFERENCES messages(id) ON DELETE CASCADE
+	);`
+	_, err = db.Exec(pinnedMessagesTable)
+	if err != nil {
+		return nil, fmt.Errorf("error creating pinned_messages table: %w", err)
+	}
+
+	// Polls are messages with options to vote on; the question is the text of the message
+	pollTables := []string{
+		`CREATE TABLE IF NOT EXISTS polls (
+			message_id TEXT PRIMARY KEY,
+			multiple_choice BOOLEAN NOT NULL DEFAULT 0,
+			anonymous BOOLEAN NOT NULL DEFAULT 0,
+			closes_at DATETIME,
+			closed_at DATETIME,
+			FOREIGN KEY(message_id) REFERENCES messages(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS poll_options (
+			message_id TEXT NOT NULL,
+			idx INTEGER NOT NULL,
+			text TEXT NOT NULL,
+			PRIMARY KEY(message_id, idx),
+			FOREIGN KEY(message_id) REFERENCES polls(message_id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS poll_votes (
+			message_id TEXT NOT NULL,
+			option_idx INTEGER NOT NULL,
+			user_id TEXT NOT NULL,
+			voted_at DATETIME NOT NULL,
+			PRIMARY KEY(message_id, option_idx, user_id),
+			FOREIGN KEY(message_id) REFERENCES polls(message_id) ON DELETE CASCADE,
+			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+	}
+	for _, table := range pollTables {
+		if _, err = db.Exec(table); err != nil {
+			return nil, fmt.Errorf("error creating poll tables: %w", err)
+		}
+	}
+
+	// Messages bookmarked by users
+	starredMessagesTable := `CREATE TABLE IF NOT EXISTS starred_messages (
+		user_id TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		conversation_id TEXT NOT NULL,
+		starred_at DATETIME NOT NULL,
+		PRIMARY KEY(user_id, message_id),
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY(message_id) REFERENCES messages(id) ON DELETE CASCADE
+	);`
+	if _, err = db.Exec(starredMessagesTable); err != nil {
+		return nil, fmt.Errorf("error creating starred_messages table: %w", err)
+	}
+	if _, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_starred_messages_user ON starred_messages(user_id, starred_at)"); err != nil {
+		return nil, fmt.Errorf("error creating starred_messages index: %w", err)
+	}
+
+	// Password hashes, one per user. Accounts created before passwords existed have none, and cannot log in with a
+	// password until they get one with a reset token.
+	userCredentialsTable := `CREATE TABLE IF NOT EXISTS user_credentials (
+		user_id TEXT PRIMARY KEY,
+		password_hash TEXT NOT NULL,
+		updated_at DATETIME NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	);`
+	if _, err = db.Exec(userCredentialsTable); err != nil {
+		return nil, fmt.Errorf("error creating user_credentials table: %w", err)
+	}
+
+	// Password reset tokens, issued by the operator for the accounts that cannot log in; each can be used once
+	passwordResetsTable := `CREATE TABLE IF NOT EXISTS password_resets (
+		token_hash TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		expires_at DATETIME NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	);`
+	if _, err = db.Exec(passwordResetsTable); err != nil {
+		return nil, fmt.Errorf("error creating password_resets table: %w", err)
+	}
+
+	// Login attempts, successful or not; the username is the one typed, which may not exist
+	loginEventsTable := `CREATE TABLE IF NOT EXISTS login_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id TEXT,
+		username TEXT NOT NULL,
+		success BOOLEAN NOT NULL,
+		remote_addr TEXT NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE SET NULL
+	);`
+	if _, err = db.Exec(loginEventsTable); err != nil {
+		return nil, fmt.Errorf("error creating login_events table: %w", err)
+	}
+	loginEventsIndexes := []string{
+		"CREATE INDEX IF NOT EXISTS login_events_username ON login_events(username COLLATE NOCASE, created_at)",
+		"CREATE INDEX IF NOT EXISTS login_events_remote_addr ON login_events(remote_addr, created_at)",
+	}
+	for _, index := range loginEventsIndexes {
+		if _, err = db.Exec(index); err != nil {
+			return nil, fmt.Errorf("error creating login_events index: %w", err)
+		}
+	}
+
+	// Logins of users on their devices, by the hash of their bearer token
+	sessionsTable := `CREATE TABLE IF NOT EXISTS sessions (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		user_agent TEXT NOT NULL DEFAULT '',
+		remote_addr TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		last_active_at DATETIME NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	);`
+	if _, err = db.Exec(sessionsTable); err != nil {
+		return nil, fmt.Errorf("error creating sessions table: %w", err)
+	}
+	if _, err = db.Exec("CREATE INDEX IF NOT EXISTS sessions_user ON sessions(user_id, last_active_at)"); err != nil {
+		return nil, fmt.Errorf("error creating sessions index: %w", err)
+	}
+
+	// Accounts at OpenID Connect providers, each linked to one user
+	userIdentitiesTable := `CREATE TABLE IF NOT EXISTS user_identities (
+		issuer TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		email TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY(issuer, subject),
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	);`
+	if _, err = db.Exec(userIdentitiesTable); err != nil {
+		return nil, fmt.Errorf("error creating user_identities table: %w", err)
+	}
+	if _, err = db.Exec("CREATE INDEX IF NOT EXISTS user_identities_user ON user_identities(user_id)"); err != nil {
+		return nil, fmt.Errorf("error creating user_identities index: %w", err)
+	}
+
+	// Messages a user deleted for themselves only
+	hiddenMessagesTable := `CREATE TABLE IF NOT EXISTS hidden_messages (
+		user_id TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		conversation_id TEXT NOT NULL,
+		hidden_at DATETIME NOT NULL,
+		PRIMARY KEY(user_id, message_id),
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY(message_id) REFERENCES messages(id) ON DELETE CASCADE
+	);`
+	if _, err = db.Exec(hiddenMessagesTable); err != nil {
+		return nil, fmt.Errorf("error creating hidden_messages table: %w", err)
+	}
+
+	// Unsent messages, one per user and conversation
+	draftsTable := `CREATE TABLE IF NOT EXISTS conversation_drafts (
+		user_id TEXT NOT NULL,
+		conversation_id TEXT NOT NULL,
+		text TEXT NOT NULL DEFAULT '',
+		reply_to_message_id TEXT,
+		updated_at DATETIME NOT NULL,
+		PRIMARY KEY(user_id, conversation_id),
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY(conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
+		FOREIGN KEY(reply_to_message_id) REFERENCES messages(id) ON DELETE SET NULL
+	);`
+	if _, err = db.Exec(draftsTable); err != nil {
+		return nil, fmt.Errorf("error creating conversation_drafts table: %w", err)
+	}
+
+	// Link previews, one per message
+	linkPreviewsTable := `CREATE TABLE IF NOT EXISTS link_previews (
+		message_id TEXT PRIMARY KEY,
+		url TEXT NOT NULL,
+		title TEXT NOT NULL DEFAULT '',
+		description TEXT NOT NULL DEFAULT '',
+		image_url TEXT NOT NULL DEFAULT '',
+		site_name TEXT NOT NULL DEFAULT '',
+		fetched_at DATETIME NOT NULL,
+		FOREIGN KEY(message_id) REFERENCES messages(id) ON DELETE CASCADE
+	);`
+	if _, err = db.Exec(linkPreviewsTable); err != nil {
+		return nil, fmt.Errorf("error creating link_previews table: %w", err)
+	}
+
+	// Idempotency keys of sent messages, so that a client retrying a send doesn't create a duplicate
+	messageClientKeysTable := `CREATE TABLE IF NOT EXISTS message_client_keys (
+		sender_id TEXT NOT NULL,
+		conversation_id TEXT NOT NULL,
+		client_key TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY(sender_id, conversation_id, client_key),
+		FOREIGN KEY(conversation_id) REFERENCES conversations(id) ON DELETE CASCADE
+	);`
+	_, err = db.Exec(messageClientKeysTable)
+	if err != nil {
+		return nil, fmt.Errorf("error creating message_client_keys table: %w", err)
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS message_client_keys_created_at ON message_client_keys(created_at)")
+	if err != nil {
+		return nil, fmt.Errorf("error creating message_client_keys index: %w", err)
+	}
+
+	// Messages waiting to be sent; send_at is in UTC
+	scheduledMessagesTable := `CREATE TABLE IF NOT EXISTS scheduled_messages (
+		id TEXT PRIMARY KEY,
+		conversation_id TEXT NOT NULL,
+		sender_id TEXT NOT NULL,
+		message TEXT NOT NULL,
+		image_url TEXT,
+		send_at DATETIME NOT NULL,
+		FOREIGN KEY(conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
+		FOREIGN KEY(sender_id) REFERENCES users(id) ON DELETE CASCADE
+	);`
+	_, err = db.Exec(scheduledMessagesTable)
+	if err != nil {
+		return nil, fmt.Errorf("error creating scheduled_messages table: %w", err)
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS scheduled_messages_send_at ON scheduled_messages(send_at)")
+	if err != nil {
+		return nil, fmt.Errorf("error creating scheduled_messages index: %w", err)
+	}
+
 	// Add image_url column to messages table if it doesn't exist
 	// This is a migration for existing databases
 	_, err = db.Exec("ALTER TABLE messages ADD COLUMN image_url TEXT")
@@ -263,6 +836,179 @@ func New(db *sql.DB) (AppDatabase, error) {
 		// Otherwise, column already exists, continue
 	}
 
+	// Add owner_id column to conversations table if it doesn't exist
+	// Conversations created before this migration are owned by their first participant. The participants are stored
+	// as IDs, or as user objects in the old format.
+	_, err = db.Exec("ALTER TABLE conversations ADD COLUMN owner_id TEXT")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column") {
+			return nil, fmt.Errorf("error adding owner_id column: %w", err)
+		}
+	}
+	_, err = db.Exec(`UPDATE conversations
+		SET owner_id = COALESCE(json_extract(participants, '$[0].id'), json_extract(participants, '$[0]'))
+		WHERE owner_id IS NULL AND json_valid(participants)`)
+	if err != nil {
+		return nil, fmt.Errorf("error setting the owners of conversations: %w", err)
+	}
+
+	// Add forwarding attribution columns to messages table if they don't exist
+	for _, column := range []string{"forwarded_from_message_id", "forwarded_from_sender_id"} {
+		_, err = db.Exec("ALTER TABLE messages ADD COLUMN " + column + " TEXT")
+		if err != nil {
+			if !strings.Contains(err.Error(), "duplicate column") {
+				return nil, fmt.Errorf("error adding %s column: %w", column, err)
+			}
+		}
+	}
+
+	// Add timestamp column to comments table if it doesn't exist. SQLite doesn't allow a non-constant default here,
+	// so the value is set on insert.
+	_, err = db.Exec("ALTER TABLE comments ADD COLUMN timestamp DATETIME")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column") {
+			return nil, fmt.Errorf("error adding comments timestamp column: %w", err)
+		}
+	}
+
+	// Disappearing messages: conversations can set a TTL in seconds, which gives each new message an expiry time
+	_, err = db.Exec("ALTER TABLE conversations ADD COLUMN message_ttl INTEGER DEFAULT 0")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column") {
+			return nil, fmt.Errorf("error adding message_ttl column: %w", err)
+		}
+	}
+	_, err = db.Exec("ALTER TABLE messages ADD COLUMN expires_at DATETIME")
+	if err != nil {
+		if !strings.Contains(err.Error(), "duplicate column") {
+			return nil, fmt.Errorf("error adding expires_at column: %w", err)
+		}
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS messages_expires_at ON messages(expires_at) WHERE expires_at IS NOT NULL")
+	if err != nil {
+		return nil, fmt.Errorf("error creating messages expires_at index: %w", err)
+	}
+
+	// Messages deleted for everyone stay as tombstones; their content is purged in the background
+	for _, column := range []string{"deleted_at", "purged_at"} {
+		_, err = db.Exec("ALTER TABLE messages ADD COLUMN " + column + " DATETIME")
+		if err != nil {
+			if !strings.Contains(err.Error(), "duplicate column") {
+				return nil, fmt.Errorf("error adding %s column: %w", column, err)
+			}
+		}
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS messages_unpurged ON messages(deleted_at) WHERE deleted_at IS NOT NULL AND purged_at IS NULL")
+	if err != nil {
+		return nil, fmt.Errorf("error creating messages deleted_at index: %w", err)
+	}
+
+	// Bots are users created by another user, their owner, and act through API tokens
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN is_bot BOOLEAN NOT NULL DEFAULT 0")
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		return nil, fmt.Errorf("error adding is_bot column: %w", err)
+	}
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN bot_owner_id TEXT REFERENCES users(id) ON DELETE CASCADE")
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		return nil, fmt.Errorf("error adding bot_owner_id column: %w", err)
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS users_bot_owner ON users(bot_owner_id) WHERE bot_owner_id IS NOT NULL")
+	if err != nil {
+		return nil, fmt.Errorf("error creating users bot_owner_id index: %w", err)
+	}
+
+	// Tokens for scripts and bots, by the hash of the token. Scopes and conversations are JSON arrays.
+	apiTokensTable := `CREATE TABLE IF NOT EXISTS api_tokens (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		name TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL,
+		conversations TEXT NOT NULL DEFAULT '[]',
+		created_at DATETIME NOT NULL,
+		last_used_at DATETIME,
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY(created_by) REFERENCES users(id) ON DELETE CASCADE
+	);`
+	if _, err = db.Exec(apiTokensTable); err != nil {
+		return nil, fmt.Errorf("error creating api_tokens table: %w", err)
+	}
+	if _, err = db.Exec("CREATE INDEX IF NOT EXISTS api_tokens_created_by ON api_tokens(created_by)"); err != nil {
+		return nil, fmt.Errorf("error creating api_tokens index: %w", err)
+	}
+
+	// Webhooks of conversations, and their deliveries: the pending ones are the queue of the deliverer, the others its
+	// log. next_attempt_at is in UTC.
+	webhookTables := []string{
+		`CREATE TABLE IF NOT EXISTS webhooks (
+			id TEXT PRIMARY KEY,
+			conversation_id TEXT NOT NULL,
+			created_by TEXT NOT NULL,
+			url TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			events TEXT NOT NULL,
+			enabled BOOLEAN NOT NULL DEFAULT 1,
+			consecutive_failures INTEGER NOT NULL DEFAULT 0,
+			disabled_reason TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY(conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
+			FOREIGN KEY(created_by) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		"CREATE INDEX IF NOT EXISTS webhooks_conversation ON webhooks(conversation_id)",
+		`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id TEXT PRIMARY KEY,
+			webhook_id TEXT NOT NULL,
+			event TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			status TEXT NOT NULL DEFAULT 'pending',
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at DATETIME,
+			last_status_code INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			delivered_at DATETIME,
+			FOREIGN KEY(webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE
+		);`,
+		"CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook ON webhook_deliveries(webhook_id, created_at)",
+		"CREATE INDEX IF NOT EXISTS webhook_deliveries_next_attempt ON webhook_deliveries(next_attempt_at) WHERE status = 'pending'",
+	}
+	for _, stmt := range webhookTables {
+		if _, err = db.Exec(stmt); err != nil {
+			return nil, fmt.Errorf("error creating webhook tables: %w", err)
+		}
+	}
+
+	// The last events sent to each user, to replay them to clients that reconnect. event_seq is the sequence number of
+	// the last event of the user; it is never reused, even when the old events are dropped.
+	_, err = db.Exec("ALTER TABLE users ADD COLUMN event_seq INTEGER NOT NULL DEFAULT 0")
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		return nil, fmt.Errorf("error adding event_seq column: %w", err)
+	}
+	userEventsTable := `CREATE TABLE IF NOT EXISTS user_events (
+		user_id TEXT NOT NULL,
+		seq INTEGER NOT NULL,
+		type TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		payload TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY (user_id, seq),
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	);`
+	if _, err = db.Exec(userEventsTable); err != nil {
+		return nil, fmt.Errorf("error creating user_events table: %w", err)
+	}
+
+	// Usernames are unique regardless of case. Databases from before this rule may have duplicates, which keep working
+	// but are not protected against concurrent registrations.
+	_, err = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS users_username ON users(username COLLATE NOCASE)")
+	if err != nil {
+		if !strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return nil, fmt.Errorf("error creating users username index: %w", err)
+		}
+		log.Println("[DB INIT] Some usernames differ only by case; they are not unique-indexed")
+	}
+
 	// Always ensure test users exist on startup (idempotent via INSERT OR IGNORE)
 	// This guarantees fresh deployments have users to test with
 	log.Println("[DB INIT] Ensuring example test users exist...")
@@ -0,0 +1,135 @@
+package database
+
+import (
+	"time"
+)
+
+// notHiddenSQL is a SQL condition that is true if the user bound to its parameter did not delete the message aliased
+// as `m` for themselves
+const notHiddenSQL = `NOT EXISTS (SELECT 1 FROM hidden_messages h WHERE h.message_id = m.id AND h.user_id = ?)`
+
+// messageTextSQL and messageImageSQL select the content of the message aliased as `m`. A message deleted for
+// everyone has no content, even before the purger clears it.
+const (
+	messageTextSQL  = `CASE WHEN m.deleted_at IS NULL THEN m.message ELSE '' END`
+	messageImageSQL = `CASE WHEN m.deleted_at IS NULL THEN COALESCE(m.image_url, '') ELSE '' END`
+)
+
+// HideMessage deletes the message `mid` of conversation `cid` for `user` only: the other participants still see it.
+// Messages deleted for everyone can be hidden too, to get rid of their tombstone. It returns false if the message was
+// already hidden.
+func (db *appdbimpl) HideMessage(cid string, user User, mid string) (bool, error) {
+	if err := db.checkMessageExists(cid, user, mid); err != nil {
+		return false, err
+	}
+
+	res, err := db.c.Exec(`INSERT OR IGNORE INTO hidden_messages (user_id, message_id, conversation_id, hidden_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)`, user.UId, mid, cid)
+	if err != nil {
+		return false, err
+	}
+	hidden, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return hidden > 0, nil
+}
+
+// DeleteMessageForEveryone replaces the message `mid` of conversation `cid` with a tombstone that keeps its ID, sender
+// and time, so that receipts, replies and forwards still point somewhere. Only the sender can do it, and only within
+// `window` from when the message was sent, otherwise ErrForbidden or ErrDeleteWindowExpired is returned.
+//
+// Pins, stars and mentions of the message go away at once. Its content, image, reactions, poll and link preview are
+// removed later by PurgeDeletedMessages. The boolean is false if the message was already deleted.
+func (db *appdbimpl) DeleteMessageForEveryone(cid string, user User, mid string, window time.Duration) (Message, bool, error) {
+	// The sender can delete for everyone a message they no longer see themselves
+	if err := db.checkMessageExists(cid, user, mid); err != nil {
+		return Message{}, false, err
+	}
+
+	message, err := db.GetMessage(cid, mid)
+	if err != nil {
+		return Message{}, false, err
+	}
+	if message.SenderId != user.UId {
+		return Message{}, false, ErrForbidden
+	}
+	if message.DeletedAt != "" {
+		return message, false, nil
+	}
+
+	tx, err := db.c.Begin()
+	if err != nil {
+		return Message{}, false, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	cutoff := time.Now().Add(-window).UTC().Format(sqlTimeLayout)
+	res, err := tx.Exec(`UPDATE messages SET deleted_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND deleted_at IS NULL AND timestamp > ?`, mid, cutoff)
+	if err != nil {
+		return Message{}, false, err
+	}
+	if deleted, _ := res.RowsAffected(); deleted == 0 {
+		return Message{}, false, ErrDeleteWindowExpired
+	}
+
+	cleanup := []string{
+		"DELETE FROM pinned_messages WHERE message_id = ?",
+		"DELETE FROM starred_messages WHERE message_id = ?",
+		"DELETE FROM message_mentions WHERE message_id = ?",
+	}
+	for _, query := range cleanup {
+		if _, err = tx.Exec(query, mid); err != nil {
+			return Message{}, false, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return Message{}, false, err
+	}
+
+	message, err = db.GetMessage(cid, mid)
+	return message, true, err
+}
+
+// PurgeDeletedMessages removes the content of up to `limit` messages deleted for everyone: text, image, reactions,
+// poll and link preview. Images are stored inline in the messages rows, so clearing the column frees them. Comments
+// and read receipts are kept with the tombstone. It returns how many messages were purged.
+func (db *appdbimpl) PurgeDeletedMessages(limit int) (int, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// The batch is the same for every statement: purged_at is only set by the last one
+	pendingIDs := "SELECT id FROM messages WHERE deleted_at IS NOT NULL AND purged_at IS NULL ORDER BY deleted_at LIMIT ?"
+	cleanup := []string{
+		"DELETE FROM reactions WHERE message_id IN (" + pendingIDs + ")",
+		"DELETE FROM poll_votes WHERE message_id IN (" + pendingIDs + ")",
+		"DELETE FROM poll_options WHERE message_id IN (" + pendingIDs + ")",
+		"DELETE FROM polls WHERE message_id IN (" + pendingIDs + ")",
+		"DELETE FROM link_previews WHERE message_id IN (" + pendingIDs + ")",
+	}
+	for _, query := range cleanup {
+		if _, err = tx.Exec(query, limit); err != nil {
+			return 0, err
+		}
+	}
+
+	res, err := tx.Exec(`UPDATE messages SET message = '', image_url = NULL, purged_at = CURRENT_TIMESTAMP
+		WHERE id IN (`+pendingIDs+`)`, limit)
+	if err != nil {
+		return 0, err
+	}
+	purged, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(purged), tx.Commit()
+}
@@ -0,0 +1,96 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// draftTimeLayout keeps milliseconds, so that the text of two update times compares like the times
+const draftTimeLayout = "2006-01-02 15:04:05.000"
+
+// SaveDraft stores the unsent `text` of `user` in conversation `cid`, with the message it will reply to, if any.
+// Concurrent edits from several sessions are resolved by `updatedAt`: the draft is saved only if it is newer than the
+// stored one. It returns the draft that is stored afterwards, and whether it is the one passed. An empty draft is
+// kept as well, so that a stale edit cannot bring back a cleared draft.
+func (db *appdbimpl) SaveDraft(cid string, user User, text string, replyTo string, updatedAt time.Time) (Draft, bool, error) {
+	ok, err := db.IsParticipant(cid, user.UId)
+	if err != nil {
+		return Draft{}, false, err
+	}
+	if !ok {
+		return Draft{}, false, ErrNotParticipant
+	}
+
+	var replyToValue interface{}
+	if replyTo != "" {
+		if deleted, err := db.checkVisibleMessage(cid, user, replyTo); errors.Is(err, sql.ErrNoRows) || deleted {
+			return Draft{}, false, ErrInvalidReplyTarget
+		} else if err != nil {
+			return Draft{}, false, err
+		}
+		replyToValue = replyTo
+	}
+
+	res, err := db.c.Exec(`
+		INSERT INTO conversation_drafts (user_id, conversation_id, text, reply_to_message_id, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(user_id, conversation_id) DO UPDATE SET
+			text = excluded.text,
+			reply_to_message_id = excluded.reply_to_message_id,
+			updated_at = excluded.updated_at
+		WHERE excluded.updated_at > conversation_drafts.updated_at`,
+		user.UId, cid, text, replyToValue, updatedAt.UTC().Format(draftTimeLayout))
+	if err != nil {
+		return Draft{}, false, err
+	}
+	saved, err := res.RowsAffected()
+	if err != nil {
+		return Draft{}, false, err
+	}
+
+	draft, err := db.getDraft(cid, user.UId)
+	return draft, saved > 0, err
+}
+
+// ClearDraft empties the draft of user `uid` in conversation `cid` as of `at`, usually because the message was sent.
+// It returns false if there was no draft, or it was edited after `at`.
+func (db *appdbimpl) ClearDraft(cid string, uid string, at time.Time) (bool, error) {
+	timestamp := at.UTC().Format(draftTimeLayout)
+	res, err := db.c.Exec(`
+		UPDATE conversation_drafts SET text = '', reply_to_message_id = NULL, updated_at = ?
+		WHERE user_id = ? AND conversation_id = ? AND updated_at < ?
+		AND (text != '' OR reply_to_message_id IS NOT NULL)`, timestamp, uid, cid, timestamp)
+	if err != nil {
+		return false, err
+	}
+	cleared, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return cleared > 0, nil
+}
+
+func (db *appdbimpl) getDraft(cid string, uid string) (Draft, error) {
+	var draft Draft
+	var replyTo sql.NullString
+	var updatedAt string
+	err := db.c.QueryRow(`
+		SELECT text, reply_to_message_id, CAST(updated_at AS TEXT) FROM conversation_drafts
+		WHERE user_id = ? AND conversation_id = ?`, uid, cid).Scan(&draft.Text, &replyTo, &updatedAt)
+	if err != nil {
+		return Draft{}, err
+	}
+	draft.ReplyToMessageId = replyTo.String
+	draft.UpdatedAt = formatDraftTime(updatedAt)
+	return draft, nil
+}
+
+// formatDraftTime converts an update time of a draft to RFC 3339, keeping the milliseconds
+func formatDraftTime(timestamp string) string {
+	t, err := time.Parse(draftTimeLayout, timestamp)
+	if err != nil {
+		return ""
+	}
+	return t.Format("2006-01-02T15:04:05.000Z07:00")
+}
@@ -0,0 +1,79 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// AppendUserEvents adds an event to the log of each user in `uids`, and returns the sequence number it got for each of
+// them. Only the last `keep` events of a user are kept. Users that do not exist are skipped.
+func (db *appdbimpl) AppendUserEvents(uids []string, event UserEvent, keep int) (map[string]int64, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	now := time.Now().UTC().Format(sqlTimeLayout)
+	seqs := make(map[string]int64, len(uids))
+	for _, uid := range uids {
+		if _, done := seqs[uid]; done {
+			continue
+		}
+
+		var seq int64
+		err = tx.QueryRow("UPDATE users SET event_seq = event_seq + 1 WHERE id = ? RETURNING event_seq", uid).Scan(&seq)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		_, err = tx.Exec(`INSERT INTO user_events (user_id, seq, type, version, payload, created_at)
+			VALUES (?, ?, ?, ?, ?, ?)`, uid, seq, event.Type, event.Version, event.Payload, now)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec("DELETE FROM user_events WHERE user_id = ? AND seq <= ?", uid, seq-int64(keep))
+		if err != nil {
+			return nil, err
+		}
+		seqs[uid] = seq
+	}
+
+	return seqs, tx.Commit()
+}
+
+// GetUserEventRange returns the sequence number of the oldest event still in the log of the user, and of their last
+// event. When the log is empty, the oldest is one past the last.
+func (db *appdbimpl) GetUserEventRange(uid string) (int64, int64, error) {
+	var oldest, last int64
+	err := db.c.QueryRow(`
+		SELECT COALESCE((SELECT MIN(seq) FROM user_events WHERE user_id = u.id), u.event_seq + 1), u.event_seq
+		FROM users u WHERE u.id = ?`, uid).Scan(&oldest, &last)
+	return oldest, last, err
+}
+
+// ListUserEvents returns the events of the user with a sequence number after `after` and up to `upTo`, oldest first
+func (db *appdbimpl) ListUserEvents(uid string, after int64, upTo int64) ([]UserEvent, error) {
+	rows, err := db.c.Query(`SELECT seq, type, version, payload, CAST(created_at AS TEXT) FROM user_events
+		WHERE user_id = ? AND seq > ? AND seq <= ? ORDER BY seq`, uid, after, upTo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []UserEvent
+	for rows.Next() {
+		var e UserEvent
+		if err := rows.Scan(&e.Seq, &e.Type, &e.Version, &e.Payload, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.CreatedAt = formatTimestamp(e.CreatedAt)
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,109 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// unexpiredSQL is a SQL condition that is true if the message aliased as `m` has not expired yet. Expired messages are
+// hidden right away, even before the reaper deletes them.
+const unexpiredSQL = `(m.expires_at IS NULL OR m.expires_at > CURRENT_TIMESTAMP)`
+
+// messageExpirySQL computes the expiry time of a message sent now to the conversation bound to its parameter, or NULL
+// if the conversation has no message TTL
+const messageExpirySQL = `(SELECT CASE WHEN message_ttl > 0 THEN datetime('now', '+' || message_ttl || ' seconds') END
+	FROM conversations WHERE id = ?)`
+
+// SetMessageTTL sets how long new messages of conversation `cid` are kept, in seconds. Zero disables expiry. Messages
+// already sent keep their expiry time. Any participant can change it.
+func (db *appdbimpl) SetMessageTTL(cid string, user User, ttl int) error {
+	ok, err := db.IsParticipant(cid, user.UId)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotParticipant
+	}
+
+	_, err = db.c.Exec("UPDATE conversations SET message_ttl = ? WHERE id = ?", ttl, cid)
+	return err
+}
+
+// NextMessageExpiry returns the time the next message expires. The boolean is false if no message has an expiry time.
+func (db *appdbimpl) NextMessageExpiry() (time.Time, bool, error) {
+	var expiresAt sql.NullString
+	err := db.c.QueryRow("SELECT CAST(MIN(expires_at) AS TEXT) FROM messages WHERE expires_at IS NOT NULL").
+		Scan(&expiresAt)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if !expiresAt.Valid {
+		return time.Time{}, false, nil
+	}
+	t, err := time.Parse(sqlTimeLayout, expiresAt.String)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return t, true, nil
+}
+
+// DeleteExpiredMessages deletes the messages that expired at `now`, together with their reactions, comments, read
+// receipts, mentions, pins, polls, link previews, stars and hidden marks. Images are stored inline in the messages
+// rows, so they go with them. It returns the IDs of the deleted messages by conversation.
+func (db *appdbimpl) DeleteExpiredMessages(now time.Time) (map[string][]string, error) {
+	cutoff := now.UTC().Format(sqlTimeLayout)
+
+	tx, err := db.c.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	rows, err := tx.Query(`SELECT id, conversation_id FROM messages
+		WHERE expires_at IS NOT NULL AND expires_at <= ?`, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	expired := make(map[string][]string)
+	for rows.Next() {
+		var id, cid string
+		if err = rows.Scan(&id, &cid); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		expired[cid] = append(expired[cid], id)
+	}
+	if err = rows.Err(); err != nil {
+		_ = rows.Close()
+		return nil, err
+	}
+	_ = rows.Close()
+	if len(expired) == 0 {
+		return expired, nil
+	}
+
+	expiredIDs := "SELECT id FROM messages WHERE expires_at IS NOT NULL AND expires_at <= ?"
+	cleanup := []string{
+		"DELETE FROM read_status WHERE message_id IN (" + expiredIDs + ")",
+		"DELETE FROM reactions WHERE message_id IN (" + expiredIDs + ")",
+		"DELETE FROM comments WHERE message_id IN (" + expiredIDs + ")",
+		"DELETE FROM message_mentions WHERE message_id IN (" + expiredIDs + ")",
+		"DELETE FROM pinned_messages WHERE message_id IN (" + expiredIDs + ")",
+		"DELETE FROM poll_votes WHERE message_id IN (" + expiredIDs + ")",
+		"DELETE FROM poll_options WHERE message_id IN (" + expiredIDs + ")",
+		"DELETE FROM polls WHERE message_id IN (" + expiredIDs + ")",
+		"DELETE FROM link_previews WHERE message_id IN (" + expiredIDs + ")",
+		"DELETE FROM starred_messages WHERE message_id IN (" + expiredIDs + ")",
+		"DELETE FROM hidden_messages WHERE message_id IN (" + expiredIDs + ")",
+		"DELETE FROM messages WHERE id IN (" + expiredIDs + ")",
+	}
+	for _, query := range cleanup {
+		if _, err = tx.Exec(query, cutoff); err != nil {
+			return nil, err
+		}
+	}
+
+	return expired, tx.Commit()
+}
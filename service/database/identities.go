@@ -0,0 +1,110 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/gofrs/uuid"
+)
+
+// GetUserByIdentity returns the user linked to the account `subject` at the provider `issuer`. It returns
+// sql.ErrNoRows if there is none.
+func (db *appdbimpl) GetUserByIdentity(issuer string, subject string) (User, error) {
+	var user User
+	var picture sql.NullString
+	err := db.c.QueryRow(`SELECT u.id, u.username, u.picture, u.is_bot FROM user_identities i JOIN users u ON u.id = i.user_id
+		WHERE i.issuer = ? AND i.subject = ?`, issuer, subject).Scan(&user.UId, &user.Username, &picture, &user.IsBot)
+	if err != nil {
+		return User{}, err
+	}
+	user.Picture = picture.String
+	return user, nil
+}
+
+// CreateUserWithIdentity provisions a new user without a password, linked to `identity`. It returns ErrUsernameTaken
+// if another user has the same username, ignoring the case of ASCII letters, and ErrIdentityLinked if the identity
+// was linked to another user in the meantime.
+func (db *appdbimpl) CreateUserWithIdentity(name string, identity Identity) (User, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return User{}, err
+	}
+
+	tx, err := db.c.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var taken bool
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ? COLLATE NOCASE)", name).Scan(&taken)
+	if err != nil {
+		return User{}, err
+	}
+	if taken {
+		return User{}, ErrUsernameTaken
+	}
+
+	_, err = tx.Exec("INSERT INTO users (id, username) VALUES (?, ?)", id.String(), name)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return User{}, ErrUsernameTaken
+		}
+		return User{}, err
+	}
+	if err = insertIdentity(tx, id.String(), identity); err != nil {
+		return User{}, err
+	}
+
+	return User{UId: id.String(), Username: name}, tx.Commit()
+}
+
+// LinkIdentity links `identity` to the user `uid`, so that they can log in with it. Linking an identity again to
+// the same user only updates its email. It returns ErrIdentityLinked if the identity is linked to another user.
+func (db *appdbimpl) LinkIdentity(uid string, identity Identity) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var owner string
+	err = tx.QueryRow("SELECT user_id FROM user_identities WHERE issuer = ? AND subject = ?",
+		identity.Issuer, identity.Subject).Scan(&owner)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		err = insertIdentity(tx, uid, identity)
+	case err != nil:
+		return err
+	case owner != uid:
+		return ErrIdentityLinked
+	default:
+		_, err = tx.Exec("UPDATE user_identities SET email = ? WHERE issuer = ? AND subject = ?",
+			identity.Email, identity.Issuer, identity.Subject)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// HasIdentity reports whether the user `uid` has an identity linked
+func (db *appdbimpl) HasIdentity(uid string) (bool, error) {
+	var linked bool
+	err := db.c.QueryRow("SELECT EXISTS(SELECT 1 FROM user_identities WHERE user_id = ?)", uid).Scan(&linked)
+	return linked, err
+}
+
+func insertIdentity(tx *sql.Tx, uid string, identity Identity) error {
+	_, err := tx.Exec(`INSERT INTO user_identities (issuer, subject, user_id, email, created_at)
+		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)`, identity.Issuer, identity.Subject, uid, identity.Email)
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return ErrIdentityLinked
+	}
+	return err
+}
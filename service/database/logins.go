@@ -0,0 +1,70 @@
+package database
+
+import (
+	"time"
+)
+
+// GetPasswordHash returns the password hash of the user `uid`. It returns sql.ErrNoRows if the user has no password,
+// which is the case of the accounts created before passwords were introduced.
+func (db *appdbimpl) GetPasswordHash(uid string) (string, error) {
+	var hash string
+	err := db.c.QueryRow("SELECT password_hash FROM user_credentials WHERE user_id = ?", uid).Scan(&hash)
+	return hash, err
+}
+
+// SetPasswordHash sets the password hash of the user `uid`, replacing the previous one
+func (db *appdbimpl) SetPasswordHash(uid string, passwordHash string) error {
+	_, err := db.c.Exec(`INSERT INTO user_credentials (user_id, password_hash, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(user_id) DO UPDATE SET password_hash = excluded.password_hash, updated_at = excluded.updated_at`,
+		uid, passwordHash)
+	return err
+}
+
+// CreatePasswordReset saves a password reset token of the user `uid`, valid until `expiresAt`. The expired tokens of
+// every user are dropped.
+func (db *appdbimpl) CreatePasswordReset(uid string, tokenHash string, expiresAt time.Time) error {
+	_, err := db.c.Exec("DELETE FROM password_resets WHERE expires_at <= ?", time.Now().UTC().Format(sqlTimeLayout))
+	if err != nil {
+		return err
+	}
+	_, err = db.c.Exec("INSERT INTO password_resets (token_hash, user_id, expires_at) VALUES (?, ?, ?)",
+		tokenHash, uid, expiresAt.UTC().Format(sqlTimeLayout))
+	return err
+}
+
+// UsePasswordReset deletes a password reset token and returns the ID of its user. It returns sql.ErrNoRows if the
+// token does not exist or has expired.
+func (db *appdbimpl) UsePasswordReset(tokenHash string) (string, error) {
+	var uid string
+	err := db.c.QueryRow("DELETE FROM password_resets WHERE token_hash = ? AND expires_at > ? RETURNING user_id",
+		tokenHash, time.Now().UTC().Format(sqlTimeLayout)).Scan(&uid)
+	return uid, err
+}
+
+// DoLogin records a login attempt. Failed attempts for unknown usernames have no user ID.
+func (db *appdbimpl) DoLogin(event LoginEvent) error {
+	var userId interface{}
+	if event.UserId != "" {
+		userId = event.UserId
+	}
+	_, err := db.c.Exec(`INSERT INTO login_events (user_id, username, success, remote_addr, user_agent, created_at)
+		VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)`, userId, event.Username, event.Success, event.RemoteAddr, event.UserAgent)
+	return err
+}
+
+// CountLoginFailures returns how many logins failed since `since`, for the username `name` and from the address
+// `remoteAddr`. The failures for a username that precede its last successful login are not counted.
+func (db *appdbimpl) CountLoginFailures(name string, remoteAddr string, since time.Time) (int, int, error) {
+	cutoff := since.UTC().Format(sqlTimeLayout)
+
+	var byName, byAddr int
+	err := db.c.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM login_events
+				WHERE username = ? COLLATE NOCASE AND NOT success AND created_at > ?
+				AND created_at >= COALESCE((SELECT MAX(created_at) FROM login_events
+					WHERE username = ? COLLATE NOCASE AND success), '')),
+			(SELECT COUNT(*) FROM login_events WHERE remote_addr = ? AND NOT success AND created_at > ?)`,
+		name, cutoff, name, remoteAddr, cutoff).Scan(&byName, &byAddr)
+	return byName, byAddr, err
+}
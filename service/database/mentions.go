@@ -0,0 +1,80 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// SetMessageMentions records the users mentioned in the message `mid`
+func (db *appdbimpl) SetMessageMentions(mid string, userIds []string) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, uid := range userIds {
+		_, err = tx.Exec("INSERT OR IGNORE INTO message_mentions (message_id, user_id) VALUES (?, ?)", mid, uid)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetMentions returns up to `limit` messages mentioning `user`, most recent first. Only messages the user can still
+// see are returned: the user must be a participant of the conversation and must not have cleared its history past the
+// message. If `before` is the ID of a message mentioning the user, only older messages are returned.
+func (db *appdbimpl) GetMentions(user User, before string, limit int) ([]Mention, error) {
+	// Messages are sorted by (timestamp, id), so the cursor is the position of the `before` message in that order
+	var beforeTimestamp sql.NullString
+	if before != "" {
+		err := db.c.QueryRow(`
+			SELECT CAST(m.timestamp AS TEXT) FROM messages m
+			JOIN message_mentions mm ON mm.message_id = m.id
+			WHERE m.id = ? AND mm.user_id = ?`, before, user.UId).Scan(&beforeTimestamp)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := db.c.Query(`
+		SELECT c.id, COALESCE(c.name, ''), m.id, m.sender_id, u.username, m.message, COALESCE(m.image_url, ''),
+			m.timestamp
+		FROM message_mentions mm
+		JOIN messages m ON m.id = mm.message_id
+		JOIN conversations c ON c.id = m.conversation_id
+		JOIN users u ON u.id = m.sender_id
+		LEFT JOIN conversation_user_state s ON s.conversation_id = c.id AND s.user_id = mm.user_id
+		WHERE mm.user_id = ?
+		AND `+participantSQL+`
+		AND (s.cleared_at IS NULL OR m.timestamp > s.cleared_at)
+		AND `+unexpiredSQL+`
+		AND (? IS NULL OR m.timestamp < ? OR (m.timestamp = ? AND m.id < ?))
+		ORDER BY m.timestamp DESC, m.id DESC
+		LIMIT ?`, user.UId, user.UId, beforeTimestamp, beforeTimestamp, beforeTimestamp, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mentions := make([]Mention, 0)
+	for rows.Next() {
+		var mention Mention
+		var timestamp time.Time
+		m := &mention.Message
+		if scanErr := rows.Scan(&mention.ConversationId, &mention.ConversationName, &m.Id, &m.SenderId,
+			&m.SenderUsername, &m.Text, &m.ImageUrl, &timestamp); scanErr != nil {
+			return nil, scanErr
+		}
+		m.Time = timestamp.Format(time.RFC3339)
+		mentions = append(mentions, mention)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return mentions, nil
+}
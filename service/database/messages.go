@@ -1,6 +1,9 @@
 package database
 
 import (
+	"database/sql"
+	"errors"
+	"strings"
 	"time"
 
 	"github.com/gofrs/uuid"
@@ -29,8 +32,8 @@ func (db *appdbimpl) SendMessage(cid string, user User, content string) (Convers
 		return Conversation{}, err
 	}
 
-	_, err = db.c.Exec("INSERT INTO messages (id, conversation_id, sender_id, message) VALUES (?, ?, ?, ?)",
-		id.String(), cid, user.UId, content)
+	_, err = db.c.Exec("INSERT INTO messages (id, conversation_id, sender_id, message, expires_at) VALUES (?, ?, ?, ?, "+
+		messageExpirySQL+")", id.String(), cid, user.UId, content, cid)
 	if err != nil {
 		return Conversation{}, err
 	}
@@ -61,8 +64,8 @@ func (db *appdbimpl) SendMessageWithImage(cid string, user User, message string,
 		return Conversation{}, err
 	}
 
-	_, err = db.c.Exec("INSERT INTO messages (id, conversation_id, sender_id, message, image_url) VALUES (?, ?, ?, ?, ?)",
-		id.String(), cid, user.UId, message, imageUrl)
+	_, err = db.c.Exec("INSERT INTO messages (id, conversation_id, sender_id, message, image_url, expires_at) VALUES (?, ?, ?, ?, ?, "+
+		messageExpirySQL+")", id.String(), cid, user.UId, message, imageUrl, cid)
 	if err != nil {
 		return Conversation{}, err
 	}
@@ -70,118 +73,494 @@ func (db *appdbimpl) SendMessageWithImage(cid string, user User, message string,
 	return db.GetConversation(cid)
 }
 
-func (db *appdbimpl) DeleteMessage(cid string, user User, mid string) (Conversation, error) {
-	_, err := db.c.Exec("DELETE FROM messages WHERE id = ? AND sender_id = ?", mid, user.UId)
+// CreateMessage saves a new message from `user` in conversation `cid`. If the conversation has a message TTL, the
+// message gets its expiry time.
+//
+// `clientKey` is an optional idempotency key chosen by the client. If the same user already sent a message with the
+// same key to the same conversation within `keyWindow`, no message is created: the original message is returned and
+// the boolean is true. If the original message was deleted in the meantime, only its ID is set.
+func (db *appdbimpl) CreateMessage(cid string, user User, text string, imageUrl string, clientKey string, keyWindow time.Duration) (Message, bool, error) {
+	return db.insertMessage(cid, user, text, imageUrl, clientKey, keyWindow, nil)
+}
+
+// insertMessage implements CreateMessage. If `attach` is not nil, it is called in the same transaction once the message
+// row exists, to save data that belongs to the message.
+func (db *appdbimpl) insertMessage(cid string, user User, text string, imageUrl string, clientKey string, keyWindow time.Duration,
+	attach func(tx *sql.Tx, mid string) error) (Message, bool, error) {
+	id, err := uuid.NewV4()
 	if err != nil {
-		return Conversation{}, err
+		return Message{}, false, err
 	}
-	return db.GetConversation(cid)
+
+	tx, err := db.c.Begin()
+	if err != nil {
+		return Message{}, false, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if clientKey != "" {
+		// Forget the keys that are out of the window, then claim this one. Writing first keeps concurrent retries from
+		// both seeing the key as free.
+		cutoff := time.Now().Add(-keyWindow).UTC().Format(sqlTimeLayout)
+		if _, err = tx.Exec("DELETE FROM message_client_keys WHERE created_at <= ?", cutoff); err != nil {
+			return Message{}, false, err
+		}
+		res, err := tx.Exec(`INSERT OR IGNORE INTO message_client_keys (sender_id, conversation_id, client_key, message_id, created_at)
+			VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)`, user.UId, cid, clientKey, id.String())
+		if err != nil {
+			return Message{}, false, err
+		}
+		if claimed, _ := res.RowsAffected(); claimed == 0 {
+			var originalId string
+			err = tx.QueryRow(`SELECT message_id FROM message_client_keys
+				WHERE sender_id = ? AND conversation_id = ? AND client_key = ?`, user.UId, cid, clientKey).Scan(&originalId)
+			if err != nil {
+				return Message{}, false, err
+			}
+			if err = tx.Commit(); err != nil {
+				return Message{}, false, err
+			}
+
+			original, err := db.GetMessage(cid, originalId)
+			if errors.Is(err, sql.ErrNoRows) {
+				return Message{Id: originalId}, true, nil
+			}
+			return original, true, err
+		}
+	}
+
+	_, err = tx.Exec("INSERT INTO messages (id, conversation_id, sender_id, message, image_url, expires_at) VALUES (?, ?, ?, ?, ?, "+
+		messageExpirySQL+")", id.String(), cid, user.UId, text, imageUrl, cid)
+	if err != nil {
+		return Message{}, false, err
+	}
+	if attach != nil {
+		if err = attach(tx, id.String()); err != nil {
+			return Message{}, false, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return Message{}, false, err
+	}
+
+	message, err := db.GetMessage(cid, id.String())
+	return message, false, err
 }
 
-func (db *appdbimpl) ForwardMessage(cid string, user User, mid string) (Conversation, error) {
-	var message string
-	err := db.c.QueryRow("SELECT message FROM messages WHERE id = ?", mid).Scan(&message)
+// GetMessage returns the message `mid` of the conversation `cid`. It returns sql.ErrNoRows if the message does not
+// exist, has expired, or belongs to another conversation. A message deleted for everyone is returned as a tombstone,
+// with DeletedAt set and no content.
+func (db *appdbimpl) GetMessage(cid string, mid string) (Message, error) {
+	var m Message
+	var timestamp time.Time
+	var fwdMessageId, fwdSenderId, fwdSenderUsername sql.NullString
+	var isPoll bool
+	var lpURL, lpTitle, lpDescription, lpImageURL, lpSiteName sql.NullString
+	var deletedAt sql.NullString
+	err := db.c.QueryRow(`
+		SELECT m.id, `+messageTextSQL+`, `+messageImageSQL+`, m.sender_id, u.username, m.timestamp,
+			m.forwarded_from_message_id, m.forwarded_from_sender_id, fu.username,
+			m.deleted_at IS NULL AND EXISTS(SELECT 1 FROM polls p WHERE p.message_id = m.id), `+linkPreviewColumns+`,
+			CAST(m.deleted_at AS TEXT)
+		FROM messages m
+		JOIN users u ON m.sender_id = u.id
+		LEFT JOIN users fu ON m.forwarded_from_sender_id = fu.id
+		`+linkPreviewJoin+`
+		WHERE m.id = ? AND m.conversation_id = ? AND `+unexpiredSQL, mid, cid).Scan(&m.Id, &m.Text, &m.ImageUrl, &m.SenderId,
+		&m.SenderUsername, &timestamp, &fwdMessageId, &fwdSenderId, &fwdSenderUsername, &isPoll,
+		&lpURL, &lpTitle, &lpDescription, &lpImageURL, &lpSiteName, &deletedAt)
 	if err != nil {
-		return Conversation{}, err
+		return Message{}, err
 	}
+	m.LinkPreview = newLinkPreview(lpURL, lpTitle, lpDescription, lpImageURL, lpSiteName)
+	if deletedAt.Valid {
+		m.DeletedAt = formatTimestamp(deletedAt.String)
+	}
+	if isPoll {
+		if m.Poll, err = db.getPoll(m.Id, ""); err != nil {
+			return Message{}, err
+		}
+	}
+	m.Time = timestamp.Format(time.RFC3339)
+	if fwdMessageId.Valid {
+		m.ForwardedFrom = &ForwardedFrom{
+			MessageId:      fwdMessageId.String,
+			SenderId:       fwdSenderId.String,
+			SenderUsername: fwdSenderUsername.String,
+		}
+	}
+	return m, nil
+}
 
-	_, err = db.SendMessage(cid, user, message)
+// ForwardMessage copies the message `mid` of conversation `sourceCid` (text and image) into `targetCid` as a new
+// message sent by `user`. The new message records the original message and sender; forwarding a forwarded message
+// keeps the attribution to the very first one. The user must be a participant of both conversations.
+func (db *appdbimpl) ForwardMessage(sourceCid string, mid string, user User, targetCid string) (Message, error) {
+	if err := db.checkMessageAccess(sourceCid, user, mid); err != nil {
+		return Message{}, err
+	}
+
+	original, err := db.GetMessage(sourceCid, mid)
 	if err != nil {
-		return Conversation{}, err
+		return Message{}, err
 	}
 
-	return db.GetConversation(cid)
+	ok, err := db.IsParticipant(targetCid, user.UId)
+	if err != nil {
+		return Message{}, err
+	}
+	if !ok {
+		return Message{}, ErrNotParticipant
+	}
+
+	forwardedFrom := ForwardedFrom{
+		MessageId:      original.Id,
+		SenderId:       original.SenderId,
+		SenderUsername: original.SenderUsername,
+	}
+	if original.ForwardedFrom != nil {
+		forwardedFrom = *original.ForwardedFrom
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return Message{}, err
+	}
+
+	var imageUrl interface{}
+	if original.ImageUrl != "" {
+		imageUrl = original.ImageUrl
+	}
+	_, err = db.c.Exec(`INSERT INTO messages (id, conversation_id, sender_id, message, image_url,
+			forwarded_from_message_id, forwarded_from_sender_id, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, `+messageExpirySQL+`)`,
+		id.String(), targetCid, user.UId, original.Text, imageUrl, forwardedFrom.MessageId, forwardedFrom.SenderId, targetCid)
+	if err != nil {
+		return Message{}, err
+	}
+
+	return db.GetMessage(targetCid, id.String())
 }
 
-func (db *appdbimpl) GetConversationMessages(cid string) ([]Message, error) {
+// GetConversationMessages returns the messages of the conversation as seen by `user`, with their reactions. Messages sent
+// before the user cleared the conversation history, and messages the user deleted for themselves, are not returned.
+// Messages deleted for everyone are returned as tombstones. The messages of `user` are read once another participant
+// read them.
+func (db *appdbimpl) GetConversationMessages(cid string, user User) ([]Message, error) {
 	rows, err := db.c.Query(`
-		SELECT m.id, m.conversation_id, m.message, COALESCE(m.image_url, '') as image_url, m.sender_id, m.timestamp, u.username
+		SELECT m.id, m.conversation_id, `+messageTextSQL+`, `+messageImageSQL+` as image_url, m.sender_id, m.timestamp, u.username,
+			m.forwarded_from_message_id, m.forwarded_from_sender_id, fu.username,
+			(SELECT COUNT(*) FROM comments c WHERE c.message_id = m.id) as comment_count,
+			(SELECT GROUP_CONCAT(mm.user_id) FROM message_mentions mm WHERE mm.message_id = m.id) as mentions,
+			m.deleted_at IS NULL AND EXISTS(SELECT 1 FROM polls p WHERE p.message_id = m.id) as is_poll, `+linkPreviewColumns+`,
+			EXISTS(SELECT 1 FROM starred_messages st WHERE st.message_id = m.id AND st.user_id = ?) as starred,
+			m.sender_id = ? AND EXISTS(SELECT 1 FROM read_status r WHERE r.message_id = m.id AND r.user_id != ?) as is_read,
+			CAST(m.deleted_at AS TEXT) as deleted_at
 		FROM messages m 
 		JOIN users u ON m.sender_id = u.id 
+		LEFT JOIN users fu ON m.forwarded_from_sender_id = fu.id
+		`+linkPreviewJoin+`
+		LEFT JOIN conversation_user_state s ON s.conversation_id = m.conversation_id AND s.user_id = ?
 		WHERE m.conversation_id = ? 
-		ORDER BY m.timestamp ASC`, cid)
+		AND (s.cleared_at IS NULL OR m.timestamp > s.cleared_at)
+		AND `+unexpiredSQL+`
+		AND `+notHiddenSQL+`
+		ORDER BY m.timestamp ASC`, user.UId, user.UId, user.UId, user.UId, cid, user.UId)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
 	var messages []Message
+	var polls []int
 	for rows.Next() {
 		var m Message
 		var sender User
 		var timestamp time.Time
 		var conversationId string
-		if scanErr := rows.Scan(&m.Id, &conversationId, &m.Text, &m.ImageUrl, &sender.UId, &timestamp, &sender.Username); scanErr != nil {
+		var fwdMessageId, fwdSenderId, fwdSenderUsername sql.NullString
+		var mentions sql.NullString
+		var isPoll bool
+		var lpURL, lpTitle, lpDescription, lpImageURL, lpSiteName sql.NullString
+		var deletedAt sql.NullString
+		if scanErr := rows.Scan(&m.Id, &conversationId, &m.Text, &m.ImageUrl, &sender.UId, &timestamp, &sender.Username,
+			&fwdMessageId, &fwdSenderId, &fwdSenderUsername, &m.CommentCount, &mentions, &isPoll,
+			&lpURL, &lpTitle, &lpDescription, &lpImageURL, &lpSiteName, &m.Starred, &m.IsRead, &deletedAt); scanErr != nil {
 			return nil, scanErr
 		}
+		m.LinkPreview = newLinkPreview(lpURL, lpTitle, lpDescription, lpImageURL, lpSiteName)
+		if deletedAt.Valid {
+			m.DeletedAt = formatTimestamp(deletedAt.String)
+		}
 		m.SenderId = sender.UId
 		m.SenderUsername = sender.Username
 		m.Time = timestamp.Format(time.RFC3339)
+		if fwdMessageId.Valid {
+			m.ForwardedFrom = &ForwardedFrom{
+				MessageId:      fwdMessageId.String,
+				SenderId:       fwdSenderId.String,
+				SenderUsername: fwdSenderUsername.String,
+			}
+		}
+		if mentions.Valid {
+			m.Mentions = strings.Split(mentions.String, ",")
+		}
+		if isPoll {
+			polls = append(polls, len(messages))
+		}
 		messages = append(messages, m)
 	}
 
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
+	rows.Close()
+
+	for _, i := range polls {
+		if messages[i].Poll, err = db.getPoll(messages[i].Id, user.UId); err != nil {
+			return nil, err
+		}
+	}
+
+	reactions, err := db.getConversationReactions(cid)
+	if err != nil {
+		return nil, err
+	}
+	for i := range messages {
+		messages[i].Reactions = reactions[messages[i].Id]
+		if messages[i].Reactions == nil {
+			messages[i].Reactions = make(map[string]Reaction)
+		}
+	}
 
 	return messages, nil
 }
 
-func (db *appdbimpl) ReactToMessage(cid string, user User, mid string, emoji string) (Conversation, error) {
-	id, err := uuid.NewV4()
+// getConversationReactions returns the reactions to the messages of the conversation `cid`, by message and emoji, as
+// GetMessageReactions groups them
+func (db *appdbimpl) getConversationReactions(cid string) (map[string]map[string]Reaction, error) {
+	rows, err := db.c.Query(`
+		SELECT r.message_id, r.emoji, r.sender_id
+		FROM reactions r
+		JOIN messages m ON m.id = r.message_id
+		WHERE m.conversation_id = ?
+		ORDER BY r.message_id, r.emoji, r.sender_id`, cid)
 	if err != nil {
-		return Conversation{}, err
+		return nil, err
+	}
+	defer rows.Close()
+
+	reactions := make(map[string]map[string]Reaction)
+	for rows.Next() {
+		var mid, emoji, senderId string
+		if scanErr := rows.Scan(&mid, &emoji, &senderId); scanErr != nil {
+			return nil, scanErr
+		}
+		if reactions[mid] == nil {
+			reactions[mid] = make(map[string]Reaction)
+		}
+		reaction := reactions[mid][emoji]
+		reaction.Count++
+		reaction.UserIds = append(reaction.UserIds, senderId)
+		reactions[mid][emoji] = reaction
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return reactions, nil
+}
+
+// ToggleReaction adds the reaction `emoji` of `user` to the message `mid` of conversation `cid`, or removes it if the
+// user already reacted with that emoji. It returns true if the reaction is now present. Adding a new distinct emoji
+// to a message that already has `maxDistinct` of them fails with ErrReactionLimit.
+func (db *appdbimpl) ToggleReaction(cid string, user User, mid string, emoji string, maxDistinct int) (bool, error) {
+	if err := db.checkMessageAccess(cid, user, mid); err != nil {
+		return false, err
+	}
+
+	tx, err := db.c.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	res, err := tx.Exec("DELETE FROM reactions WHERE message_id = ? AND sender_id = ? AND emoji = ?",
+		mid, user.UId, emoji)
+	if err != nil {
+		return false, err
+	}
+	if removed, _ := res.RowsAffected(); removed > 0 {
+		return false, tx.Commit()
 	}
 
-	_, err = db.c.Exec("INSERT INTO reactions (id, message_id, sender_id, emoji) VALUES (?, ?, ?, ?)",
+	// Only a new emoji counts towards the limit; joining an existing reaction is always allowed
+	var distinct int
+	var present bool
+	err = tx.QueryRow(`SELECT COUNT(DISTINCT emoji), COALESCE(SUM(emoji = ?), 0) > 0 FROM reactions WHERE message_id = ?`,
+		emoji, mid).Scan(&distinct, &present)
+	if err != nil {
+		return false, err
+	}
+	if !present && distinct >= maxDistinct {
+		return false, ErrReactionLimit
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec("INSERT OR IGNORE INTO reactions (id, message_id, sender_id, emoji) VALUES (?, ?, ?, ?)",
 		id.String(), mid, user.UId, emoji)
 	if err != nil {
-		return Conversation{}, err
+		return false, err
 	}
 
-	return db.GetConversation(cid)
+	return true, tx.Commit()
 }
 
-func (db *appdbimpl) RemoveReaction(cid string, user User, mid string, emoji string) (Conversation, error) {
-	_, err := db.c.Exec("DELETE FROM reactions WHERE message_id = ? AND sender_id = ? AND emoji = ?",
+// RemoveReaction removes the reaction `emoji` of `user` from the message `mid`. Removing a reaction that does not
+// exist is not an error; the returned value tells whether a reaction was actually removed.
+func (db *appdbimpl) RemoveReaction(cid string, user User, mid string, emoji string) (bool, error) {
+	if err := db.checkMessageAccess(cid, user, mid); err != nil {
+		return false, err
+	}
+
+	res, err := db.c.Exec("DELETE FROM reactions WHERE message_id = ? AND sender_id = ? AND emoji = ?",
 		mid, user.UId, emoji)
 	if err != nil {
-		return Conversation{}, err
+		return false, err
+	}
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return false, err
 	}
+	return removed > 0, nil
+}
 
-	return db.GetConversation(cid)
+// GetVisibleMessage is GetMessage for a participant of the conversation: it returns ErrNotParticipant if `user` is not
+// one, and sql.ErrNoRows if they cannot see the message, like GetConversationMessages
+func (db *appdbimpl) GetVisibleMessage(cid string, user User, mid string) (Message, error) {
+	if err := db.checkMessageReadAccess(cid, user, mid); err != nil {
+		return Message{}, err
+	}
+	return db.GetMessage(cid, mid)
 }
 
-func (db *appdbimpl) CommentMessage(cid string, user User, mid string, comment string) (Conversation, error) {
-	id, err := uuid.NewV4()
+// GetMessageReactions returns the reactions to the message `mid`, grouped by emoji
+func (db *appdbimpl) GetMessageReactions(mid string) (map[string]Reaction, error) {
+	rows, err := db.c.Query("SELECT emoji, sender_id FROM reactions WHERE message_id = ? ORDER BY emoji, sender_id", mid)
 	if err != nil {
-		return Conversation{}, err
+		return nil, err
+	}
+	defer rows.Close()
+
+	reactions := make(map[string]Reaction)
+	for rows.Next() {
+		var emoji, senderId string
+		if scanErr := rows.Scan(&emoji, &senderId); scanErr != nil {
+			return nil, scanErr
+		}
+		reaction := reactions[emoji]
+		reaction.Count++
+		reaction.UserIds = append(reaction.UserIds, senderId)
+		reactions[emoji] = reaction
 	}
 
-	_, err = db.c.Exec("INSERT INTO comments (id, message_id, sender_id, comment) VALUES (?, ?, ?, ?)",
-		id.String(), mid, user.UId, comment)
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return reactions, nil
+}
+
+// checkMessageAccess checks that the message `mid` belongs to the conversation `cid` and that `user` is one of its
+// participants who can see it, as GetConversationMessages lists them. It returns sql.ErrNoRows if the conversation or
+// the message does not exist, if the message was deleted for everyone, or if the user cannot see it: it expired, was
+// sent before the history they cleared, or they deleted it for themselves.
+func (db *appdbimpl) checkMessageAccess(cid string, user User, mid string) error {
+	deleted, err := db.checkVisibleMessage(cid, user, mid)
 	if err != nil {
-		return Conversation{}, err
+		return err
+	}
+	if deleted {
+		return sql.ErrNoRows
 	}
+	return nil
+}
 
-	return db.GetConversation(cid)
+// checkMessageReadAccess is like checkMessageAccess, but accepts messages deleted for everyone
+func (db *appdbimpl) checkMessageReadAccess(cid string, user User, mid string) error {
+	_, err := db.checkVisibleMessage(cid, user, mid)
+	return err
 }
 
-func (db *appdbimpl) UncommentMessage(cid string, user User, mid string, commentId string) (Conversation, error) {
-	_, err := db.c.Exec("DELETE FROM comments WHERE id = ? AND sender_id = ?",
-		commentId, user.UId)
+// checkVisibleMessage checks that `user` is a participant of the conversation `cid` who can see the message `mid`,
+// and returns whether the message was deleted for everyone
+func (db *appdbimpl) checkVisibleMessage(cid string, user User, mid string) (bool, error) {
+	ok, err := db.IsParticipant(cid, user.UId)
 	if err != nil {
-		return Conversation{}, err
+		return false, err
+	}
+	if !ok {
+		return false, ErrNotParticipant
 	}
 
-	return db.GetConversation(cid)
+	var deleted bool
+	err = db.c.QueryRow(`
+		SELECT m.deleted_at IS NOT NULL
+		FROM messages m
+		LEFT JOIN conversation_user_state s ON s.conversation_id = m.conversation_id AND s.user_id = ?
+		WHERE m.id = ? AND m.conversation_id = ?
+		AND (s.cleared_at IS NULL OR m.timestamp > s.cleared_at)
+		AND `+unexpiredSQL+`
+		AND `+notHiddenSQL, user.UId, mid, cid, user.UId).Scan(&deleted)
+	return deleted, err
+}
+
+// checkMessageExists checks that the message `mid` belongs to the conversation `cid` and that `user` is one of its
+// participants, whether or not they can still see the message
+func (db *appdbimpl) checkMessageExists(cid string, user User, mid string) error {
+	ok, err := db.IsParticipant(cid, user.UId)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotParticipant
+	}
+	_, err = db.GetMessage(cid, mid)
+	return err
 }
 
 func (db *appdbimpl) MarkMessageAsRead(messageId string, userId string) error {
+	// A message read again keeps the time it was first read
 	_, err := db.c.Exec(`
-		INSERT OR REPLACE INTO read_status (id, message_id, user_id, read_at) 
+		INSERT OR IGNORE INTO read_status (id, message_id, user_id, read_at) 
 		VALUES (?, ?, ?, strftime('%s', 'now'))`,
 		messageId+"-"+userId, messageId, userId)
 
 	return err
 }
+
+// MarkConversationRead marks as read by `user` the messages of the conversation that they received and can see, and
+// returns how many were not read yet
+func (db *appdbimpl) MarkConversationRead(cid string, user User) (int, error) {
+	res, err := db.c.Exec(`
+		INSERT OR IGNORE INTO read_status (id, message_id, user_id, read_at)
+		SELECT m.id || '-' || ?, m.id, ?, strftime('%s', 'now')
+		FROM messages m
+		LEFT JOIN conversation_user_state s ON s.conversation_id = m.conversation_id AND s.user_id = ?
+		WHERE m.conversation_id = ? AND m.sender_id != ?
+		AND (s.cleared_at IS NULL OR m.timestamp > s.cleared_at)
+		AND `+unexpiredSQL+`
+		AND `+notHiddenSQL,
+		user.UId, user.UId, user.UId, cid, user.UId, user.UId)
+	if err != nil {
+		return 0, err
+	}
+	marked, err := res.RowsAffected()
+	return int(marked), err
+}
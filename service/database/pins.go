@@ -0,0 +1,112 @@
+package database
+
+import (
+	"database/sql"
+)
+
+// checkPinAccess verifies that `user` can pin and unpin the message `mid` of conversation `cid`. Any participant can
+// pin in a one-to-one conversation, while in groups only the owner can. Groups created before conversations had an
+// owner are open to every participant.
+func (db *appdbimpl) checkPinAccess(cid string, user User, mid string) error {
+	if err := db.checkMessageAccess(cid, user, mid); err != nil {
+		return err
+	}
+
+	var ownerId sql.NullString
+	var participantCount int
+	err := db.c.QueryRow("SELECT owner_id, json_array_length(participants) FROM conversations WHERE id = ?", cid).
+		Scan(&ownerId, &participantCount)
+	if err != nil {
+		return err
+	}
+	if participantCount > 2 && ownerId.Valid && ownerId.String != user.UId {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// PinMessage pins the message `mid` in conversation `cid`. It returns false if the message was already pinned.
+func (db *appdbimpl) PinMessage(cid string, user User, mid string) (bool, error) {
+	if err := db.checkPinAccess(cid, user, mid); err != nil {
+		return false, err
+	}
+
+	res, err := db.c.Exec(`INSERT OR IGNORE INTO pinned_messages (conversation_id, message_id, pinned_by, pinned_at)
+		VALUES (?, ?, ?, strftime('%Y-%m-%d %H:%M:%f', 'now'))`, cid, mid, user.UId)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// UnpinMessage unpins the message `mid` from conversation `cid`. It returns false if the message was not pinned.
+func (db *appdbimpl) UnpinMessage(cid string, user User, mid string) (bool, error) {
+	if err := db.checkPinAccess(cid, user, mid); err != nil {
+		return false, err
+	}
+
+	res, err := db.c.Exec("DELETE FROM pinned_messages WHERE conversation_id = ? AND message_id = ?", cid, mid)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// ListPins returns the pinned messages of conversation `cid`, most recently pinned first. The user must be a
+// participant of the conversation.
+func (db *appdbimpl) ListPins(cid string, user User) ([]Pin, error) {
+	ok, err := db.IsParticipant(cid, user.UId)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotParticipant
+	}
+	return db.getPins(cid, -1)
+}
+
+// getPins returns up to `limit` pins of conversation `cid`, most recent first. A negative limit returns all of them.
+func (db *appdbimpl) getPins(cid string, limit int) ([]Pin, error) {
+	rows, err := db.c.Query(`
+		SELECT p.message_id, p.pinned_by, COALESCE(u.username, ''), CAST(p.pinned_at AS TEXT)
+		FROM pinned_messages p
+		JOIN messages m ON m.id = p.message_id
+		LEFT JOIN users u ON p.pinned_by = u.id
+		WHERE p.conversation_id = ? AND `+unexpiredSQL+`
+		ORDER BY p.pinned_at DESC, p.message_id
+		LIMIT ?`, cid, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pins := make([]Pin, 0)
+	for rows.Next() {
+		var p Pin
+		var pinnedAt string
+		if scanErr := rows.Scan(&p.Message.Id, &p.PinnedBy, &p.PinnedByUsername, &pinnedAt); scanErr != nil {
+			return nil, scanErr
+		}
+		p.PinnedAt = formatTimestamp(pinnedAt)
+		pins = append(pins, p)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range pins {
+		pins[i].Message, err = db.GetMessage(cid, pins[i].Message.Id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pins, nil
+}
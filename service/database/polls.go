@@ -0,0 +1,196 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// CreatePollMessage sends a poll to conversation `cid`. The text of the message is the question of the poll. Only the
+// question, options and flags of `poll` are used; `closesAt` optionally closes the poll at that time. Idempotency keys
+// work as in CreateMessage.
+func (db *appdbimpl) CreatePollMessage(cid string, user User, poll Poll, closesAt *time.Time, clientKey string, keyWindow time.Duration) (Message, bool, error) {
+	var closesAtValue interface{}
+	if closesAt != nil {
+		closesAtValue = closesAt.UTC().Format(sqlTimeLayout)
+	}
+
+	return db.insertMessage(cid, user, poll.Question, "", clientKey, keyWindow, func(tx *sql.Tx, mid string) error {
+		_, err := tx.Exec(`INSERT INTO polls (message_id, multiple_choice, anonymous, closes_at) VALUES (?, ?, ?, ?)`,
+			mid, poll.MultipleChoice, poll.Anonymous, closesAtValue)
+		if err != nil {
+			return err
+		}
+		for i, option := range poll.Options {
+			_, err = tx.Exec("INSERT INTO poll_options (message_id, idx, text) VALUES (?, ?, ?)", mid, i, option.Text)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// VotePoll replaces the votes of `user` on the poll `mid` of conversation `cid` with `options`, which are indexes in
+// the options of the poll. A single choice poll takes exactly one option. It returns the updated poll.
+func (db *appdbimpl) VotePoll(cid string, user User, mid string, options []int) (*Poll, error) {
+	poll, err := db.checkPollAccess(cid, user, mid)
+	if err != nil {
+		return nil, err
+	}
+	if poll.Closed {
+		return nil, ErrPollClosed
+	}
+	if len(options) == 0 || (!poll.MultipleChoice && len(options) > 1) {
+		return nil, ErrInvalidVote
+	}
+	seen := make(map[int]bool)
+	for _, option := range options {
+		if option < 0 || option >= len(poll.Options) || seen[option] {
+			return nil, ErrInvalidVote
+		}
+		seen[option] = true
+	}
+
+	tx, err := db.c.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err = tx.Exec("DELETE FROM poll_votes WHERE message_id = ? AND user_id = ?", mid, user.UId); err != nil {
+		return nil, err
+	}
+	for _, option := range options {
+		_, err = tx.Exec(`INSERT INTO poll_votes (message_id, option_idx, user_id, voted_at)
+			VALUES (?, ?, ?, strftime('%Y-%m-%d %H:%M:%f', 'now'))`, mid, option, user.UId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return db.getPoll(mid, user.UId)
+}
+
+// RetractVote removes the votes of `user` on the poll `mid` of conversation `cid`. It returns the updated poll.
+func (db *appdbimpl) RetractVote(cid string, user User, mid string) (*Poll, error) {
+	poll, err := db.checkPollAccess(cid, user, mid)
+	if err != nil {
+		return nil, err
+	}
+	if poll.Closed {
+		return nil, ErrPollClosed
+	}
+
+	if _, err = db.c.Exec("DELETE FROM poll_votes WHERE message_id = ? AND user_id = ?", mid, user.UId); err != nil {
+		return nil, err
+	}
+	return db.getPoll(mid, user.UId)
+}
+
+// ClosePoll stops the voting on the poll `mid` of conversation `cid`. Only the creator of the poll can close it.
+// Closing a closed poll has no effect. It returns the updated poll.
+func (db *appdbimpl) ClosePoll(cid string, user User, mid string) (*Poll, error) {
+	poll, err := db.checkPollAccess(cid, user, mid)
+	if err != nil {
+		return nil, err
+	}
+
+	var senderId string
+	err = db.c.QueryRow("SELECT sender_id FROM messages WHERE id = ?", mid).Scan(&senderId)
+	if err != nil {
+		return nil, err
+	}
+	if senderId != user.UId {
+		return nil, ErrForbidden
+	}
+	if poll.Closed {
+		return poll, nil
+	}
+
+	_, err = db.c.Exec("UPDATE polls SET closed_at = CURRENT_TIMESTAMP WHERE message_id = ? AND closed_at IS NULL", mid)
+	if err != nil {
+		return nil, err
+	}
+	return db.getPoll(mid, user.UId)
+}
+
+// checkPollAccess verifies that `user` can see the message `mid` of conversation `cid`, and returns its poll. It
+// returns sql.ErrNoRows if the message is not a poll.
+func (db *appdbimpl) checkPollAccess(cid string, user User, mid string) (*Poll, error) {
+	if err := db.checkMessageAccess(cid, user, mid); err != nil {
+		return nil, err
+	}
+	return db.getPoll(mid, user.UId)
+}
+
+// getPoll returns the poll of message `mid` with its tallies. MyVotes is filled in for `viewerId`, if not empty. Voters
+// are listed only if the poll is not anonymous. It returns sql.ErrNoRows if the message is not a poll.
+func (db *appdbimpl) getPoll(mid string, viewerId string) (*Poll, error) {
+	var poll Poll
+	var closesAt sql.NullString
+	err := db.c.QueryRow(`
+		SELECT m.message, p.multiple_choice, p.anonymous, CAST(p.closes_at AS TEXT),
+			p.closed_at IS NOT NULL OR COALESCE(p.closes_at <= CURRENT_TIMESTAMP, 0)
+		FROM polls p
+		JOIN messages m ON m.id = p.message_id
+		WHERE p.message_id = ?`, mid).Scan(&poll.Question, &poll.MultipleChoice, &poll.Anonymous, &closesAt, &poll.Closed)
+	if err != nil {
+		return nil, err
+	}
+	if closesAt.Valid {
+		poll.ClosesAt = formatTimestamp(closesAt.String)
+	}
+
+	rows, err := db.c.Query("SELECT text FROM poll_options WHERE message_id = ? ORDER BY idx", mid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	poll.Options = make([]PollOption, 0)
+	for rows.Next() {
+		var option PollOption
+		if err = rows.Scan(&option.Text); err != nil {
+			return nil, err
+		}
+		poll.Options = append(poll.Options, option)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	votes, err := db.c.Query("SELECT option_idx, user_id FROM poll_votes WHERE message_id = ? ORDER BY voted_at, user_id", mid)
+	if err != nil {
+		return nil, err
+	}
+	defer votes.Close()
+	voters := make(map[string]bool)
+	for votes.Next() {
+		var option int
+		var userId string
+		if err = votes.Scan(&option, &userId); err != nil {
+			return nil, err
+		}
+		if option < 0 || option >= len(poll.Options) {
+			continue
+		}
+		poll.Options[option].Votes++
+		if !poll.Anonymous {
+			poll.Options[option].VoterIds = append(poll.Options[option].VoterIds, userId)
+		}
+		if userId == viewerId {
+			poll.MyVotes = append(poll.MyVotes, option)
+		}
+		voters[userId] = true
+	}
+	if err = votes.Err(); err != nil {
+		return nil, err
+	}
+	poll.VoterCount = len(voters)
+
+	return &poll, nil
+}
@@ -0,0 +1,42 @@
+package database
+
+import (
+	"database/sql"
+)
+
+// SetLinkPreview saves the preview of the link in message `mid`, replacing the previous one. It returns
+// sql.ErrNoRows if the message was deleted in the meantime, for everyone or because it expired.
+func (db *appdbimpl) SetLinkPreview(mid string, preview LinkPreview) error {
+	res, err := db.c.Exec(`
+		INSERT OR REPLACE INTO link_previews (message_id, url, title, description, image_url, site_name, fetched_at)
+		SELECT id, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP FROM messages WHERE id = ? AND deleted_at IS NULL`,
+		preview.URL, preview.Title, preview.Description, preview.ImageURL, preview.SiteName, mid)
+	if err != nil {
+		return err
+	}
+	if saved, _ := res.RowsAffected(); saved == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// linkPreviewColumns selects the preview of message `m` from linkPreviewJoin; all the columns are NULL if the message
+// has no preview
+const linkPreviewColumns = "lp.url, lp.title, lp.description, lp.image_url, lp.site_name"
+
+// linkPreviewJoin joins the preview of message `m`, if any, as `lp`. Messages deleted for everyone have none.
+const linkPreviewJoin = "LEFT JOIN link_previews lp ON lp.message_id = m.id AND m.deleted_at IS NULL"
+
+// newLinkPreview returns the preview scanned from linkPreviewColumns, or nil if the message has none
+func newLinkPreview(url, title, description, imageURL, siteName sql.NullString) *LinkPreview {
+	if !url.Valid {
+		return nil
+	}
+	return &LinkPreview{
+		URL:         url.String,
+		Title:       title.String,
+		Description: description.String,
+		ImageURL:    imageURL.String,
+		SiteName:    siteName.String,
+	}
+}
@@ -0,0 +1,225 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// sqlTimeLayout is how times are stored, in UTC. It sorts and compares as text like the timestamps SQLite generates
+// with CURRENT_TIMESTAMP.
+const sqlTimeLayout = "2006-01-02 15:04:05"
+
+// ScheduleMessage queues a message from `user` to conversation `cid`, to be sent at `sendAt`. The user must be a
+// participant of the conversation.
+func (db *appdbimpl) ScheduleMessage(cid string, user User, text string, imageUrl string, sendAt time.Time) (ScheduledMessage, error) {
+	ok, err := db.IsParticipant(cid, user.UId)
+	if err != nil {
+		return ScheduledMessage{}, err
+	}
+	if !ok {
+		return ScheduledMessage{}, ErrNotParticipant
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return ScheduledMessage{}, err
+	}
+
+	_, err = db.c.Exec(`INSERT INTO scheduled_messages (id, conversation_id, sender_id, message, image_url, send_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, id.String(), cid, user.UId, text, imageUrl, sendAt.UTC().Format(sqlTimeLayout))
+	if err != nil {
+		return ScheduledMessage{}, err
+	}
+	return db.getScheduledMessage(user, id.String())
+}
+
+// ListScheduledMessages returns the messages `user` scheduled and that were not sent yet, the next to be sent first
+func (db *appdbimpl) ListScheduledMessages(user User) ([]ScheduledMessage, error) {
+	rows, err := db.c.Query(`
+		SELECT id, conversation_id, sender_id, message, COALESCE(image_url, ''), CAST(send_at AS TEXT)
+		FROM scheduled_messages
+		WHERE sender_id = ?
+		ORDER BY send_at, id`, user.UId)
+	if err != nil {
+		return nil, err
+	}
+	return scanScheduledMessages(rows)
+}
+
+// UpdateScheduledMessage changes the content and send time of a message `user` scheduled. It returns sql.ErrNoRows if
+// the message does not exist, was already sent, or was scheduled by someone else.
+func (db *appdbimpl) UpdateScheduledMessage(user User, id string, text string, imageUrl string, sendAt time.Time) (ScheduledMessage, error) {
+	res, err := db.c.Exec(`UPDATE scheduled_messages SET message = ?, image_url = ?, send_at = ?
+		WHERE id = ? AND sender_id = ?`, text, imageUrl, sendAt.UTC().Format(sqlTimeLayout), id, user.UId)
+	if err != nil {
+		return ScheduledMessage{}, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return ScheduledMessage{}, err
+	}
+	if affected == 0 {
+		return ScheduledMessage{}, sql.ErrNoRows
+	}
+	return db.getScheduledMessage(user, id)
+}
+
+// CancelScheduledMessage removes a message `user` scheduled before it is sent. It returns sql.ErrNoRows if the
+// message does not exist, was already sent, or was scheduled by someone else.
+func (db *appdbimpl) CancelScheduledMessage(user User, id string) error {
+	res, err := db.c.Exec("DELETE FROM scheduled_messages WHERE id = ? AND sender_id = ?", id, user.UId)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetDueScheduledMessages returns up to `limit` scheduled messages whose send time is not after `now`, oldest first
+func (db *appdbimpl) GetDueScheduledMessages(now time.Time, limit int) ([]ScheduledMessage, error) {
+	rows, err := db.c.Query(`
+		SELECT id, conversation_id, sender_id, message, COALESCE(image_url, ''), CAST(send_at AS TEXT)
+		FROM scheduled_messages
+		WHERE CAST(send_at AS TEXT) <= ?
+		ORDER BY send_at, id
+		LIMIT ?`, now.UTC().Format(sqlTimeLayout), limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanScheduledMessages(rows)
+}
+
+// NextScheduledMessageTime returns the send time of the next scheduled message. The boolean is false if no message
+// is scheduled.
+func (db *appdbimpl) NextScheduledMessageTime() (time.Time, bool, error) {
+	var sendAt sql.NullString
+	err := db.c.QueryRow("SELECT CAST(MIN(send_at) AS TEXT) FROM scheduled_messages").Scan(&sendAt)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if !sendAt.Valid {
+		return time.Time{}, false, nil
+	}
+	t, err := time.Parse(sqlTimeLayout, sendAt.String)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return t, true, nil
+}
+
+// DeliverScheduledMessage turns the scheduled message `id` into a regular message of its conversation, keeping the
+// same ID. It returns sql.ErrNoRows if the message is not due anymore (it was sent, cancelled or postponed) or if its
+// conversation was deleted, and ErrNotParticipant if the sender left the conversation in the meantime. In the last two
+// cases the message is discarded.
+func (db *appdbimpl) DeliverScheduledMessage(id string, now time.Time) (Message, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return Message{}, err
+	}
+
+	var sm ScheduledMessage
+	err = tx.QueryRow(`
+		SELECT conversation_id, sender_id, message, COALESCE(image_url, '')
+		FROM scheduled_messages
+		WHERE id = ? AND CAST(send_at AS TEXT) <= ?`, id, now.UTC().Format(sqlTimeLayout)).
+		Scan(&sm.ConversationId, &sm.SenderId, &sm.Text, &sm.ImageUrl)
+	if err != nil {
+		_ = tx.Rollback()
+		return Message{}, err
+	}
+
+	if _, err = tx.Exec("DELETE FROM scheduled_messages WHERE id = ?", id); err != nil {
+		_ = tx.Rollback()
+		return Message{}, err
+	}
+
+	var participantsJSON string
+	err = tx.QueryRow("SELECT participants FROM conversations WHERE id = ?", sm.ConversationId).Scan(&participantsJSON)
+	if errors.Is(err, sql.ErrNoRows) {
+		// The conversation is gone, drop the message with it
+		if err = tx.Commit(); err != nil {
+			return Message{}, err
+		}
+		return Message{}, sql.ErrNoRows
+	} else if err != nil {
+		_ = tx.Rollback()
+		return Message{}, err
+	}
+	participantIDs, err := parseParticipantIDs(participantsJSON)
+	if err != nil {
+		_ = tx.Rollback()
+		return Message{}, err
+	}
+	isParticipant := false
+	for _, pid := range participantIDs {
+		if pid == sm.SenderId {
+			isParticipant = true
+			break
+		}
+	}
+	if !isParticipant {
+		if err = tx.Commit(); err != nil {
+			return Message{}, err
+		}
+		return Message{}, ErrNotParticipant
+	}
+
+	_, err = tx.Exec("INSERT INTO messages (id, conversation_id, sender_id, message, image_url, expires_at) VALUES (?, ?, ?, ?, ?, "+
+		messageExpirySQL+")", id, sm.ConversationId, sm.SenderId, sm.Text, sm.ImageUrl, sm.ConversationId)
+	if err != nil {
+		_ = tx.Rollback()
+		return Message{}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return Message{}, err
+	}
+
+	return db.GetMessage(sm.ConversationId, id)
+}
+
+// getScheduledMessage returns the message `id` scheduled by `user`
+func (db *appdbimpl) getScheduledMessage(user User, id string) (ScheduledMessage, error) {
+	rows, err := db.c.Query(`
+		SELECT id, conversation_id, sender_id, message, COALESCE(image_url, ''), CAST(send_at AS TEXT)
+		FROM scheduled_messages
+		WHERE id = ? AND sender_id = ?`, id, user.UId)
+	if err != nil {
+		return ScheduledMessage{}, err
+	}
+	messages, err := scanScheduledMessages(rows)
+	if err != nil {
+		return ScheduledMessage{}, err
+	}
+	if len(messages) == 0 {
+		return ScheduledMessage{}, sql.ErrNoRows
+	}
+	return messages[0], nil
+}
+
+func scanScheduledMessages(rows *sql.Rows) ([]ScheduledMessage, error) {
+	defer rows.Close()
+
+	messages := make([]ScheduledMessage, 0)
+	for rows.Next() {
+		var sm ScheduledMessage
+		var sendAt string
+		if err := rows.Scan(&sm.Id, &sm.ConversationId, &sm.SenderId, &sm.Text, &sm.ImageUrl, &sendAt); err != nil {
+			return nil, err
+		}
+		sm.SendAt = formatTimestamp(sendAt)
+		messages = append(messages, sm)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
@@ -0,0 +1,103 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// CreateSession records a new session of the user `uid`, authenticated by the token with the given hash
+func (db *appdbimpl) CreateSession(uid string, tokenHash string, userAgent string, remoteAddr string) (Session, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return Session{}, err
+	}
+	now := time.Now().UTC().Format(sqlTimeLayout)
+	_, err = db.c.Exec(`INSERT INTO sessions (id, user_id, token_hash, user_agent, remote_addr, created_at, last_active_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, id.String(), uid, tokenHash, userAgent, remoteAddr, now, now)
+	if err != nil {
+		return Session{}, err
+	}
+	return Session{
+		Id:           id.String(),
+		UserId:       uid,
+		UserAgent:    userAgent,
+		RemoteAddr:   remoteAddr,
+		CreatedAt:    formatTimestamp(now),
+		LastActiveAt: formatTimestamp(now),
+	}, nil
+}
+
+// GetSessionByToken returns the session authenticated by the token with the given hash, and its user. It returns
+// sql.ErrNoRows if there is none, e.g. because the session was revoked.
+func (db *appdbimpl) GetSessionByToken(tokenHash string) (Session, User, error) {
+	var s Session
+	var u User
+	var picture sql.NullString
+	var createdAt, lastActiveAt string
+	err := db.c.QueryRow(`SELECT s.id, s.user_agent, s.remote_addr, CAST(s.created_at AS TEXT),
+			CAST(s.last_active_at AS TEXT), u.id, u.username, u.picture, u.is_bot
+		FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.token_hash = ?`, tokenHash).Scan(&s.Id, &s.UserAgent, &s.RemoteAddr, &createdAt, &lastActiveAt,
+		&u.UId, &u.Username, &picture, &u.IsBot)
+	if err != nil {
+		return Session{}, User{}, err
+	}
+	s.UserId = u.UId
+	s.CreatedAt = formatTimestamp(createdAt)
+	s.LastActiveAt = formatTimestamp(lastActiveAt)
+	u.Picture = picture.String
+	return s, u, nil
+}
+
+// TouchSession records that the session `sid` was used now, from `remoteAddr`. Sessions last used after `before` are
+// left alone, so that a burst of requests doesn't write to the database each time.
+func (db *appdbimpl) TouchSession(sid string, remoteAddr string, before time.Time) error {
+	_, err := db.c.Exec("UPDATE sessions SET last_active_at = ?, remote_addr = ? WHERE id = ? AND last_active_at < ?",
+		time.Now().UTC().Format(sqlTimeLayout), remoteAddr, sid, before.UTC().Format(sqlTimeLayout))
+	return err
+}
+
+// ListSessions returns the sessions of the user `uid`, the most recently used first
+func (db *appdbimpl) ListSessions(uid string) ([]Session, error) {
+	rows, err := db.c.Query(`SELECT id, user_agent, remote_addr, CAST(created_at AS TEXT), CAST(last_active_at AS TEXT)
+		FROM sessions WHERE user_id = ? ORDER BY last_active_at DESC, created_at DESC`, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make([]Session, 0)
+	for rows.Next() {
+		s := Session{UserId: uid}
+		var createdAt, lastActiveAt string
+		if err := rows.Scan(&s.Id, &s.UserAgent, &s.RemoteAddr, &createdAt, &lastActiveAt); err != nil {
+			return nil, err
+		}
+		s.CreatedAt = formatTimestamp(createdAt)
+		s.LastActiveAt = formatTimestamp(lastActiveAt)
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// DeleteSession revokes the session `sid` of the user `uid`. It reports whether there was such a session.
+func (db *appdbimpl) DeleteSession(uid string, sid string) (bool, error) {
+	res, err := db.c.Exec("DELETE FROM sessions WHERE id = ? AND user_id = ?", sid, uid)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteSessions revokes all the sessions of the user `uid`, and returns how many there were
+func (db *appdbimpl) DeleteSessions(uid string) (int, error) {
+	res, err := db.c.Exec("DELETE FROM sessions WHERE user_id = ?", uid)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
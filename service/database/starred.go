@@ -0,0 +1,99 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// StarMessage bookmarks the message `mid` of conversation `cid` for `user`. It returns false if the message was
+// already starred.
+func (db *appdbimpl) StarMessage(cid string, user User, mid string) (bool, error) {
+	if err := db.checkMessageAccess(cid, user, mid); err != nil {
+		return false, err
+	}
+
+	res, err := db.c.Exec(`INSERT OR IGNORE INTO starred_messages (user_id, message_id, conversation_id, starred_at)
+		VALUES (?, ?, ?, strftime('%Y-%m-%d %H:%M:%f', 'now'))`, user.UId, mid, cid)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// UnstarMessage removes the bookmark of `user` on the message `mid` of conversation `cid`. It returns false if the
+// message was not starred.
+func (db *appdbimpl) UnstarMessage(cid string, user User, mid string) (bool, error) {
+	if err := db.checkMessageAccess(cid, user, mid); err != nil {
+		return false, err
+	}
+
+	res, err := db.c.Exec("DELETE FROM starred_messages WHERE user_id = ? AND message_id = ?", user.UId, mid)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// GetStarredMessages returns up to `limit` messages starred by `user`, most recently starred first. Stars are removed
+// with their message and when the user leaves the conversation; messages hidden by clearing the history are skipped.
+// If `before` is the ID of a starred message, only the messages starred before it are returned.
+func (db *appdbimpl) GetStarredMessages(user User, before string, limit int) ([]StarredMessage, error) {
+	// Stars are sorted by (starred_at, message_id), so the cursor is the position of the `before` star in that order
+	var beforeStarredAt sql.NullString
+	if before != "" {
+		err := db.c.QueryRow("SELECT CAST(starred_at AS TEXT) FROM starred_messages WHERE user_id = ? AND message_id = ?",
+			user.UId, before).Scan(&beforeStarredAt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := db.c.Query(`
+		SELECT c.id, COALESCE(c.name, ''), CAST(st.starred_at AS TEXT), m.id, m.sender_id, u.username, m.message,
+			COALESCE(m.image_url, ''), m.timestamp
+		FROM starred_messages st
+		JOIN messages m ON m.id = st.message_id
+		JOIN conversations c ON c.id = st.conversation_id
+		JOIN users u ON u.id = m.sender_id
+		LEFT JOIN conversation_user_state s ON s.conversation_id = c.id AND s.user_id = st.user_id
+		WHERE st.user_id = ?
+		AND (s.cleared_at IS NULL OR m.timestamp > s.cleared_at)
+		AND `+unexpiredSQL+`
+		AND (? IS NULL OR st.starred_at < ? OR (st.starred_at = ? AND st.message_id < ?))
+		ORDER BY st.starred_at DESC, st.message_id DESC
+		LIMIT ?`, user.UId, beforeStarredAt, beforeStarredAt, beforeStarredAt, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	starred := make([]StarredMessage, 0)
+	for rows.Next() {
+		var star StarredMessage
+		var starredAt string
+		var timestamp time.Time
+		m := &star.Message
+		if scanErr := rows.Scan(&star.ConversationId, &star.ConversationName, &starredAt, &m.Id, &m.SenderId,
+			&m.SenderUsername, &m.Text, &m.ImageUrl, &timestamp); scanErr != nil {
+			return nil, scanErr
+		}
+		star.StarredAt = formatTimestamp(starredAt)
+		m.Time = timestamp.Format(time.RFC3339)
+		m.Starred = true
+		starred = append(starred, star)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return starred, nil
+}
@@ -2,20 +2,17 @@ package database
 
 import (
 	"database/sql"
+	"strings"
 
 	"github.com/gofrs/uuid"
 )
 
-func (db *appdbimpl) DoLogin(user User) {
-	// TODO: Implement login logic
-}
-
 func (db *appdbimpl) GetUserByID(userID string) (User, error) {
 	var user User
 	var picture sql.NullString
 
-	err := db.c.QueryRow("SELECT id, username, picture FROM users WHERE id = ?", userID).Scan(
-		&user.UId, &user.Username, &picture)
+	err := db.c.QueryRow("SELECT id, username, picture, is_bot FROM users WHERE id = ?", userID).Scan(
+		&user.UId, &user.Username, &picture, &user.IsBot)
 	if err != nil {
 		return User{}, err
 	}
@@ -30,8 +27,63 @@ func (db *appdbimpl) GetUserByID(userID string) (User, error) {
 	return user, nil
 }
 
+// GetUserByName returns the user whose username is `name`, ignoring the case of ASCII letters. It returns
+// sql.ErrNoRows if there is none.
+func (db *appdbimpl) GetUserByName(name string) (User, error) {
+	var user User
+	var picture sql.NullString
+	err := db.c.QueryRow("SELECT id, username, picture, is_bot FROM users WHERE username = ? COLLATE NOCASE ORDER BY id LIMIT 1", name).
+		Scan(&user.UId, &user.Username, &picture, &user.IsBot)
+	if err != nil {
+		return User{}, err
+	}
+	user.Picture = picture.String
+	return user, nil
+}
+
+// CreateUser registers a new user with the hash of their password. It returns ErrUsernameTaken if another user has
+// the same username, ignoring the case of ASCII letters.
+func (db *appdbimpl) CreateUser(name string, passwordHash string) (User, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return User{}, err
+	}
+
+	tx, err := db.c.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// The unique index catches concurrent registrations, but it may be missing on databases with older duplicates. The
+	// check is part of the insert: a transaction that read first could not take the write lock once another connection
+	// wrote, and would fail with "database is locked" without waiting.
+	res, err := tx.Exec(`INSERT INTO users (id, username) SELECT ?, ?
+		WHERE NOT EXISTS(SELECT 1 FROM users WHERE username = ? COLLATE NOCASE)`, id.String(), name, name)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return User{}, ErrUsernameTaken
+		}
+		return User{}, err
+	}
+	if inserted, err := res.RowsAffected(); err != nil {
+		return User{}, err
+	} else if inserted == 0 {
+		return User{}, ErrUsernameTaken
+	}
+	_, err = tx.Exec("INSERT INTO user_credentials (user_id, password_hash, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP)",
+		id.String(), passwordHash)
+	if err != nil {
+		return User{}, err
+	}
+
+	return User{UId: id.String(), Username: name}, tx.Commit()
+}
+
 func (db *appdbimpl) ListUsers(username string) ([]User, error) {
-	rows, err := db.c.Query("SELECT id, username, picture FROM users WHERE username LIKE ?",
+	rows, err := db.c.Query("SELECT id, username, picture, is_bot FROM users WHERE username LIKE ?",
 		"%"+username+"%")
 	if err != nil {
 		return nil, err
@@ -42,7 +94,7 @@ func (db *appdbimpl) ListUsers(username string) ([]User, error) {
 	for rows.Next() {
 		var user User
 		var picture sql.NullString
-		if scanErr := rows.Scan(&user.UId, &user.Username, &picture); scanErr != nil {
+		if scanErr := rows.Scan(&user.UId, &user.Username, &picture, &user.IsBot); scanErr != nil {
 			return nil, scanErr
 		}
 		// Handle NULL picture values
@@ -0,0 +1,336 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// webhookLogSize is how many finished deliveries are kept for each webhook
+const webhookLogSize = 100
+
+const webhookColumns = `id, conversation_id, created_by, url, secret, events, enabled, consecutive_failures,
+	disabled_reason, CAST(created_at AS TEXT)`
+
+// CreateWebhook saves a new webhook, enabled. The ID and creation time are assigned here.
+func (db *appdbimpl) CreateWebhook(webhook Webhook) (Webhook, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return Webhook{}, err
+	}
+	events, err := json.Marshal(webhook.Events)
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	now := time.Now().UTC().Format(sqlTimeLayout)
+	_, err = db.c.Exec(`INSERT INTO webhooks (id, conversation_id, created_by, url, secret, events, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, id.String(), webhook.ConversationId, webhook.CreatedBy, webhook.URL,
+		webhook.Secret, string(events), now)
+	if err != nil {
+		return Webhook{}, err
+	}
+	webhook.Id = id.String()
+	webhook.Enabled = true
+	webhook.ConsecutiveFailures = 0
+	webhook.DisabledReason = ""
+	webhook.CreatedAt = formatTimestamp(now)
+	return webhook, nil
+}
+
+// GetWebhook returns the webhook `id` of the conversation `cid`. It returns sql.ErrNoRows if there is none.
+func (db *appdbimpl) GetWebhook(cid string, id string) (Webhook, error) {
+	rows, err := db.c.Query("SELECT "+webhookColumns+" FROM webhooks WHERE id = ? AND conversation_id = ?", id, cid)
+	if err != nil {
+		return Webhook{}, err
+	}
+	webhooks, err := scanWebhooks(rows)
+	if err != nil {
+		return Webhook{}, err
+	}
+	if len(webhooks) == 0 {
+		return Webhook{}, sql.ErrNoRows
+	}
+	return webhooks[0], nil
+}
+
+// ListWebhooks returns the webhooks of the conversation `cid`, the oldest first
+func (db *appdbimpl) ListWebhooks(cid string) ([]Webhook, error) {
+	rows, err := db.c.Query("SELECT "+webhookColumns+" FROM webhooks WHERE conversation_id = ? ORDER BY created_at, id",
+		cid)
+	if err != nil {
+		return nil, err
+	}
+	return scanWebhooks(rows)
+}
+
+// SetWebhookEnabled enables or disables the webhook `id` of the conversation `cid`. Enabling it clears its failures;
+// disabling it gives up on its pending deliveries. It returns sql.ErrNoRows if there is no such webhook.
+func (db *appdbimpl) SetWebhookEnabled(cid string, id string, enabled bool) (Webhook, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return Webhook{}, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	res, err := tx.Exec(`UPDATE webhooks SET enabled = ?, consecutive_failures = 0, disabled_reason = ''
+		WHERE id = ? AND conversation_id = ?`, enabled, id, cid)
+	if err != nil {
+		return Webhook{}, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return Webhook{}, err
+	}
+	if n == 0 {
+		return Webhook{}, sql.ErrNoRows
+	}
+	if !enabled {
+		if err = failPendingDeliveries(tx, id); err != nil {
+			return Webhook{}, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return Webhook{}, err
+	}
+	return db.GetWebhook(cid, id)
+}
+
+// DeleteWebhook deletes the webhook `id` of the conversation `cid` with its deliveries. It reports whether there was
+// such a webhook.
+func (db *appdbimpl) DeleteWebhook(cid string, id string) (bool, error) {
+	res, err := db.c.Exec("DELETE FROM webhooks WHERE id = ? AND conversation_id = ?", id, cid)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// EnqueueWebhookEvent queues a delivery of `event`, with the JSON data `payload`, to every enabled webhook of the
+// conversation `cid` that subscribed to it. It returns how many deliveries were queued.
+func (db *appdbimpl) EnqueueWebhookEvent(cid string, event string, payload string) (int, error) {
+	rows, err := db.c.Query("SELECT "+webhookColumns+" FROM webhooks WHERE conversation_id = ? AND enabled", cid)
+	if err != nil {
+		return 0, err
+	}
+	webhooks, err := scanWebhooks(rows)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now().UTC().Format(sqlTimeLayout)
+	queued := 0
+	for _, webhook := range webhooks {
+		subscribed := false
+		for _, e := range webhook.Events {
+			subscribed = subscribed || e == event
+		}
+		if !subscribed {
+			continue
+		}
+
+		id, err := uuid.NewV4()
+		if err != nil {
+			return queued, err
+		}
+		_, err = db.c.Exec(`INSERT INTO webhook_deliveries (id, webhook_id, event, payload, next_attempt_at, created_at)
+			VALUES (?, ?, ?, ?, ?, ?)`, id.String(), webhook.Id, event, payload, now, now)
+		if err != nil {
+			return queued, err
+		}
+		queued++
+	}
+	return queued, nil
+}
+
+// GetDueWebhookDeliveries returns up to `limit` pending deliveries of enabled webhooks whose next attempt is not
+// after `now`, the longest waiting first
+func (db *appdbimpl) GetDueWebhookDeliveries(now time.Time, limit int) ([]DueWebhookDelivery, error) {
+	rows, err := db.c.Query(`
+		SELECT d.id, d.event, d.payload, d.attempts, CAST(d.created_at AS TEXT),
+			w.id, w.conversation_id, w.url, w.secret
+		FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.status = 'pending' AND w.enabled AND CAST(d.next_attempt_at AS TEXT) <= ?
+		ORDER BY d.next_attempt_at, d.created_at, d.id
+		LIMIT ?`, now.UTC().Format(sqlTimeLayout), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	due := make([]DueWebhookDelivery, 0)
+	for rows.Next() {
+		var d DueWebhookDelivery
+		var createdAt string
+		err := rows.Scan(&d.Delivery.Id, &d.Delivery.Event, &d.Delivery.Payload, &d.Delivery.Attempts, &createdAt,
+			&d.Webhook.Id, &d.Webhook.ConversationId, &d.Webhook.URL, &d.Webhook.Secret)
+		if err != nil {
+			return nil, err
+		}
+		d.Delivery.WebhookId = d.Webhook.Id
+		d.Delivery.Status = WebhookDeliveryPending
+		d.Delivery.CreatedAt = formatTimestamp(createdAt)
+		d.Webhook.Enabled = true
+		due = append(due, d)
+	}
+	return due, rows.Err()
+}
+
+// NextWebhookDeliveryTime returns when the next pending delivery is due. The boolean is false if there is none.
+func (db *appdbimpl) NextWebhookDeliveryTime() (time.Time, bool, error) {
+	var next sql.NullString
+	err := db.c.QueryRow(`SELECT CAST(MIN(d.next_attempt_at) AS TEXT)
+		FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.status = 'pending' AND w.enabled`).Scan(&next)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if !next.Valid {
+		return time.Time{}, false, nil
+	}
+	t, err := time.Parse(sqlTimeLayout, next.String)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return t, true, nil
+}
+
+// RecordWebhookAttempt saves the outcome of an attempt to deliver an event. A failure that is not retried fails the
+// delivery. The webhook is disabled, with its pending deliveries, once attempt.DisableAfter attempts in a row failed;
+// the boolean reports whether this attempt disabled it.
+func (db *appdbimpl) RecordWebhookAttempt(attempt WebhookAttempt) (bool, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	now := time.Now().UTC().Format(sqlTimeLayout)
+	status := WebhookDeliveryFailed
+	var nextAttemptAt, deliveredAt interface{}
+	switch {
+	case attempt.Succeeded:
+		status = WebhookDeliverySucceeded
+		deliveredAt = now
+	case !attempt.RetryAt.IsZero():
+		status = WebhookDeliveryPending
+		nextAttemptAt = attempt.RetryAt.UTC().Format(sqlTimeLayout)
+	}
+	_, err = tx.Exec(`UPDATE webhook_deliveries SET attempts = attempts + 1, status = ?, next_attempt_at = ?,
+			last_status_code = ?, last_error = ?, delivered_at = ?
+		WHERE id = ? AND status = 'pending'`, status, nextAttemptAt, attempt.StatusCode, attempt.Error, deliveredAt,
+		attempt.DeliveryId)
+	if err != nil {
+		return false, err
+	}
+
+	disabled := false
+	if attempt.Succeeded {
+		_, err = tx.Exec("UPDATE webhooks SET consecutive_failures = 0 WHERE id = ?", attempt.WebhookId)
+	} else {
+		var failures int
+		err = tx.QueryRow(`UPDATE webhooks SET consecutive_failures = consecutive_failures + 1 WHERE id = ?
+			RETURNING consecutive_failures`, attempt.WebhookId).Scan(&failures)
+		if err == nil && attempt.DisableAfter > 0 && failures >= attempt.DisableAfter {
+			var res sql.Result
+			res, err = tx.Exec(`UPDATE webhooks SET enabled = 0, disabled_reason = 'too many failed deliveries'
+				WHERE id = ? AND enabled`, attempt.WebhookId)
+			var n int64
+			if err == nil {
+				n, err = res.RowsAffected()
+			}
+			// Another attempt may have disabled it already
+			if err == nil && n > 0 {
+				disabled = true
+				err = failPendingDeliveries(tx, attempt.WebhookId)
+			}
+		}
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		// No rows means the webhook was deleted in the meantime
+		return false, err
+	}
+
+	// Only the most recent deliveries are kept in the log
+	_, err = tx.Exec(`DELETE FROM webhook_deliveries WHERE webhook_id = ? AND status != 'pending' AND id NOT IN (
+			SELECT id FROM webhook_deliveries WHERE webhook_id = ? AND status != 'pending'
+			ORDER BY created_at DESC, rowid DESC LIMIT ?)`, attempt.WebhookId, attempt.WebhookId, webhookLogSize)
+	if err != nil {
+		return false, err
+	}
+	return disabled, tx.Commit()
+}
+
+// ListWebhookDeliveries returns the latest `limit` deliveries of the webhook `webhookId`, pending or not, the most
+// recent first
+func (db *appdbimpl) ListWebhookDeliveries(webhookId string, limit int) ([]WebhookDelivery, error) {
+	rows, err := db.c.Query(`
+		SELECT id, event, status, attempts, CAST(next_attempt_at AS TEXT), last_status_code, last_error,
+			CAST(created_at AS TEXT), CAST(delivered_at AS TEXT)
+		FROM webhook_deliveries
+		WHERE webhook_id = ?
+		ORDER BY created_at DESC, rowid DESC
+		LIMIT ?`, webhookId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := make([]WebhookDelivery, 0)
+	for rows.Next() {
+		d := WebhookDelivery{WebhookId: webhookId}
+		var nextAttemptAt, deliveredAt sql.NullString
+		var createdAt string
+		err := rows.Scan(&d.Id, &d.Event, &d.Status, &d.Attempts, &nextAttemptAt, &d.LastStatusCode, &d.LastError,
+			&createdAt, &deliveredAt)
+		if err != nil {
+			return nil, err
+		}
+		d.CreatedAt = formatTimestamp(createdAt)
+		if nextAttemptAt.Valid {
+			d.NextAttemptAt = formatTimestamp(nextAttemptAt.String)
+		}
+		if deliveredAt.Valid {
+			d.DeliveredAt = formatTimestamp(deliveredAt.String)
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// failPendingDeliveries gives up on the pending deliveries of a webhook that is being disabled
+func failPendingDeliveries(tx *sql.Tx, webhookId string) error {
+	_, err := tx.Exec(`UPDATE webhook_deliveries SET status = 'failed', next_attempt_at = NULL,
+			last_error = CASE WHEN last_error = '' THEN 'webhook disabled' ELSE last_error END
+		WHERE webhook_id = ? AND status = 'pending'`, webhookId)
+	return err
+}
+
+func scanWebhooks(rows *sql.Rows) ([]Webhook, error) {
+	defer rows.Close()
+
+	webhooks := make([]Webhook, 0)
+	for rows.Next() {
+		var w Webhook
+		var events, createdAt string
+		err := rows.Scan(&w.Id, &w.ConversationId, &w.CreatedBy, &w.URL, &w.Secret, &events, &w.Enabled,
+			&w.ConsecutiveFailures, &w.DisabledReason, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(events), &w.Events); err != nil {
+			return nil, err
+		}
+		w.CreatedAt = formatTimestamp(createdAt)
+		webhooks = append(webhooks, w)
+	}
+	return webhooks, rows.Err()
+}
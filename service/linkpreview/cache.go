@@ -0,0 +1,105 @@
+package linkpreview
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// Cache remembers the previews returned by another Fetcher, failures included, so that a page linked in many
+// messages is downloaded once. Concurrent fetches of the same URL share a single download.
+type Cache struct {
+	fetcher Fetcher
+	size    int
+	ttl     time.Duration
+
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	order    *list.List // most recently used first
+	inflight map[string]*pendingFetch
+}
+
+type cacheEntry struct {
+	url     string
+	preview Preview
+	err     error
+	expires time.Time
+}
+
+type pendingFetch struct {
+	done    chan struct{}
+	preview Preview
+	err     error
+}
+
+// NewCache returns a Fetcher that keeps up to `size` results of `fetcher` for `ttl`, evicting the least recently used
+// ones first
+func NewCache(fetcher Fetcher, size int, ttl time.Duration) *Cache {
+	return &Cache{
+		fetcher:  fetcher,
+		size:     size,
+		ttl:      ttl,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		inflight: make(map[string]*pendingFetch),
+	}
+}
+
+// Fetch returns the cached result for `url`, or fetches it
+func (c *Cache) Fetch(ctx context.Context, url string) (Preview, error) {
+	c.mu.Lock()
+	if element, ok := c.entries[url]; ok {
+		entry := element.Value.(*cacheEntry)
+		if time.Now().Before(entry.expires) {
+			c.order.MoveToFront(element)
+			c.mu.Unlock()
+			return entry.preview, entry.err
+		}
+		c.order.Remove(element)
+		delete(c.entries, url)
+	}
+	if pending, ok := c.inflight[url]; ok {
+		c.mu.Unlock()
+		select {
+		case <-pending.done:
+			return pending.preview, pending.err
+		case <-ctx.Done():
+			return Preview{}, ctx.Err()
+		}
+	}
+	pending := &pendingFetch{done: make(chan struct{})}
+	c.inflight[url] = pending
+	c.mu.Unlock()
+
+	pending.preview, pending.err = c.fetcher.Fetch(ctx, url)
+
+	c.mu.Lock()
+	delete(c.inflight, url)
+	// A fetch cut short by the caller says nothing about the page
+	if ctx.Err() == nil {
+		c.store(url, pending.preview, pending.err)
+	}
+	c.mu.Unlock()
+	close(pending.done)
+
+	return pending.preview, pending.err
+}
+
+// store adds a result to the cache, evicting the least recently used entries if it is full. The caller must hold mu.
+func (c *Cache) store(url string, preview Preview, err error) {
+	if c.size <= 0 {
+		return
+	}
+	for c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).url)
+	}
+	c.entries[url] = c.order.PushFront(&cacheEntry{
+		url:     url,
+		preview: preview,
+		err:     err,
+		expires: time.Now().Add(c.ttl),
+	})
+}
@@ -0,0 +1,200 @@
+package linkpreview
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Config is used to customize an HTTPFetcher. Zero fields take the default values.
+type Config struct {
+	// Timeout bounds a whole fetch, redirects and download included. Default: 5 seconds.
+	Timeout time.Duration
+
+	// MaxBytes is the most that is read of a page; the metadata is in the head, so large pages are truncated rather
+	// than rejected. Default: 512 KiB.
+	MaxBytes int64
+
+	// MaxRedirects is how many redirects are followed. Default: 3.
+	MaxRedirects int
+
+	// UserAgent is sent with the requests
+	UserAgent string
+
+	// AllowAddress decides whether the fetcher can connect to an address. It is checked on the resolved address of
+	// every connection, so a host name cannot point the fetcher somewhere else after the check. Default: PublicAddress.
+	AllowAddress func(ip net.IP, port int) bool
+}
+
+// HTTPFetcher downloads the pages to preview
+type HTTPFetcher struct {
+	cfg    Config
+	client *http.Client
+}
+
+// NewHTTPFetcher returns a Fetcher that downloads the pages with the given configuration
+func NewHTTPFetcher(cfg Config) *HTTPFetcher {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = 512 * 1024
+	}
+	if cfg.MaxRedirects <= 0 {
+		cfg.MaxRedirects = 3
+	}
+	if cfg.UserAgent == "" {
+		cfg.UserAgent = "Mozilla/5.0 (compatible; WASAText link preview)"
+	}
+	if cfg.AllowAddress == nil {
+		cfg.AllowAddress = PublicAddress
+	}
+
+	dialer := &net.Dialer{
+		Timeout: cfg.Timeout,
+		Control: func(network string, address string, _ syscall.RawConn) error {
+			host, portText, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			port, err := strconv.Atoi(portText)
+			if ip == nil || err != nil || !cfg.AllowAddress(ip, port) {
+				return ErrForbiddenAddress
+			}
+			return nil
+		},
+	}
+
+	transport := &http.Transport{
+		// Never go through a proxy: the address checks would apply to the proxy instead of the page
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   cfg.Timeout,
+		ResponseHeaderTimeout: cfg.Timeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	}
+
+	return &HTTPFetcher{
+		cfg: cfg,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   cfg.Timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) > cfg.MaxRedirects {
+					return errors.New("too many redirects")
+				}
+				if !isWebURL(req.URL) {
+					return ErrForbiddenAddress
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// Fetch downloads the page at `rawURL` and returns its metadata. It returns ErrNoPreview if the URL is not a web
+// page, or the page has no title or description.
+func (f *HTTPFetcher) Fetch(ctx context.Context, rawURL string) (Preview, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || !isWebURL(u) {
+		return Preview{}, ErrNoPreview
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, f.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return Preview{}, err
+	}
+	req.Header.Set("User-Agent", f.cfg.UserAgent)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return Preview{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Preview{}, fmt.Errorf("%w: status %d", ErrNoPreview, resp.StatusCode)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return Preview{}, fmt.Errorf("%w: content type %q", ErrNoPreview, mediaType)
+	}
+
+	page, err := io.ReadAll(io.LimitReader(resp.Body, f.cfg.MaxBytes))
+	if err != nil {
+		return Preview{}, err
+	}
+
+	// Relative image links are resolved against the page after the redirects
+	preview := parsePage(string(page), resp.Request.URL)
+	if preview.Title == "" && preview.Description == "" {
+		return Preview{}, ErrNoPreview
+	}
+	preview.URL = rawURL
+	return preview, nil
+}
+
+// isWebURL reports whether u is an absolute http(s) URL without credentials
+func isWebURL(u *url.URL) bool {
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Hostname() != "" && u.User == nil
+}
+
+// nonPublicNetworks are the special-purpose ranges that net.IP has no method for
+var nonPublicNetworks = mustParseCIDRs(
+	"0.0.0.0/8",       // "this" network
+	"100.64.0.0/10",   // carrier-grade NAT
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // documentation
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // documentation
+	"203.0.113.0/24",  // documentation
+	"240.0.0.0/4",     // reserved, and broadcast
+	"64:ff9b::/96",    // NAT64, can embed a private IPv4 address
+	"64:ff9b:1::/48",  // local-use NAT64
+	"2001:db8::/32",   // documentation
+	"2002::/16",       // 6to4, can embed a private IPv4 address
+)
+
+// PublicAddress allows the standard web ports of the addresses that are reachable on the public internet. Loopback,
+// private, link-local, multicast and other special-purpose ranges are refused.
+func PublicAddress(ip net.IP, port int) bool {
+	if port != 80 && port != 443 {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsMulticast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
@@ -0,0 +1,279 @@
+package linkpreview_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/linkpreview"
+)
+
+// newTestFetcher returns a fetcher with `cfg` that can only reach the given test servers
+func newTestFetcher(t *testing.T, cfg linkpreview.Config, servers ...*httptest.Server) *linkpreview.HTTPFetcher {
+	t.Helper()
+	ports := make(map[int]bool)
+	for _, server := range servers {
+		u, err := url.Parse(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		port, err := strconv.Atoi(u.Port())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports[port] = true
+	}
+	cfg.AllowAddress = func(ip net.IP, port int) bool {
+		return ip.IsLoopback() && ports[port]
+	}
+	return linkpreview.NewHTTPFetcher(cfg)
+}
+
+// servePage answers every request with `page` as HTML
+func servePage(page string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = fmt.Fprint(w, page)
+	}))
+}
+
+func TestFetchOpenGraph(t *testing.T) {
+	server := servePage(`<!doctype html><html><head>
+		<title>Page title</title>
+		<meta name="description" content="Page description">
+		<!-- <meta property="og:title" content="Commented out"> -->
+		<script>document.write('<meta property="og:title" content="Written by a script">')</script>
+		<meta property="og:title" content="OpenGraph &amp; title">
+		<meta property="og:title" content="Second title">
+		<meta name="twitter:description" content="Twitter description">
+		<meta property="og:image" content="/images/cover.png">
+		<meta property="og:site_name" content='Example   site'>
+		</head><body><meta property="og:description" content="In the body"></body></html>`)
+	defer server.Close()
+
+	preview, err := newTestFetcher(t, linkpreview.Config{}, server).Fetch(context.Background(), server.URL+"/article")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := linkpreview.Preview{
+		URL:         server.URL + "/article",
+		Title:       "OpenGraph & title",
+		Description: "Twitter description",
+		ImageURL:    server.URL + "/images/cover.png",
+		SiteName:    "Example site",
+	}
+	if preview != want {
+		t.Errorf("got %+v, want %+v", preview, want)
+	}
+}
+
+func TestFetchTitle(t *testing.T) {
+	server := servePage("<html><head><TITLE>\n  A   &quot;plain&quot;\n  page </TITLE>" +
+		`<meta name="Description" content="Its description"><meta property="og:image" content="javascript:alert(1)">` +
+		"</head></html>")
+	defer server.Close()
+
+	preview, err := newTestFetcher(t, linkpreview.Config{}, server).Fetch(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.Title != `A "plain" page` || preview.Description != "Its description" || preview.ImageURL != "" {
+		t.Errorf("got %+v", preview)
+	}
+}
+
+func TestFetchNoPreview(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/empty", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = fmt.Fprint(w, "<html><head></head><body><h1>No metadata</h1></body></html>")
+	})
+	mux.HandleFunc("/json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprint(w, `{"title": "<title>Not a page</title>"}`)
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = fmt.Fprint(w, "<title>Not found</title>")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	fetcher := newTestFetcher(t, linkpreview.Config{}, server)
+
+	for _, link := range []string{
+		server.URL + "/empty",
+		server.URL + "/json",
+		server.URL + "/missing",
+		"ftp://example.com/",
+		"http://user:password@" + strings.TrimPrefix(server.URL, "http://") + "/empty",
+		"/relative",
+	} {
+		if _, err := fetcher.Fetch(context.Background(), link); !errors.Is(err, linkpreview.ErrNoPreview) {
+			t.Errorf("%s: got %v, want %v", link, err, linkpreview.ErrNoPreview)
+		}
+	}
+}
+
+func TestFetchSizeLimit(t *testing.T) {
+	filler := strings.Repeat("<!-- filler -->", 1000)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/head", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = fmt.Fprint(w, "<html><head><title>Early title</title></head><body>")
+		// A page far larger than the limit is truncated, not downloaded
+		for i := 0; i < 1000; i++ {
+			if _, err := fmt.Fprint(w, filler); err != nil {
+				return
+			}
+		}
+	})
+	mux.HandleFunc("/late", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = fmt.Fprint(w, "<html><head>"+filler+"<title>Late title</title></head></html>")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	fetcher := newTestFetcher(t, linkpreview.Config{MaxBytes: 4096}, server)
+
+	preview, err := fetcher.Fetch(context.Background(), server.URL+"/head")
+	if err != nil || preview.Title != "Early title" {
+		t.Errorf("got %+v, %v, want the early title", preview, err)
+	}
+	if _, err := fetcher.Fetch(context.Background(), server.URL+"/late"); !errors.Is(err, linkpreview.ErrNoPreview) {
+		t.Errorf("a title after the size limit got %v, want %v", err, linkpreview.ErrNoPreview)
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/headers", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	mux.HandleFunc("/body", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = fmt.Fprint(w, "<html><head>")
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+		_, _ = fmt.Fprint(w, "<title>Too late</title></head></html>")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	fetcher := newTestFetcher(t, linkpreview.Config{Timeout: 200 * time.Millisecond}, server)
+
+	for _, path := range []string{"/headers", "/body"} {
+		start := time.Now()
+		if _, err := fetcher.Fetch(context.Background(), server.URL+path); err == nil {
+			t.Errorf("%s: a page slower than the timeout was previewed", path)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("%s: the fetch took %v, longer than the timeout", path, elapsed)
+		}
+	}
+}
+
+func TestFetchRedirects(t *testing.T) {
+	other := servePage("<title>Another server</title>")
+	defer other.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/articles/new", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/articles/new", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = fmt.Fprint(w, `<title>Moved</title><meta property="og:image" content="cover.png">`)
+	})
+	mux.HandleFunc("/elsewhere", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, other.URL, http.StatusFound)
+	})
+	mux.HandleFunc("/ftp", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "ftp://example.com/", http.StatusFound)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	fetcher := newTestFetcher(t, linkpreview.Config{}, server)
+
+	// A redirect to an allowed address is followed, and relative links resolved against the page it leads to
+	preview, err := fetcher.Fetch(context.Background(), server.URL+"/moved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.URL != server.URL+"/moved" || preview.Title != "Moved" || preview.ImageURL != server.URL+"/articles/cover.png" {
+		t.Errorf("got %+v", preview)
+	}
+
+	// A redirect cannot lead the fetcher to an address it is not allowed to reach, or out of the web
+	for _, path := range []string{"/elsewhere", "/ftp"} {
+		if _, err := fetcher.Fetch(context.Background(), server.URL+path); !errors.Is(err, linkpreview.ErrForbiddenAddress) {
+			t.Errorf("%s: got %v, want %v", path, err, linkpreview.ErrForbiddenAddress)
+		}
+	}
+	if _, err := fetcher.Fetch(context.Background(), server.URL+"/loop"); err == nil {
+		t.Error("a redirect loop was followed")
+	}
+}
+
+func TestFetchRefusesLocalAddressesByDefault(t *testing.T) {
+	server := servePage("<title>Internal</title>")
+	defer server.Close()
+
+	fetcher := linkpreview.NewHTTPFetcher(linkpreview.Config{})
+	if _, err := fetcher.Fetch(context.Background(), server.URL); !errors.Is(err, linkpreview.ErrForbiddenAddress) {
+		t.Errorf("got %v, want %v", err, linkpreview.ErrForbiddenAddress)
+	}
+}
+
+func TestPublicAddress(t *testing.T) {
+	tests := []struct {
+		ip   string
+		port int
+		want bool
+	}{
+		{"93.184.216.34", 443, true},
+		{"93.184.216.34", 80, true},
+		{"2606:2800:220:1:248:1893:25c8:1946", 443, true},
+		{"93.184.216.34", 8080, false},
+		{"93.184.216.34", 22, false},
+		{"127.0.0.1", 80, false},
+		{"127.8.9.10", 443, false},
+		{"::1", 443, false},
+		{"10.0.0.1", 443, false},
+		{"172.16.5.4", 443, false},
+		{"192.168.1.1", 80, false},
+		{"fd00::1", 443, false},
+		{"169.254.169.254", 80, false},
+		{"fe80::1", 443, false},
+		{"0.0.0.0", 80, false},
+		{"::", 80, false},
+		{"100.64.0.1", 443, false},
+		{"224.0.0.1", 80, false},
+		{"255.255.255.255", 80, false},
+		{"::ffff:127.0.0.1", 80, false},
+		{"::ffff:10.0.0.1", 443, false},
+		{"64:ff9b::a00:1", 443, false},
+		{"2002:a00:1::", 443, false},
+	}
+	for _, tt := range tests {
+		if got := linkpreview.PublicAddress(net.ParseIP(tt.ip), tt.port); got != tt.want {
+			t.Errorf("PublicAddress(%s, %d) = %v, want %v", tt.ip, tt.port, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+/*
+Package linkpreview fetches the metadata used to preview a link in a message: the OpenGraph properties of the page, or
+its title and description.
+
+The default HTTPFetcher only connects to public addresses, and caps the time and the size of each download. A Cache
+in front of it avoids downloading the same page again for every message that links it:
+
+	fetcher := linkpreview.NewCache(linkpreview.NewHTTPFetcher(linkpreview.Config{}), 1000, time.Hour)
+	preview, err := fetcher.Fetch(ctx, "https://example.com/")
+
+Everything that needs previews should depend on the Fetcher interface, so that tests can plug in a fetcher that is
+allowed to reach a local server.
+*/
+package linkpreview
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// Preview is the metadata of a web page
+type Preview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	ImageURL    string `json:"imageUrl,omitempty"`
+	SiteName    string `json:"siteName,omitempty"`
+}
+
+// Fetcher returns the preview of a URL
+type Fetcher interface {
+	Fetch(ctx context.Context, url string) (Preview, error)
+}
+
+// ErrNoPreview is returned when the URL is not a web page, or the page has no metadata to show
+var ErrNoPreview = errors.New("no preview available")
+
+// ErrForbiddenAddress is returned when the URL, or one of its redirects, points to an address that is not allowed,
+// like a private network
+var ErrForbiddenAddress = errors.New("address not allowed")
+
+// urlPattern matches the http(s) links in a text
+var urlPattern = regexp.MustCompile(`(?i)\bhttps?://[^\s<>"'` + "`" + `]+`)
+
+// FirstURL returns the first http(s) link in `text`, without the punctuation that usually follows a link in a
+// sentence, or an empty string if there are none.
+func FirstURL(text string) string {
+	link := urlPattern.FindString(text)
+	for link != "" {
+		last := link[len(link)-1]
+		switch {
+		case strings.IndexByte(".,;:!?", last) >= 0:
+		case last == ')' && strings.Count(link, "(") < strings.Count(link, ")"):
+		case last == ']' && strings.Count(link, "[") < strings.Count(link, "]"):
+		default:
+			return link
+		}
+		link = link[:len(link)-1]
+	}
+	return ""
+}
@@ -0,0 +1,99 @@
+package linkpreview
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxTitleLength       = 300
+	maxDescriptionLength = 1000
+	maxSiteNameLength    = 100
+	maxImageURLLength    = 2048
+)
+
+var (
+	// ignoredPattern matches the parts of a page that can contain tags that are not part of the document
+	ignoredPattern = regexp.MustCompile(`(?is)<!--.*?-->|<script\b.*?</script\s*>|<style\b.*?</style\s*>`)
+	headEndPattern = regexp.MustCompile(`(?i)</head\s*>|<body\b`)
+	metaPattern    = regexp.MustCompile(`(?i)<meta\b([^>]*)>`)
+	titlePattern   = regexp.MustCompile(`(?is)<title\b[^>]*>(.*?)</title\s*>`)
+	attrPattern    = regexp.MustCompile(`(?i)([a-z][a-z0-9_:.-]*)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+	spacePattern   = regexp.MustCompile(`\s+`)
+)
+
+// parsePage extracts the preview of an HTML page, which was downloaded from `base`. OpenGraph properties take
+// precedence over Twitter cards, which take precedence over the title and the description of the page.
+func parsePage(page string, base *url.URL) Preview {
+	page = ignoredPattern.ReplaceAllString(page, "")
+	if end := headEndPattern.FindStringIndex(page); end != nil {
+		page = page[:end[0]]
+	}
+
+	meta := make(map[string]string)
+	for _, tag := range metaPattern.FindAllStringSubmatch(page, -1) {
+		attrs := parseAttributes(tag[1])
+		key := attrs["property"]
+		if key == "" {
+			key = attrs["name"]
+		}
+		key = strings.ToLower(key)
+		if _, seen := meta[key]; key != "" && !seen {
+			meta[key] = attrs["content"]
+		}
+	}
+
+	var title string
+	if match := titlePattern.FindStringSubmatch(page); match != nil {
+		title = match[1]
+	}
+
+	preview := Preview{
+		Title:       clean(firstOf(meta["og:title"], meta["twitter:title"], title), maxTitleLength),
+		Description: clean(firstOf(meta["og:description"], meta["twitter:description"], meta["description"]), maxDescriptionLength),
+		SiteName:    clean(meta["og:site_name"], maxSiteNameLength),
+	}
+
+	image := strings.TrimSpace(firstOf(meta["og:image:secure_url"], meta["og:image"], meta["og:image:url"], meta["twitter:image"]))
+	if ref, err := url.Parse(image); image != "" && err == nil {
+		if abs := base.ResolveReference(ref); isWebURL(abs) && len(abs.String()) <= maxImageURLLength {
+			preview.ImageURL = abs.String()
+		}
+	}
+	return preview
+}
+
+// parseAttributes returns the attributes of a tag by lowercase name, with the entities decoded
+func parseAttributes(tag string) map[string]string {
+	attrs := make(map[string]string)
+	for _, match := range attrPattern.FindAllStringSubmatch(tag, -1) {
+		name := strings.ToLower(match[1])
+		if _, seen := attrs[name]; !seen {
+			attrs[name] = html.UnescapeString(match[2] + match[3] + match[4])
+		}
+	}
+	return attrs
+}
+
+func firstOf(values ...string) string {
+	for _, value := range values {
+		if strings.TrimSpace(value) != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// clean decodes the entities of a text, collapses its whitespace and truncates it to `maxLength` characters
+func clean(text string, maxLength int) string {
+	text = strings.ToValidUTF8(html.UnescapeString(text), "")
+	text = strings.TrimSpace(spacePattern.ReplaceAllString(text, " "))
+	if utf8.RuneCountInString(text) > maxLength {
+		runes := []rune(text)
+		text = strings.TrimSpace(string(runes[:maxLength-1])) + "…"
+	}
+	return text
+}
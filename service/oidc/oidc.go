@@ -0,0 +1,277 @@
+/*
+Package oidc signs users in with an OpenID Connect provider, using the authorization code flow with PKCE (RFC 7636).
+
+A Provider is configured with the issuer URL and the client registered there. The endpoints are discovered from the
+issuer the first time they are needed, so that the server starts even while the provider is unreachable:
+
+	provider, err := oidc.NewProvider(oidc.Config{
+		Issuer:       "https://sso.example.com",
+		ClientID:     "wasatext",
+		ClientSecret: "...",
+		RedirectURL:  "https://chat.example.com/oidc/callback",
+	})
+
+	// Send the browser to the provider, remembering state, nonce and verifier for the callback
+	state, nonce, verifier := oidc.RandomString(), oidc.RandomString(), oidc.RandomString()
+	authURL, err := provider.AuthCodeURL(ctx, state, nonce, oidc.Challenge(verifier))
+
+	// In the callback, after checking the state, trade the code for the identity of the user
+	identity, err := provider.Exchange(ctx, code, verifier, nonce)
+
+The ID token returned by the provider is verified here: signature against the keys the issuer publishes (RS256,
+RS384, RS512, PS256, PS384, PS512, ES256, ES384 or ES512), issuer, audience, expiry and nonce.
+*/
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config is the configuration of a Provider
+type Config struct {
+	// Issuer is the URL of the provider, as found in the `iss` claim of its tokens
+	Issuer string
+
+	// ClientID and ClientSecret identify this application at the provider. The secret is optional for public clients.
+	ClientID     string
+	ClientSecret string
+
+	// RedirectURL is where the provider sends the browser back with the authorization code
+	RedirectURL string
+
+	// Scopes requested in addition to `openid`. Default: profile and email.
+	Scopes []string
+
+	// HTTPClient is used to reach the provider. Default: a client with a 10 seconds timeout.
+	HTTPClient *http.Client
+}
+
+// Identity is the user authenticated by the provider, read from the verified ID token
+type Identity struct {
+	Issuer  string
+	Subject string
+
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+	Name              string
+}
+
+// ErrInvalidToken is returned when the ID token cannot be trusted: bad signature, wrong issuer or audience, expired,
+// or a nonce that does not match the login
+var ErrInvalidToken = errors.New("invalid ID token")
+
+// maxResponseSize caps the responses read from the provider
+const maxResponseSize = 1 << 20
+
+// clockSkew is the tolerance when checking the expiry and issue times of tokens
+const clockSkew = time.Minute
+
+// Provider is an OpenID Connect provider. It is safe for concurrent use.
+type Provider struct {
+	cfg    Config
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *discovery
+	keys      *keySet
+}
+
+// discovery is the part of the provider metadata this package uses
+type discovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	CodeChallengeMethods  []string `json:"code_challenge_methods_supported"`
+}
+
+// NewProvider returns a provider for the given configuration. It does not contact the provider.
+func NewProvider(cfg Config) (*Provider, error) {
+	if cfg.Issuer == "" {
+		return nil, errors.New("issuer is required")
+	}
+	if cfg.ClientID == "" {
+		return nil, errors.New("client ID is required")
+	}
+	if u, err := url.Parse(cfg.RedirectURL); err != nil || !u.IsAbs() {
+		return nil, errors.New("redirect URL must be an absolute URL")
+	}
+	if cfg.Scopes == nil {
+		cfg.Scopes = []string{"profile", "email"}
+	}
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Provider{cfg: cfg, client: client}, nil
+}
+
+// Issuer returns the issuer URL of the provider
+func (p *Provider) Issuer() string {
+	return p.cfg.Issuer
+}
+
+// RandomString returns a random URL-safe string with 256 bits of entropy, suitable for state, nonce and PKCE
+// verifier values
+func RandomString() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic("oidc: cannot read random bytes: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Challenge returns the S256 PKCE challenge of `verifier`
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns the URL of the provider where the user signs in. The provider redirects back to the redirect
+// URL with `state` and an authorization code.
+func (p *Provider) AuthCodeURL(ctx context.Context, state string, nonce string, challenge string) (string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", p.cfg.RedirectURL)
+	q.Set("scope", strings.Join(append([]string{"openid"}, p.cfg.Scopes...), " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", challenge)
+	q.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange trades the authorization code for tokens, and returns the identity in the verified ID token. `verifier`
+// is the PKCE verifier of the login, and `nonce` the value passed to AuthCodeURL.
+func (p *Provider) Exchange(ctx context.Context, code string, verifier string, nonce string) (Identity, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", p.cfg.ClientID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Identity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	status, err := p.doJSON(req, &tokens)
+	if err != nil {
+		return Identity{}, err
+	}
+	if status != http.StatusOK || tokens.Error != "" {
+		return Identity{}, fmt.Errorf("token request failed with status %d: %s %s", status, tokens.Error,
+			tokens.ErrorDescription)
+	}
+	if tokens.IDToken == "" {
+		return Identity{}, errors.New("the provider returned no ID token")
+	}
+
+	return p.verify(ctx, d, tokens.IDToken, nonce)
+}
+
+// discover returns the provider metadata, fetching it the first time
+func (p *Provider) discover(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	d := p.discovery
+	p.mu.Unlock()
+	if d != nil {
+		return d, nil
+	}
+
+	wellKnown := strings.TrimSuffix(p.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wellKnown, nil)
+	if err != nil {
+		return nil, err
+	}
+	d = &discovery{}
+	status, err := p.doJSON(req, d)
+	if err != nil {
+		return nil, fmt.Errorf("fetching the provider metadata: %w", err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("fetching the provider metadata: status %d", status)
+	}
+	if d.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("the provider metadata is for issuer %q, not %q", d.Issuer, p.cfg.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("the provider metadata lacks required endpoints")
+	}
+	if len(d.CodeChallengeMethods) > 0 && !contains(d.CodeChallengeMethods, "S256") {
+		return nil, errors.New("the provider does not support PKCE with S256")
+	}
+
+	p.mu.Lock()
+	p.discovery = d
+	p.keys = newKeySet(d.JWKSURI, p.client)
+	p.mu.Unlock()
+	return d, nil
+}
+
+// doJSON sends the request and decodes the JSON response into `v`, whatever the status code
+func (p *Provider) doJSON(req *http.Request, v interface{}) (int, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return 0, err
+	}
+	if err = json.Unmarshal(body, v); err != nil && resp.StatusCode == http.StatusOK {
+		return 0, fmt.Errorf("decoding the response: %w", err)
+	}
+	return resp.StatusCode, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
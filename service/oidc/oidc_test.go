@@ -0,0 +1,154 @@
+package oidc_test
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/oidc"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/oidc/oidctest"
+)
+
+const testClientID = "wasatext"
+
+func newProvider(t *testing.T, issuer string) *oidc.Provider {
+	t.Helper()
+	p, err := oidc.NewProvider(oidc.Config{
+		Issuer:      issuer,
+		ClientID:    testClientID,
+		RedirectURL: "https://chat.example.com/oidc/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// login signs in as `subject` at the issuer and exchanges the code, with the PKCE verifier and nonce of the login
+func login(t *testing.T, p *oidc.Provider, issuer *oidctest.Issuer, subject string) (oidc.Identity, error) {
+	t.Helper()
+	ctx := context.Background()
+	state, nonce, verifier := oidc.RandomString(), oidc.RandomString(), oidc.RandomString()
+	authURL, err := p.AuthCodeURL(ctx, state, nonce, oidc.Challenge(verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authURL, issuer.URL+"/authorize?") {
+		t.Fatalf("the authorization URL %s is not the one discovered", authURL)
+	}
+
+	callback, err := issuer.SignIn(authURL, subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Query().Get("state") != state {
+		t.Fatal("the state was not sent back")
+	}
+	return p.Exchange(ctx, u.Query().Get("code"), verifier, nonce)
+}
+
+func TestExchange(t *testing.T) {
+	issuer := oidctest.NewIssuer(testClientID)
+	defer issuer.Close()
+	p := newProvider(t, issuer.URL)
+
+	identity, err := login(t, p, issuer, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := oidc.Identity{
+		Issuer:            issuer.URL,
+		Subject:           "alice",
+		Email:             "alice@example.com",
+		EmailVerified:     true,
+		PreferredUsername: "alice",
+	}
+	if identity != want {
+		t.Errorf("got %+v, want %+v", identity, want)
+	}
+
+	// A second login uses the metadata and keys fetched by the first
+	if _, err := login(t, p, issuer, "bob"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExchangeRejectsInvalidTokens(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(issuer *oidctest.Issuer)
+	}{
+		{"bad signature", func(issuer *oidctest.Issuer) { issuer.ForgeSignatures() }},
+		{"wrong audience", func(issuer *oidctest.Issuer) { issuer.SetClaim("aud", "another-client") }},
+		{"audience list without azp", func(issuer *oidctest.Issuer) {
+			issuer.SetClaim("aud", []string{testClientID, "another-client"})
+		}},
+		{"wrong issuer", func(issuer *oidctest.Issuer) { issuer.SetClaim("iss", "https://evil.example.com") }},
+		{"wrong nonce", func(issuer *oidctest.Issuer) { issuer.SetClaim("nonce", oidc.RandomString()) }},
+		{"no nonce", func(issuer *oidctest.Issuer) { issuer.SetClaim("nonce", nil) }},
+		{"expired", func(issuer *oidctest.Issuer) { issuer.SetClaim("exp", time.Now().Add(-time.Hour).Unix()) }},
+		{"no expiry", func(issuer *oidctest.Issuer) { issuer.SetClaim("exp", nil) }},
+		{"issued in the future", func(issuer *oidctest.Issuer) {
+			issuer.SetClaim("iat", time.Now().Add(time.Hour).Unix())
+		}},
+		{"no subject", func(issuer *oidctest.Issuer) { issuer.SetClaim("sub", "") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer := oidctest.NewIssuer(testClientID)
+			defer issuer.Close()
+			p := newProvider(t, issuer.URL)
+
+			tt.setup(issuer)
+			if _, err := login(t, p, issuer, "alice"); !errors.Is(err, oidc.ErrInvalidToken) {
+				t.Errorf("got %v, want %v", err, oidc.ErrInvalidToken)
+			}
+		})
+	}
+}
+
+func TestExchangeChecksVerifier(t *testing.T) {
+	issuer := oidctest.NewIssuer(testClientID)
+	defer issuer.Close()
+	p := newProvider(t, issuer.URL)
+
+	ctx := context.Background()
+	nonce := oidc.RandomString()
+	authURL, err := p.AuthCodeURL(ctx, oidc.RandomString(), nonce, oidc.Challenge(oidc.RandomString()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback, err := issuer.SignIn(authURL, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(callback)
+	if _, err := p.Exchange(ctx, u.Query().Get("code"), oidc.RandomString(), nonce); err == nil {
+		t.Error("a code was exchanged with the wrong verifier")
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	issuer := oidctest.NewIssuer(testClientID)
+	defer issuer.Close()
+
+	// The metadata must be for the configured issuer, exactly
+	p := newProvider(t, issuer.URL+"/")
+	if _, err := p.AuthCodeURL(context.Background(), "state", "nonce", "challenge"); err == nil {
+		t.Error("the metadata of another issuer was accepted")
+	}
+
+	// An unreachable issuer fails the login
+	issuer.Close()
+	p = newProvider(t, issuer.URL)
+	if _, err := p.AuthCodeURL(context.Background(), "state", "nonce", "challenge"); err == nil {
+		t.Error("an unreachable issuer was accepted")
+	}
+}
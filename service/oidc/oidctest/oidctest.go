@@ -0,0 +1,244 @@
+/*
+Package oidctest provides an OpenID Connect issuer for tests, served by an httptest.Server.
+
+The issuer publishes its metadata and keys, and its token endpoint returns an ID token for any code handed out by
+SignIn, after checking the PKCE verifier. Tests that need a broken token change the issuer before the exchange:
+
+	issuer := oidctest.NewIssuer("client")
+	defer issuer.Close()
+
+	issuer.SetClaim("aud", "someone-else")
+	callback, err := issuer.SignIn(authURL, "subject")
+*/
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// keyID is the ID of the key the issuer signs with
+const keyID = "test-key"
+
+// Issuer is an OpenID Connect provider for tests. It is safe for concurrent use.
+type Issuer struct {
+	*httptest.Server
+	clientID string
+	key      *rsa.PrivateKey
+
+	mu     sync.Mutex
+	codes  map[string]authorization
+	claims map[string]interface{}
+	// forger signs the tokens instead of key when set, with the same key ID
+	forger *rsa.PrivateKey
+}
+
+// authorization is a sign-in waiting for its code to be exchanged
+type authorization struct {
+	subject     string
+	nonce       string
+	challenge   string
+	redirectURI string
+}
+
+// NewIssuer starts an issuer for the client `clientID`. It panics if the key cannot be generated.
+func NewIssuer(clientID string) *Issuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic("oidctest: cannot generate a key: " + err.Error())
+	}
+	iss := &Issuer{
+		clientID: clientID,
+		key:      key,
+		codes:    make(map[string]authorization),
+		claims:   make(map[string]interface{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", iss.serveDiscovery)
+	mux.HandleFunc("/jwks", iss.serveKeys)
+	mux.HandleFunc("/token", iss.serveToken)
+	iss.Server = httptest.NewServer(mux)
+	return iss
+}
+
+// SetClaim sets a claim of the ID tokens issued from now on, replacing the default value. A nil value removes it.
+func (iss *Issuer) SetClaim(name string, value interface{}) {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	iss.claims[name] = value
+}
+
+// ForgeSignatures makes the issuer sign the ID tokens from now on with another key, under the ID of its own
+func (iss *Issuer) ForgeSignatures() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic("oidctest: cannot generate a key: " + err.Error())
+	}
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	iss.forger = key
+}
+
+// SignIn plays the user signing in as `subject` at the authorization URL built by the relying party. It returns the
+// redirect URL, with the code and state, where the provider would send the browser back.
+func (iss *Issuer) SignIn(authURL string, subject string) (string, error) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	if q.Get("client_id") != iss.clientID || q.Get("response_type") != "code" {
+		return "", errors.New("oidctest: not an authorization request for the client")
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		return "", errors.New("oidctest: the authorization request has no S256 challenge")
+	}
+
+	code := randomString()
+	iss.mu.Lock()
+	iss.codes[code] = authorization{
+		subject:     subject,
+		nonce:       q.Get("nonce"),
+		challenge:   q.Get("code_challenge"),
+		redirectURI: q.Get("redirect_uri"),
+	}
+	iss.mu.Unlock()
+
+	callback, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil {
+		return "", err
+	}
+	cq := callback.Query()
+	cq.Set("code", code)
+	cq.Set("state", q.Get("state"))
+	callback.RawQuery = cq.Encode()
+	return callback.String(), nil
+}
+
+func (iss *Issuer) serveDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                           iss.URL,
+		"authorization_endpoint":           iss.URL + "/authorize",
+		"token_endpoint":                   iss.URL + "/token",
+		"jwks_uri":                         iss.URL + "/jwks",
+		"code_challenge_methods_supported": []string{"S256"},
+	})
+}
+
+func (iss *Issuer) serveKeys(w http.ResponseWriter, r *http.Request) {
+	pub := iss.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": keyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+func (iss *Issuer) serveToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ParseForm() != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	code := r.PostForm.Get("code")
+	iss.mu.Lock()
+	auth, ok := iss.codes[code]
+	delete(iss.codes, code)
+	iss.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case !ok || r.PostForm.Get("grant_type") != "authorization_code":
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	case base64.RawURLEncoding.EncodeToString(sum[:]) != auth.challenge:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "PKCE"})
+		return
+	case r.PostForm.Get("redirect_uri") != auth.redirectURI:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "redirect"})
+		return
+	}
+
+	token, err := iss.idToken(auth)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"token_type": "Bearer", "access_token": randomString(), "id_token": token})
+}
+
+// idToken returns a signed ID token for the sign-in, with the claims set by the test
+func (iss *Issuer) idToken(auth authorization) (string, error) {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":                iss.URL,
+		"sub":                auth.subject,
+		"aud":                iss.clientID,
+		"exp":                now.Add(time.Hour).Unix(),
+		"iat":                now.Unix(),
+		"nonce":              auth.nonce,
+		"email":              auth.subject + "@example.com",
+		"email_verified":     true,
+		"preferred_username": auth.subject,
+	}
+
+	iss.mu.Lock()
+	for name, value := range iss.claims {
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+	}
+	key := iss.key
+	if iss.forger != nil {
+		key = iss.forger
+	}
+	iss.mu.Unlock()
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": keyID, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("oidctest: cannot read random bytes: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,122 @@
+/*
+Package password hashes and verifies user passwords with Argon2id, a memory-hard function, so that a leaked database
+is expensive to brute force even with dedicated hardware.
+
+Hashes are encoded in the PHC string format used by the reference implementation, which records the parameters next to
+the salt and the key:
+
+	$argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+
+so that the parameters can be raised later without invalidating the stored hashes: NeedsRehash tells when a hash
+was made with weaker parameters than the current ones.
+*/
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Parameters of new hashes, as recommended by RFC 9106 for memory-constrained environments. Memory is in KiB.
+const (
+	memory      = 64 * 1024
+	iterations  = 3
+	parallelism = 4
+	saltLength  = 16
+	keyLength   = 32
+)
+
+// MaxLength is the maximum length of a password, in bytes. Longer passwords are refused rather than truncated.
+const MaxLength = 128
+
+// ErrInvalidHash is returned when a stored hash is not an Argon2id hash in the PHC string format
+var ErrInvalidHash = errors.New("invalid password hash")
+
+// slots bounds how many hashes are computed at the same time. Each one takes `memory` KiB, so a burst of logins
+// would otherwise exhaust the memory of the server.
+var slots = make(chan struct{}, runtime.NumCPU())
+
+// params are the Argon2id parameters of a hash
+type params struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+}
+
+var current = params{memory: memory, iterations: iterations, parallelism: parallelism}
+
+// Hash returns the encoded hash of `password` with a new random salt
+func Hash(password string) (string, error) {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := derive(password, salt, current, keyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, current.memory, current.iterations,
+		current.parallelism, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify reports whether `password` matches the encoded hash. The comparison takes constant time.
+func Verify(encoded string, password string) (bool, error) {
+	p, salt, key, err := decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := derive(password, salt, p, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// NeedsRehash reports whether the encoded hash was made with parameters other than the current ones, and should be
+// replaced with a new hash of the password the next time it is known
+func NeedsRehash(encoded string) bool {
+	p, _, key, err := decode(encoded)
+	return err != nil || p != current || len(key) != keyLength
+}
+
+func derive(password string, salt []byte, p params, length uint32) []byte {
+	slots <- struct{}{}
+	defer func() {
+		<-slots
+	}()
+	return argon2.IDKey([]byte(password), salt, p.iterations, p.memory, p.parallelism, length)
+}
+
+func decode(encoded string) (params, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return params{}, nil, nil, ErrInvalidHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params{}, nil, nil, ErrInvalidHash
+	}
+
+	var p params
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.iterations, &p.parallelism); err != nil {
+		return params{}, nil, nil, ErrInvalidHash
+	}
+	// Bound the work a corrupted or hostile hash can ask for
+	if p.memory < 8*uint32(p.parallelism) || p.memory > 4*memory || p.iterations < 1 || p.iterations > 4*iterations ||
+		p.parallelism < 1 {
+		return params{}, nil, nil, ErrInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(salt) < 8 {
+		return params{}, nil, nil, ErrInvalidHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) < 16 {
+		return params{}, nil, nil, ErrInvalidHash
+	}
+	return p, salt, key, nil
+}
@@ -0,0 +1,56 @@
+package richtext
+
+import (
+	"html"
+	"strings"
+)
+
+// HTML renders `nodes` as HTML. All the text is escaped, line breaks become <br>, and links open in a new tab without
+// a referrer. Links to anything but http(s) URLs are rendered as their label only, so nodes that do not come from
+// Parse are safe too.
+func HTML(nodes []Node) string {
+	var b strings.Builder
+	writeHTML(&b, nodes)
+	return b.String()
+}
+
+func writeHTML(b *strings.Builder, nodes []Node) {
+	for _, node := range nodes {
+		switch node.Type {
+		case TypeText:
+			b.WriteString(strings.ReplaceAll(html.EscapeString(node.Text), "\n", "<br>"))
+		case TypeBold:
+			b.WriteString("<strong>")
+			writeHTML(b, node.Children)
+			b.WriteString("</strong>")
+		case TypeItalic:
+			b.WriteString("<em>")
+			writeHTML(b, node.Children)
+			b.WriteString("</em>")
+		case TypeCode:
+			b.WriteString("<code>")
+			b.WriteString(html.EscapeString(node.Text))
+			b.WriteString("</code>")
+		case TypeCodeBlock:
+			b.WriteString("<pre><code")
+			if languagePattern.MatchString(node.Language) {
+				b.WriteString(` class="language-`)
+				b.WriteString(html.EscapeString(node.Language))
+				b.WriteString(`"`)
+			}
+			b.WriteString(">")
+			b.WriteString(html.EscapeString(node.Text))
+			b.WriteString("</code></pre>")
+		case TypeLink:
+			if !isSafeURL(node.URL) {
+				writeHTML(b, node.Children)
+				continue
+			}
+			b.WriteString(`<a href="`)
+			b.WriteString(html.EscapeString(node.URL))
+			b.WriteString(`" target="_blank" rel="noopener noreferrer nofollow">`)
+			writeHTML(b, node.Children)
+			b.WriteString("</a>")
+		}
+	}
+}
@@ -0,0 +1,290 @@
+/*
+Package richtext parses the small markup that can be used in message texts, so that every client shows the same
+formatting. The markup is:
+
+	*bold*   _italic_   `code`   [label](https://example.com)
+
+	```language
+	code block
+	```
+
+Links written without markup are recognized too. Bold, italic and links can be nested into each other, but not into
+themselves; nothing is parsed inside code. A backslash escapes the characters of the markup.
+
+Parse returns the text as a tree of nodes, and HTML renders the nodes as HTML that is safe to show in a page: all the
+text is escaped, and only http(s) links are kept.
+*/
+package richtext
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxLength is the maximum length of a text, in characters. Longer texts are not parsed.
+const MaxLength = 5000
+
+// maxURLLength is the maximum length of a link; longer links are left as text
+const maxURLLength = 2048
+
+// Node types
+const (
+	TypeText      = "text"
+	TypeBold      = "bold"
+	TypeItalic    = "italic"
+	TypeCode      = "code"
+	TypeCodeBlock = "codeBlock"
+	TypeLink      = "link"
+)
+
+// Node is a piece of formatted text. Text and code nodes have a Text; bold, italic and link nodes have Children. Code
+// blocks may have a Language.
+type Node struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	URL      string `json:"url,omitempty"`
+	Language string `json:"language,omitempty"`
+	Children []Node `json:"children,omitempty"`
+}
+
+// styles is a set of the node types that can still be opened while parsing nested text
+type styles uint8
+
+const (
+	styleBold styles = 1 << iota
+	styleItalic
+	styleLink
+
+	allStyles = styleBold | styleItalic | styleLink
+)
+
+const (
+	codeFence = "```"
+
+	// escapable are the characters that lose their meaning after a backslash
+	escapable = "\\`*_[]()"
+)
+
+var (
+	languagePattern = regexp.MustCompile(`^[A-Za-z0-9_+#.-]{1,20}$`)
+	autolinkPattern = regexp.MustCompile("^(?i)https?://[^\\s<>\"'`]+")
+)
+
+// Parse returns the formatting of `text`. Invalid UTF-8 is replaced, and a text longer than MaxLength is returned as
+// a single text node.
+func Parse(text string) []Node {
+	text = strings.ToValidUTF8(text, "�")
+	if text == "" {
+		return []Node{}
+	}
+	if utf8.RuneCountInString(text) > MaxLength {
+		return []Node{{Type: TypeText, Text: text}}
+	}
+
+	nodes := make([]Node, 0)
+	for {
+		start := strings.Index(text, codeFence)
+		if start < 0 {
+			break
+		}
+		rest := text[start+len(codeFence):]
+		end := strings.Index(rest, codeFence)
+		if end < 0 {
+			break
+		}
+
+		code, language := rest[:end], ""
+		if newline := strings.IndexByte(code, '\n'); newline >= 0 && languagePattern.MatchString(code[:newline]) {
+			code, language = code[newline+1:], code[:newline]
+		}
+		code = strings.TrimPrefix(strings.TrimSuffix(code, "\n"), "\n")
+		if strings.TrimSpace(code) == "" {
+			// An empty block is shown as it was written
+			nodes = appendNodes(nodes, parseInline(text[:start+len(codeFence)+end+len(codeFence)], allStyles)...)
+		} else {
+			nodes = appendNodes(nodes, parseInline(text[:start], allStyles)...)
+			nodes = append(nodes, Node{Type: TypeCodeBlock, Text: code, Language: language})
+		}
+		text = rest[end+len(codeFence):]
+	}
+	return appendNodes(nodes, parseInline(text, allStyles)...)
+}
+
+// parseInline parses a text without code blocks. Only the styles in `allowed` are recognized.
+func parseInline(s string, allowed styles) []Node {
+	var nodes []Node
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			nodes = appendNodes(nodes, Node{Type: TypeText, Text: text.String()})
+			text.Reset()
+		}
+	}
+
+	// Once a delimiter has no closing match, the following ones of the same kind cannot have one either
+	var unclosed [2]bool
+
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte(escapable, s[i+1]) >= 0:
+			text.WriteByte(s[i+1])
+			i += 2
+			continue
+
+		case c == '`':
+			if end := strings.IndexByte(s[i+1:], '`'); end > 0 {
+				flush()
+				nodes = append(nodes, Node{Type: TypeCode, Text: s[i+1 : i+1+end]})
+				i += end + 2
+				continue
+			}
+
+		case c == '*' || c == '_':
+			style, nodeType, kind := styleBold, TypeBold, 0
+			if c == '_' {
+				style, nodeType, kind = styleItalic, TypeItalic, 1
+			}
+			if allowed&style == 0 || unclosed[kind] || !canOpen(s, i) {
+				break
+			}
+			end := findCloser(s, i)
+			if end < 0 {
+				unclosed[kind] = true
+				break
+			}
+			flush()
+			nodes = append(nodes, Node{Type: nodeType, Children: parseInline(s[i+1:end], allowed&^style)})
+			i = end + 1
+			continue
+
+		case c == '[' && allowed&styleLink != 0:
+			if label, target, end, ok := parseLink(s, i); ok {
+				flush()
+				nodes = append(nodes, Node{Type: TypeLink, URL: target, Children: parseInline(label, allowed&^styleLink)})
+				i = end
+				continue
+			}
+
+		case (c == 'h' || c == 'H') && allowed&styleLink != 0 && (i == 0 || !isWordByte(s[i-1])):
+			if link := autolink(s[i:]); link != "" {
+				flush()
+				nodes = append(nodes, Node{Type: TypeLink, URL: link, Children: []Node{{Type: TypeText, Text: link}}})
+				i += len(link)
+				continue
+			}
+		}
+
+		text.WriteByte(c)
+		i++
+	}
+	flush()
+	return nodes
+}
+
+// canOpen reports whether the delimiter at `i` can start a bold or italic text: it must be followed by a non-space
+// character, and not be in the middle of a word, like in snake_case or 2*3*4.
+func canOpen(s string, i int) bool {
+	if i+1 >= len(s) || isSpace(s[i+1]) {
+		return false
+	}
+	return i == 0 || !isWordByte(s[i-1])
+}
+
+// findCloser returns the index of the delimiter that closes the one at `start`, or -1. The closing delimiter follows
+// a non-space character, and is not followed by a word character. Code spans and escaped characters are skipped.
+func findCloser(s string, start int) int {
+	delimiter := s[start]
+	for j := start + 1; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			if j+1 < len(s) && strings.IndexByte(escapable, s[j+1]) >= 0 {
+				j++
+			}
+		case '`':
+			if end := strings.IndexByte(s[j+1:], '`'); end > 0 {
+				j += end + 1
+			}
+		case delimiter:
+			if j > start+1 && !isSpace(s[j-1]) && (j+1 == len(s) || !isWordByte(s[j+1])) {
+				return j
+			}
+		}
+	}
+	return -1
+}
+
+// parseLink parses a `[label](url)` link starting at `start`. It returns the label, the URL and the index after the
+// link.
+func parseLink(s string, start int) (string, string, int, bool) {
+	// The label cannot contain brackets, so that a run of brackets is scanned only once
+	closing := strings.IndexAny(s[start+1:], "[]")
+	if closing <= 0 || s[start+1+closing] != ']' {
+		return "", "", 0, false
+	}
+	label := s[start+1 : start+1+closing]
+	rest := s[start+1+closing+1:]
+	if !strings.HasPrefix(rest, "(") {
+		return "", "", 0, false
+	}
+
+	end := strings.IndexAny(rest, ") \t\r\n")
+	if end < 0 || rest[end] != ')' || end-1 > maxURLLength {
+		return "", "", 0, false
+	}
+	target := rest[1:end]
+	if strings.TrimSpace(label) == "" || !isSafeURL(target) {
+		return "", "", 0, false
+	}
+	return label, target, start + 1 + closing + 1 + end + 1, true
+}
+
+// autolink returns the link at the start of `s`, without the punctuation that usually follows a link in a sentence,
+// or an empty string
+func autolink(s string) string {
+	link := autolinkPattern.FindString(s)
+	for link != "" {
+		last := link[len(link)-1]
+		switch {
+		case strings.IndexByte(".,;:!?*_", last) >= 0:
+		case last == ')' && strings.Count(link, "(") < strings.Count(link, ")"):
+		case last == ']' && strings.Count(link, "[") < strings.Count(link, "]"):
+		default:
+			if len(link) > maxURLLength || !isSafeURL(link) {
+				return ""
+			}
+			return link
+		}
+		link = link[:len(link)-1]
+	}
+	return ""
+}
+
+// isSafeURL reports whether `link` is an absolute http(s) URL
+func isSafeURL(link string) bool {
+	u, err := url.Parse(link)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// appendNodes appends `more` to `nodes`, merging adjacent text nodes
+func appendNodes(nodes []Node, more ...Node) []Node {
+	for _, node := range more {
+		if last := len(nodes) - 1; last >= 0 && node.Type == TypeText && nodes[last].Type == TypeText {
+			nodes[last].Text += node.Text
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// isWordByte reports whether c is part of a word. Bytes of multi-byte characters count as letters.
+func isWordByte(c byte) bool {
+	return c >= 0x80 || c == '_' || ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
@@ -0,0 +1,53 @@
+//go:build go1.18
+
+package richtext_test
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"testing"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/richtext"
+)
+
+var (
+	// renderedTag matches the tags that HTML writes; the first group is the href of a link
+	renderedTag = regexp.MustCompile(`<(?:/?(?:strong|em|code|pre|a)|br|code class="language-[A-Za-z0-9_+#.-]{1,20}"|` +
+		`a href="([^"<>]*)" target="_blank" rel="noopener noreferrer nofollow")>`)
+	safeHref = regexp.MustCompile(`^(?i)https?://[^\s]`)
+)
+
+// FuzzParse checks that the HTML of any text has no markup but the tags written by HTML, so that every <, > and " of
+// the text is escaped, and that every link goes to an http(s) URL
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{
+		"*bold* _italic_ `code` [label](https://example.com)",
+		"```go\nfmt.Println(\"<b>\")\n```",
+		"```\"><script>alert(1)</script>\ncode\n```",
+		"[click](javascript:alert(1)) [click](JaVaScRiPt:alert(1)) [x]( https://example.com)",
+		`[x](https://example.com/"onmouseover="alert(1)) https://example.com/<script>`,
+		"[*_`nested`_*](http://example.com/a_(b)) *[link](https://a.b)*",
+		"https://example.com/?q=\"x\"&y=<z> http://a.b/c.",
+		"\\*not bold\\* \\[not](a link) <img src=x onerror=alert(1)>",
+		"[a](data:text/html,<script>alert(1)</script>) [b](//evil.example.com) [c](https:evil)",
+		"line\nbreak\r\n\x00\xff\xfe",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, text string) {
+		out := richtext.HTML(richtext.Parse(text))
+		rest := renderedTag.ReplaceAllStringFunc(out, func(tag string) string {
+			if m := renderedTag.FindStringSubmatch(tag); m[1] != "" || strings.HasPrefix(tag, "<a ") {
+				if href := html.UnescapeString(m[1]); !safeHref.MatchString(href) {
+					t.Errorf("link to %q in the HTML of %q", href, text)
+				}
+			}
+			return ""
+		})
+		if i := strings.IndexAny(rest, `<>"`); i >= 0 {
+			t.Errorf("unescaped %q in the HTML of %q: %s", rest[i], text, out)
+		}
+	})
+}
@@ -0,0 +1,188 @@
+/*
+Package webhook posts the events of conversations to the URLs that subscribed to them.
+
+Each delivery is a JSON POST signed with the secret of the webhook, so that the receiver can check that it comes from
+this server and was not replayed:
+
+	X-Webhook-Signature: sha256=hex(HMAC-SHA256(secret, timestamp + "." + body))
+
+where timestamp is the X-Webhook-Timestamp header, in Unix seconds. The default HTTPSender only connects to public
+addresses, like the link preview fetcher, so that webhooks cannot be used to reach the internal network.
+
+Everything that delivers webhooks should depend on the Sender interface, so that tests can plug in a sender that is
+allowed to reach a local server.
+*/
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/linkpreview"
+)
+
+// Headers of a delivery
+const (
+	HeaderID        = "X-Webhook-Id"
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// ErrForbiddenAddress is returned when the URL of a webhook points to an address that is not allowed, like a private
+// network
+var ErrForbiddenAddress = errors.New("address not allowed")
+
+// Delivery is an event to post to a webhook
+type Delivery struct {
+	// ID identifies the delivery; it is the same for every attempt, so that receivers can drop duplicates
+	ID    string
+	Event string
+	URL   string
+
+	// Secret signs the body
+	Secret string
+	Body   []byte
+}
+
+// Sender posts deliveries
+type Sender interface {
+	// Send posts the delivery and returns the status code of the response. A status other than 2xx is not an error.
+	Send(ctx context.Context, d Delivery) (int, error)
+}
+
+// Sign returns the signature of a body sent at `timestamp`, as found in the X-Webhook-Signature header
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewSecret returns a random secret to sign the deliveries of a new webhook
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// ValidURL reports whether `rawURL` can be the URL of a webhook: an absolute http(s) URL without credentials. Whether
+// its address is allowed is only known when connecting.
+func ValidURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Hostname() != "" && u.User == nil &&
+		u.Fragment == ""
+}
+
+// Config is used to customize an HTTPSender. Zero fields take the default values.
+type Config struct {
+	// Timeout bounds a whole delivery. Default: 10 seconds.
+	Timeout time.Duration
+
+	// UserAgent is sent with the requests
+	UserAgent string
+
+	// AllowAddress decides whether the sender can connect to an address. It is checked on the resolved address of
+	// every connection. Default: linkpreview.PublicAddress.
+	AllowAddress func(ip net.IP, port int) bool
+}
+
+// HTTPSender posts deliveries over HTTP. Redirects are not followed.
+type HTTPSender struct {
+	cfg    Config
+	client *http.Client
+}
+
+// NewHTTPSender returns a Sender with the given configuration
+func NewHTTPSender(cfg Config) *HTTPSender {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.UserAgent == "" {
+		cfg.UserAgent = "WASAText-Webhook/1.0"
+	}
+	if cfg.AllowAddress == nil {
+		cfg.AllowAddress = linkpreview.PublicAddress
+	}
+
+	dialer := &net.Dialer{
+		Timeout: cfg.Timeout,
+		Control: func(network string, address string, _ syscall.RawConn) error {
+			host, portText, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			port, err := strconv.Atoi(portText)
+			if ip == nil || err != nil || !cfg.AllowAddress(ip, port) {
+				return ErrForbiddenAddress
+			}
+			return nil
+		},
+	}
+
+	transport := &http.Transport{
+		// Never go through a proxy: the address checks would apply to the proxy instead of the receiver
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   cfg.Timeout,
+		ResponseHeaderTimeout: cfg.Timeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	}
+
+	return &HTTPSender{
+		cfg: cfg,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   cfg.Timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// Send posts the delivery, signed with the current time
+func (s *HTTPSender) Send(ctx context.Context, d Delivery) (int, error) {
+	if !ValidURL(d.URL) {
+		return 0, fmt.Errorf("invalid webhook URL %q", d.URL)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", s.cfg.UserAgent)
+	req.Header.Set(HeaderID, d.ID)
+	req.Header.Set(HeaderEvent, d.Event)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(d.Secret, timestamp, d.Body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		if errors.Is(err, ErrForbiddenAddress) {
+			return 0, ErrForbiddenAddress
+		}
+		return 0, err
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode, nil
+}
@@ -8,14 +8,144 @@ import axios from './axios.js';
 // ============ AUTHENTICATION ============
 export const auth = {
 	/**
-	 * User login/registration
-	 * @param {string} name - Username (3-16 characters)
-	 * @returns {Promise<{identifier: string}>}
+	 * Log in an existing user
+	 * @param {string} name - Username (3-16 characters), matched regardless of case
+	 * @param {string} password - Password
+	 * @returns {Promise<{identifier: string, token: string}>}
 	 */
-	async login(name) {
-		const response = await axios.post('/session', { name });
+	async login(name, password) {
+		const response = await axios.post('/session', { name, password });
 		return response.data;
 	},
+
+	/**
+	 * Create a user and log it in
+	 * @param {string} name - Username (3-16 letters, digits or underscores)
+	 * @param {string} password - Password (at least 8 characters)
+	 * @returns {Promise<{identifier: string, token: string}>}
+	 */
+	async register(name, password) {
+		const response = await axios.post('/users', { name, password });
+		return response.data;
+	},
+
+	/**
+	 * Start a login with the OpenID Connect provider. When logged in, the
+	 * identity is linked to the current user instead.
+	 * @returns {Promise<{authorizationUrl: string, state: string}>}
+	 */
+	async startOIDC() {
+		const response = await axios.post('/oidc/authorize');
+		return response.data;
+	},
+
+	/**
+	 * Redeem the ticket the provider login came back with
+	 * @param {string} ticket - Ticket from the `#oidc=` fragment
+	 * @param {string} state - State returned by startOIDC
+	 * @returns {Promise<{identifier: string, name: string, token: string}>}
+	 */
+	async finishOIDC(ticket, state) {
+		const response = await axios.post('/oidc/session', { ticket, state });
+		return response.data;
+	},
+
+	/**
+	 * End a session, usually the current one
+	 * @param {string} token - Token of the session, passed explicitly since
+	 * the caller may forget it locally before the request is sent
+	 * @returns {Promise<object>}
+	 */
+	async logout(token) {
+		const response = await axios.delete('/session', {
+			headers: { Authorization: `Bearer ${token}` },
+		});
+		return response.data;
+	},
+
+	/**
+	 * List the sessions of the user on their devices
+	 * @param {string} userId - User ID
+	 * @returns {Promise<Session[]>}
+	 */
+	async listSessions(userId) {
+		const response = await axios.get(`/users/${userId}/sessions`);
+		return response.data;
+	},
+
+	/**
+	 * Revoke one session of the user
+	 * @param {string} userId - User ID
+	 * @param {string} sessionId - Session ID
+	 * @returns {Promise<void>}
+	 */
+	async revokeSession(userId, sessionId) {
+		await axios.delete(`/users/${userId}/sessions/${sessionId}`);
+	},
+
+	/**
+	 * Revoke every session of the user, including the current one
+	 * @param {string} userId - User ID
+	 * @returns {Promise<void>}
+	 */
+	async logoutEverywhere(userId) {
+		await axios.delete(`/users/${userId}/sessions`);
+	},
+};
+
+// ============ BOTS AND API TOKENS ============
+export const bots = {
+	/**
+	 * Create a bot owned by the user
+	 * @param {string} userId - User ID
+	 * @param {string} name - Username of the bot
+	 * @returns {Promise<User>}
+	 */
+	async create(userId, name) {
+		const response = await axios.post(`/users/${userId}/bots`, { name });
+		return response.data;
+	},
+
+	/**
+	 * List the bots owned by the user
+	 * @param {string} userId - User ID
+	 * @returns {Promise<User[]>}
+	 */
+	async list(userId) {
+		const response = await axios.get(`/users/${userId}/bots`);
+		return response.data;
+	},
+
+	/**
+	 * Create an API token, shown only in the response
+	 * @param {string} userId - User ID
+	 * @param {{name: string, scopes: string[], conversations?: string[], botId?: string}} token - Token to create
+	 * @returns {Promise<APIToken>}
+	 */
+	async createToken(userId, token) {
+		const response = await axios.post(`/users/${userId}/tokens`, token);
+		return response.data;
+	},
+
+	/**
+	 * List the API tokens created by the user
+	 * @param {string} userId - User ID
+	 * @returns {Promise<APIToken[]>}
+	 */
+	async listTokens(userId) {
+		const response = await axios.get(`/users/${userId}/tokens`);
+		return response.data;
+	},
+
+	/**
+	 * Revoke an API token
+	 * @param {string} userId - User ID
+	 * @param {string} tokenId - Token ID
+	 * @returns {Promise<void>}
+	 */
+	async deleteToken(userId, tokenId) {
+		await axios.delete(`/users/${userId}/tokens/${tokenId}`);
+	},
 };
 
 // ============ USERS ============
@@ -172,6 +302,57 @@ export const conversations = {
 		return response.data;
 	},
 
+	/**
+	 * Delete a conversation for everyone (owner only)
+	 * @param {string} userId - User UUID
+	 * @param {string} conversationId - Conversation UUID
+	 * @returns {Promise<void>}
+	 */
+	async delete(userId, conversationId) {
+		await axios.delete(`/users/${userId}/conversations/${conversationId}`);
+	},
+
+	/**
+	 * Set how long new messages are kept before they disappear
+	 * @param {string} userId - User UUID
+	 * @param {string} conversationId - Conversation UUID
+	 * @param {number} ttl - Seconds to keep new messages, 0 to keep them forever
+	 * @returns {Promise<void>}
+	 */
+	async setMessageTtl(userId, conversationId, ttl) {
+		await axios.put(`/users/${userId}/conversations/${conversationId}/ttl`, { ttl });
+	},
+
+	/**
+	 * Save the text being written in a conversation; the newest edit wins
+	 * @param {string} userId - User UUID
+	 * @param {string} conversationId - Conversation UUID
+	 * @param {string} text - Draft text, empty to clear it
+	 * @param {string} [replyToMessageId] - Message UUID the draft replies to
+	 * @param {string} [updatedAt] - Time of the edit (ISO 8601), defaults to now on the server
+	 * @returns {Promise<Draft>} The stored draft; a 409 error carries the newer one
+	 */
+	async saveDraft(userId, conversationId, text, replyToMessageId, updatedAt) {
+		const data = { text };
+		if (replyToMessageId) data.replyToMessageId = replyToMessageId;
+		if (updatedAt) data.updatedAt = updatedAt;
+
+		const response = await axios.put(`/users/${userId}/conversations/${conversationId}/draft`, data);
+		return response.data;
+	},
+
+	/**
+	 * Clear the conversation history for the current user only
+	 * @param {string} userId - User UUID
+	 * @param {string} conversationId - Conversation UUID
+	 * @returns {Promise<void>}
+	 */
+	async clearHistory(userId, conversationId) {
+		await axios.delete(
+			`/users/${userId}/conversations/${conversationId}/messages`
+		);
+	},
+
 	/**
 	 * Get all conversations in the system (admin function)
 	 * @returns {Promise<Conversation[]>}
@@ -200,12 +381,14 @@ export const messages = {
 	 * @param {string} conversationId - Conversation UUID
 	 * @param {string} [content] - Text content
 	 * @param {string} [imageUrl] - Base64 image data URL
+	 * @param {string} [clientMessageId] - Idempotency key; retries with the same key don't create duplicates
 	 * @returns {Promise<string>} Message UUID
 	 */
-	async send(userId, conversationId, content, imageUrl) {
+	async send(userId, conversationId, content, imageUrl, clientMessageId) {
 		const data = {};
 		if (content) data.content = content;
 		if (imageUrl) data.imageUrl = imageUrl;
+		if (clientMessageId) data.clientMessageId = clientMessageId;
 
 		const response = await axios.post(
 			`/users/${userId}/conversations/${conversationId}/messages`,
@@ -215,50 +398,52 @@ export const messages = {
 	},
 
 	/**
-	 * Delete a message (only by sender)
+	 * Delete a message for the current user only, or for everyone (only by the sender, shortly after sending)
 	 * @param {string} userId - User UUID
 	 * @param {string} conversationId - Conversation UUID
 	 * @param {string} messageId - Message UUID
-	 * @returns {Promise<{message: string}>}
+	 * @param {'me'|'everyone'} [scope='me'] - Who the message is deleted for
+	 * @returns {Promise<void>}
 	 */
-	async delete(userId, conversationId, messageId) {
+	async delete(userId, conversationId, messageId, scope = 'me') {
 		const response = await axios.delete(
-			`/users/${userId}/conversations/${conversationId}/messages/${messageId}`
+			`/users/${userId}/conversations/${conversationId}/messages/${messageId}`,
+			{ params: { scope } }
 		);
 		return response.data;
 	},
 
 	/**
-	 * Forward a message to another conversation
+	 * Forward a message to one or more conversations
 	 * @param {string} userId - User UUID
 	 * @param {string} conversationId - Source conversation UUID
 	 * @param {string} messageId - Message UUID to forward
-	 * @param {string} targetConversationId - Target conversation UUID
-	 * @returns {Promise<Conversation>}
+	 * @param {string|string[]} targetConversationIds - Target conversation UUID(s)
+	 * @returns {Promise<ForwardResult[]>} One result per target
 	 */
-	async forward(userId, conversationId, messageId, targetConversationId) {
+	async forward(userId, conversationId, messageId, targetConversationIds) {
+		const targets = [].concat(targetConversationIds);
 		const response = await axios.post(
 			`/users/${userId}/conversations/${conversationId}/messages/${messageId}/forward`,
-			{ content: targetConversationId }
+			{ targets }
 		);
 		return response.data;
 	},
 };
 
 // ============ REACTIONS ============
-// ============ COMMENTS (emoji) ============
-export const comments = {
+export const reactions = {
 	/**
-	 * Toggle a reaction on a message
+	 * Toggle a reaction on a message (added if missing, removed otherwise)
 	 * @param {string} userId - User UUID
 	 * @param {string} conversationId - Conversation UUID
 	 * @param {string} messageId - Message UUID
 	 * @param {string} emoji - Emoji to toggle
-	 * @returns {Promise<{message: string}>}
+	 * @returns {Promise<{emoji: string, reacted: boolean}>}
 	 */
 	async toggle(userId, conversationId, messageId, emoji) {
 		const response = await axios.post(
-			`/users/${userId}/conversations/${conversationId}/messages/${messageId}/comments`,
+			`/users/${userId}/conversations/${conversationId}/messages/${messageId}/reactions`,
 			{ emoji }
 		);
 		return response.data;
@@ -270,14 +455,275 @@ export const comments = {
 	 * @param {string} conversationId - Conversation UUID
 	 * @param {string} messageId - Message UUID
 	 * @param {string} emoji - Emoji to remove
-	 * @returns {Promise<{message: string}>}
+	 * @returns {Promise<void>}
 	 */
 	async remove(userId, conversationId, messageId, emoji) {
 		const response = await axios.delete(
-			`/users/${userId}/conversations/${conversationId}/messages/${messageId}/comments/${emoji}`
+			`/users/${userId}/conversations/${conversationId}/messages/${messageId}/reactions/${encodeURIComponent(emoji)}`
+		);
+		return response.data;
+	},
+};
+
+// ============ COMMENTS (threaded replies) ============
+export const comments = {
+	/**
+	 * List comments on a message, oldest first
+	 * @param {string} userId - User UUID
+	 * @param {string} conversationId - Conversation UUID
+	 * @param {string} messageId - Message UUID
+	 * @param {string} [after] - Cursor returned as nextCursor by the previous page
+	 * @returns {Promise<{comments: Comment[], nextCursor?: string}>}
+	 */
+	async list(userId, conversationId, messageId, after) {
+		const response = await axios.get(
+			`/users/${userId}/conversations/${conversationId}/messages/${messageId}/comments`,
+			{ params: after ? { after } : {} }
+		);
+		return response.data;
+	},
+
+	/**
+	 * Comment on a message
+	 * @param {string} userId - User UUID
+	 * @param {string} conversationId - Conversation UUID
+	 * @param {string} messageId - Message UUID
+	 * @param {string} text - Comment text
+	 * @returns {Promise<Comment>}
+	 */
+	async add(userId, conversationId, messageId, text) {
+		const response = await axios.post(
+			`/users/${userId}/conversations/${conversationId}/messages/${messageId}/comments`,
+			{ text }
 		);
 		return response.data;
 	},
+
+	/**
+	 * Remove one of your comments
+	 * @param {string} userId - User UUID
+	 * @param {string} conversationId - Conversation UUID
+	 * @param {string} messageId - Message UUID
+	 * @param {string} commentId - Comment UUID
+	 * @returns {Promise<void>}
+	 */
+	async remove(userId, conversationId, messageId, commentId) {
+		await axios.delete(
+			`/users/${userId}/conversations/${conversationId}/messages/${messageId}/comments/${commentId}`
+		);
+	},
+};
+
+// ============ SCHEDULED MESSAGES ============
+export const scheduledMessages = {
+	/**
+	 * Schedule a message to be sent later
+	 * @param {string} userId - User UUID
+	 * @param {string} conversationId - Conversation UUID
+	 * @param {string} content - Message text
+	 * @param {Date|string} sendAt - When to send the message
+	 * @param {string} [imageUrl] - Optional image as data URL
+	 * @returns {Promise<ScheduledMessage>}
+	 */
+	async schedule(userId, conversationId, content, sendAt, imageUrl) {
+		const response = await axios.post(`/users/${userId}/conversations/${conversationId}/messages`, {
+			content,
+			imageUrl,
+			sendAt: new Date(sendAt).toISOString(),
+		});
+		return response.data;
+	},
+
+	/**
+	 * List the user's messages waiting to be sent
+	 * @param {string} userId - User UUID
+	 * @returns {Promise<ScheduledMessage[]>}
+	 */
+	async list(userId) {
+		const response = await axios.get(`/users/${userId}/scheduled-messages`);
+		return response.data;
+	},
+
+	/**
+	 * Edit a scheduled message
+	 * @param {string} userId - User UUID
+	 * @param {string} scheduledId - Scheduled message UUID
+	 * @param {string} content - New message text
+	 * @param {Date|string} sendAt - New send time
+	 * @param {string} [imageUrl] - Optional image as data URL
+	 * @returns {Promise<ScheduledMessage>}
+	 */
+	async update(userId, scheduledId, content, sendAt, imageUrl) {
+		const response = await axios.put(`/users/${userId}/scheduled-messages/${scheduledId}`, {
+			content,
+			imageUrl,
+			sendAt: new Date(sendAt).toISOString(),
+		});
+		return response.data;
+	},
+
+	/**
+	 * Cancel a scheduled message
+	 * @param {string} userId - User UUID
+	 * @param {string} scheduledId - Scheduled message UUID
+	 * @returns {Promise<void>}
+	 */
+	async cancel(userId, scheduledId) {
+		await axios.delete(`/users/${userId}/scheduled-messages/${scheduledId}`);
+	},
+};
+
+// ============ PINS ============
+export const pins = {
+	/**
+	 * List the pinned messages of a conversation, most recently pinned first
+	 * @param {string} userId - User UUID
+	 * @param {string} conversationId - Conversation UUID
+	 * @returns {Promise<Pin[]>}
+	 */
+	async list(userId, conversationId) {
+		const response = await axios.get(`/users/${userId}/conversations/${conversationId}/pins`);
+		return response.data;
+	},
+
+	/**
+	 * Pin a message
+	 * @param {string} userId - User UUID
+	 * @param {string} conversationId - Conversation UUID
+	 * @param {string} messageId - Message UUID
+	 * @returns {Promise<void>}
+	 */
+	async pin(userId, conversationId, messageId) {
+		await axios.put(`/users/${userId}/conversations/${conversationId}/pins/${messageId}`);
+	},
+
+	/**
+	 * Unpin a message
+	 * @param {string} userId - User UUID
+	 * @param {string} conversationId - Conversation UUID
+	 * @param {string} messageId - Message UUID
+	 * @returns {Promise<void>}
+	 */
+	async unpin(userId, conversationId, messageId) {
+		await axios.delete(`/users/${userId}/conversations/${conversationId}/pins/${messageId}`);
+	},
+};
+
+// ============ STARRED ============
+export const starred = {
+	/**
+	 * List the messages starred by the user, most recently starred first
+	 * @param {string} userId - User UUID
+	 * @param {string} [before] - Cursor returned as nextCursor by the previous page
+	 * @returns {Promise<{starred: StarredMessage[], nextCursor?: string}>}
+	 */
+	async list(userId, before) {
+		const response = await axios.get(`/users/${userId}/starred`, {
+			params: before ? { before } : {},
+		});
+		return response.data;
+	},
+
+	/**
+	 * Star a message
+	 * @param {string} userId - User UUID
+	 * @param {string} conversationId - Conversation UUID
+	 * @param {string} messageId - Message UUID
+	 * @returns {Promise<void>}
+	 */
+	async star(userId, conversationId, messageId) {
+		await axios.put(`/users/${userId}/conversations/${conversationId}/messages/${messageId}/star`);
+	},
+
+	/**
+	 * Unstar a message
+	 * @param {string} userId - User UUID
+	 * @param {string} conversationId - Conversation UUID
+	 * @param {string} messageId - Message UUID
+	 * @returns {Promise<void>}
+	 */
+	async unstar(userId, conversationId, messageId) {
+		await axios.delete(`/users/${userId}/conversations/${conversationId}/messages/${messageId}/star`);
+	},
+};
+
+// ============ POLLS ============
+export const polls = {
+	/**
+	 * Send a poll to a conversation
+	 * @param {string} userId - User UUID
+	 * @param {string} conversationId - Conversation UUID
+	 * @param {{question: string, options: string[], multipleChoice?: boolean, anonymous?: boolean, closesAt?: string}} poll
+	 * @param {string} [clientMessageId] - Idempotency key; retries with the same key don't create duplicates
+	 * @returns {Promise<string>} Message UUID
+	 */
+	async create(userId, conversationId, poll, clientMessageId) {
+		const data = { poll };
+		if (clientMessageId) data.clientMessageId = clientMessageId;
+
+		const response = await axios.post(`/users/${userId}/conversations/${conversationId}/messages`, data);
+		return response.data;
+	},
+
+	/**
+	 * Vote on a poll, replacing the previous votes
+	 * @param {string} userId - User UUID
+	 * @param {string} conversationId - Conversation UUID
+	 * @param {string} messageId - Poll message UUID
+	 * @param {number[]} options - Indexes of the chosen options
+	 * @returns {Promise<Poll>}
+	 */
+	async vote(userId, conversationId, messageId, options) {
+		const response = await axios.put(
+			`/users/${userId}/conversations/${conversationId}/messages/${messageId}/votes`,
+			{ options }
+		);
+		return response.data;
+	},
+
+	/**
+	 * Remove the votes of the user from a poll
+	 * @param {string} userId - User UUID
+	 * @param {string} conversationId - Conversation UUID
+	 * @param {string} messageId - Poll message UUID
+	 * @returns {Promise<Poll>}
+	 */
+	async retract(userId, conversationId, messageId) {
+		const response = await axios.delete(
+			`/users/${userId}/conversations/${conversationId}/messages/${messageId}/votes`
+		);
+		return response.data;
+	},
+
+	/**
+	 * Close a poll before its closing time (only by its creator)
+	 * @param {string} userId - User UUID
+	 * @param {string} conversationId - Conversation UUID
+	 * @param {string} messageId - Poll message UUID
+	 * @returns {Promise<Poll>}
+	 */
+	async close(userId, conversationId, messageId) {
+		const response = await axios.post(
+			`/users/${userId}/conversations/${conversationId}/messages/${messageId}/poll/close`
+		);
+		return response.data;
+	},
+};
+
+// ============ MENTIONS ============
+export const mentions = {
+	/**
+	 * List messages that mention the user, newest first
+	 * @param {string} userId - User UUID
+	 * @param {string} [before] - Cursor returned as nextCursor by the previous page
+	 * @returns {Promise<{mentions: Mention[], nextCursor?: string}>}
+	 */
+	async list(userId, before) {
+		const response = await axios.get(`/users/${userId}/mentions`, {
+			params: before ? { before } : {},
+		});
+		return response.data;
+	},
 };
 
 // ============ CONTACTS ============
@@ -319,6 +765,81 @@ export const contacts = {
 	},
 };
 
+// ============ WEBHOOKS ============
+export const webhooks = {
+	/**
+	 * Subscribe a URL to events of a conversation
+	 * @param {string} userId - User ID
+	 * @param {string} conversationId - Conversation ID
+	 * @param {string} url - URL to post the events to
+	 * @param {string[]} [events] - Events to send, all when omitted
+	 * @returns {Promise<Webhook>} The webhook, with the secret of its signatures
+	 */
+	async create(userId, conversationId, url, events) {
+		const response = await axios.post(
+			`/users/${userId}/conversations/${conversationId}/webhooks`,
+			{ url, events }
+		);
+		return response.data;
+	},
+
+	/**
+	 * List the webhooks of a conversation
+	 * @param {string} userId - User ID
+	 * @param {string} conversationId - Conversation ID
+	 * @returns {Promise<Webhook[]>}
+	 */
+	async list(userId, conversationId) {
+		const response = await axios.get(
+			`/users/${userId}/conversations/${conversationId}/webhooks`
+		);
+		return response.data;
+	},
+
+	/**
+	 * Enable or disable a webhook
+	 * @param {string} userId - User ID
+	 * @param {string} conversationId - Conversation ID
+	 * @param {string} webhookId - Webhook ID
+	 * @param {boolean} enabled - Whether the webhook gets events
+	 * @returns {Promise<Webhook>}
+	 */
+	async setEnabled(userId, conversationId, webhookId, enabled) {
+		const response = await axios.put(
+			`/users/${userId}/conversations/${conversationId}/webhooks/${webhookId}/enabled`,
+			{ enabled }
+		);
+		return response.data;
+	},
+
+	/**
+	 * Remove a webhook
+	 * @param {string} userId - User ID
+	 * @param {string} conversationId - Conversation ID
+	 * @param {string} webhookId - Webhook ID
+	 * @returns {Promise<void>}
+	 */
+	async remove(userId, conversationId, webhookId) {
+		await axios.delete(
+			`/users/${userId}/conversations/${conversationId}/webhooks/${webhookId}`
+		);
+	},
+
+	/**
+	 * List the latest deliveries of a webhook
+	 * @param {string} userId - User ID
+	 * @param {string} conversationId - Conversation ID
+	 * @param {string} webhookId - Webhook ID
+	 * @returns {Promise<WebhookDelivery[]>}
+	 */
+	async deliveries(userId, conversationId, webhookId) {
+		const response = await axios.get(
+			`/users/${userId}/conversations/${conversationId}/webhooks/${webhookId}/deliveries`
+		);
+		return response.data;
+	},
+};
+
 // ============ WEBSOCKET ============
 export const websocket = {
 	/**
@@ -328,7 +849,8 @@ export const websocket = {
 	connect() {
 		const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
 		const host = window.location.host;
-		const wsUrl = `${protocol}//${host}/ws`;
+		const token = encodeURIComponent(localStorage.getItem('sessionToken') || '');
+		const wsUrl = `${protocol}//${host}/ws?token=${token}`;
 
 		return new WebSocket(wsUrl);
 	},
@@ -365,11 +887,19 @@ export const health = {
 // Create the API service object
 const apiService = {
 	auth,
+	bots,
 	users,
 	conversations,
 	messages,
+	scheduledMessages,
+	reactions,
 	comments,
+	pins,
+	starred,
+	polls,
+	mentions,
 	contacts,
+	webhooks,
 	websocket,
 	health,
 };
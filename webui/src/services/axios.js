@@ -8,18 +8,13 @@ const instance = axios.create({
 // Add a request interceptor to include authentication headers
 instance.interceptors.request.use(
 	(config) => {
-		// Get user ID from localStorage
-		const userId = localStorage.getItem('userId');
+		// Get the session token from localStorage
+		const token = localStorage.getItem('sessionToken');
 
-		// Add Authorization header if user is logged in
-		// Skip for public endpoints like /session and /liveness
-		const publicEndpoints = ['/session', '/liveness'];
-		const isPublicEndpoint = publicEndpoints.some((endpoint) =>
-			config.url.includes(endpoint)
-		);
-
-		if (userId && !isPublicEndpoint) {
-			config.headers.Authorization = `Bearer ${userId}`;
+		// Add Authorization header if user is logged in, unless the request
+		// sets its own. Logging in again with a token is harmless.
+		if (token && !config.headers.Authorization) {
+			config.headers.Authorization = `Bearer ${token}`;
 		}
 
 		return config;
@@ -38,12 +33,13 @@ instance.interceptors.response.use(
 		// If we get a 401 Unauthorized, clear localStorage and reload for protected endpoints
 		if (error.response && error.response.status === 401) {
 			// Do not force a reload for public endpoints like /session (login) or /liveness
-			const publicEndpoints = ['/session', '/liveness'];
+			const publicEndpoints = ['/session', '/liveness', '/oidc/session'];
 			const url = error.config && error.config.url ? error.config.url : '';
-			const isPublicEndpoint = publicEndpoints.some((endpoint) => url.includes(endpoint));
+			const isPublicEndpoint = publicEndpoints.includes(url);
 
 			if (!isPublicEndpoint) {
 				localStorage.removeItem('userId');
+				localStorage.removeItem('sessionToken');
 				localStorage.removeItem('currentUsername');
 				// Optionally redirect to login or reload the page
 				window.location.reload();
@@ -13,6 +13,10 @@ class WebSocketService {
 		this.listeners = new Map();
 		this.heartbeatInterval = null;
 		this.userId = null;
+		// Sequence number of the last event received, to get the missed ones after reconnecting
+		this.lastSeq = null;
+		// Server-Sent Events stream, used when WebSocket connections keep failing
+		this.eventSource = null;
 	}
 
 	/**
@@ -25,9 +29,18 @@ class WebSocketService {
 			return;
 		}
 
+		if (this.userId !== userId) {
+			this.lastSeq = null;
+		}
 		this.userId = userId;
+		this.revoked = false;
 		const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-		const wsUrl = `${protocol}//${window.location.host}/ws?user_id=${userId}`;
+		// Browsers cannot set the Authorization header on WebSocket requests
+		const token = encodeURIComponent(localStorage.getItem('sessionToken') || '');
+		let wsUrl = `${protocol}//${window.location.host}/ws?token=${token}`;
+		if (this.lastSeq !== null) {
+			wsUrl += `&lastSeq=${this.lastSeq}`;
+		}
 
 		try {
 			this.ws = new WebSocket(wsUrl);
@@ -66,8 +79,12 @@ class WebSocketService {
 			this.stopHeartbeat();
 			this.emit('disconnected');
 
-			// Attempt to reconnect unless it was a clean close
-			if (event.code !== 1000) {
+			// Attempt to reconnect unless it was a clean close, or the session is gone. 1008 is sent when the
+			// session was revoked, in case the session_revoked message could not be delivered.
+			if (event.code === 1008) {
+				this.revoked = true;
+			}
+			if (event.code !== 1000 && !this.revoked) {
 				this.scheduleReconnect();
 			}
 		};
@@ -83,15 +100,40 @@ class WebSocketService {
 	 * @param {Object} data - Message data
 	 */
 	handleMessage(data) {
-		const { type, payload } = data;
+		const { type, payload, seq } = data;
+
+		if (seq) {
+			// Replayed events may also arrive live
+			if (this.lastSeq !== null && seq <= this.lastSeq) {
+				return;
+			}
+			this.lastSeq = seq;
+		}
 
 		switch (type) {
+			case 'ready':
+				this.lastSeq = payload.seq;
+				break;
+			case 'resync_required':
+				// Too many events were missed: reload everything
+				this.lastSeq = payload.seq;
+				this.emit('resync', payload);
+				break;
 			case 'message':
 				this.emit('message', payload);
 				break;
 			case 'message_deleted':
 				this.emit('messageDeleted', payload);
 				break;
+			case 'messages_expired':
+				this.emit('messagesExpired', payload);
+				break;
+			case 'message_updated':
+				this.emit('messageUpdated', payload);
+				break;
+			case 'draft_updated':
+				this.emit('draftUpdated', payload);
+				break;
 			case 'reaction_added':
 			case 'reaction_removed':
 				this.emit('reactionChanged', payload);
@@ -102,6 +144,9 @@ class WebSocketService {
 			case 'user_offline':
 				this.emit('userOffline', payload);
 				break;
+			case 'user_updated':
+				this.emit('userUpdated', payload);
+				break;
 			case 'conversation_updated':
 				this.emit('conversationUpdated', payload);
 				break;
@@ -111,6 +156,10 @@ class WebSocketService {
 			case 'typing_stop':
 				this.emit('typingStop', payload);
 				break;
+			case 'session_revoked':
+				this.revoked = true;
+				this.emit('sessionRevoked', payload);
+				break;
 			case 'pong':
 				// Heartbeat response - connection is alive
 				break;
@@ -216,6 +265,7 @@ class WebSocketService {
 		if (this.reconnectAttempts >= this.maxReconnectAttempts) {
 			console.error('Max reconnection attempts reached');
 			this.emit('maxReconnectAttemptsReached');
+			this.connectEventSource();
 			return;
 		}
 
@@ -235,6 +285,44 @@ class WebSocketService {
 		this.reconnectInterval = Math.min(this.reconnectInterval * 2, 30000);
 	}
 
+	/**
+	 * Receive the events with Server-Sent Events, for networks that break
+	 * WebSocket connections. The stream only goes from the server to the
+	 * client, and the browser reconnects it by itself.
+	 */
+	connectEventSource() {
+		if (this.eventSource || this.revoked || !this.userId) {
+			return;
+		}
+
+		const token = encodeURIComponent(localStorage.getItem('sessionToken') || '');
+		let url = `${__API_URL__}/users/${this.userId}/events?token=${token}`;
+		if (this.lastSeq !== null) {
+			url += `&lastEventId=${this.lastSeq}`;
+		}
+
+		this.eventSource = new EventSource(url);
+		this.eventSource.onopen = () => {
+			console.log('Event stream connected');
+			this.emit('connected');
+		};
+		this.eventSource.onmessage = (event) => {
+			try {
+				this.handleMessage(JSON.parse(event.data));
+			} catch (error) {
+				console.error('Failed to parse event stream message:', error);
+			}
+		};
+		this.eventSource.onerror = () => {
+			this.emit('disconnected');
+			// The browser retries by itself, unless the server refused the stream
+			if (this.revoked || this.eventSource.readyState === EventSource.CLOSED) {
+				this.eventSource.close();
+				this.eventSource = null;
+			}
+		};
+	}
+
 	/**
 	 * Manually disconnect WebSocket
 	 */
@@ -243,6 +331,10 @@ class WebSocketService {
 			this.ws.close(1000, 'Manual disconnect');
 			this.ws = null;
 		}
+		if (this.eventSource) {
+			this.eventSource.close();
+			this.eventSource = null;
+		}
 		this.isConnected = false;
 		this.stopHeartbeat();
 	}
@@ -254,8 +346,7 @@ class WebSocketService {
 	 */
 	sendTypingIndicator(conversationId, isTyping) {
 		this.send(isTyping ? 'typing_start' : 'typing_stop', {
-			conversation_id: conversationId,
-			user_id: this.userId,
+			conversationId,
 		});
 	}
 